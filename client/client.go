@@ -0,0 +1,310 @@
+// Package client is a Go client for the file server's HTTP API. It streams bodies, retries throttled and failed
+// requests with jittered backoff, and checks every transfer against the SHA-256 checksum the server reports as ETag.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxConns matches the file server's slot limit. More connections only wait in its queue or get throttled.
+	DefaultMaxConns   = 15
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+
+	// Long enough for the file server's error messages, short enough to not buffer a misrouted body.
+	maxErrorBody = 4096
+)
+
+type Config struct {
+	BaseURL    string       // Where files are served, e.g. http://localhost:1234/api/fileserver
+	TLSConfig  *tls.Config  // Used for https, ignored with HTTPClient
+	HTTPClient *http.Client // Replaces the pooled client New builds, MaxConns and TLSConfig don't apply to it
+	MaxConns   int          // Connections per host, zero for DefaultMaxConns
+	MaxRetries int          // Retries after the first attempt, zero for DefaultMaxRetries, negative for none
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// FileInfo describes a file as the server reported it.
+type FileInfo struct {
+	Name     string
+	Size     int64
+	ETag     string
+	Checksum string // Hex SHA-256 of the contents, empty if the server didn't report one
+	ModTime  time.Time
+}
+
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url %s: %w", cfg.BaseURL, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base url %s: scheme must be http or https", cfg.BaseURL)
+	}
+
+	c := &Client{
+		baseURL:    strings.TrimSuffix(base.String(), "/"),
+		http:       cfg.HTTPClient,
+		maxRetries: cfg.MaxRetries,
+		backoff:    cfg.Backoff,
+		maxBackoff: cfg.MaxBackoff,
+	}
+	if c.http == nil {
+		maxConns := cfg.MaxConns
+		if maxConns == 0 {
+			maxConns = DefaultMaxConns
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = maxConns
+		transport.MaxIdleConnsPerHost = maxConns
+		transport.TLSClientConfig = cfg.TLSConfig
+		c.http = &http.Client{Transport: transport}
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultMaxRetries
+	}
+	if c.backoff <= 0 {
+		c.backoff = DefaultBackoff
+	}
+	if c.maxBackoff <= 0 {
+		c.maxBackoff = DefaultMaxBackoff
+	}
+	return c, nil
+}
+
+// Get writes name's contents to w. The contents are only verified once all of them are written, on
+// ErrChecksumMismatch w has received bytes that aren't the file's.
+func (c *Client) Get(ctx context.Context, name string, w io.Writer) (FileInfo, error) {
+	response, err := c.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer response.Body.Close()
+
+	info := fileInfo(name, response)
+	hasher := sha256.New()
+	info.Size, err = io.Copy(io.MultiWriter(w, hasher), response.Body)
+	if err != nil {
+		return info, fmt.Errorf("GET %s: %w", name, err)
+	}
+	if err := verifyChecksum(http.MethodGet, info, hasher); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// Put uploads size bytes of body as name, replacing any existing file. size may be -1 if unknown. Bodies that
+// implement io.Seeker are rewound to retry, others are sent once.
+func (c *Client) Put(ctx context.Context, name string, body io.Reader, size int64) (FileInfo, error) {
+	up := &upload{body: body, size: size, start: -1, hash: sha256.New()}
+	if seeker, ok := body.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			up.start = start
+		}
+	}
+
+	response, err := c.do(ctx, http.MethodPut, name, up)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxErrorBody))
+
+	info := fileInfo(name, response)
+	info.Size = up.sent
+	if err := verifyChecksum(http.MethodPut, info, up.hash); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+func (c *Client) Delete(ctx context.Context, name string) error {
+	response, err := c.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxErrorBody))
+	return nil
+}
+
+// Head describes name without downloading it.
+func (c *Client) Head(ctx context.Context, name string) (FileInfo, error) {
+	response, err := c.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	response.Body.Close()
+
+	info := fileInfo(name, response)
+	info.Size, err = strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return info, fmt.Errorf("HEAD %s: invalid Content-Length %q", name, response.Header.Get("Content-Length"))
+	}
+	return info, nil
+}
+
+// upload is a PUT body. Bodies that can seek are rewound for each attempt.
+type upload struct {
+	body  io.Reader
+	size  int64
+	start int64 // Offset to rewind to, -1 if body can't seek
+	hash  hash.Hash
+	sent  int64
+}
+
+func (u *upload) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	u.hash.Write(p[:n])
+	u.sent += int64(n)
+	return n, err
+}
+
+func (u *upload) rewind() error {
+	if u.sent == 0 {
+		return nil
+	}
+	if u.start < 0 {
+		return errors.New("body can't be rewound")
+	}
+	if _, err := u.body.(io.Seeker).Seek(u.start, io.SeekStart); err != nil {
+		return err
+	}
+	u.hash.Reset()
+	u.sent = 0
+	return nil
+}
+
+// do sends a request for name, retrying 429 and 5xx responses. A 2xx response is returned with its body unread,
+// anything else as a *StatusError.
+func (c *Client) do(ctx context.Context, method string, name string, up *upload) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		switch {
+		case up == nil:
+		case up.size == 0:
+			// A zero ContentLength with a body means unknown length to net/http.
+			body = http.NoBody
+		default:
+			body = up
+		}
+		request, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/"+url.PathEscape(name), body)
+		if err != nil {
+			return nil, err
+		}
+		if up != nil {
+			request.ContentLength = up.size
+		}
+
+		response, err := c.http.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			return response, nil
+		}
+
+		statusErr := readStatusError(method, name, response)
+		if !statusErr.retryable() || attempt >= c.maxRetries {
+			return nil, statusErr
+		}
+		if up != nil && up.rewind() != nil {
+			return nil, statusErr
+		}
+		timer := time.NewTimer(c.delay(attempt, statusErr.RetryAfter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, statusErr
+		case <-timer.C:
+		}
+	}
+}
+
+// delay is how long to wait before retrying attempt. Backoff doubles per attempt up to maxBackoff with full jitter,
+// so clients throttled together don't all come back together. A Retry-After from the server is a lower bound.
+func (c *Client) delay(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := c.maxBackoff
+	if attempt < 32 && c.backoff<<attempt < c.maxBackoff {
+		backoff = c.backoff << attempt
+	}
+	wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if wait < retryAfter {
+		wait = retryAfter + time.Duration(rand.Int63n(int64(c.backoff)+1))
+	}
+	return wait
+}
+
+func readStatusError(method string, name string, response *http.Response) *StatusError {
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxErrorBody))
+	return &StatusError{
+		Method:     method,
+		Name:       name,
+		StatusCode: response.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+		RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date, zero if absent or invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
+
+func fileInfo(name string, response *http.Response) FileInfo {
+	info := FileInfo{Name: name, ETag: response.Header.Get("ETag")}
+	// The server's ETags are the quoted hex SHA-256 of the contents. Weak ones don't say anything about the bytes.
+	if !strings.HasPrefix(info.ETag, "W/") {
+		info.Checksum = strings.Trim(info.ETag, `"`)
+	}
+	if modTime, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
+
+func verifyChecksum(method string, info FileInfo, hasher hash.Hash) error {
+	if info.Checksum == "" {
+		return nil
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != info.Checksum {
+		return fmt.Errorf("%s %s: %w: got %s, server reported %s", method, info.Name, ErrChecksumMismatch, sum, info.Checksum)
+	}
+	return nil
+}
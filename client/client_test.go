@@ -0,0 +1,185 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer answers each request with the next status in statuses, then stores and serves files the way the file
+// server does, with the hex SHA-256 of the contents as ETag.
+type fileServer struct {
+	statuses []int
+	requests int
+	files    map[string][]byte
+	mutex    sync.Mutex
+}
+
+func newTestClient(t *testing.T) (*Client, *fileServer) {
+	t.Helper()
+	server := &fileServer{files: map[string][]byte{}}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	client, err := New(Config{BaseURL: httpServer.URL + "/api/fileserver", Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func (s *fileServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	name := strings.TrimPrefix(request.URL.Path, "/api/fileserver/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	if len(s.statuses) > 0 {
+		var status int
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+		response.WriteHeader(status)
+		_, _ = io.WriteString(response, "Too many requests. Slow down.")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodPut:
+		s.files[name] = body
+		response.Header().Set("ETag", etag(body))
+		response.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		data, ok := s.files[name]
+		if !ok {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		response.Header().Set("ETag", etag(data))
+		_, _ = response.Write(data)
+	}
+}
+
+// throttle answers the next n requests with 429.
+func (s *fileServer) throttle(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		s.statuses = append(s.statuses, http.StatusTooManyRequests)
+	}
+}
+
+func (s *fileServer) requestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *fileServer) file(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return string(s.files[name])
+}
+
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestThrottledRequestRetried(t *testing.T) {
+	client, server := newTestClient(t)
+	server.throttle(1)
+
+	body := strings.NewReader("retried")
+	info, err := client.Put(context.Background(), "a", body, body.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 2 {
+		t.Errorf("sent %d requests, want the throttled one retried once", server.requestCount())
+	}
+	if stored := server.file("a"); info.Size != 7 || stored != "retried" {
+		t.Errorf("stored %q as %+v, want the whole body after rewinding", stored, info)
+	}
+
+	var got bytes.Buffer
+	server.throttle(1)
+	if _, err := client.Get(context.Background(), "a", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "retried" {
+		t.Errorf("got %q", got.String())
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	client, server := newTestClient(t)
+	server.throttle(DefaultMaxRetries + 1)
+
+	_, err := client.Get(context.Background(), "a", io.Discard)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("get = %v, want ErrThrottled", err)
+	}
+	if StatusCode(err) != http.StatusTooManyRequests {
+		t.Errorf("status code = %d, want 429", StatusCode(err))
+	}
+	if server.requestCount() != DefaultMaxRetries+1 {
+		t.Errorf("sent %d requests, want %d", server.requestCount(), DefaultMaxRetries+1)
+	}
+}
+
+func TestNonSeekableBodyNotRetried(t *testing.T) {
+	client, server := newTestClient(t)
+	server.throttle(1)
+
+	// Hides strings.Reader's Seek.
+	body := struct{ io.Reader }{strings.NewReader("sent once")}
+	_, err := client.Put(context.Background(), "a", body, 9)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("put = %v, want ErrThrottled", err)
+	}
+	if server.requestCount() != 1 {
+		t.Errorf("sent %d requests, want a body that can't be rewound sent once", server.requestCount())
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	// Serves and accepts other bytes than the ETag it reports.
+	client := newRawClient(t, func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("ETag", etag([]byte("expected")))
+		_, _ = io.WriteString(response, "corrupt")
+	})
+	if _, err := client.Get(context.Background(), "a", io.Discard); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("get of corrupted contents = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := client.Put(context.Background(), "a", strings.NewReader("sent"), 4); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("put stored as other contents = %v, want ErrChecksumMismatch", err)
+	}
+
+	// Weak ETags say nothing about the bytes.
+	weak := newRawClient(t, func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("ETag", "W/"+etag([]byte("expected")))
+		_, _ = io.WriteString(response, "encoded")
+	})
+	if _, err := weak.Get(context.Background(), "a", io.Discard); err != nil {
+		t.Errorf("get with a weak ETag = %v", err)
+	}
+}
+
+func newRawClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := New(Config{BaseURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
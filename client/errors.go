@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("file not found")
+	ErrThrottled    = errors.New("throttled by file server")
+	ErrPrecondition = errors.New("precondition failed")
+	// ErrChecksumMismatch is returned when the bytes sent or received don't hash to the ETag the server reported.
+	ErrChecksumMismatch = errors.New("checksum does not match ETag")
+)
+
+// StatusError is a non 2xx response. It matches ErrNotFound, ErrThrottled and ErrPrecondition with errors.Is.
+type StatusError struct {
+	Method     string
+	Name       string
+	StatusCode int
+	Message    string        // Response body, trimmed
+	RetryAfter time.Duration // From the Retry-After header, zero if absent
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: %d %s", e.Method, e.Name, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Name, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrThrottled:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrPrecondition:
+		return e.StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// retryable reports whether the request may succeed if sent again.
+func (e *StatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// StatusCode returns the HTTP status of the response err came from, 0 if there wasn't one.
+func StatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
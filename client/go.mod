@@ -0,0 +1,3 @@
+module github.com/mancej/fileserver-challenge/client
+
+go 1.19
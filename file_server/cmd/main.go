@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"github.com/mancej/fileserver-challenge/file_server/internal"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"time"
 )
 
@@ -13,13 +15,42 @@ func main() {
 		FullTimestamp: false,
 	})
 
+	if args := os.Args[1:]; internal.IsCommand(args) {
+		if err := internal.RunCommand(context.Background(), args); err != nil {
+			log.Fatalf("%s failed: %+v", args[0], err)
+		}
+		return
+	}
+
 	start := time.Now()
+	cfg := internal.LoadConfig()
+
+	shutdownTracing, err := internal.InitTracing(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %+v", err)
+	}
+	// log.Fatal exits without running deferred calls, so traces are flushed explicitly before exiting.
+	flushTraces := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("Failed to flush traces: %+v", err)
+		}
+	}
 
 	log.Infof("Starting FileServer.")
-	fs := internal.NewFileServer()
-	log.Fatal(fs.Run())
+	fs, err := internal.NewFileServer(cfg)
+	if err != nil {
+		log.Errorf("Failed to initialize FileServer: %+v", err)
+		flushTraces()
+		os.Exit(1)
+	}
+	err = fs.Run()
+	log.Errorf("FileServer stopped: %+v", err)
+	flushTraces()
 
 	finish := time.Now()
 	totalTime := finish.Sub(start)
 	log.Infof("Finished in %f seconds.", totalTime.Seconds())
+	os.Exit(1)
 }
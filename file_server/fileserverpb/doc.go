@@ -0,0 +1,5 @@
+// Package fileserverpb holds the messages, client and service definition of the file server's gRPC API, generated
+// from fileserver.proto. Regenerate with go generate after changing it.
+package fileserverpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fileserver.proto
@@ -0,0 +1,371 @@
+// The file server's gRPC API. It mirrors the HTTP API: files are addressed by name, and calls are admitted,
+// authenticated and rate limited the same way.
+//
+// Authenticate by sending an API key's secret in x-api-key metadata, or its id and secret as Basic credentials in
+// authorization metadata. Calls over the connection limit fail with RESOURCE_EXHAUSTED and a retry-after trailer
+// in seconds.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.1
+// source: fileserver.proto
+
+package fileserverpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	FileService_Stat_FullMethodName   = "/fileserver.v1.FileService/Stat"
+	FileService_Delete_FullMethodName = "/fileserver.v1.FileService/Delete"
+	FileService_Put_FullMethodName    = "/fileserver.v1.FileService/Put"
+	FileService_Get_FullMethodName    = "/fileserver.v1.FileService/Get"
+	FileService_Batch_FullMethodName  = "/fileserver.v1.FileService/Batch"
+)
+
+// FileServiceClient is the client API for FileService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FileServiceClient interface {
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Stores a file from a stream of chunks. The first message names the file, any message may carry data.
+	Put(ctx context.Context, opts ...grpc.CallOption) (FileService_PutClient, error)
+	// Streams a file: its info first, then its data in chunks.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (FileService_GetClient, error)
+	// Runs small operations over one stream. Each is admitted on its own and answered in the order sent; a failed
+	// operation is reported in its response rather than ending the stream.
+	Batch(ctx context.Context, opts ...grpc.CallOption) (FileService_BatchClient, error)
+}
+
+type fileServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFileServiceClient(cc grpc.ClientConnInterface) FileServiceClient {
+	return &fileServiceClient{cc}
+}
+
+func (c *fileServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, FileService_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, FileService_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileServiceClient) Put(ctx context.Context, opts ...grpc.CallOption) (FileService_PutClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileService_ServiceDesc.Streams[0], FileService_Put_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileServicePutClient{ClientStream: stream}
+	return x, nil
+}
+
+type FileService_PutClient interface {
+	Send(*PutRequest) error
+	CloseAndRecv() (*FileInfo, error)
+	grpc.ClientStream
+}
+
+type fileServicePutClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileServicePutClient) Send(m *PutRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileServicePutClient) CloseAndRecv() (*FileInfo, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(FileInfo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileServiceClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (FileService_GetClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileService_ServiceDesc.Streams[1], FileService_Get_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileServiceGetClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileService_GetClient interface {
+	Recv() (*GetResponse, error)
+	grpc.ClientStream
+}
+
+type fileServiceGetClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileServiceGetClient) Recv() (*GetResponse, error) {
+	m := new(GetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileServiceClient) Batch(ctx context.Context, opts ...grpc.CallOption) (FileService_BatchClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileService_ServiceDesc.Streams[2], FileService_Batch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileServiceBatchClient{ClientStream: stream}
+	return x, nil
+}
+
+type FileService_BatchClient interface {
+	Send(*BatchRequest) error
+	Recv() (*BatchResponse, error)
+	grpc.ClientStream
+}
+
+type fileServiceBatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileServiceBatchClient) Send(m *BatchRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileServiceBatchClient) Recv() (*BatchResponse, error) {
+	m := new(BatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FileServiceServer is the server API for FileService service.
+// All implementations must embed UnimplementedFileServiceServer
+// for forward compatibility
+type FileServiceServer interface {
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Stores a file from a stream of chunks. The first message names the file, any message may carry data.
+	Put(FileService_PutServer) error
+	// Streams a file: its info first, then its data in chunks.
+	Get(*GetRequest, FileService_GetServer) error
+	// Runs small operations over one stream. Each is admitted on its own and answered in the order sent; a failed
+	// operation is reported in its response rather than ending the stream.
+	Batch(FileService_BatchServer) error
+	mustEmbedUnimplementedFileServiceServer()
+}
+
+// UnimplementedFileServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedFileServiceServer struct {
+}
+
+func (UnimplementedFileServiceServer) Stat(context.Context, *StatRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedFileServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedFileServiceServer) Put(FileService_PutServer) error {
+	return status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedFileServiceServer) Get(*GetRequest, FileService_GetServer) error {
+	return status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedFileServiceServer) Batch(FileService_BatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (UnimplementedFileServiceServer) mustEmbedUnimplementedFileServiceServer() {}
+
+// UnsafeFileServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileServiceServer will
+// result in compilation errors.
+type UnsafeFileServiceServer interface {
+	mustEmbedUnimplementedFileServiceServer()
+}
+
+func RegisterFileServiceServer(s grpc.ServiceRegistrar, srv FileServiceServer) {
+	s.RegisterService(&FileService_ServiceDesc, srv)
+}
+
+func _FileService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileService_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileService_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileService_Put_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileServiceServer).Put(&fileServicePutServer{ServerStream: stream})
+}
+
+type FileService_PutServer interface {
+	SendAndClose(*FileInfo) error
+	Recv() (*PutRequest, error)
+	grpc.ServerStream
+}
+
+type fileServicePutServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileServicePutServer) SendAndClose(m *FileInfo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileServicePutServer) Recv() (*PutRequest, error) {
+	m := new(PutRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileService_Get_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileServiceServer).Get(m, &fileServiceGetServer{ServerStream: stream})
+}
+
+type FileService_GetServer interface {
+	Send(*GetResponse) error
+	grpc.ServerStream
+}
+
+type fileServiceGetServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileServiceGetServer) Send(m *GetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FileService_Batch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileServiceServer).Batch(&fileServiceBatchServer{ServerStream: stream})
+}
+
+type FileService_BatchServer interface {
+	Send(*BatchResponse) error
+	Recv() (*BatchRequest, error)
+	grpc.ServerStream
+}
+
+type fileServiceBatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileServiceBatchServer) Send(m *BatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileServiceBatchServer) Recv() (*BatchRequest, error) {
+	m := new(BatchRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FileService_ServiceDesc is the grpc.ServiceDesc for FileService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FileService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fileserver.v1.FileService",
+	HandlerType: (*FileServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stat",
+			Handler:    _FileService_Stat_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _FileService_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Put",
+			Handler:       _FileService_Put_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Get",
+			Handler:       _FileService_Get_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Batch",
+			Handler:       _FileService_Batch_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "fileserver.proto",
+}
@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Priority int
+
+// Lower values are admitted first.
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	default:
+		return "low"
+	}
+}
+
+var (
+	ErrQueueFull      = errors.New("admission queue is full")
+	ErrQueueTimeout   = errors.New("timed out waiting in admission queue")
+	ErrClientBusy     = errors.New("client concurrency limit reached")
+	ErrClientThrottle = errors.New("client rate limit exceeded")
+)
+
+type AdmissionConfig struct {
+	QueueEnabled       bool          // If false, requests over the connection limit are rejected immediately
+	MaxQueueDepth      int           // Maximum number of requests waiting for a slot
+	MaxQueueWait       time.Duration // Maximum time a request waits for a slot before being rejected
+	SmallFileThreshold int64         // GETs for files at or under this size are admitted with high priority
+}
+
+// AdmissionController is a counting semaphore over the connection slots, with an optional priority queue in front of
+// it. Within a priority, queued clients are admitted in weighted fair order, so one client's burst can't starve others.
+type AdmissionController struct {
+	cfg     AdmissionConfig
+	clients *ClientLimiter
+	limit   int
+	inUse   int
+	queued  int
+	waiters [numPriorities][]*admissionWaiter
+	lock    sync.Mutex
+
+	inFlight    map[string]int     // Slots held per client
+	finishTags  map[string]float64 // Last virtual finish tag assigned per client
+	virtualTime float64            // Tag of the most recently admitted waiter
+
+	// Exponentially weighted moving average of how long a slot is held, used to estimate Retry-After.
+	avgHold time.Duration
+}
+
+type admissionWaiter struct {
+	client  string
+	tag     float64
+	ready   chan struct{}
+	granted bool
+}
+
+type AdmissionStats struct {
+	Limit      int
+	InUse      int
+	Queued     int
+	QueueLimit int
+}
+
+func NewAdmissionController(limit int, cfg AdmissionConfig, clients *ClientLimiter) *AdmissionController {
+	return &AdmissionController{
+		cfg:        cfg,
+		clients:    clients,
+		limit:      limit,
+		inFlight:   map[string]int{},
+		finishTags: map[string]float64{},
+		avgHold:    baseLatencyPerRequest * time.Millisecond,
+	}
+}
+
+// TryAcquire takes a slot for client if one is free without queueing.
+func (ac *AdmissionController) TryAcquire(client string) bool {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if ac.canAdmit(client) && !ac.hasEligibleWaiter() {
+		ac.admit(client)
+		return true
+	}
+	return false
+}
+
+// Acquire takes a slot for client, waiting in the admission queue for up to MaxQueueWait if queueing is enabled.
+// Returns ErrQueueFull, ErrClientBusy or ErrQueueTimeout if the request should be throttled.
+func (ac *AdmissionController) Acquire(ctx context.Context, client string, priority Priority) error {
+	ac.lock.Lock()
+	if ac.canAdmit(client) && !ac.hasEligibleWaiter() {
+		ac.admit(client)
+		ac.lock.Unlock()
+		return nil
+	}
+
+	if !ac.cfg.QueueEnabled || ac.queued >= ac.cfg.MaxQueueDepth {
+		err := ErrQueueFull
+		if ac.inUse < ac.limit {
+			err = ErrClientBusy
+		}
+		ac.lock.Unlock()
+		return err
+	}
+
+	start := math.Max(ac.virtualTime, ac.finishTags[client])
+	waiter := &admissionWaiter{
+		client: client,
+		tag:    start + 1/ac.clients.Weight(client),
+		ready:  make(chan struct{}),
+	}
+	ac.finishTags[client] = waiter.tag
+	ac.waiters[priority] = append(ac.waiters[priority], waiter)
+	ac.queued++
+	ac.lock.Unlock()
+
+	timer := time.NewTimer(ac.cfg.MaxQueueWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if waiter.granted {
+		// Release handed us the slot while we were timing out, keep it.
+		return nil
+	}
+	ac.removeWaiter(priority, waiter)
+	return err
+}
+
+// Release returns a slot that client held for heldFor. If requests are queued, the slot is handed directly to the
+// next eligible waiter instead of being freed.
+func (ac *AdmissionController) Release(client string, heldFor time.Duration) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ac.avgHold = (ac.avgHold*7 + heldFor) / 8
+	ac.inUse--
+	ac.inFlight[client]--
+	if ac.inFlight[client] <= 0 {
+		delete(ac.inFlight, client)
+	}
+
+	// A client's concurrency cap can leave the head of the queue ineligible, so keep dispatching while there
+	// is both a free slot and someone allowed to take it.
+	for ac.inUse < ac.limit {
+		priority, waiter := ac.nextWaiter()
+		if waiter == nil {
+			break
+		}
+		ac.removeWaiter(priority, waiter)
+		ac.virtualTime = waiter.tag
+		ac.admit(waiter.client)
+		waiter.granted = true
+		close(waiter.ready)
+	}
+
+	ac.pruneFinishTags()
+}
+
+// nextWaiter returns the waiter with the smallest finish tag in the highest non-empty priority class whose client
+// is still under its concurrency cap.
+func (ac *AdmissionController) nextWaiter() (Priority, *admissionWaiter) {
+	for priority, waiters := range ac.waiters {
+		var next *admissionWaiter
+		for _, waiter := range waiters {
+			if !ac.clients.UnderConcurrencyCap(waiter.client, ac.inFlight[waiter.client]) {
+				continue
+			}
+			if next == nil || waiter.tag < next.tag {
+				next = waiter
+			}
+		}
+		if next != nil {
+			return Priority(priority), next
+		}
+	}
+	return 0, nil
+}
+
+// hasEligibleWaiter reports whether a queued request could take a free slot ahead of a new arrival.
+func (ac *AdmissionController) hasEligibleWaiter() bool {
+	_, waiter := ac.nextWaiter()
+	return waiter != nil
+}
+
+func (ac *AdmissionController) canAdmit(client string) bool {
+	return ac.inUse < ac.limit && ac.clients.UnderConcurrencyCap(client, ac.inFlight[client])
+}
+
+func (ac *AdmissionController) admit(client string) {
+	ac.inUse++
+	ac.inFlight[client]++
+}
+
+func (ac *AdmissionController) removeWaiter(priority Priority, waiter *admissionWaiter) {
+	waiters := ac.waiters[priority]
+	for i, w := range waiters {
+		if w == waiter {
+			ac.waiters[priority] = append(waiters[:i], waiters[i+1:]...)
+			ac.queued--
+			return
+		}
+	}
+}
+
+// pruneFinishTags forgets clients whose tags are already behind virtual time, they'd start from virtual time anyway.
+func (ac *AdmissionController) pruneFinishTags() {
+	for client, tag := range ac.finishTags {
+		if tag <= ac.virtualTime {
+			delete(ac.finishTags, client)
+		}
+	}
+}
+
+func (ac *AdmissionController) Stats() AdmissionStats {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	return AdmissionStats{
+		Limit:      ac.limit,
+		InUse:      ac.inUse,
+		Queued:     ac.queued,
+		QueueLimit: ac.cfg.MaxQueueDepth,
+	}
+}
+
+// ClientInFlight returns a copy of the number of slots held per client.
+func (ac *AdmissionController) ClientInFlight() map[string]int {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	inFlight := make(map[string]int, len(ac.inFlight))
+	for client, count := range ac.inFlight {
+		inFlight[client] = count
+	}
+	return inFlight
+}
+
+// RetryAfter estimates how long a rejected request should back off, based on how many requests are ahead of it
+// and how long slots are currently being held.
+func (ac *AdmissionController) RetryAfter() time.Duration {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ahead := ac.queued + 1
+	waves := math.Ceil(float64(ahead) / float64(ac.limit))
+	return time.Duration(waves * float64(ac.avgHold))
+}
+
+// WriteRateLimitHeaders sets Retry-After and X-RateLimit-* headers on a throttled response. retryAfter overrides
+// the queue based estimate when non-zero.
+func (ac *AdmissionController) WriteRateLimitHeaders(response http.ResponseWriter, retryAfter time.Duration) {
+	ac.setRateLimitHeaders(response.Header(), retryAfter)
+}
+
+func (ac *AdmissionController) setRateLimitHeaders(header http.Header, retryAfter time.Duration) {
+	stats := ac.Stats()
+	if retryAfter == 0 {
+		retryAfter = ac.RetryAfter()
+	}
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+
+	remaining := stats.Limit - stats.InUse
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	header.Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	header.Set("X-RateLimit-Limit", strconv.Itoa(stats.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(retryAfterSeconds))
+	header.Set("X-RateLimit-Queue-Depth", strconv.Itoa(stats.Queued))
+}
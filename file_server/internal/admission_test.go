@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAdmission(limit int, cfg AdmissionConfig, rateLimit RateLimitConfig) *AdmissionController {
+	return NewAdmissionController(limit, cfg, NewClientLimiter(rateLimit))
+}
+
+// enqueue starts an Acquire for name's client, <client>/<n>, that has to queue and waits until it has. name is sent to
+// admitted once it's admitted.
+func enqueue(t *testing.T, ac *AdmissionController, name string, priority Priority, admitted chan<- string) {
+	t.Helper()
+	queued := ac.Stats().Queued
+	client, _, _ := strings.Cut(name, "/")
+	go func() {
+		if err := ac.Acquire(context.Background(), client, priority); err == nil {
+			admitted <- name
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ac.Stats().Queued == queued; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s wasn't queued", name)
+		}
+	}
+}
+
+// admittedOrder releases holder's slot, and then each admitted request's in turn, until n were admitted.
+func admittedOrder(t *testing.T, ac *AdmissionController, holder string, n int, admitted <-chan string) []string {
+	t.Helper()
+	var order []string
+	for len(order) < n {
+		ac.Release(holder, time.Millisecond)
+		select {
+		case name := <-admitted:
+			order = append(order, name)
+			holder, _, _ = strings.Cut(name, "/")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("releasing a slot admitted no one after %v", order)
+		}
+	}
+	return order
+}
+
+func TestAdmissionPriorityOrder(t *testing.T) {
+	ac := newTestAdmission(1, AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 10, MaxQueueWait: 5 * time.Second}, RateLimitConfig{})
+	if !ac.TryAcquire("holder") {
+		t.Fatal("first slot wasn't free")
+	}
+	admitted := make(chan string, 3)
+	enqueue(t, ac, "low", PriorityLow, admitted)
+	enqueue(t, ac, "normal", PriorityNormal, admitted)
+	enqueue(t, ac, "high", PriorityHigh, admitted)
+	order := admittedOrder(t, ac, "holder", 3, admitted)
+	if want := []string{"high", "normal", "low"}; !slices.Equal(order, want) {
+		t.Errorf("admitted %v, want %v", order, want)
+	}
+	if stats := ac.Stats(); stats.InUse != 1 || stats.Queued != 0 {
+		t.Errorf("stats after draining the queue = %+v", stats)
+	}
+}
+
+// With the queue enabled a request over the limit waits for a slot rather than getting a 429.
+func TestRequestQueuedForSlot(t *testing.T) {
+	t.Setenv("ADMISSION_QUEUE_ENABLED", "true")
+	fs := newTestFileServer(t)
+	router := fs.newRouter()
+	for i := 0; i < maxConnections; i++ {
+		fs.admission.TryAcquire("holder")
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodHead, "/api/fileserver/a", nil))
+		done <- response.Code
+	}()
+	for deadline := time.Now().Add(5 * time.Second); fs.admission.Stats().Queued == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("request wasn't queued")
+		}
+	}
+	fs.admission.Release("holder", time.Millisecond)
+	if code := <-done; code != http.StatusNotFound {
+		t.Errorf("queued request got %d, want it served once a slot was released", code)
+	}
+}
+
+func TestAdmissionRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AdmissionConfig
+		queued  int
+		ctx     func() context.Context
+		wantErr error
+	}{
+		{"queue disabled", AdmissionConfig{}, 0, context.Background, ErrQueueFull},
+		{"queue full", AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 1, MaxQueueWait: time.Minute}, 1, context.Background, ErrQueueFull},
+		{"waited too long", AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 1, MaxQueueWait: 20 * time.Millisecond}, 0, context.Background, ErrQueueTimeout},
+		{"client gone", AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 1, MaxQueueWait: time.Minute}, 0, func() context.Context {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			t.Cleanup(cancel)
+			return ctx
+		}, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac := newTestAdmission(1, test.cfg, RateLimitConfig{})
+			if !ac.TryAcquire("holder") {
+				t.Fatal("first slot wasn't free")
+			}
+			for i := 0; i < test.queued; i++ {
+				enqueue(t, ac, "queued", PriorityNormal, make(chan string, 1))
+			}
+			if err := ac.Acquire(test.ctx(), "late", PriorityHigh); !errors.Is(err, test.wantErr) {
+				t.Fatalf("acquire = %v, want %v", err, test.wantErr)
+			}
+			if stats := ac.Stats(); stats.InUse != 1 || stats.Queued != test.queued {
+				t.Errorf("stats after rejecting = %+v, want the rejected request gone", stats)
+			}
+		})
+	}
+}
+
+func TestAdmissionRateLimitHeaders(t *testing.T) {
+	ac := newTestAdmission(2, AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 5, MaxQueueWait: time.Minute}, RateLimitConfig{})
+	ac.TryAcquire("a")
+	ac.TryAcquire("b")
+	enqueue(t, ac, "c", PriorityNormal, make(chan string, 1))
+
+	tests := []struct {
+		retryAfter time.Duration
+		want       map[string]string
+	}{
+		// One queued plus this one fill one wave of two slots, each held for the 333ms default.
+		{0, map[string]string{"Retry-After": "1", "X-RateLimit-Limit": "2", "X-RateLimit-Remaining": "0", "X-RateLimit-Queue-Depth": "1"}},
+		{2500 * time.Millisecond, map[string]string{"Retry-After": "3", "X-RateLimit-Reset": "3"}},
+	}
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		ac.WriteRateLimitHeaders(response, test.retryAfter)
+		for header, want := range test.want {
+			if got := response.Header().Get(header); got != want {
+				t.Errorf("retry after %s: %s = %q, want %q", test.retryAfter, header, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AuditCopy records a file written as a copy of another, by WebDAV COPY and MOVE.
+	AuditCopy = "copy"
+	// AuditQuarantine records a corrupt file the scrubber moved out of the way.
+	AuditQuarantine = "quarantine"
+
+	auditDir        = "audit"
+	auditFile       = "audit.log"
+	requestIDHeader = "X-Request-ID"
+	maxRequestID    = 128
+	auditTailChunk  = 64 << 10
+)
+
+var ErrAuditChainBroken = errors.New("audit log chain is broken")
+
+type AuditConfig struct {
+	Enabled bool
+	Dir     string // Where the log lives, defaults to .fileserver/audit/<instance id> in the data dir
+	// Keys the record hashes with HMAC-SHA256. Without it the chain shows edits, but whoever can write the log can
+	// also rehash it, with it they'd need the key too.
+	Key string
+	// How often the chain head is logged when it moved, so a copy of it lives outside the volume. verify-audit -head
+	// checks the log against it, which catches a rehashed or truncated log even without a key.
+	HeadInterval time.Duration
+}
+
+// AuditHead is the seq and hash of a record, as exported by the server, that the log has to contain.
+type AuditHead struct {
+	Seq  uint64
+	Hash string
+}
+
+func (h AuditHead) String() string {
+	return fmt.Sprintf("%d:%s", h.Seq, h.Hash)
+}
+
+// ParseAuditHead parses a head in the <seq>:<hash> form the server logs it in.
+func ParseAuditHead(raw string) (AuditHead, error) {
+	seq, digest, ok := strings.Cut(raw, ":")
+	head := AuditHead{Hash: digest}
+	var err error
+	if head.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil || !ok || digest == "" {
+		return AuditHead{}, fmt.Errorf("invalid audit head %q, must be <seq>:<hash>", raw)
+	}
+	return head, nil
+}
+
+// AuditRecord is one mutation. Hash covers the record including PrevHash, chaining each record to the one before.
+type AuditRecord struct {
+	Seq       uint64     `json:"seq"`
+	Time      time.Time  `json:"time"`
+	Action    string     `json:"action"`
+	Name      string     `json:"name"`
+	Source    string     `json:"source,omitempty"` // What a copy was made from
+	OldETag   string     `json:"old_etag,omitempty"`
+	NewETag   string     `json:"new_etag,omitempty"`
+	Size      int64      `json:"size"`                // Of the new version, or of the deleted one
+	Retention *Retention `json:"retention,omitempty"` // Set on metadata changes
+	Client    string     `json:"client,omitempty"`    // Remote address of the request
+	KeyID     string     `json:"key_id,omitempty"`    // API key the request authenticated with
+	RequestID string     `json:"request_id,omitempty"`
+	PrevHash  string     `json:"prev_hash"`
+	Hash      string     `json:"hash,omitempty"`
+}
+
+// AuditLog appends hash-chained records to a log, one JSON record per line. It's synced like the metadata journal.
+type AuditLog struct {
+	file  *os.File
+	lock  *os.File // flock held while the log is open, so two processes can't interleave chains
+	key   []byte
+	fsync string
+	seq   uint64
+	head  string // Hash of the last record
+	dirty bool
+	mutex sync.Mutex
+}
+
+// OpenAuditLog opens the log and picks up its chain where it ends. A torn final record left by a crash is dropped,
+// one that's complete but doesn't verify is refused: chaining onto it would hide whatever was done to it.
+func OpenAuditLog(cfg AuditConfig, journal JournalConfig) (*AuditLog, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit dir %s: %w", cfg.Dir, err)
+	}
+	lock, err := lockDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w, give each file server its own INSTANCE_ID or AUDIT_DIR", err)
+	}
+	file, err := os.OpenFile(filepath.Join(cfg.Dir, auditFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	audit := &AuditLog{file: file, lock: lock, key: []byte(cfg.Key), fsync: journal.Fsync}
+	if err := audit.resume(); err != nil {
+		_ = file.Close()
+		_ = lock.Close()
+		return nil, err
+	}
+	if journal.Fsync == FsyncBatch && journal.BatchInterval > 0 {
+		go audit.syncEvery(journal.BatchInterval)
+	}
+	if cfg.Key == "" {
+		log.Warnf("AUDIT_HMAC_KEY is not set, check the audit log against the heads it logs with verify-audit -head.")
+	}
+	if cfg.HeadInterval > 0 {
+		go audit.exportHeadEvery(cfg.HeadInterval)
+	}
+	return audit, nil
+}
+
+// resume finds the last complete record and leaves the log open for appending after it.
+func (a *AuditLog) resume() error {
+	stat, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	end, last, err := lastLine(a.file, stat.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+	if end < stat.Size() {
+		log.Warnf("Dropping torn audit log tail at offset %d", end)
+		if err := a.file.Truncate(end); err != nil {
+			return fmt.Errorf("failed to truncate audit log: %w", err)
+		}
+	}
+	if _, err := a.file.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	if last == nil {
+		return nil
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal(last, &record); err != nil {
+		return fmt.Errorf("%w: last record doesn't parse: %v", ErrAuditChainBroken, err)
+	}
+	if expected, err := hashAuditRecord(a.key, record); err != nil || expected != record.Hash {
+		return fmt.Errorf("%w: last record, seq %d, fails verification. Run the verify-audit command", ErrAuditChainBroken, record.Seq)
+	}
+	a.seq, a.head = record.Seq, record.Hash
+	log.Infof("Resuming audit log at seq %d", a.seq)
+	return nil
+}
+
+// Append chains record onto the log. Once it returns, the record is as durable as the fsync policy makes it.
+func (a *AuditLog) Append(record AuditRecord) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	record.Seq, record.PrevHash = a.seq+1, a.head
+	hash, err := hashAuditRecord(a.key, record)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	offset, err := a.file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = a.file.Write(append(line, '\n'))
+	}
+	a.dirty = true
+	if err == nil && a.fsync == FsyncAlways {
+		err = a.sync()
+	}
+	if err != nil {
+		// Cut any partial write, so the next record isn't appended after half a line.
+		_ = a.file.Truncate(offset)
+		_, _ = a.file.Seek(offset, io.SeekStart)
+		return fmt.Errorf("failed to append to audit log: %w", err)
+	}
+	a.seq, a.head = record.Seq, record.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	err := a.sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	_ = a.lock.Close()
+	return err
+}
+
+func (a *AuditLog) sync() error {
+	if !a.dirty {
+		return nil
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	a.dirty = false
+	return nil
+}
+
+func (a *AuditLog) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.mutex.Lock()
+		err := a.sync()
+		a.mutex.Unlock()
+		if err != nil {
+			log.Errorf("Batched audit log sync failed: %+v", err)
+		}
+	}
+}
+
+// exportHeadEvery logs the chain head whenever it moved. Logs are shipped off the host, out of reach of whoever can
+// rewrite the audit log.
+func (a *AuditLog) exportHeadEvery(interval time.Duration) {
+	var exported uint64
+	for range time.Tick(interval) {
+		a.mutex.Lock()
+		head := AuditHead{Seq: a.seq, Hash: a.head}
+		a.mutex.Unlock()
+		if head.Seq != exported {
+			log.Infof("Audit chain head is %s", head)
+			exported = head.Seq
+		}
+	}
+}
+
+// hashAuditRecord returns the hex hash of record without its Hash, keyed if key isn't empty.
+func hashAuditRecord(key []byte, record AuditRecord) (string, error) {
+	record.Hash = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	var digest hash.Hash
+	if len(key) > 0 {
+		digest = hmac.New(sha256.New, key)
+	} else {
+		digest = sha256.New()
+	}
+	digest.Write(data)
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// lastLine returns the offset just past the last newline in the first size bytes of file, and the line it ends.
+// line is nil if there's no complete line.
+func lastLine(file *os.File, size int64) (int64, []byte, error) {
+	for chunk := int64(auditTailChunk); ; chunk *= 2 {
+		start := max(size-chunk, 0)
+		data := make([]byte, size-start)
+		if _, err := file.ReadAt(data, start); err != nil && err != io.EOF {
+			return 0, nil, err
+		}
+		newline := bytes.LastIndexByte(data, '\n')
+		if newline < 0 && start > 0 {
+			continue
+		}
+		if newline < 0 {
+			return 0, nil, nil
+		}
+		previous := bytes.LastIndexByte(data[:newline], '\n')
+		if previous < 0 && start > 0 {
+			continue
+		}
+		return start + int64(newline) + 1, data[previous+1 : newline], nil
+	}
+}
+
+// AuditReport is the outcome of verifying an audit log.
+type AuditReport struct {
+	Records  uint64 `json:"records"`
+	HeadSeq  uint64 `json:"head_seq"`
+	HeadHash string `json:"head_hash"`
+}
+
+// VerifyAuditLog checks r's hash chain under key, and that each of heads is in it, returning ErrAuditChainBroken with
+// the first line that isn't.
+func VerifyAuditLog(r io.Reader, key []byte, heads ...AuditHead) (AuditReport, error) {
+	var report AuditReport
+	exported := make(map[uint64]string, len(heads))
+	for _, head := range heads {
+		exported[head.Seq] = head.Hash
+	}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			for _, head := range heads {
+				if head.Seq > report.HeadSeq {
+					return report, fmt.Errorf("%w: the log ends at seq %d, before exported head %s, records were cut", ErrAuditChainBroken, report.HeadSeq, head)
+				}
+			}
+			return report, nil
+		}
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+		if err == io.EOF {
+			// Only a crash mid-append leaves this, the server drops it on start.
+			return report, fmt.Errorf("%w: line %d is incomplete", ErrAuditChainBroken, line)
+		}
+
+		var record AuditRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return report, fmt.Errorf("%w: line %d doesn't parse: %v", ErrAuditChainBroken, line, err)
+		}
+		switch expected, err := hashAuditRecord(key, record); {
+		case err != nil:
+			return report, err
+		case report.Records > 0 && record.Seq != report.HeadSeq+1:
+			return report, fmt.Errorf("%w: line %d has seq %d after %d, records were removed or reordered", ErrAuditChainBroken, line, record.Seq, report.HeadSeq)
+		case record.PrevHash != report.HeadHash:
+			return report, fmt.Errorf("%w: line %d, seq %d, doesn't follow on from the record before it", ErrAuditChainBroken, line, record.Seq)
+		case expected != record.Hash:
+			return report, fmt.Errorf("%w: line %d, seq %d, was modified, or the key is wrong", ErrAuditChainBroken, line, record.Seq)
+		}
+		if hash, ok := exported[record.Seq]; ok && hash != record.Hash {
+			return report, fmt.Errorf("%w: line %d, seq %d, isn't the record exported as the head, the log was rewritten", ErrAuditChainBroken, line, record.Seq)
+		}
+		report.Records++
+		report.HeadSeq, report.HeadHash = record.Seq, record.Hash
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo identifies the request a change was made by, for its audit record.
+type requestInfo struct {
+	ID     string
+	Client string
+}
+
+// withRequestInfo tags ctx with request's ID, the X-Request-ID it was sent with if any, and returns the ID.
+func withRequestInfo(ctx context.Context, request *http.Request) (context.Context, string) {
+	id := request.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestID || strings.ContainsFunc(id, func(r rune) bool { return r < 0x21 || r > 0x7e }) {
+		random := make([]byte, 16)
+		_, _ = rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	return context.WithValue(ctx, requestInfoKey{}, requestInfo{ID: id, Client: remoteIP(request)}), id
+}
+
+// requestIDMiddleware gives every request an ID, echoed in X-Request-ID, that its audit records are tagged with.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx, id := withRequestInfo(request.Context(), request)
+		response.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+type copySourceKey struct{}
+
+type copySource struct {
+	from string
+	to   string
+}
+
+// withCopySource marks writes under to, a file or a folder prefix, as copies of the same names under from.
+func withCopySource(ctx context.Context, from string, to string) context.Context {
+	return context.WithValue(ctx, copySourceKey{}, copySource{from: from, to: to})
+}
+
+// audit records a change of old into current, either of which is zero if the file didn't or no longer exists.
+// Failing to record it doesn't undo the change, it's logged and counted.
+func (fs *FileServer) audit(ctx context.Context, action string, old ObjectMeta, current ObjectMeta) {
+	if fs.auditLog == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Name:    current.Name,
+		OldETag: old.ETag(),
+		NewETag: current.ETag(),
+		Size:    current.Size,
+	}
+	if current.Name == "" {
+		record.Name, record.Size = old.Name, old.Size
+	}
+	if action == EventMetadata {
+		record.Retention = current.Retention
+	}
+	if source, ok := ctx.Value(copySourceKey{}).(copySource); ok && current.Name != "" && strings.HasPrefix(current.Name, source.to) {
+		record.Action, record.Source = AuditCopy, source.from+strings.TrimPrefix(current.Name, source.to)
+	}
+	if info, ok := ctx.Value(requestInfoKey{}).(requestInfo); ok {
+		record.RequestID, record.Client = info.ID, info.Client
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		record.KeyID = principal.KeyID
+	}
+
+	if err := fs.auditLog.Append(record); err != nil {
+		fs.metrics.auditFailures.Inc()
+		log.Errorf("Failed to audit %s of %s: %+v", record.Action, record.Name, err)
+		return
+	}
+	fs.metrics.auditRecords.Inc(record.Action)
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Without a key whoever can write the log can rehash it, an exported head still gives the rewrite away.
+func TestAuditHeadCatchesRewrite(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(AuditConfig{Enabled: true, Dir: dir}, JournalConfig{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := audit.Append(AuditRecord{Action: EventCreate, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := AuditHead{Seq: audit.seq, Hash: audit.head}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(data), nil, head); err != nil {
+		t.Fatalf("verify against the exported head: %v", err)
+	}
+	parsed, err := ParseAuditHead(head.String())
+	if err != nil || parsed != head {
+		t.Fatalf("parsed %s as %+v, %v", head, parsed, err)
+	}
+
+	// Rename b to hide it, rehashing the chain from there.
+	var rewritten bytes.Buffer
+	previous := ""
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Name == "b" {
+			record.Name = "innocent"
+		}
+		record.PrevHash = previous
+		if record.Hash, err = hashAuditRecord(nil, record); err != nil {
+			t.Fatal(err)
+		}
+		previous = record.Hash
+		line, _ = json.Marshal(record)
+		rewritten.Write(append(line, '\n'))
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(rewritten.Bytes()), nil); err != nil {
+		t.Fatalf("a rehashed log should verify on its own: %v", err)
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(rewritten.Bytes()), nil, head); !errors.Is(err, ErrAuditChainBroken) {
+		t.Errorf("verify of a rehashed log against the exported head = %v, want ErrAuditChainBroken", err)
+	}
+
+	// Dropping the last records doesn't pass either.
+	truncated := data[:bytes.IndexByte(data, '\n')+1]
+	if _, err := VerifyAuditLog(bytes.NewReader(truncated), nil, head); !errors.Is(err, ErrAuditChainBroken) {
+		t.Errorf("verify of a truncated log against the exported head = %v, want ErrAuditChainBroken", err)
+	}
+}
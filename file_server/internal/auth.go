@@ -0,0 +1,416 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+type Permission string
+
+const (
+	PermissionRead   Permission = "read"
+	PermissionWrite  Permission = "write"
+	PermissionDelete Permission = "delete"
+	// PermissionBypassGovernance lets a key overwrite and delete files under governance retention, if the server
+	// allows it.
+	PermissionBypassGovernance Permission = "bypass_governance"
+	// PermissionManageRetention lets a key place and lift legal holds, and shorten or remove retention periods in
+	// force, on top of the write permission setting retention takes. Extending retention only takes write.
+	PermissionManageRetention Permission = "manage_retention"
+
+	hmacAlgorithm     = "FS-HMAC-SHA256"
+	hmacDateHeader    = "X-FS-Date"
+	hmacPayloadHeader = "X-FS-Content-SHA256"
+	hmacDateFormat    = "20060102T150405Z"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials provided")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrSignatureMismatch  = errors.New("request signature does not match")
+	ErrClockSkew          = errors.New("request date outside allowed clock skew")
+	ErrForbidden          = errors.New("key is not permitted to perform this operation")
+)
+
+type AuthConfig struct {
+	Enabled      bool
+	KeysFile     string        // JSON file holding the list of APIKeys
+	MaxClockSkew time.Duration // Maximum difference between a signed request's date and server time
+}
+
+// APIKey is one entry in the keys file. A key can authenticate by sending its secret in the X-API-Key header or as
+// Basic credentials, or by signing requests with it.
+type APIKey struct {
+	ID          string       `json:"id"`
+	Secret      string       `json:"secret"`
+	Permissions []Permission `json:"permissions"`
+	Prefix      string       `json:"prefix"` // Only file names starting with this prefix are accessible. Empty allows all.
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	KeyID       string
+	Permissions []Permission
+	Prefix      string
+}
+
+// Authenticator resolves the caller of a request. It returns ErrNoCredentials if the request doesn't carry the
+// kind of credentials it handles, so the next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(request *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller, or nil if the request wasn't authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// Allows reports whether the principal may perform permission on fileName.
+func (p *Principal) Allows(permission Permission, fileName string) bool {
+	if !strings.HasPrefix(fileName, p.Prefix) {
+		return false
+	}
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAPIKeys reads the keys file.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys file %s: %w", path, err)
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse keys file %s: %w", path, err)
+	}
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("keys file %s contains a key without an id or secret", path)
+		}
+	}
+	return keys, nil
+}
+
+func principalFor(key APIKey) *Principal {
+	return &Principal{KeyID: key.ID, Permissions: key.Permissions, Prefix: key.Prefix}
+}
+
+// StaticKeyAuthenticator accepts a key's secret sent in the X-API-Key header.
+type StaticKeyAuthenticator struct {
+	keys []APIKey
+}
+
+func NewStaticKeyAuthenticator(keys []APIKey) *StaticKeyAuthenticator {
+	return &StaticKeyAuthenticator{keys: keys}
+}
+
+func (a *StaticKeyAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	secret := request.Header.Get(apiKeyHeader)
+	if secret == "" {
+		return nil, ErrNoCredentials
+	}
+
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) == 1 {
+			return principalFor(key), nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// BasicAuthenticator accepts a key's id and secret as HTTP Basic credentials, for clients such as WebDAV mounts that
+// can't send anything else. Like X-API-Key, the secret travels as is, so it belongs behind TLS.
+type BasicAuthenticator struct {
+	keys map[string]APIKey
+}
+
+func NewBasicAuthenticator(keys []APIKey) *BasicAuthenticator {
+	byID := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+	return &BasicAuthenticator{keys: byID}
+}
+
+func (a *BasicAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	id, secret, ok := request.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	key, found := a.keys[id]
+	if !found || subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return principalFor(key), nil
+}
+
+// HMACAuthenticator verifies requests signed like AWS SigV4, with an FS-HMAC-SHA256 Authorization header and an
+// X-FS-Date within MaxClockSkew of the server clock.
+type HMACAuthenticator struct {
+	keys         map[string]APIKey
+	maxClockSkew time.Duration
+	now          func() time.Time
+}
+
+func NewHMACAuthenticator(keys []APIKey, maxClockSkew time.Duration) *HMACAuthenticator {
+	byID := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+	return &HMACAuthenticator{keys: byID, maxClockSkew: maxClockSkew, now: time.Now}
+}
+
+func (a *HMACAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, hmacAlgorithm+" ") {
+		return nil, ErrNoCredentials
+	}
+
+	fields := parseAuthorizationFields(strings.TrimPrefix(authorization, hmacAlgorithm+" "))
+	key, ok := a.keys[fields["Credential"]]
+	if !ok || fields["Signature"] == "" || fields["SignedHeaders"] == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	date, err := time.Parse(hmacDateFormat, request.Header.Get(hmacDateHeader))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	skew := a.now().Sub(date)
+	if skew > a.maxClockSkew || skew < -a.maxClockSkew {
+		return nil, ErrClockSkew
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !containsString(signedHeaders, strings.ToLower(hmacDateHeader)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	expected := SignRequest(request, key.Secret, signedHeaders, date)
+	provided, err := hex.DecodeString(fields["Signature"])
+	if err != nil || !hmac.Equal(expected, provided) {
+		return nil, ErrSignatureMismatch
+	}
+
+	// The signature only covers the payload hash header, so check the body actually hashes to it as it is read.
+	if payloadHash := request.Header.Get(hmacPayloadHeader); payloadHash != "" && payloadHash != unsignedPayload {
+		request.Body = &payloadVerifier{ReadCloser: request.Body, hash: sha256.New(), expected: payloadHash}
+	}
+
+	return principalFor(key), nil
+}
+
+// payloadVerifier fails the final read of a body whose SHA-256 doesn't match the signed payload hash.
+type payloadVerifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (v *payloadVerifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != strings.ToLower(v.expected) {
+		return n, ErrSignatureMismatch
+	}
+	return n, err
+}
+
+// SignRequest computes the signature of request over signedHeaders (lower case names) at date. Clients sign the
+// same way and send the hex encoded result in the Authorization header.
+func SignRequest(request *http.Request, secret string, signedHeaders []string, date time.Time) []byte {
+	canonical := canonicalRequest(request, signedHeaders)
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		hmacAlgorithm,
+		date.UTC().Format(hmacDateFormat),
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	dateKey := hmacSHA256([]byte("FS"+secret), []byte(date.UTC().Format("20060102")))
+	signingKey := hmacSHA256(dateKey, []byte("fs_request"))
+	return hmacSHA256(signingKey, []byte(stringToSign))
+}
+
+func canonicalRequest(request *http.Request, signedHeaders []string) string {
+	sorted := append([]string(nil), signedHeaders...)
+	sort.Strings(sorted)
+
+	var headers strings.Builder
+	for _, name := range sorted {
+		value := request.Header.Get(name)
+		if name == "host" {
+			value = request.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	payloadHash := request.Header.Get(hmacPayloadHeader)
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+
+	return strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		headers.String(),
+		strings.Join(sorted, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	// url.Values.Encode sorts by key, which is what the canonical form needs.
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func parseAuthorizationFields(raw string) map[string]string {
+	fields := map[string]string{}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if found {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAuthenticators builds the configured authenticator chain. Returns nil if auth is disabled.
+func NewAuthenticators(cfg AuthConfig) ([]Authenticator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	keys, err := LoadAPIKeys(cfg.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d API keys from %s", len(keys), cfg.KeysFile)
+
+	return []Authenticator{
+		NewHMACAuthenticator(keys, cfg.MaxClockSkew),
+		NewSigV4Authenticator(keys, cfg.MaxClockSkew),
+		NewStaticKeyAuthenticator(keys),
+		NewBasicAuthenticator(keys),
+	}, nil
+}
+
+// authorize wraps handle so it only runs for callers holding permission on the requested file. Pre-signed URLs are
+// honoured on the file's own route.
+func (fs *FileServer) authorize(permission Permission, handle httprouter.Handle) httprouter.Handle {
+	return func(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		err := fs.signer.Verify(request, params.ByName("filename"))
+		if err == nil {
+			principal := &Principal{KeyID: presignedPrincipal, Permissions: []Permission{permission}}
+			handle(response, request.WithContext(withPrincipal(request.Context(), principal)), params)
+			return
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			fs.metrics.authFailures.Inc(authFailureReason(err))
+			response.WriteHeader(http.StatusForbidden)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+
+		if len(fs.authenticators) == 0 {
+			handle(response, request, params)
+			return
+		}
+
+		principal, err := fs.authenticate(request)
+		if err != nil {
+			fs.metrics.authFailures.Inc(authFailureReason(err))
+			response.Header().Set("WWW-Authenticate", hmacAlgorithm)
+			response.WriteHeader(http.StatusUnauthorized)
+			fs.WriteResponseBody(response, "Unauthorized.")
+			return
+		}
+
+		if !principal.Allows(permission, params.ByName("filename")) {
+			fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+			response.WriteHeader(http.StatusForbidden)
+			fs.WriteResponseBody(response, "Forbidden.")
+			return
+		}
+
+		handle(response, request.WithContext(withPrincipal(request.Context(), principal)), params)
+	}
+}
+
+func (fs *FileServer) authenticate(request *http.Request) (*Principal, error) {
+	for _, authenticator := range fs.authenticators {
+		principal, err := authenticator.Authenticate(request)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+func authFailureReason(err error) string {
+	switch err {
+	case ErrNoCredentials:
+		return "missing_credentials"
+	case ErrSignatureMismatch:
+		return "bad_signature"
+	case ErrClockSkew:
+		return "clock_skew"
+	case ErrForbidden:
+		return "forbidden"
+	case ErrPresignExpired:
+		return "presign_expired"
+	case ErrPresignInvalid:
+		return "presign_invalid"
+	default:
+		return "invalid_credentials"
+	}
+}
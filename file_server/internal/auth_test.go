@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKeys = []APIKey{
+	{ID: "rw", Secret: "rw-secret", Permissions: []Permission{PermissionRead, PermissionWrite}},
+	{ID: "ro", Secret: "ro-secret", Permissions: []Permission{PermissionRead}, Prefix: "pub-"},
+}
+
+// signHMAC signs request as key id with secret at date.
+func signHMAC(request *http.Request, id string, secret string, date time.Time) {
+	request.Header.Set(hmacDateHeader, date.UTC().Format(hmacDateFormat))
+	signedHeaders := []string{"host", "x-fs-date"}
+	signature := SignRequest(request, secret, signedHeaders, date)
+	request.Header.Set("Authorization", hmacAlgorithm+" Credential="+id+", SignedHeaders=host;x-fs-date, Signature="+hex.EncodeToString(signature))
+}
+
+func TestAuthenticate(t *testing.T) {
+	withKeys(t, testKeys...)
+	fs := newTestFileServer(t)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		prepare func(request *http.Request)
+		want    string
+		wantErr error
+	}{
+		{"no credentials", func(*http.Request) {}, "", ErrNoCredentials},
+		{"hmac", func(r *http.Request) { signHMAC(r, "rw", "rw-secret", now) }, "rw", nil},
+		{"hmac with the wrong secret", func(r *http.Request) { signHMAC(r, "rw", "ro-secret", now) }, "", ErrSignatureMismatch},
+		{"hmac of another path", func(r *http.Request) {
+			signHMAC(r, "rw", "rw-secret", now)
+			r.URL.Path = "/api/fileserver/other"
+		}, "", ErrSignatureMismatch},
+		{"hmac of an unknown key", func(r *http.Request) { signHMAC(r, "nobody", "rw-secret", now) }, "", ErrInvalidCredentials},
+		{"hmac too old", func(r *http.Request) { signHMAC(r, "rw", "rw-secret", now.Add(-time.Hour)) }, "", ErrClockSkew},
+		{"hmac without the date signed", func(r *http.Request) {
+			signHMAC(r, "rw", "rw-secret", now)
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "host;x-fs-date", "host", 1))
+		}, "", ErrInvalidCredentials},
+		{"static key", func(r *http.Request) { r.Header.Set(apiKeyHeader, "ro-secret") }, "ro", nil},
+		{"unknown static key", func(r *http.Request) { r.Header.Set(apiKeyHeader, "guess") }, "", ErrInvalidCredentials},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("rw", "rw-secret") }, "rw", nil},
+		{"basic with another key's secret", func(r *http.Request) { r.SetBasicAuth("rw", "ro-secret") }, "", ErrInvalidCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/fileserver/a?versions=1", nil)
+			test.prepare(request)
+			principal, err := fs.authenticate(request)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("authenticate = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && principal.KeyID != test.want {
+				t.Errorf("authenticated as %s, want %s", principal.KeyID, test.want)
+			}
+		})
+	}
+}
+
+// The signature covers the payload hash header, the body has to match it.
+func TestHMACPayloadHash(t *testing.T) {
+	authenticator := NewHMACAuthenticator(testKeys, time.Minute)
+	signed := sha256.Sum256([]byte("signed"))
+	for _, body := range []string{"signed", "tampered"} {
+		request := httptest.NewRequest(http.MethodPut, "/api/fileserver/a", strings.NewReader(body))
+		request.Header.Set(hmacPayloadHeader, hex.EncodeToString(signed[:]))
+		signHMAC(request, "rw", "rw-secret", time.Now())
+		if _, err := authenticator.Authenticate(request); err != nil {
+			t.Fatal(err)
+		}
+		_, err := io.ReadAll(request.Body)
+		if wantErr := body == "tampered"; errors.Is(err, ErrSignatureMismatch) != wantErr {
+			t.Errorf("reading a %s body = %v", body, err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	withKeys(t, testKeys...)
+	fs := newTestFileServer(t)
+	router := fs.newRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"without credentials", http.MethodGet, "/api/fileserver/a", "", http.StatusUnauthorized},
+		{"with a wrong key", http.MethodGet, "/api/fileserver/a", "guess", http.StatusUnauthorized},
+		{"write", http.MethodPut, "/api/fileserver/a", "rw-secret", http.StatusCreated},
+		{"read", http.MethodGet, "/api/fileserver/a", "rw-secret", http.StatusOK},
+		{"read in prefix", http.MethodGet, "/api/fileserver/pub-missing", "ro-secret", http.StatusNotFound},
+		{"read outside prefix", http.MethodGet, "/api/fileserver/a", "ro-secret", http.StatusForbidden},
+		{"write without permission", http.MethodPut, "/api/fileserver/pub-a", "ro-secret", http.StatusForbidden},
+		{"delete without permission", http.MethodDelete, "/api/fileserver/a", "rw-secret", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader("data"))
+			if test.key != "" {
+				request.Header.Set(apiKeyHeader, test.key)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != test.want {
+				t.Errorf("got %d: %s, want %d", response.Code, response.Body, test.want)
+			}
+			if test.want == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") != hmacAlgorithm {
+				t.Errorf("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StorageModeDisk = "disk"
+	StorageModeCAS  = "cas"
+
+	casDir     = "cas"
+	casBlobDir = "blobs"
+)
+
+// NewStorage builds the storage backend selected by cfg.Mode.
+func NewStorage(cfg StorageConfig, keyring *Keyring) (Storage, error) {
+	switch cfg.Mode {
+	case StorageModeDisk, "":
+		return NewDiskStorage(cfg, keyring)
+	case StorageModeCAS:
+		return NewCASStorage(cfg, keyring)
+	default:
+		return nil, fmt.Errorf("unknown storage mode: %s", cfg.Mode)
+	}
+}
+
+// CASStats summarises how much space deduplication is saving.
+type CASStats struct {
+	Names       int
+	Blobs       int
+	LogicalSize int64 // Sum of stored sizes over every name
+	StoredSize  int64 // Sum of stored sizes over every blob
+}
+
+// CASStorage stores each body once under .fileserver/cas/blobs, keyed by its checksum, with names pointing at blobs in
+// a journaled index. Blobs no name points to are deleted by a background collector.
+type CASStorage struct {
+	dataDir    string
+	compressor *Compressor
+	keyring    *Keyring // Nil if no master keys are configured
+	index      *MetaIndex
+	durable    bool // Sync blobs before the index entries pointing at them
+}
+
+func NewCASStorage(cfg StorageConfig, keyring *Keyring) (*CASStorage, error) {
+	for _, dir := range []string{filepath.Join(cfg.DataDir, reservedDir, tmpDir), filepath.Join(cfg.DataDir, reservedDir, casDir, casBlobDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	removeStaleTemps(filepath.Join(cfg.DataDir, reservedDir, tmpDir))
+
+	if cfg.Journal.Dir == "" {
+		cfg.Journal.Dir = filepath.Join(cfg.DataDir, reservedDir, casDir, journalDir)
+	}
+	index, err := OpenMetaIndex(cfg.Journal)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CASStorage{
+		dataDir:    cfg.DataDir,
+		compressor: NewCompressor(cfg.Compression),
+		keyring:    keyring,
+		index:      index,
+		durable:    cfg.Journal.Fsync == FsyncAlways,
+	}
+	if err := index.SetRepair(s.repair); err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	stats := s.Stats()
+	log.Infof("Storage index has %d names over %d blobs", stats.Names, stats.Blobs)
+	if cfg.GCInterval > 0 {
+		go s.collectGarbageEvery(cfg.GCInterval)
+	}
+	return s, nil
+}
+
+func (s *CASStorage) blobPath(blob string) string {
+	// Fan out on the first byte so no single directory holds every blob.
+	return filepath.Join(s.dataDir, reservedDir, casDir, casBlobDir, blob[:2], blob)
+}
+
+// Create renames the blob into place and journals the name pointing at it under the index's exclusive lock, so the
+// collector, which takes the same lock, can't remove a blob between being reused and referenced.
+func (s *CASStorage) Create(name string, body io.Reader, opts CreateOptions) (ObjectMeta, error) {
+	tmpPath, meta, err := writeObjectTemp(filepath.Join(s.dataDir, reservedDir, tmpDir), s.compressor, s.keyring, name, body, s.durable)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer func() {
+		// No-op once the temp file has been renamed into place.
+		_ = os.Remove(tmpPath)
+	}()
+	meta.Blob = s.keyring.BlobName(meta.Checksum)
+	meta.Hashes = nil // Blobs may be shared, they're never written in place
+	meta.Retention = opts.Retention
+	if opts.MD5 != "" {
+		meta.MD5 = opts.MD5
+	}
+
+	err = s.index.Update(func(tx IndexTx) error {
+		if stored, refs := tx.Blob(meta.Blob); refs > 0 {
+			// Already stored, possibly with different compression or encryption settings. Describe the copy that's on disk.
+			meta.Encoding, meta.StoredSize, meta.Incompressible, meta.Envelope = stored.Encoding, stored.StoredSize, stored.Incompressible, stored.Envelope
+		} else {
+			path := s.blobPath(meta.Blob)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			// Replaces an unreferenced blob still waiting for collection, whose encoding isn't known anymore.
+			if err := os.Rename(tmpPath, path); err != nil {
+				return err
+			}
+			if s.durable {
+				if err := syncDir(filepath.Dir(path)); err != nil {
+					return err
+				}
+			}
+		}
+		// The blob is in place before anything points at it. If journaling fails it's unreferenced and gets collected.
+		return tx.Put(meta)
+	})
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	return meta, nil
+}
+
+// WriteAt always fails with ErrNotInPlace, a blob may back other names.
+func (s *CASStorage) WriteAt(string, ObjectMeta, int64, io.Reader) (ObjectMeta, error) {
+	return ObjectMeta{}, ErrNotInPlace
+}
+
+func (s *CASStorage) Open(name string) (io.ReadCloser, ObjectMeta, error) {
+	meta, err := s.Stat(name)
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	file, err := os.Open(s.blobPath(meta.Blob))
+	if errors.Is(err, os.ErrNotExist) {
+		// Replaced and collected since it was looked up. Once open, removal doesn't affect reads.
+		if err := s.index.Refresh(); err != nil {
+			return nil, ObjectMeta{}, err
+		}
+		if meta, err = s.lookup(name); err != nil {
+			return nil, ObjectMeta{}, err
+		}
+		file, err = os.Open(s.blobPath(meta.Blob))
+	}
+	if err != nil {
+		return nil, ObjectMeta{}, fmt.Errorf("blob %s of %s is unreadable: %w", meta.Blob, name, err)
+	}
+	stored, err := decryptStored(s.keyring, file, meta)
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	return stored, meta, nil
+}
+
+// Stat catches up with the other file servers when name isn't indexed, one of them may just have written it.
+func (s *CASStorage) Stat(name string) (ObjectMeta, error) {
+	if meta, ok := s.index.Get(name); ok {
+		return meta, nil
+	}
+	if err := s.index.Refresh(); err != nil {
+		return ObjectMeta{}, err
+	}
+	return s.lookup(name)
+}
+
+func (s *CASStorage) lookup(name string) (ObjectMeta, error) {
+	meta, ok := s.index.Get(name)
+	if !ok {
+		return ObjectMeta{}, ErrObjectNotFound
+	}
+	return meta, nil
+}
+
+func (s *CASStorage) Remove(name string) error {
+	return s.index.Update(func(tx IndexTx) error {
+		if _, ok := tx.Get(name); !ok {
+			return ErrObjectNotFound
+		}
+		return tx.Delete(name)
+	})
+}
+
+func (s *CASStorage) Index() *MetaIndex {
+	return s.index
+}
+
+func (s *CASStorage) List() ([]ObjectMeta, error) {
+	if err := s.index.Refresh(); err != nil {
+		return nil, err
+	}
+	var objects []ObjectMeta
+	s.index.Range(func(_ string, meta ObjectMeta) bool {
+		objects = append(objects, meta)
+		return true
+	})
+	return objects, nil
+}
+
+func (s *CASStorage) Reconcile() ([]string, error) {
+	var dropped []string
+	err := s.index.Update(func(tx IndexTx) error {
+		var missing []string
+		tx.Range(func(name string, meta ObjectMeta) bool {
+			if _, err := os.Stat(s.blobPath(meta.Blob)); errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, name)
+			}
+			return true
+		})
+		for _, name := range missing {
+			if err := tx.Delete(name); err != nil {
+				return err
+			}
+			dropped = append(dropped, name)
+		}
+		return nil
+	})
+	return dropped, err
+}
+
+// Adopt has nothing to do, blobs are only reachable through the index.
+func (s *CASStorage) Adopt(int) ([]string, error) {
+	return nil, nil
+}
+
+func (s *CASStorage) Verify(name string) error {
+	file, meta, err := s.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return verifyChecksum(meta, file)
+}
+
+// Quarantine moves name's blob to .fileserver/quarantine and drops every name pointing at it, since they all share
+// the corrupt bytes.
+func (s *CASStorage) Quarantine(name string) (string, error) {
+	dir := filepath.Join(s.dataDir, reservedDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	var target string
+	err := s.index.Update(func(tx IndexTx) error {
+		meta, ok := tx.Get(name)
+		if !ok {
+			return ErrObjectNotFound
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s.%d", meta.Blob, time.Now().Unix()))
+		if err := os.Rename(s.blobPath(meta.Blob), target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		sharing := s.sharing(tx, meta.Blob)
+		for _, other := range sharing {
+			if err := tx.Delete(other.Name); err != nil {
+				return err
+			}
+		}
+		if data, err := json.Marshal(sharing); err == nil {
+			_ = os.WriteFile(target+".json", data, 0644)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// Rewrap rewraps the data key of name's blob, which every name pointing at the blob shares.
+func (s *CASStorage) Rewrap(name string) (bool, error) {
+	rewrapped := false
+	err := s.index.Update(func(tx IndexTx) error {
+		meta, ok := tx.Get(name)
+		if !ok {
+			return ErrObjectNotFound
+		}
+		if meta.Envelope == nil {
+			return nil
+		}
+		envelope, changed, err := s.keyring.Rewrap(meta.Envelope)
+		if !changed {
+			return err
+		}
+
+		// Until every name is updated some still carry the old envelope, which stays valid while the old key is loaded.
+		for _, other := range s.sharing(tx, meta.Blob) {
+			other.Envelope = envelope
+			if err := tx.Put(other); err != nil {
+				return err
+			}
+		}
+		rewrapped = true
+		return nil
+	})
+	return rewrapped, err
+}
+
+// sharing returns every name pointing at blob.
+func (s *CASStorage) sharing(tx IndexTx, blob string) []ObjectMeta {
+	var sharing []ObjectMeta
+	tx.Range(func(_ string, other ObjectMeta) bool {
+		if other.Blob == blob {
+			sharing = append(sharing, other)
+		}
+		return true
+	})
+	return sharing
+}
+
+func (s *CASStorage) SetRetention(name string, retention *Retention) (ObjectMeta, error) {
+	var meta ObjectMeta
+	err := s.index.Update(func(tx IndexTx) error {
+		var ok bool
+		meta, ok = tx.Get(name)
+		if !ok {
+			return ErrObjectNotFound
+		}
+		meta.Retention = retention
+		return tx.Put(meta)
+	})
+	return meta, err
+}
+
+// Snapshot hard links every referenced blob once, however many names point at it. Blobs are never modified, holding
+// the index's exclusive lock only keeps the index and the linked blobs in step.
+func (s *CASStorage) Snapshot() (*StorageSnapshot, error) {
+	snapshot, err := newStorageSnapshot(s.dataDir, s.keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.index.Update(func(tx IndexTx) error {
+		var err error
+		linked := map[string]bool{}
+		tx.Range(func(_ string, meta ObjectMeta) bool {
+			if linked[meta.Blob] {
+				snapshot.share(meta, meta.Blob)
+				return true
+			}
+			if err = snapshot.add(meta, s.blobPath(meta.Blob), meta.Blob); err != nil {
+				err = fmt.Errorf("blob %s of %s is unreadable: %w", meta.Blob, meta.Name, err)
+				return false
+			}
+			linked[meta.Blob] = true
+			return true
+		})
+		return err
+	})
+	if err != nil {
+		_ = snapshot.Close()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *CASStorage) Stats() CASStats {
+	var stats CASStats
+	blobs := map[string]bool{}
+	s.index.Range(func(_ string, meta ObjectMeta) bool {
+		stats.Names++
+		stats.LogicalSize += meta.StoredSize
+		if !blobs[meta.Blob] {
+			blobs[meta.Blob] = true
+			stats.StoredSize += meta.StoredSize
+		}
+		return true
+	})
+	stats.Blobs = len(blobs)
+	return stats
+}
+
+// CollectGarbage deletes every blob no name points to and returns how many were removed.
+func (s *CASStorage) CollectGarbage() (int, error) {
+	// List without the lock so writes aren't blocked while walking the tree, the candidates are rechecked under it.
+	var candidates []string
+	root := filepath.Join(s.dataDir, reservedDir, casDir, casBlobDir)
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		candidates = append(candidates, path)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = s.index.Update(func(tx IndexTx) error {
+		for _, path := range candidates {
+			if _, refs := tx.Blob(filepath.Base(path)); refs > 0 {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *CASStorage) collectGarbageEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := s.CollectGarbage()
+		if err != nil {
+			log.Errorf("Blob garbage collection failed: %+v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Infof("Garbage collected %d unreferenced blobs", removed)
+		}
+	}
+}
+
+// repair drops index entries whose blob never made it to disk, which can only happen when the journal is synced more
+// eagerly than blobs are.
+func (s *CASStorage) repair(name string, current ObjectMeta, indexed bool, _ []ObjectMeta, _ bool) (ObjectMeta, bool, error) {
+	if !indexed {
+		return ObjectMeta{}, false, nil
+	}
+	if _, err := os.Stat(s.blobPath(current.Blob)); errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Recovery: blob %s of %s is missing, dropping it from the index", current.Blob, name)
+		return ObjectMeta{}, false, nil
+	}
+	return current, true, nil
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestCASStorage(t *testing.T, dir string) *CASStorage {
+	t.Helper()
+	storage, err := NewCASStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = storage.Index().Close() })
+	return storage
+}
+
+func createAll(t *testing.T, storage Storage, bodies map[string]string) {
+	t.Helper()
+	for name, body := range bodies {
+		if _, err := storage.Create(name, strings.NewReader(body), CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// blobFiles counts the blobs on disk, referenced or not.
+func blobFiles(t *testing.T, dir string) int {
+	t.Helper()
+	count := 0
+	err := filepath.WalkDir(filepath.Join(dir, reservedDir, casDir, casBlobDir), func(_ string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func readBody(t *testing.T, storage Storage, name string) string {
+	t.Helper()
+	file, _, err := storage.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCASDedup(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestCASStorage(t, dir)
+	bodies := map[string]string{"a": "shared body", "b": "shared body", "c": "other body"}
+	createAll(t, storage, bodies)
+
+	a, _ := storage.Stat("a")
+	b, _ := storage.Stat("b")
+	c, _ := storage.Stat("c")
+	want := CASStats{Names: 3, Blobs: 2, LogicalSize: 2*a.StoredSize + c.StoredSize, StoredSize: a.StoredSize + c.StoredSize}
+	if a.Blob != b.Blob {
+		t.Errorf("identical bodies stored as blobs %s and %s", a.Blob, b.Blob)
+	}
+	if got := storage.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got := blobFiles(t, dir); got != 2 {
+		t.Errorf("got %d blob files, want 2", got)
+	}
+	for name, body := range bodies {
+		if got := readBody(t, storage, name); got != body {
+			t.Errorf("%s: got %q, want %q", name, got, body)
+		}
+	}
+
+	// Blobs are never written in place, they may back other names.
+	if _, err := storage.WriteAt("a", a, 0, strings.NewReader("x")); !errors.Is(err, ErrNotInPlace) {
+		t.Errorf("got %v writing in place, want %v", err, ErrNotInPlace)
+	}
+
+	_ = storage.Index().Close()
+	if got := newTestCASStorage(t, dir).Stats(); got != want {
+		t.Errorf("got stats %+v after reopening, want %+v", got, want)
+	}
+}
+
+func TestCASCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestCASStorage(t, dir)
+	createAll(t, storage, map[string]string{"a": "shared body", "b": "shared body", "c": "other body"})
+
+	steps := []struct {
+		name        string
+		remove      string
+		create      string // Created with the shared body after removing
+		wantRemoved int
+		wantBlobs   int
+	}{
+		{"blob still shared", "a", "", 0, 2},
+		{"blob reused before collection", "b", "d", 0, 2},
+		{"last reference removed", "d", "", 1, 1},
+		{"nothing left to collect", "", "", 0, 1},
+		{"every blob unreferenced", "c", "", 1, 0},
+	}
+	for _, step := range steps {
+		if step.remove != "" {
+			if err := storage.Remove(step.remove); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.create != "" {
+			createAll(t, storage, map[string]string{step.create: "shared body"})
+		}
+		removed, err := storage.CollectGarbage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != step.wantRemoved || blobFiles(t, dir) != step.wantBlobs {
+			t.Errorf("%s: removed %d leaving %d blobs, want %d leaving %d", step.name, removed, blobFiles(t, dir), step.wantRemoved, step.wantBlobs)
+		}
+		// Every remaining name is still readable.
+		objects, err := storage.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, meta := range objects {
+			readBody(t, storage, meta.Name)
+		}
+	}
+}
+
+func TestCASReconcile(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestCASStorage(t, dir)
+	createAll(t, storage, map[string]string{"a": "shared body", "b": "shared body", "c": "other body"})
+
+	a, _ := storage.Stat("a")
+	if err := os.Remove(storage.blobPath(a.Blob)); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := storage.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(dropped)
+	if strings.Join(dropped, ",") != "a,b" {
+		t.Errorf("got dropped %v, want every name of the missing blob", dropped)
+	}
+	if _, err := storage.Stat("c"); err != nil {
+		t.Errorf("c: %v", err)
+	}
+}
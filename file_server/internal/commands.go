@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands run by the server binary instead of serving, e.g. `main snapshot -o backup.tar.zst`.
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"snapshot":       snapshotCommand,
+	"restore":        restoreCommand,
+	"migrate-layout": migrateLayoutCommand,
+	"verify-audit":   verifyAuditCommand,
+}
+
+// IsCommand reports whether args, without the program name, name a command rather than serving.
+func IsCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	_, ok := commands[args[0]]
+	return ok
+}
+
+// RunCommand runs the command named by args[0] with the rest of args as its flags.
+func RunCommand(ctx context.Context, args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	return command(ctx, args[1:])
+}
+
+// adminFlags are the flags of commands that go through a running server's admin API.
+type adminFlags struct {
+	server string
+	apiKey string
+}
+
+func (f *adminFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.server, "server", GetEnv("FILE_SERVER_URL", fmt.Sprintf("http://localhost:%d", defaultPort)), "Base URL of the file server, defaults to $FILE_SERVER_URL")
+	flags.StringVar(&f.apiKey, "api-key", os.Getenv("FILE_SERVER_API_KEY"), "API key to authenticate with if auth is enabled, defaults to $FILE_SERVER_API_KEY")
+}
+
+func (f *adminFlags) do(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	endpoint := strings.TrimSuffix(f.server, "/") + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if f.apiKey != "" {
+		request.Header.Set(apiKeyHeader, f.apiKey)
+	}
+	return http.DefaultClient.Do(request)
+}
+
+// snapshotCommand downloads a snapshot archive from a running server.
+func snapshotCommand(ctx context.Context, args []string) error {
+	var admin adminFlags
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	admin.register(flags)
+	output := flags.String("o", "", "File to write the archive to, - for stdout. Required")
+	format := flags.String("format", "", "tar or tar.zst, defaults to tar for a .tar output and tar.zst otherwise")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" {
+		flags.Usage()
+		return errors.New("-o is required")
+	}
+	if *format == "" {
+		*format = SnapshotFormatTarZstd
+		if strings.HasSuffix(*output, ".tar") {
+			*format = SnapshotFormatTar
+		}
+	}
+
+	response, err := admin.do(ctx, http.MethodGet, "/admin/snapshot", url.Values{"format": {*format}}, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("snapshot failed with %s: %s", response.Status, message)
+	}
+
+	if *output == "-" {
+		_, err = io.Copy(os.Stdout, response.Body)
+		return err
+	}
+	// Written beside the output first, so a failed download never leaves what looks like a whole archive.
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".snapshot.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, response.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("snapshot download failed: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		return err
+	}
+	log.Infof("Wrote %d byte snapshot to %s", size, *output)
+	return nil
+}
+
+// restoreCommand uploads a snapshot archive to a running server and prints its report.
+func restoreCommand(ctx context.Context, args []string) error {
+	var admin adminFlags
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	admin.register(flags)
+	dryRun := flags.Bool("dry-run", false, "Only check the archive's checksums and report what would change")
+	prune := flags.Bool("prune", false, "Also delete files the snapshot doesn't have")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected the archive to restore, - for stdin")
+	}
+
+	var archive io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		archive = file
+	}
+
+	query := url.Values{"dry_run": {fmt.Sprint(*dryRun)}, "prune": {fmt.Sprint(*prune)}}
+	response, err := admin.do(ctx, http.MethodPost, "/admin/restore", query, archive)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnprocessableEntity {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("restore failed with %s: %s", response.Status, message)
+	}
+
+	var report RestoreReport
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		return fmt.Errorf("failed to read restore report: %w", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d files failed", len(report.Failed))
+	}
+	return nil
+}
+
+// migrateLayoutCommand moves the files in DATA_DIR into the layout STORAGE_LAYOUT configures. It opens the storage
+// itself, sharing the index with any file server running on the data dir.
+func migrateLayoutCommand(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-layout", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only count the files that would be moved")
+	indexedOnly := flags.Bool("indexed-only", false, "Leave files the server didn't write, e.g. other processes' logs, in the flat layout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg := LoadConfig().Storage
+	if cfg.Mode != StorageModeDisk && cfg.Mode != "" {
+		return fmt.Errorf("only disk storage has a layout, STORAGE_MODE is %s", cfg.Mode)
+	}
+	// Recovery runs on open and reads encrypted files back, it needs the master keys.
+	keyring, err := NewKeyring(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	storage, err := NewDiskStorage(cfg, keyring)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", cfg.DataDir, err)
+	}
+	defer storage.index.Close()
+
+	moved, err := storage.MigrateLayout(*indexedOnly, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Infof("Would move %d files into the %s layout", moved, cfg.Layout.Mode)
+	} else {
+		log.Infof("Moved %d files into the %s layout", moved, cfg.Layout.Mode)
+	}
+	return nil
+}
+
+// verifyAuditCommand checks the audit log's hash chain. It only reads the log, so the server can keep running.
+func verifyAuditCommand(_ context.Context, args []string) error {
+	cfg := LoadConfig().Audit
+	flags := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	path := flags.String("log", filepath.Join(cfg.Dir, auditFile), "Audit log to verify, defaults to the one in $AUDIT_DIR")
+	key := flags.String("key", cfg.Key, "HMAC key the log was written with, defaults to $AUDIT_HMAC_KEY")
+	var heads []AuditHead
+	flags.Func("head", "A chain head the server logged, <seq>:<hash>, the log must contain. Repeatable", func(raw string) error {
+		head, err := ParseAuditHead(raw)
+		heads = append(heads, head)
+		return err
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	report, err := VerifyAuditLog(file, []byte(*key), heads...)
+	if err != nil {
+		return fmt.Errorf("%w, %d records verified before it", err, report.Records)
+	}
+	log.Infof("Verified %d audit records, head is seq %d with hash %s", report.Records, report.HeadSeq, report.HeadHash)
+	return nil
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+
+	CompressionFastest = "fastest"
+	CompressionDefault = "default"
+	CompressionBetter  = "better"
+	CompressionBest    = "best"
+
+	// Number of leading bytes compressed to judge whether a body is worth compressing.
+	compressionSampleSize = 64 * 1024
+)
+
+type CompressionConfig struct {
+	AtRest    bool    // Store compressible files compressed
+	Algorithm string  // Encoding used at rest, zstd or gzip
+	Level     string  // fastest, default, better or best. Faster levels skip entropy coding, so base64 barely shrinks.
+	Transfer  bool    // Compress GET responses of files stored as is for clients that accept it
+	MinSize   int64   // Files smaller than this are never compressed
+	MaxRatio  float64 // Files whose sample compresses to more than this fraction of its size are left as is
+}
+
+// Compressor encodes bodies on their way to disk and decides which bodies are worth compressing.
+type Compressor struct {
+	cfg CompressionConfig
+}
+
+func NewCompressor(cfg CompressionConfig) *Compressor {
+	return &Compressor{cfg: cfg}
+}
+
+func (c *Compressor) newEncoder(encoding string, dst io.Writer) (io.WriteCloser, error) {
+	return newEncoder(encoding, c.cfg.Level, dst)
+}
+
+// Encode copies src to dst, compressing it if compression at rest is enabled and a sample of src compresses well
+// enough. The returned metadata has Size and StoredSize set, Encoding and Incompressible only if sampled.
+func (c *Compressor) Encode(dst io.Writer, src io.Reader) (ObjectMeta, error) {
+	var meta ObjectMeta
+	if !c.cfg.AtRest {
+		written, err := io.Copy(dst, src)
+		meta.Size, meta.StoredSize = written, written
+		return meta, err
+	}
+
+	// Not io.ReadFull: it reports a short sample as io.ErrUnexpectedEOF, the same error a truncated request body fails
+	// with, which would then be stored as if complete.
+	sample := make([]byte, compressionSampleSize)
+	n, err := 0, error(nil)
+	for n < len(sample) && err == nil {
+		var read int
+		read, err = src.Read(sample[n:])
+		n += read
+	}
+	if err != nil && err != io.EOF {
+		return meta, err
+	}
+	sample = sample[:n]
+	complete := err == io.EOF
+
+	if complete && int64(n) < c.cfg.MinSize {
+		written, err := dst.Write(sample)
+		meta.Size, meta.StoredSize = int64(written), int64(written)
+		return meta, err
+	}
+
+	meta.Incompressible = !c.compressible(sample)
+	body := io.MultiReader(bytes.NewReader(sample), src)
+	counter := &countingWriter{Writer: dst}
+
+	if meta.Incompressible {
+		meta.Size, err = io.Copy(counter, body)
+		meta.StoredSize = counter.written
+		return meta, err
+	}
+
+	encoder, err := c.newEncoder(c.cfg.Algorithm, counter)
+	if err != nil {
+		return meta, err
+	}
+	meta.Encoding = c.cfg.Algorithm
+	meta.Size, err = io.Copy(encoder, body)
+	if err != nil {
+		_ = encoder.Close()
+		return meta, err
+	}
+	if err := encoder.Close(); err != nil {
+		return meta, err
+	}
+	meta.StoredSize = counter.written
+	return meta, nil
+}
+
+// ShouldCompressTransfer reports whether a file stored as is should be compressed on the way to the client.
+func (c *Compressor) ShouldCompressTransfer(meta ObjectMeta) bool {
+	return c.cfg.Transfer && meta.Encoding == EncodingIdentity && !meta.Incompressible && meta.Size >= c.cfg.MinSize
+}
+
+func (c *Compressor) compressible(sample []byte) bool {
+	var compressed countingWriter
+	encoder, err := c.newEncoder(c.cfg.Algorithm, &compressed)
+	if err != nil {
+		return false
+	}
+	_, _ = encoder.Write(sample)
+	_ = encoder.Close()
+	return float64(compressed.written) <= float64(len(sample))*c.cfg.MaxRatio
+}
+
+func newEncoder(encoding string, level string, dst io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		gzipLevel := map[string]int{
+			CompressionFastest: gzip.BestSpeed,
+			CompressionBetter:  7,
+			CompressionBest:    gzip.BestCompression,
+		}[level]
+		if gzipLevel == 0 {
+			gzipLevel = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(dst, gzipLevel)
+	case EncodingZstd:
+		zstdLevel := map[string]zstd.EncoderLevel{
+			CompressionFastest: zstd.SpeedFastest,
+			CompressionBetter:  zstd.SpeedBetterCompression,
+			CompressionBest:    zstd.SpeedBestCompression,
+		}[level]
+		if zstdLevel == 0 {
+			zstdLevel = zstd.SpeedDefault
+		}
+		if encoder, ok := zstdEncoders[zstdLevel].Get().(*zstd.Encoder); ok {
+			encoder.Reset(dst)
+			return &pooledEncoder{Encoder: encoder, pool: &zstdEncoders[zstdLevel]}, nil
+		}
+		encoder, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &pooledEncoder{Encoder: encoder, pool: &zstdEncoders[zstdLevel]}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// zstdEncoders keeps closed zstd encoders by level, they're costly to allocate for every body.
+var zstdEncoders [zstd.SpeedBestCompression + 1]sync.Pool
+
+// pooledEncoder returns its encoder to the pool once closed.
+type pooledEncoder struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (e *pooledEncoder) Close() error {
+	if e.Encoder == nil {
+		return nil
+	}
+	err := e.Encoder.Close()
+	e.Encoder.Reset(nil)
+	e.pool.Put(e.Encoder)
+	e.Encoder = nil
+	return err
+}
+
+// newDecoder wraps src so reads return the decoded bytes.
+func newDecoder(encoding string, src io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingIdentity, "identity":
+		return io.NopCloser(src), nil
+	case EncodingGzip:
+		return gzip.NewReader(src)
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows encoding.
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	return encodingQuality(acceptEncoding, encoding) > 0
+}
+
+// preferredEncoding picks zstd or gzip, whichever the client weights higher, or "" if it accepts neither.
+func preferredEncoding(acceptEncoding string) string {
+	zstdQ, gzipQ := encodingQuality(acceptEncoding, EncodingZstd), encodingQuality(acceptEncoding, EncodingGzip)
+	switch {
+	case zstdQ > 0 && zstdQ >= gzipQ:
+		return EncodingZstd
+	case gzipQ > 0:
+		return EncodingGzip
+	default:
+		return EncodingIdentity
+	}
+}
+
+func encodingQuality(acceptEncoding string, encoding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case encoding:
+			return quality
+		case "*":
+			wildcard = quality
+		}
+	}
+	return wildcard
+}
+
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.Writer == nil {
+		w.written += int64(len(p))
+		return len(p), nil
+	}
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
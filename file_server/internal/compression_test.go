@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible "), 10*1024)
+	random := make([]byte, 128*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	atRest := CompressionConfig{AtRest: true, Algorithm: EncodingZstd, Level: CompressionBetter, Transfer: true, MinSize: 1024, MaxRatio: 0.9}
+	transferOnly := atRest
+	transferOnly.AtRest = false
+
+	tests := []struct {
+		name               string
+		cfg                CompressionConfig
+		body               []byte
+		wantEncoding       string
+		wantIncompressible bool
+	}{
+		{"compressible at rest", atRest, compressible, EncodingZstd, false},
+		{"incompressible at rest", atRest, random, EncodingIdentity, true},
+		{"smaller than min size", atRest, compressible[:100], EncodingIdentity, false},
+		{"gzip at rest", CompressionConfig{AtRest: true, Algorithm: EncodingGzip, MaxRatio: 0.9}, compressible, EncodingGzip, false},
+		{"transfer only isn't sampled", transferOnly, random, EncodingIdentity, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Twice, the second time with an encoder from the pool.
+			for i := 0; i < 2; i++ {
+				var stored bytes.Buffer
+				meta, err := NewCompressor(test.cfg).Encode(&stored, bytes.NewReader(test.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if meta.Encoding != test.wantEncoding || meta.Incompressible != test.wantIncompressible {
+					t.Fatalf("encoded as %q, incompressible %t, want %q, %t", meta.Encoding, meta.Incompressible, test.wantEncoding, test.wantIncompressible)
+				}
+				if meta.Size != int64(len(test.body)) || meta.StoredSize != int64(stored.Len()) {
+					t.Errorf("size %d stored as %d, want %d stored as %d", meta.Size, meta.StoredSize, len(test.body), stored.Len())
+				}
+
+				decoder, err := newDecoder(meta.Encoding, &stored)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := io.ReadAll(decoder)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, test.body) {
+					t.Errorf("decoded %d bytes, want the %d encoded", len(decoded), len(test.body))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FileServerConfig struct {
+	Port        int
+	Tracing     TracingConfig
+	Admission   AdmissionConfig
+	RateLimit   RateLimitConfig
+	Auth        AuthConfig
+	Presign     PresignConfig
+	TLS         TLSConfig
+	Listen      ListenConfig
+	Storage     StorageConfig
+	Scrub       ScrubConfig
+	Watch       WatchConfig
+	Events      EventsConfig
+	Webhooks    WebhookConfig
+	Replication ReplicationConfig
+	S3          S3Config
+	WebDAV      WebDAVConfig
+	GRPC        GRPCConfig
+	Retention   RetentionConfig
+	Audit       AuditConfig
+}
+
+type TracingConfig struct {
+	Exporter     string  // none, otlp, stdout or file
+	OTLPEndpoint string  // host:port of the OTLP/HTTP collector, e.g. otel-collector:4318
+	OTLPInsecure bool    // If true, export over plain HTTP instead of HTTPS
+	FilePath     string  // Destination for the file exporter
+	ServiceName  string  // service.name resource attribute
+	SampleRatio  float64 // Fraction of root spans sampled. Parent sampling decisions are always honoured.
+}
+
+// LoadConfig builds the file server configuration from environment variables, falling back to defaults
+// that match the original hardcoded behaviour.
+func LoadConfig() FileServerConfig {
+	port, _ := strconv.Atoi(GetEnv("FILE_SERVER_PORT", strconv.Itoa(defaultPort)))
+	otlpInsecure, _ := strconv.ParseBool(GetEnv("TRACING_OTLP_INSECURE", "true"))
+	sampleRatio, err := strconv.ParseFloat(GetEnv("TRACING_SAMPLE_RATIO", "1.0"), 64)
+	if err != nil {
+		sampleRatio = 1.0
+	}
+	queueEnabled, _ := strconv.ParseBool(GetEnv("ADMISSION_QUEUE_ENABLED", "false"))
+	maxQueueDepth, _ := strconv.Atoi(GetEnv("ADMISSION_MAX_QUEUE_DEPTH", "100"))
+	maxQueueWait, _ := time.ParseDuration(GetEnv("ADMISSION_MAX_QUEUE_WAIT", "2s"))
+	smallFileThreshold, _ := strconv.ParseInt(GetEnv("ADMISSION_SMALL_FILE_THRESHOLD", "65536"), 10, 64)
+	clientRPS, _ := strconv.ParseFloat(GetEnv("RATE_LIMIT_RPS", "0"), 64)
+	clientBurst, _ := strconv.Atoi(GetEnv("RATE_LIMIT_BURST", "10"))
+	clientConcurrency, _ := strconv.Atoi(GetEnv("RATE_LIMIT_MAX_CONCURRENCY", "0"))
+	authEnabled, _ := strconv.ParseBool(GetEnv("AUTH_ENABLED", "false"))
+	maxClockSkew, _ := time.ParseDuration(GetEnv("AUTH_MAX_CLOCK_SKEW", "5m"))
+	presignMaxTTL, _ := time.ParseDuration(GetEnv("PRESIGN_MAX_TTL", "24h"))
+	tlsEnabled, _ := strconv.ParseBool(GetEnv("TLS_ENABLED", "false"))
+	tlsSelfSigned, _ := strconv.ParseBool(GetEnv("TLS_SELF_SIGNED", "false"))
+	http2Enabled, _ := strconv.ParseBool(GetEnv("HTTP2_ENABLED", "true"))
+	unixSocketMode, err := strconv.ParseUint(GetEnv("UNIX_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		unixSocketMode = 0660
+	}
+	casGCInterval, _ := time.ParseDuration(GetEnv("CAS_GC_INTERVAL", "1m"))
+	journalBatchInterval, _ := time.ParseDuration(GetEnv("JOURNAL_BATCH_INTERVAL", "100ms"))
+	journalSnapshotEvery, _ := strconv.Atoi(GetEnv("JOURNAL_SNAPSHOT_EVERY", "1000"))
+	encryptionEnabled, _ := strconv.ParseBool(GetEnv("ENCRYPTION_ENABLED", "false"))
+	layoutDepth, _ := strconv.Atoi(GetEnv("STORAGE_LAYOUT_DEPTH", "2"))
+	scrubInterval, _ := time.ParseDuration(GetEnv("SCRUB_INTERVAL", "1h"))
+	scrubVerify, _ := strconv.ParseBool(GetEnv("SCRUB_VERIFY_CHECKSUMS", "true"))
+	scrubQuarantine, _ := strconv.ParseBool(GetEnv("SCRUB_QUARANTINE", "false"))
+	warmUpLimit, _ := strconv.Atoi(GetEnv("WARM_UP_LIMIT", "100000"))
+	watchPollInterval, _ := time.ParseDuration(GetEnv("WATCH_POLL_INTERVAL", "30s"))
+	eventsBufferSize, _ := strconv.Atoi(GetEnv("EVENTS_BUFFER_SIZE", "1024"))
+	var webhookURLs []string
+	if raw := GetEnv("WEBHOOK_URLS", ""); raw != "" {
+		for _, webhookURL := range strings.Split(raw, ",") {
+			if webhookURL = strings.TrimSpace(webhookURL); webhookURL != "" {
+				webhookURLs = append(webhookURLs, webhookURL)
+			}
+		}
+	}
+	webhookMaxAttempts, err := strconv.Atoi(GetEnv("WEBHOOK_MAX_ATTEMPTS", "8"))
+	if err != nil || webhookMaxAttempts < 1 {
+		webhookMaxAttempts = 8
+	}
+	webhookInitialBackoff, _ := time.ParseDuration(GetEnv("WEBHOOK_INITIAL_BACKOFF", "1s"))
+	webhookMaxBackoff, _ := time.ParseDuration(GetEnv("WEBHOOK_MAX_BACKOFF", "5m"))
+	webhookTimeout, _ := time.ParseDuration(GetEnv("WEBHOOK_TIMEOUT", "5s"))
+	var replicaURLs []string
+	if raw := GetEnv("REPLICATION_REPLICAS", ""); raw != "" {
+		for _, replicaURL := range strings.Split(raw, ",") {
+			if replicaURL = strings.TrimSpace(replicaURL); replicaURL != "" {
+				replicaURLs = append(replicaURLs, replicaURL)
+			}
+		}
+	}
+	replicationSyncTimeout, _ := time.ParseDuration(GetEnv("REPLICATION_SYNC_TIMEOUT", "5s"))
+	replicationQueueSize, err := strconv.Atoi(GetEnv("REPLICATION_QUEUE_SIZE", "10000"))
+	if err != nil || replicationQueueSize < 1 {
+		replicationQueueSize = 10000
+	}
+	replicationHeartbeat, err := time.ParseDuration(GetEnv("REPLICATION_HEARTBEAT_INTERVAL", "5s"))
+	if err != nil || replicationHeartbeat <= 0 {
+		replicationHeartbeat = 5 * time.Second
+	}
+	s3Enabled, _ := strconv.ParseBool(GetEnv("S3_ENABLED", "false"))
+	webdavEnabled, _ := strconv.ParseBool(GetEnv("WEBDAV_ENABLED", "false"))
+	var grpcListen []string
+	if raw := GetEnv("GRPC_LISTEN", ""); raw != "" {
+		for _, address := range strings.Split(raw, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				grpcListen = append(grpcListen, address)
+			}
+		}
+	}
+	dataDir := GetEnv("DATA_DIR", "/tmp")
+	// Names this file server's own state under the shared data dir. Keep it stable across restarts, a server picks up
+	// the audit chain and webhook queue of the instance it's named as.
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "default"
+	}
+	instanceID := GetEnv("INSTANCE_ID", hostname)
+	auditEnabled, _ := strconv.ParseBool(GetEnv("AUDIT_ENABLED", "true"))
+	auditHeadInterval, err := time.ParseDuration(GetEnv("AUDIT_HEAD_INTERVAL", "1m"))
+	if err != nil {
+		auditHeadInterval = time.Minute
+	}
+	governanceBypass, _ := strconv.ParseBool(GetEnv("RETENTION_GOVERNANCE_BYPASS", "false"))
+	compressAtRest, _ := strconv.ParseBool(GetEnv("COMPRESSION_AT_REST", "false"))
+	compressTransfer, _ := strconv.ParseBool(GetEnv("COMPRESSION_TRANSFER", "true"))
+	compressMinSize, _ := strconv.ParseInt(GetEnv("COMPRESSION_MIN_SIZE", "1024"), 10, 64)
+	compressMaxRatio, err := strconv.ParseFloat(GetEnv("COMPRESSION_MAX_RATIO", "0.9"), 64)
+	if err != nil {
+		compressMaxRatio = 0.9
+	}
+
+	return FileServerConfig{
+		Port: port,
+		Tracing: TracingConfig{
+			Exporter:     GetEnv("TRACING_EXPORTER", TracingExporterNone),
+			OTLPEndpoint: GetEnv("TRACING_OTLP_ENDPOINT", "localhost:4318"),
+			OTLPInsecure: otlpInsecure,
+			FilePath:     GetEnv("TRACING_FILE_PATH", "/tmp/file_server_traces.json"),
+			ServiceName:  GetEnv("TRACING_SERVICE_NAME", "file-server"),
+			SampleRatio:  sampleRatio,
+		},
+		Admission: AdmissionConfig{
+			QueueEnabled:       queueEnabled,
+			MaxQueueDepth:      maxQueueDepth,
+			MaxQueueWait:       maxQueueWait,
+			SmallFileThreshold: smallFileThreshold,
+		},
+		RateLimit: RateLimitConfig{
+			KeySource:         GetEnv("RATE_LIMIT_KEY", ClientKeyIP),
+			KeyHeader:         GetEnv("RATE_LIMIT_KEY_HEADER", "X-Client-ID"),
+			RequestsPerSecond: clientRPS,
+			Burst:             clientBurst,
+			MaxConcurrency:    clientConcurrency,
+			Weights:           ParseClientValues(GetEnv("RATE_LIMIT_WEIGHTS", "")),
+			ClientOverrides:   ParseClientValues(GetEnv("RATE_LIMIT_CLIENT_RPS", "")),
+		},
+		Auth: AuthConfig{
+			Enabled:      authEnabled,
+			KeysFile:     GetEnv("AUTH_KEYS_FILE", "/etc/fileserver/keys.json"),
+			MaxClockSkew: maxClockSkew,
+		},
+		Presign: PresignConfig{
+			Secret:  GetEnv("PRESIGN_SECRET", ""),
+			BaseURL: GetEnv("PRESIGN_BASE_URL", ""),
+			MaxTTL:  presignMaxTTL,
+		},
+		TLS: TLSConfig{
+			Enabled:      tlsEnabled,
+			CertFile:     GetEnv("TLS_CERT_FILE", "/etc/fileserver/tls/cert.pem"),
+			KeyFile:      GetEnv("TLS_KEY_FILE", "/etc/fileserver/tls/key.pem"),
+			SelfSigned:   tlsSelfSigned,
+			Hosts:        strings.Split(GetEnv("TLS_HOSTS", "localhost,file_server,127.0.0.1"), ","),
+			ClientCAFile: GetEnv("TLS_CLIENT_CA_FILE", ""),
+			ClientAuth:   GetEnv("TLS_CLIENT_AUTH", ClientAuthNone),
+			HTTP2:        http2Enabled,
+		},
+		Listen: ListenConfig{
+			Addresses:      strings.Split(GetEnv("FILE_SERVER_LISTEN", fmt.Sprintf("tcp://:%d", port)), ","),
+			UnixSocketMode: os.FileMode(unixSocketMode),
+		},
+		Storage: StorageConfig{
+			DataDir:    dataDir,
+			Mode:       GetEnv("STORAGE_MODE", StorageModeDisk),
+			GCInterval: casGCInterval,
+			Compression: CompressionConfig{
+				AtRest:    compressAtRest,
+				Algorithm: GetEnv("COMPRESSION_ALGORITHM", EncodingZstd),
+				Level:     GetEnv("COMPRESSION_LEVEL", CompressionBetter),
+				Transfer:  compressTransfer,
+				MinSize:   compressMinSize,
+				MaxRatio:  compressMaxRatio,
+			},
+			Journal: JournalConfig{
+				Dir:           GetEnv("JOURNAL_DIR", ""),
+				Fsync:         GetEnv("JOURNAL_FSYNC", FsyncBatch),
+				BatchInterval: journalBatchInterval,
+				SnapshotEvery: journalSnapshotEvery,
+			},
+			Encryption: EncryptionConfig{
+				Enabled:   encryptionEnabled,
+				KeyFile:   GetEnv("ENCRYPTION_KEY_FILE", ""),
+				Keys:      GetEnv("ENCRYPTION_MASTER_KEYS", ""),
+				ActiveKey: GetEnv("ENCRYPTION_ACTIVE_KEY", ""),
+			},
+			Layout: LayoutConfig{
+				Mode:  GetEnv("STORAGE_LAYOUT", LayoutFlat),
+				Root:  GetEnv("STORAGE_LAYOUT_ROOT", ""),
+				Depth: layoutDepth,
+			},
+		},
+		Scrub: ScrubConfig{
+			Interval:        scrubInterval,
+			VerifyChecksums: scrubVerify,
+			Quarantine:      scrubQuarantine,
+			WarmUpLimit:     warmUpLimit,
+		},
+		Watch: WatchConfig{
+			Mode:         GetEnv("WATCH_MODE", WatchModeFSNotify),
+			PollInterval: watchPollInterval,
+		},
+		Events: EventsConfig{
+			BufferSize: eventsBufferSize,
+		},
+		Webhooks: WebhookConfig{
+			URLs:           webhookURLs,
+			Secret:         GetEnv("WEBHOOK_SECRET", ""),
+			MaxAttempts:    webhookMaxAttempts,
+			InitialBackoff: webhookInitialBackoff,
+			MaxBackoff:     webhookMaxBackoff,
+			Timeout:        webhookTimeout,
+			QueueDir:       GetEnv("WEBHOOK_QUEUE_DIR", filepath.Join(dataDir, reservedDir, webhooksDir, instanceID)),
+		},
+		Replication: ReplicationConfig{
+			Role:              GetEnv("REPLICATION_ROLE", ReplicationRoleStandalone),
+			Mode:              GetEnv("REPLICATION_MODE", ReplicationModeAsync),
+			Replicas:          replicaURLs,
+			PrimaryURL:        GetEnv("REPLICATION_PRIMARY_URL", ""),
+			Secret:            GetEnv("REPLICATION_SECRET", ""),
+			SyncTimeout:       replicationSyncTimeout,
+			QueueSize:         replicationQueueSize,
+			HeartbeatInterval: replicationHeartbeat,
+		},
+		S3: S3Config{
+			Enabled: s3Enabled,
+		},
+		WebDAV: WebDAVConfig{
+			Enabled: webdavEnabled,
+		},
+		GRPC: GRPCConfig{
+			Listen: grpcListen,
+		},
+		Retention: RetentionConfig{
+			GovernanceBypass: governanceBypass,
+		},
+		Audit: AuditConfig{
+			Enabled:      auditEnabled,
+			Dir:          GetEnv("AUDIT_DIR", filepath.Join(dataDir, reservedDir, auditDir, instanceID)),
+			Key:          GetEnv("AUDIT_HMAC_KEY", ""),
+			HeadInterval: auditHeadInterval,
+		},
+	}
+}
+
+func GetEnv(varName string, dephault string) string {
+	val := os.Getenv(varName)
+	if val == "" {
+		return dephault
+	}
+	return val
+}
@@ -0,0 +1,466 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bodies are sealed in chunks of this many bytes, each with its own tag, so reads are authenticated as they
+	// stream rather than only once the whole file has been read.
+	encryptionChunkSize = 64 * 1024
+	encryptionTagSize   = 16
+	dataKeySize         = 32
+)
+
+var (
+	// ErrDecryptionFailed means stored bytes were modified or truncated, so it counts as a checksum mismatch.
+	ErrDecryptionFailed = fmt.Errorf("%w: encrypted data failed authentication", ErrChecksumMismatch)
+	ErrUnknownMasterKey = errors.New("data key is wrapped by a master key that isn't loaded")
+)
+
+type EncryptionConfig struct {
+	Enabled   bool   // Encrypt new files. Encrypted files stay readable while disabled as long as their master key is loaded
+	KeyFile   string // JSON list of MasterKeys
+	Keys      string // Master keys as comma separated id:base64 pairs, in addition to KeyFile
+	ActiveKey string // Id of the master key new data keys are wrapped with, defaults to the last key listed
+}
+
+// MasterKey is one entry in the key file. Key is 32 random bytes, base64 encoded.
+type MasterKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// Envelope holds what decrypting a file takes: its data key, wrapped by the master key KeyID. It's kept in the
+// metadata index, so wrapping the data key with another master key doesn't touch the file.
+type Envelope struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// Keyring encrypts file bodies with AES-256-GCM under a fresh data key per file, wrapped by a master key. Master keys
+// are rotated by adding a new one, making it active, rewrapping every data key, then dropping the old one.
+type Keyring struct {
+	masters       map[string]cipher.AEAD
+	active        string // Empty if new files are stored as is
+	blobNames     []byte // Keys the names of content addressed blobs, derived from the active master key
+	onAuthFailure func()
+}
+
+// NewKeyring loads the configured master keys. Returns nil if there are none and encryption is disabled.
+func NewKeyring(cfg EncryptionConfig) (*Keyring, error) {
+	var keys []MasterKey
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file %s: %w", cfg.KeyFile, err)
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("failed to parse master key file %s: %w", cfg.KeyFile, err)
+		}
+	}
+	for _, pair := range strings.Split(cfg.Keys, ",") {
+		if id, key, found := strings.Cut(strings.TrimSpace(pair), ":"); found {
+			keys = append(keys, MasterKey{ID: id, Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		if cfg.Enabled {
+			return nil, errors.New("encryption is enabled but no master keys are configured")
+		}
+		return nil, nil
+	}
+
+	k := &Keyring{masters: map[string]cipher.AEAD{}}
+	raws := map[string][]byte{}
+	for _, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(raw) != dataKeySize {
+			return nil, fmt.Errorf("master key %q must be %d base64 encoded bytes", key.ID, dataKeySize)
+		}
+		if key.ID == "" {
+			return nil, errors.New("master keys need an id")
+		}
+		if _, ok := k.masters[key.ID]; ok {
+			return nil, fmt.Errorf("master key %q is listed twice", key.ID)
+		}
+		if k.masters[key.ID], err = newGCM(raw); err != nil {
+			return nil, err
+		}
+		raws[key.ID] = raw
+	}
+
+	active := cfg.ActiveKey
+	if active == "" {
+		active = keys[len(keys)-1].ID
+	}
+	if _, ok := k.masters[active]; !ok {
+		return nil, fmt.Errorf("active master key %q isn't configured", active)
+	}
+	if cfg.Enabled {
+		k.active = active
+		// A key of its own rather than the master key itself, which only ever wraps data keys.
+		mac := hmac.New(sha256.New, raws[active])
+		mac.Write([]byte("fileserver blob names"))
+		k.blobNames = mac.Sum(nil)
+		log.Infof("Encrypting files at rest, %d master keys loaded, data keys wrapped with %q", len(k.masters), active)
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypting reports whether new files are encrypted.
+func (k *Keyring) Encrypting() bool {
+	return k != nil && k.active != ""
+}
+
+// BlobName returns the blob name for checksum, an HMAC of it while encrypting so names don't give away contents.
+func (k *Keyring) BlobName(checksum string) string {
+	if !k.Encrypting() {
+		return checksum
+	}
+	mac := hmac.New(sha256.New, k.blobNames)
+	mac.Write([]byte(checksum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ActiveKey returns the id of the master key new data keys are wrapped with, "" if new files aren't encrypted.
+func (k *Keyring) ActiveKey() string {
+	if k == nil {
+		return ""
+	}
+	return k.active
+}
+
+// KeyIDs returns the ids of the loaded master keys.
+func (k *Keyring) KeyIDs() []string {
+	if k == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(k.masters))
+	for id := range k.masters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// NewWriter encrypts what's written to it into dst under a new data key, returned wrapped in the envelope. Close
+// seals the final chunk, without it the file fails authentication.
+func (k *Keyring) NewWriter(dst io.Writer) (io.WriteCloser, *Envelope, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	envelope, err := k.wrap(k.active, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &encryptWriter{dst: dst, aead: aead, buf: make([]byte, 0, encryptionChunkSize+encryptionTagSize)}, envelope, nil
+}
+
+// NewReader decrypts src, which was written under envelope. The first chunk is checked before returning, so a file
+// that fails authentication from the start fails before anything is read from it.
+func (k *Keyring) NewReader(src io.Reader, envelope *Envelope) (io.Reader, error) {
+	dataKey, err := k.unwrap(envelope)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptReader{src: bufio.NewReader(src), aead: aead, buf: make([]byte, encryptionChunkSize+encryptionTagSize), onAuthFailure: k.onAuthFailure}
+	if r.err = r.next(); r.err != nil && r.err != io.EOF {
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// Rewrap returns envelope's data key wrapped by the active master key, and false if it already was.
+func (k *Keyring) Rewrap(envelope *Envelope) (*Envelope, bool, error) {
+	if !k.Encrypting() || envelope.KeyID == k.active {
+		return envelope, false, nil
+	}
+	dataKey, err := k.unwrap(envelope)
+	if err != nil {
+		return envelope, false, err
+	}
+	rewrapped, err := k.wrap(k.active, dataKey)
+	return rewrapped, err == nil, err
+}
+
+func (k *Keyring) wrap(keyID string, dataKey []byte) (*Envelope, error) {
+	master := k.masters[keyID]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The key id is authenticated with the data key so an envelope can't be pointed at another master key.
+	return &Envelope{KeyID: keyID, WrappedKey: master.Seal(nonce, nonce, dataKey, []byte(keyID))}, nil
+}
+
+func (k *Keyring) unwrap(envelope *Envelope) ([]byte, error) {
+	var master cipher.AEAD
+	if k != nil {
+		master = k.masters[envelope.KeyID]
+	}
+	if master == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMasterKey, envelope.KeyID)
+	}
+	if len(envelope.WrappedKey) < master.NonceSize() {
+		return nil, k.authFailure("wrapped data key is too short")
+	}
+	nonce, sealed := envelope.WrappedKey[:master.NonceSize()], envelope.WrappedKey[master.NonceSize():]
+	dataKey, err := master.Open(nil, nonce, sealed, []byte(envelope.KeyID))
+	if err != nil {
+		return nil, k.authFailure("wrapped data key")
+	}
+	return dataKey, nil
+}
+
+func (k *Keyring) authFailure(what string) error {
+	if k.onAuthFailure != nil {
+		k.onAuthFailure()
+	}
+	return fmt.Errorf("%w: %s", ErrDecryptionFailed, what)
+}
+
+// encryptedSize returns how many bytes size bytes take once encrypted: a tag per chunk, with at least one chunk.
+func encryptedSize(size int64) int64 {
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*encryptionTagSize
+}
+
+// chunkNonce numbers the chunks and flags the last one, so chunks can't be reordered, dropped or truncated at a chunk
+// boundary without failing authentication. Every file has its own data key, so counting from zero never reuses a nonce.
+func chunkNonce(chunk uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	dst   io.Writer
+	aead  cipher.AEAD
+	buf   []byte // Plaintext of the chunk being filled
+	chunk uint64
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows it, the last one is sealed by Close.
+		if len(w.buf) == encryptionChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptionChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	sealed := w.aead.Seal(w.buf[:0], chunkNonce(w.chunk, last), w.buf, nil)
+	w.buf = w.buf[:0]
+	w.chunk++
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	src           *bufio.Reader
+	aead          cipher.AEAD
+	buf           []byte // Chunk being read, decrypted in place
+	plain         []byte // Decrypted bytes not returned yet
+	chunk         uint64
+	err           error // Returned once plain is drained, io.EOF after the last chunk
+	onAuthFailure func()
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into plain. Returns io.EOF once the last chunk has been read.
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	last := err == io.ErrUnexpectedEOF
+	switch {
+	case err == io.EOF:
+		// The previous chunk wasn't sealed as the last one, the file was cut short.
+		return r.authFailure()
+	case err == nil:
+		_, err = r.src.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last = err == io.EOF
+	case !last:
+		return err
+	}
+
+	plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.chunk, last), r.buf[:n], nil)
+	if err != nil {
+		return r.authFailure()
+	}
+	r.plain = plain
+	r.chunk++
+	if last {
+		return io.EOF
+	}
+	return nil
+}
+
+func (r *decryptReader) authFailure() error {
+	if r.onAuthFailure != nil {
+		r.onAuthFailure()
+	}
+	return fmt.Errorf("%w: chunk %d", ErrDecryptionFailed, r.chunk)
+}
+
+// EncryptionStatus is what GET /admin/encryption returns. Once no file uses a master key, it can be dropped.
+type EncryptionStatus struct {
+	Enabled    bool           `json:"enabled"`
+	ActiveKey  string         `json:"active_key,omitempty"`
+	LoadedKeys []string       `json:"loaded_keys"`
+	FilesByKey map[string]int `json:"files_by_key"` // Encrypted files by the master key their data key is wrapped with
+	Plaintext  int            `json:"plaintext"`    // Files stored as is, written before encryption was enabled
+}
+
+// RewrapReport is what POST /admin/encryption/rewrap returns.
+type RewrapReport struct {
+	ActiveKey string            `json:"active_key"`
+	Rewrapped int               `json:"rewrapped"`
+	Failed    map[string]string `json:"failed,omitempty"` // Error by file name
+}
+
+// HandleEncryptionStatus reports which master keys the stored files depend on.
+func (fs *FileServer) HandleEncryptionStatus(response http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	objects, err := fs.storage.List()
+	if err != nil {
+		log.Errorf("Failed to list files: %+v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+
+	status := EncryptionStatus{
+		Enabled:    fs.keyring.Encrypting(),
+		ActiveKey:  fs.keyring.ActiveKey(),
+		LoadedKeys: fs.keyring.KeyIDs(),
+		FilesByKey: map[string]int{},
+	}
+	for _, meta := range objects {
+		if meta.Envelope == nil {
+			status.Plaintext++
+			continue
+		}
+		status.FilesByKey[meta.Envelope.KeyID]++
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		log.Errorf("Failed to write encryption status: %+v", err)
+	}
+}
+
+// HandleRewrap wraps every data key not wrapped with the active master key yet with it. Only the index is written,
+// file data isn't touched. Each file is rewrapped under its in-process lock so it can't race a write.
+func (fs *FileServer) HandleRewrap(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if !fs.keyring.Encrypting() {
+		response.WriteHeader(http.StatusConflict)
+		fs.WriteResponseBody(response, "Encryption is not enabled.")
+		return
+	}
+	objects, err := fs.storage.List()
+	if err != nil {
+		log.Errorf("Failed to list files: %+v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+
+	ctx := request.Context()
+	report := RewrapReport{ActiveKey: fs.keyring.ActiveKey(), Failed: map[string]string{}}
+	for _, meta := range objects {
+		if meta.Envelope == nil || meta.Envelope.KeyID == report.ActiveKey {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fs.waitForOpenInProcess(ctx, meta.Name)
+		rewrapped, err := fs.storage.Rewrap(meta.Name)
+		fs.removeInProcessLock(meta.Name)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			log.Errorf("Failed to rewrap the data key of %s: %+v", meta.Name, err)
+			report.Failed[meta.Name] = err.Error()
+		}
+		if rewrapped {
+			report.Rewrapped++
+		}
+	}
+	log.Infof("Rewrapped %d data keys with master key %q, %d failed", report.Rewrapped, report.ActiveKey, len(report.Failed))
+
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Errorf("Failed to write rewrap report: %+v", err)
+	}
+}
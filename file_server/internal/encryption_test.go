@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(EncryptionConfig{Enabled: true, Keys: "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, dataKeySize))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// Plaintext planted on the volume isn't served while encryption is on, whatever name it takes.
+func TestUnindexedFileRefusedWhileEncrypting(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(testStorageConfig(dir), testKeyring(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+
+	if _, err := storage.Create("real", strings.NewReader("secret"), CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	file, _, err := storage.Open("real")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil || string(data) != "secret" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "planted"), []byte("plaintext"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.Open("planted"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("open of an unindexed file = %v, want ErrObjectNotFound", err)
+	}
+	// Replacing an indexed file with plaintext doesn't get it served either.
+	if err := os.WriteFile(filepath.Join(dir, "real"), []byte("swapped in"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if file, _, err := storage.Open("real"); err == nil {
+		data, err = io.ReadAll(file)
+		_ = file.Close()
+		if err == nil {
+			t.Errorf("served %q from a replaced encrypted file", data)
+		}
+	}
+	objects, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if object.Name == "planted" {
+			t.Error("unindexed file listed while encrypting")
+		}
+	}
+}
+
+func TestCASBlobNamesKeyed(t *testing.T) {
+	storage, err := NewCASStorage(testStorageConfig(t.TempDir()), testKeyring(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+
+	first, err := storage.Create("a", strings.NewReader("same"), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Blob == first.Checksum {
+		t.Fatal("encrypted blob is named by its plaintext checksum")
+	}
+	if _, err := os.Stat(storage.blobPath(first.Blob)); err != nil {
+		t.Fatal(err)
+	}
+	second, err := storage.Create("b", strings.NewReader("same"), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Blob != first.Blob {
+		t.Errorf("same content stored as blobs %s and %s, want it deduplicated", first.Blob, second.Blob)
+	}
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	// EventMetadata is a change to a file's metadata, e.g. its retention, that leaves its data as is.
+	EventMetadata = "metadata"
+	// EventReset tells a subscriber the events it asked to resume from are gone, so it should drop whatever it cached.
+	EventReset = "reset"
+
+	// Reserved file name the event stream is served under.
+	eventsPath = "_events"
+
+	eventKeepAlive   = 15 * time.Second
+	subscriberBuffer = 256
+)
+
+type EventsConfig struct {
+	BufferSize int // Recent events kept for subscribers resuming from a sequence number
+}
+
+// FileEvent is one file mutation. Seq orders events within an epoch, a new epoch starts every time the server does.
+type FileEvent struct {
+	Epoch   string    `json:"epoch"`
+	Seq     uint64    `json:"seq"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	ETag    string    `json:"etag,omitempty"`
+	Version int64     `json:"version,omitempty"` // Modification time of the written version in unix nanoseconds
+	Time    time.Time `json:"time"`
+}
+
+// Cursor is what a subscriber passes back to resume after this event.
+func (e FileEvent) Cursor() string {
+	return fmt.Sprintf("%s:%d", e.Epoch, e.Seq)
+}
+
+func newFileEvent(eventType string, meta ObjectMeta) FileEvent {
+	event := FileEvent{Type: eventType, Name: meta.Name}
+	if eventType != EventDelete {
+		event.Size, event.ETag, event.Version = meta.Size, meta.ETag(), meta.ModTime.UnixNano()
+	}
+	return event
+}
+
+type eventSubscriber struct {
+	prefix string
+	events chan FileEvent // Closed by the broker if the subscriber falls too far behind
+}
+
+// EventBroker fans file events out to subscribers and keeps the most recent ones for subscribers resuming after a
+// disconnect. Subscribers that can't keep up are cut off rather than slowing down writes.
+type EventBroker struct {
+	epoch       string
+	size        int
+	seq         uint64
+	recent      []FileEvent // Oldest first, at most size long
+	subscribers map[*eventSubscriber]bool
+	onDrop      func()
+	mutex       sync.Mutex
+}
+
+func NewEventBroker(cfg EventsConfig) *EventBroker {
+	epoch := make([]byte, 4)
+	_, _ = rand.Read(epoch)
+	return &EventBroker{
+		epoch:       hex.EncodeToString(epoch),
+		size:        cfg.BufferSize,
+		subscribers: map[*eventSubscriber]bool{},
+		onDrop:      func() {},
+	}
+}
+
+// Publish assigns event the next sequence number, delivers it and returns it as delivered.
+func (b *EventBroker) Publish(event FileEvent) FileEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.seq++
+	event.Epoch, event.Seq, event.Time = b.epoch, b.seq, time.Now().UTC()
+	if b.size > 0 {
+		if len(b.recent) >= b.size {
+			b.recent = b.recent[1:]
+		}
+		b.recent = append(b.recent, event)
+	}
+
+	for subscriber := range b.subscribers {
+		if !strings.HasPrefix(event.Name, subscriber.prefix) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber.events)
+			b.onDrop()
+		}
+	}
+	return event
+}
+
+// Subscribe registers a subscriber for names starting with prefix, returning the events since cursor to replay first.
+// reset is true if they can't all be replayed.
+func (b *EventBroker) Subscribe(prefix string, cursor string) (subscriber *eventSubscriber, backlog []FileEvent, reset bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriber = &eventSubscriber{prefix: prefix, events: make(chan FileEvent, subscriberBuffer)}
+	b.subscribers[subscriber] = true
+
+	if cursor == "" {
+		return subscriber, nil, false
+	}
+	epoch, seq, ok := parseEventCursor(cursor)
+	if !ok || (epoch != "" && epoch != b.epoch) || seq > b.seq {
+		return subscriber, nil, true
+	}
+	// Resumable only if the first event after the cursor is still buffered, or nothing happened since.
+	if seq < b.seq && (len(b.recent) == 0 || b.recent[0].Seq > seq+1) {
+		return subscriber, nil, true
+	}
+	for _, event := range b.recent {
+		if event.Seq > seq && strings.HasPrefix(event.Name, prefix) {
+			backlog = append(backlog, event)
+		}
+	}
+	return subscriber, backlog, false
+}
+
+func (b *EventBroker) Unsubscribe(subscriber *eventSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[subscriber] {
+		delete(b.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// Position returns the current epoch and the seq of the latest event published.
+func (b *EventBroker) Position() (string, uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.epoch, b.seq
+}
+
+func (b *EventBroker) Subscribers() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subscribers)
+}
+
+func (b *EventBroker) resetEvent() FileEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return FileEvent{Epoch: b.epoch, Seq: b.seq, Type: EventReset, Time: time.Now().UTC()}
+}
+
+// parseEventCursor accepts "epoch:seq", or a bare seq in the current epoch.
+func parseEventCursor(cursor string) (string, uint64, bool) {
+	epoch, seqString, found := strings.Cut(cursor, ":")
+	if !found {
+		epoch, seqString = "", cursor
+	}
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	return epoch, seq, err == nil
+}
+
+// publish records a mutation for event stream subscribers, webhook receivers and, if replicate, replicas. Returns the
+// seq replicas have to apply before the mutation is acknowledged, 0 if there's nothing to wait for.
+func (fs *FileServer) publish(eventType string, meta ObjectMeta, replicate bool) uint64 {
+	// Numbered and queued under fileLock so subscribers, replicas and webhook receivers all see changes in the same
+	// order. Webhook deliveries are written to disk after releasing it.
+	var seq uint64
+	var deliveries webhookBatch
+	fs.fileLock.Lock()
+	event := fs.events.Publish(newFileEvent(eventType, meta))
+	if replicate {
+		seq = fs.replicate(event)
+	}
+	if fs.webhooks != nil {
+		deliveries = fs.webhooks.Reserve(event)
+	}
+	fs.fileLock.Unlock()
+
+	fs.metrics.eventsPublished.Inc(eventType)
+	if fs.webhooks != nil {
+		if err := fs.webhooks.Save(deliveries); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}
+	return seq
+}
+
+// HandleEvents streams file events as Server-Sent Events, or WebSocket messages if the client upgrades. Streams don't
+// take a connection slot.
+func (fs *FileServer) HandleEvents(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	query := request.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("since")
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		cursor = lastEventID
+	}
+
+	if strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		server := websocket.Server{
+			// Not a browser-facing API, accept any origin. Auth already happened in authorize.
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(conn *websocket.Conn) {
+				fs.streamEvents(request, prefix, cursor, func(event FileEvent) error {
+					return websocket.JSON.Send(conn, event)
+				}, func() error { return nil }, func() {
+					// Clients don't send anything, a read only returns once the connection is gone.
+					var discard []byte
+					for websocket.Message.Receive(conn, &discard) == nil {
+					}
+				})
+			},
+		}
+		server.ServeHTTP(response, request)
+		return
+	}
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, "Streaming is not supported on this connection.")
+		return
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	fs.streamEvents(request, prefix, cursor, func(event FileEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(response, "id: %s\nevent: %s\ndata: %s\n\n", event.Cursor(), event.Type, data)
+		flusher.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(response, ": keep-alive\n\n")
+		flusher.Flush()
+		return err
+	}, nil)
+}
+
+// streamEvents subscribes and sends events until the client goes away or falls too far behind. If waitClosed is set
+// it's run in the background and its return ends the stream.
+func (fs *FileServer) streamEvents(request *http.Request, prefix string, cursor string, send func(FileEvent) error, keepAlive func() error, waitClosed func()) {
+	subscriber, backlog, reset := fs.events.Subscribe(prefix, cursor)
+	defer fs.events.Unsubscribe(subscriber)
+
+	closed := request.Context().Done()
+	if waitClosed != nil {
+		done := make(chan struct{})
+		go func() {
+			waitClosed()
+			close(done)
+		}()
+		closed = done
+	}
+
+	if reset {
+		if send(fs.events.resetEvent()) != nil {
+			return
+		}
+	}
+	for _, event := range backlog {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if keepAlive() != nil {
+				return
+			}
+		case event, ok := <-subscriber.events:
+			if !ok {
+				// Dropped for falling behind. The client resumes from its last cursor on reconnect.
+				log.Warnf("Event subscriber for prefix %q fell behind and was disconnected", prefix)
+				return
+			}
+			if send(event) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBrokerSubscribe(t *testing.T) {
+	broker := NewEventBroker(EventsConfig{BufferSize: 3})
+	// Seqs 1 to 5, only 3 to 5 stay buffered.
+	for _, name := range []string{"a1", "b1", "a2", "a3", "b2"} {
+		broker.Publish(FileEvent{Type: EventCreate, Name: name})
+	}
+	epoch, _ := broker.Position()
+
+	tests := []struct {
+		name      string
+		prefix    string
+		cursor    string
+		wantSeqs  []uint64
+		wantReset bool
+	}{
+		{"no cursor", "", "", nil, false},
+		{"caught up", "", epoch + ":5", nil, false},
+		{"buffered", "", epoch + ":3", []uint64{4, 5}, false},
+		{"bare seq", "", "4", []uint64{5}, false},
+		{"prefix", "a", epoch + ":2", []uint64{3, 4}, false},
+		{"first event after cursor evicted", "", epoch + ":1", nil, true},
+		{"other epoch", "", "0badcafe:4", nil, true},
+		{"future seq", "", epoch + ":9", nil, true},
+		{"malformed", "", "junk", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscriber, backlog, reset := broker.Subscribe(test.prefix, test.cursor)
+			defer broker.Unsubscribe(subscriber)
+			var seqs []uint64
+			for _, event := range backlog {
+				seqs = append(seqs, event.Seq)
+			}
+			if !slices.Equal(seqs, test.wantSeqs) || reset != test.wantReset {
+				t.Errorf("got backlog %v, reset %t, want %v, %t", seqs, reset, test.wantSeqs, test.wantReset)
+			}
+		})
+	}
+}
+
+func TestEventBrokerDelivery(t *testing.T) {
+	broker := NewEventBroker(EventsConfig{})
+	subscriber, _, _ := broker.Subscribe("a", "")
+	broker.Publish(FileEvent{Type: EventCreate, Name: "b"})
+	broker.Publish(FileEvent{Type: EventCreate, Name: "a"})
+	if event := <-subscriber.events; event.Name != "a" || event.Seq != 2 {
+		t.Errorf("got %+v, want only the event for a", event)
+	}
+
+	// A subscriber that falls a full buffer behind is cut off rather than blocking Publish.
+	for i := 0; i <= subscriberBuffer; i++ {
+		broker.Publish(FileEvent{Type: EventCreate, Name: "a"})
+	}
+	received := 0
+	for range subscriber.events {
+		received++
+	}
+	if received != subscriberBuffer || broker.Subscribers() != 0 {
+		t.Errorf("received %d events with %d subscribers left, want %d and 0", received, broker.Subscribers(), subscriberBuffer)
+	}
+	broker.Unsubscribe(subscriber)
+}
+
+// sseStream reads Server-Sent Events from the event stream.
+type sseStream struct {
+	scanner *bufio.Scanner
+	cancel  context.CancelFunc
+}
+
+func openEventStream(t *testing.T, url string, lastEventID string) *sseStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = response.Body.Close()
+	})
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %s, want an event stream", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	return &sseStream{scanner: bufio.NewScanner(response.Body), cancel: cancel}
+}
+
+// next returns the next event, checking its id and event fields match its data.
+func (s *sseStream) next(t *testing.T) FileEvent {
+	t.Helper()
+	timer := time.AfterFunc(5*time.Second, s.cancel)
+	defer timer.Stop()
+	fields := map[string]string{}
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" && fields["data"] != "" {
+			var event FileEvent
+			if err := json.Unmarshal([]byte(fields["data"]), &event); err != nil {
+				t.Fatal(err)
+			}
+			if fields["id"] != event.Cursor() || fields["event"] != event.Type {
+				t.Errorf("got id %s and event %s for %+v", fields["id"], fields["event"], event)
+			}
+			return event
+		}
+		if key, value, ok := strings.Cut(line, ": "); ok {
+			fields[key] = value
+		}
+	}
+	t.Fatalf("event stream ended: %v", s.scanner.Err())
+	return FileEvent{}
+}
+
+func TestHandleEvents(t *testing.T) {
+	fs := newTestFileServer(t)
+	server := httptest.NewServer(fs.newRouter())
+	// Cleanups run last in first out, streams are closed before the server waits for them.
+	t.Cleanup(server.Close)
+	eventsURL := server.URL + "/api/fileserver/_events?prefix=pub-"
+
+	stream := openEventStream(t, eventsURL, "")
+	for _, step := range []struct{ method, name string }{
+		{http.MethodPut, "pub-a"},
+		{http.MethodPut, "private-b"},
+		{http.MethodDelete, "pub-a"},
+	} {
+		request, _ := http.NewRequest(step.method, server.URL+"/api/fileserver/"+step.name, strings.NewReader("body"))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode >= 300 {
+			t.Fatalf("%s %s: got %d", step.method, step.name, response.StatusCode)
+		}
+	}
+
+	created, deleted := stream.next(t), stream.next(t)
+	if created.Type != EventCreate || created.Name != "pub-a" || created.Size != 4 || deleted.Type != EventDelete || deleted.Name != "pub-a" {
+		t.Fatalf("got %+v then %+v, want pub-a created then deleted", created, deleted)
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		wantType    string
+		wantSeq     uint64
+	}{
+		{"resume", created.Cursor(), EventDelete, deleted.Seq},
+		{"resume in another epoch", fmt.Sprintf("0badcafe:%d", created.Seq), EventReset, deleted.Seq},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if event := openEventStream(t, eventsURL, test.lastEventID).next(t); event.Type != test.wantType || event.Seq != test.wantSeq {
+				t.Errorf("got %+v, want %s with seq %d", event, test.wantType, test.wantSeq)
+			}
+		})
+	}
+}
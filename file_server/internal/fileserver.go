@@ -1,13 +1,19 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/webdav"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,53 +22,297 @@ import (
 const (
 	maxConnections        = 15
 	baseLatencyPerRequest = 333 // # of ms added for all requests
-	port                  = 1234
+	defaultPort           = 1234
 )
 
-func NewFileServer() *FileServer {
-	return &FileServer{connections: 0,
-		knownFiles: map[string]bool{},
-		inProcess:  make(map[string]bool),
+func NewFileServer(cfg FileServerConfig) (*FileServer, error) {
+	authenticators, err := NewAuthenticators(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewURLSigner(cfg.Presign)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := NewKeyring(cfg.Storage.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := NewStorage(cfg.Storage, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks *WebhookDispatcher
+	if len(cfg.Webhooks.URLs) > 0 {
+		if webhooks, err = NewWebhookDispatcher(cfg.Webhooks, cfg.Storage.DataDir); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Replication.Role {
+	case ReplicationRoleStandalone:
+	case ReplicationRolePrimary, ReplicationRoleReplica:
+		// Replicas apply whatever they're shipped, retention notwithstanding. Their endpoints must never be open.
+		needsSecret := cfg.Replication.Role == ReplicationRoleReplica || len(cfg.Replication.Replicas) > 0
+		if needsSecret && cfg.Replication.Secret == "" {
+			return nil, fmt.Errorf("REPLICATION_SECRET is required for the %s replication role", cfg.Replication.Role)
+		}
+	default:
+		return nil, fmt.Errorf("unknown replication role %q", cfg.Replication.Role)
+	}
+
+	var auditLog *AuditLog
+	if cfg.Audit.Enabled {
+		if auditLog, err = OpenAuditLog(cfg.Audit, cfg.Storage.Journal); err != nil {
+			return nil, err
+		}
+	}
+
+	clients := NewClientLimiter(cfg.RateLimit)
+	fs := &FileServer{cfg: cfg,
+		storage:        storage,
+		keyring:        keyring,
+		compressor:     NewCompressor(cfg.Storage.Compression),
+		authenticators: authenticators,
+		signer:         signer,
+		clients:        clients,
+		admission:      NewAdmissionController(maxConnections, cfg.Admission, clients),
+		events:         NewEventBroker(cfg.Events),
+		webhooks:       webhooks,
+		auditLog:       auditLog,
+		inProcess:      make(map[string]bool),
 	}
+	fs.metrics = newServerMetrics(fs)
+	fs.events.onDrop = func() { fs.metrics.eventSubscribersDropped.Inc() }
+	if keyring != nil {
+		keyring.onAuthFailure = func() { fs.metrics.decryptionFailures.Inc() }
+	}
+	switch cfg.Replication.Role {
+	case ReplicationRolePrimary:
+		epoch, _ := fs.events.Position()
+		if fs.replicator, err = NewReplicator(cfg.Replication, storage, epoch); err != nil {
+			return nil, err
+		}
+	case ReplicationRoleReplica:
+		fs.replica = newReplicaState()
+	}
+	return fs, nil
 }
 
 type FileServer struct {
-	connections   int
-	knownFiles    map[string]bool
-	inProcess     FileSet
-	fileLock      sync.RWMutex
-	inProcessLock sync.RWMutex
-	connLock      sync.RWMutex
+	cfg            FileServerConfig
+	storage        Storage
+	keyring        *Keyring // Nil if no master keys are configured
+	compressor     *Compressor
+	authenticators []Authenticator
+	signer         *URLSigner
+	clients        *ClientLimiter
+	admission      *AdmissionController
+	metrics        *serverMetrics
+	events         *EventBroker
+	webhooks       *WebhookDispatcher
+	auditLog       *AuditLog     // Nil if auditing is off
+	replicator     *Replicator   // Set on primaries
+	replica        *replicaState // Set on replicas
+	dav            *webdav.Handler
+	inProcess      FileSet
+	fileLock       sync.RWMutex
+	inProcessLock  sync.RWMutex
+	scrubber       scrubber
+	watcher        indexWatcher
 }
 
 func (fs *FileServer) Run() error {
-	router := httprouter.New()
-	router.GET("/api/fileserver/:filename", fs.HandleGet)
-	router.PUT("/api/fileserver/:filename", fs.HandlePut)
-	router.DELETE("/api/fileserver/:filename", fs.HandleDelete)
+	handler := fs.newRouter()
+	fs.watchIndex()
+	if fs.cfg.Scrub.WarmUpLimit > 0 {
+		go fs.warmUp()
+	}
+	if fs.cfg.Scrub.Interval > 0 {
+		go fs.scrubEvery(fs.cfg.Scrub.Interval)
+	}
+	if fs.webhooks != nil {
+		fs.webhooks.Start(fs.metrics)
+	}
+	if fs.replicator != nil {
+		fs.replicator.Start(fs.metrics)
+	}
+
+	server, err := newHTTPServer(fmt.Sprintf(":%d", fs.cfg.Port), handler, fs.cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	listeners, err := openListeners(fs.cfg.Listen)
+	if err != nil {
+		return err
+	}
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+	var grpcListeners []net.Listener
+	if len(fs.cfg.GRPC.Listen) > 0 {
+		grpcListeners, err = openListeners(ListenConfig{Addresses: fs.cfg.GRPC.Listen, UnixSocketMode: fs.cfg.Listen.UnixSocketMode})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Serve every listener with the same server, the first one to fail takes the process down.
+	errs := make(chan error, len(listeners)+len(grpcListeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if fs.cfg.TLS.Enabled {
+				errs <- server.ServeTLS(listener, "", "")
+				return
+			}
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+	if len(grpcListeners) > 0 {
+		grpcServer := fs.newGRPCServer(server.TLSConfig)
+		for _, listener := range grpcListeners {
+			go func(listener net.Listener) {
+				errs <- grpcServer.Serve(listener)
+			}(listener)
+		}
+	}
+	return <-errs
 }
 
-func (fs *FileServer) SimulateLatency() {
+// newRouter routes the HTTP API.
+func (fs *FileServer) newRouter() http.Handler {
+	router := httprouter.New()
+	getFile := fs.authorize(PermissionRead, fs.HandleGet)
+	getEvents := fs.authorize(PermissionRead, fs.HandleEvents)
+	router.GET("/api/fileserver/:filename", func(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		// httprouter can't register a static path next to :filename, so the event stream is dispatched here. It's
+		// authorized against the prefix watched rather than a file name.
+		if params.ByName("filename") == eventsPath {
+			getEvents(response, request, httprouter.Params{{Key: "filename", Value: request.URL.Query().Get("prefix")}})
+			return
+		}
+		getFile(response, request, params)
+	})
+	router.HEAD("/api/fileserver/:filename", fs.authorize(PermissionRead, fs.HandleHead))
+	router.PUT("/api/fileserver/:filename", fs.primaryOnly(fs.authorize(PermissionWrite, fs.HandlePut)))
+	router.DELETE("/api/fileserver/:filename", fs.primaryOnly(fs.authorize(PermissionDelete, fs.HandleDelete)))
+	router.POST("/api/fileserver/:filename", fs.primaryOnly(fs.authorize(PermissionWrite, fs.HandlePost)))
+	router.PATCH("/api/fileserver/:filename", fs.primaryOnly(fs.authorize(PermissionWrite, fs.HandlePatch)))
+	router.GET("/metrics", fs.metrics.registry.HandleMetrics)
+	router.POST("/admin/presign", fs.HandlePresign)
+	router.GET("/admin/scrub", fs.authorize(PermissionRead, fs.HandleScrubReport))
+	router.POST("/admin/scrub", fs.authorize(PermissionDelete, fs.HandleScrub))
+	router.GET("/admin/replication", fs.authorize(PermissionRead, fs.HandleReplicationStatus))
+	router.GET("/admin/encryption", fs.authorize(PermissionRead, fs.HandleEncryptionStatus))
+	router.POST("/admin/encryption/rewrap", fs.authorize(PermissionWrite, fs.HandleRewrap))
+	router.GET("/admin/snapshot", fs.authorize(PermissionRead, fs.HandleSnapshot))
+	router.POST("/admin/restore", fs.primaryOnly(fs.authorize(PermissionWrite, fs.HandleRestore)))
+	router.GET("/admin/retention/:filename", fs.authorize(PermissionRead, fs.HandleGetRetention))
+	router.PUT("/admin/retention/:filename", fs.primaryOnly(fs.authorize(PermissionWrite, fs.HandlePutRetention)))
+	if fs.replica != nil {
+		router.PUT("/replication/objects/:filename", fs.replicationAuth(fs.HandleReplicaPut))
+		router.DELETE("/replication/objects/:filename", fs.replicationAuth(fs.HandleReplicaDelete))
+		router.GET("/replication/manifest", fs.replicationAuth(fs.HandleReplicaManifest))
+		router.POST("/replication/heartbeat", fs.replicationAuth(fs.HandleReplicaHeartbeat))
+	}
+	if fs.cfg.S3.Enabled {
+		// HandleS3 authenticates, S3 clients expect S3 errors rather than the API's.
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete} {
+			router.Handle(method, s3PathPrefix+"/*path", fs.HandleS3)
+		}
+	}
+	if fs.cfg.WebDAV.Enabled {
+		fs.dav = newDAVHandler(fs)
+		for _, method := range davMethods {
+			handle := fs.HandleWebDAV
+			if method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions && method != "PROPFIND" {
+				handle = fs.primaryOnly(handle)
+			}
+			router.Handle(method, webdavPrefix, handle)
+			router.Handle(method, webdavPrefix+"/*path", handle)
+		}
+	}
+	return traceMiddleware(requestIDMiddleware(router))
+}
+
+func (fs *FileServer) SimulateLatency(ctx context.Context) {
+	_, span := startSpan(ctx, "fileserver.simulated_latency")
+	defer span.End()
 	time.Sleep(baseLatencyPerRequest * time.Millisecond)
 }
 
-func (fs *FileServer) HandleGet(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	// Throttle if > maxConnections
-	if !fs.CanTakeConnection() {
+// takeConnection applies the client's rate limit and takes a connection slot, queueing if enabled. Returns false after
+// writing a 429 if throttled.
+func (fs *FileServer) takeConnection(ctx context.Context, response http.ResponseWriter, request *http.Request, priority Priority) (string, bool) {
+	client, retryAfter, err := fs.admit(ctx, request, priority)
+	if err != nil {
+		fs.admission.WriteRateLimitHeaders(response, retryAfter)
 		response.WriteHeader(http.StatusTooManyRequests)
 		fs.WriteResponseBody(response, "Too many requests. Slow down.")
-		return
+		return client, false
 	}
+	return client, true
+}
+
+// admit is takeConnection without the response, for APIs that report throttling in their own format.
+func (fs *FileServer) admit(ctx context.Context, request *http.Request, priority Priority) (string, time.Duration, error) {
+	client := fs.clients.ClientID(request)
+	_, span := startSpan(ctx, "fileserver.connection_slot",
+		attribute.String("fileserver.priority", priority.String()),
+		attribute.String("fileserver.client", client),
+	)
+	defer span.End()
+
+	fs.metrics.requests.Inc(client)
+	err := ErrClientThrottle
+	allowed, retryAfter := fs.clients.Allow(client)
+	if allowed {
+		err = fs.admission.Acquire(ctx, client, priority)
+	}
+
+	if err != nil {
+		span.SetAttributes(attribute.Bool("fileserver.throttled", true), attribute.String("fileserver.throttle_reason", err.Error()))
+		fs.metrics.throttled.Inc(client, throttleReason(err))
+	}
+	return client, retryAfter, err
+}
 
-	// Consume connection
-	fs.IncrementConnection()
-	defer fs.DecrementConnection()
-	fs.SimulateLatency()
+// releaseConnection frees the slot client took at acquiredAt.
+func (fs *FileServer) releaseConnection(client string, acquiredAt time.Time) {
+	fs.admission.Release(client, time.Since(acquiredAt))
+}
+
+// getPriority admits reads of small (or missing) files ahead of large transfers. It only consults the index, a file
+// it doesn't describe is admitted as small rather than stat'ed before the read stats it again.
+func (fs *FileServer) getPriority(fileName string) Priority {
+	meta, ok := fs.storage.Index().Get(fileName)
+	if !ok || meta.StoredSize <= fs.cfg.Admission.SmallFileThreshold {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// putPriority admits small writes ahead of large uploads.
+func (fs *FileServer) putPriority(request *http.Request) Priority {
+	if request.ContentLength >= 0 && request.ContentLength <= fs.cfg.Admission.SmallFileThreshold {
+		return PriorityNormal
+	}
+	return PriorityLow
+}
 
+func (fs *FileServer) HandleGet(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ctx := request.Context()
 	fileName := params.ByName("filename")
-	filePath := fmt.Sprintf("/tmp/%s", fileName)
+	client, ok := fs.takeConnection(ctx, response, request, fs.getPriority(fileName))
+	if !ok {
+		return
+	}
+	defer fs.releaseConnection(client, time.Now())
+	fs.SimulateLatency(ctx)
+
 	defer request.Body.Close()
 
 	if fileName == "" {
@@ -70,60 +320,84 @@ func (fs *FileServer) HandleGet(response http.ResponseWriter, request *http.Requ
 		fs.WriteResponseBody(response, "File name is empty.")
 		return
 	}
-
-	// Mark file in process so other FS ops for this file wait behind it
-	fs.waitForOpenInProcess(fileName)
-	defer fs.removeInProcessLock(fileName)
-
-	fs.fileLock.RLock()
-	_, hasFile := fs.knownFiles[fileName]
-	if !hasFile {
-		// If file not found in known file cache, check fs directly in case file was written by different process.
-		_, err := os.Stat(filePath)
-		if err != nil {
-			log.Errorf("File not found err: %+v", err)
-			response.WriteHeader(http.StatusNotFound)
-			fs.WriteResponseBody(response, "File not found.")
-			fs.fileLock.RUnlock()
-			return
-		}
-
-		// No err, file must exist, add it to known files
-		fs.fileLock.RUnlock()
-		fs.fileLock.Lock()
-		fs.knownFiles[fileName] = true
-		fs.fileLock.Unlock()
-	} else {
-		defer fs.fileLock.RUnlock()
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
+		return
 	}
 
-	// Read file from FS
-	file, err := os.Open(filePath)
-	defer file.Close()
-	if err != nil {
-		log.Errorf("Failed to read file: %s. Error: %+v", filePath, err)
-		fs.WriteResponseBody(response, err.Error())
-		response.WriteHeader(http.StatusInternalServerError)
+	file, meta, release, err := fs.openFile(ctx, fileName)
+	if errors.Is(err, ErrObjectNotFound) {
+		response.WriteHeader(http.StatusNotFound)
+		fs.WriteResponseBody(response, "File not found.")
 		return
 	}
-
-	// Get file size
-	stat, err := file.Stat()
 	if err != nil {
-		log.Errorf("Failed to read file stat for file: %s. Error: %+v", filePath, err)
+		log.Errorf("Failed to read file: %s. Error: %+v", fileName, err)
 		response.WriteHeader(http.StatusInternalServerError)
 		fs.WriteResponseBody(response, err.Error())
 		return
 	}
-	numBytes := stat.Size()
+	defer release()
+	defer file.Close()
+
+	// Pick what goes on the wire: stored bytes as is if the client accepts their encoding, decoded bytes otherwise,
+	// optionally compressed on the fly.
+	acceptEncoding := request.Header.Get("Accept-Encoding")
+	var body io.Reader = file
+	numBytes := meta.StoredSize
+	contentEncoding := meta.Encoding
+	if meta.Encoding != EncodingIdentity && !acceptsEncoding(acceptEncoding, meta.Encoding) {
+		decoder, err := newDecoder(meta.Encoding, file)
+		if err != nil {
+			log.Errorf("Failed to decode file: %s. Error: %+v", fileName, err)
+			response.WriteHeader(http.StatusInternalServerError)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		defer decoder.Close()
+		body, numBytes, contentEncoding = decoder, meta.Size, EncodingIdentity
+	}
+	if contentEncoding == EncodingIdentity && fs.compressor.ShouldCompressTransfer(meta) {
+		contentEncoding = preferredEncoding(acceptEncoding)
+	}
 
 	// Set header type
 	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Vary", "Accept-Encoding")
+	if etag := meta.ETag(); etag != "" {
+		response.Header().Set("ETag", etag)
+	}
+	setRetentionHeaders(response.Header(), meta)
+	if contentEncoding != EncodingIdentity {
+		response.Header().Set("Content-Encoding", contentEncoding)
+	}
+
+	var out io.Writer = response
+	if contentEncoding != EncodingIdentity && contentEncoding != meta.Encoding {
+		// Compressing on the fly, numBytes counts what goes into the encoder.
+		encoder, err := fs.compressor.newEncoder(contentEncoding, response)
+		if err != nil {
+			log.Errorf("Failed to create %s encoder. Error: %+v", contentEncoding, err)
+			response.WriteHeader(http.StatusInternalServerError)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		defer encoder.Close()
+		out = encoder
+	}
 
 	// Copy data
-	written, err := io.Copy(response, file)
+	_, span := startSpan(ctx, "response.write", attribute.Int64("file.size", numBytes), attribute.String("http.content_encoding", contentEncoding))
+	written, err := io.Copy(out, body)
+	endSpan(span, err)
+	if errors.Is(err, ErrDecryptionFailed) && written > 0 {
+		// Too late for a 500, abort so the client can't take what it got for the whole file.
+		log.Errorf("Get aborted, %s failed authentication after %d bytes. Error: %+v", fileName, written, err)
+		panic(http.ErrAbortHandler)
+	}
 	if err != nil {
-		log.Errorf("Get failed to read file bytes for file: %s. Error: %+v", filePath, err)
+		log.Errorf("Get failed to read file bytes for file: %s. Error: %+v", fileName, err)
 		response.WriteHeader(http.StatusInternalServerError)
 		fs.WriteResponseBody(response, err.Error())
 		return
@@ -140,21 +414,51 @@ func (fs *FileServer) HandleGet(response http.ResponseWriter, request *http.Requ
 	return
 }
 
-func (fs *FileServer) HandlePut(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	// Throttle if > maxConnections
-	if !fs.CanTakeConnection() {
-		response.WriteHeader(http.StatusTooManyRequests)
-		fs.WriteResponseBody(response, "Too many requests. Slow down.")
+// HandleHead describes a file without reading it: its decoded size, ETag, modification time and retention settings.
+func (fs *FileServer) HandleHead(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ctx := request.Context()
+	fileName := params.ByName("filename")
+	client, ok := fs.takeConnection(ctx, response, request, PriorityHigh)
+	if !ok {
+		return
+	}
+	defer fs.releaseConnection(client, time.Now())
+
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	meta, err := fs.statFile(ctx, fileName)
+	if errors.Is(err, ErrObjectNotFound) {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to stat file: %s. Error: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Consume connection
-	fs.IncrementConnection()
-	defer fs.DecrementConnection()
-	fs.SimulateLatency()
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	response.Header().Set("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+	if etag := meta.ETag(); etag != "" {
+		response.Header().Set("ETag", etag)
+	}
+	setRetentionHeaders(response.Header(), meta)
+	response.WriteHeader(http.StatusOK)
+}
 
+func (fs *FileServer) HandlePut(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ctx := request.Context()
 	fileName := params.ByName("filename")
-	filePath := fmt.Sprintf("/tmp/%s", fileName)
+	client, ok := fs.takeConnection(ctx, response, request, fs.putPriority(request))
+	if !ok {
+		return
+	}
+	defer fs.releaseConnection(client, time.Now())
+	fs.SimulateLatency(ctx)
+
 	defer request.Body.Close()
 
 	if fileName == "" {
@@ -162,64 +466,81 @@ func (fs *FileServer) HandlePut(response http.ResponseWriter, request *http.Requ
 		fs.WriteResponseBody(response, "No file name provided")
 		return
 	}
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
+		return
+	}
 
-	// Mark file in process so other FS ops for this file wait behind it
-	fs.waitForOpenInProcess(fileName)
-	defer fs.removeInProcessLock(fileName)
+	// Bodies may be sent compressed, they're always stored decoded (and recompressed if compression at rest is on).
+	var body io.Reader = &lengthVerifier{Reader: request.Body, expected: request.ContentLength}
+	if contentEncoding := request.Header.Get("Content-Encoding"); contentEncoding != "" {
+		decoder, err := newDecoder(strings.ToLower(contentEncoding), body)
+		if err != nil {
+			response.WriteHeader(http.StatusUnsupportedMediaType)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		defer decoder.Close()
+		body = decoder
+	}
 
-	// Open file for writing
-	file, err := os.Create(filePath)
-	defer file.Close()
+	retention, err := parseRetentionHeaders(request.Header)
 	if err != nil {
-		log.Errorf("Failed to create file: %s. Error: %+v", filePath, err)
-		response.WriteHeader(http.StatusInternalServerError)
-		fs.WriteResponseBody(response, err.Error())
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("Invalid retention, %s.", err))
 		return
 	}
 
-	// Copy data
-	written, err := io.Copy(file, request.Body)
-	if err != nil {
-		log.Errorf("Failed to read file bytes for file: %s. Error: %+v", filePath, err)
-		response.WriteHeader(http.StatusInternalServerError)
+	ctx = fs.governanceBypass(ctx, request.Header.Get(bypassGovernanceHeader), fileName)
+	meta, replicated, err := fs.writeFileWith(ctx, fileName, body, request.ContentLength, CreateOptions{Retention: retention})
+	if errors.Is(err, ErrRetained) {
+		fs.writeRetained(response, err)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+		response.WriteHeader(http.StatusForbidden)
 		fs.WriteResponseBody(response, err.Error())
-		_ = os.Remove(filePath)
 		return
 	}
-
-	// Verify correct amount of data written.
-	if request.ContentLength != written {
-		log.Errorf("Invalid number of bytes written to response. Expected %d, got %d", request.ContentLength, written)
+	if errors.Is(err, ErrSignatureMismatch) {
+		fs.metrics.authFailures.Inc(authFailureReason(err))
+		response.WriteHeader(http.StatusUnauthorized)
+		fs.WriteResponseBody(response, "Body does not match signed payload hash.")
+		return
+	}
+	if errors.Is(err, ErrShortBody) {
+		// Verify correct amount of data written.
+		log.Errorf("Invalid number of bytes written for file: %s. Error: %+v", fileName, err)
 		response.WriteHeader(http.StatusInternalServerError)
 		fs.WriteResponseBody(response, "Write corruption, please retry.")
-		_ = os.Remove(filePath)
 		return
 	}
-
-	fs.fileLock.Lock()
-	defer fs.fileLock.Unlock()
+	if err != nil {
+		log.Errorf("Failed to write file bytes for file: %s. Error: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	fs.awaitReplication(ctx, response, replicated)
 
 	// Write successful response
-	fs.knownFiles[fileName] = true
+	response.Header().Set("ETag", meta.ETag())
 	response.WriteHeader(http.StatusCreated)
 	return
 }
 
 func (fs *FileServer) HandleDelete(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	// Throttle if > maxConnections
-	if !fs.CanTakeConnection() {
-		response.WriteHeader(http.StatusTooManyRequests)
-		fs.WriteResponseBody(response, "Too many requests. Slow down.")
+	ctx := request.Context()
+	fileName := params.ByName("filename")
+	client, ok := fs.takeConnection(ctx, response, request, PriorityHigh)
+	if !ok {
 		return
 	}
+	defer fs.releaseConnection(client, time.Now())
+	fs.SimulateLatency(ctx)
 
-	// Consume connection
-	fs.IncrementConnection()
-	defer fs.DecrementConnection()
-	fs.SimulateLatency()
-
-	fileName := params.ByName("filename")
-	filePath := fmt.Sprintf("/tmp/%s", fileName)
 	defer request.Body.Close()
 
 	if fileName == "" {
@@ -227,54 +548,149 @@ func (fs *FileServer) HandleDelete(response http.ResponseWriter, request *http.R
 		fs.WriteResponseBody(response, "No file name specified.")
 		return
 	}
-
-	fs.fileLock.Lock()
-	defer fs.fileLock.Unlock()
-
-	// Mark file in process so other FS ops for this file wait behind it
-	fs.waitForOpenInProcess(fileName)
-	defer fs.removeInProcessLock(fileName)
-
-	_, err := os.Stat(filePath)
-	if err != nil {
-		delete(fs.knownFiles, fileName)
-		response.WriteHeader(http.StatusOK)
-		fs.WriteResponseBody(response, "File not found. Already deleted.")
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
 		return
 	}
 
-	// Open file for writing
-	err = os.Remove(filePath)
+	ctx = fs.governanceBypass(ctx, request.Header.Get(bypassGovernanceHeader), fileName)
+	found, replicated, err := fs.deleteFile(ctx, fileName)
+	if errors.Is(err, ErrRetained) {
+		fs.writeRetained(response, err)
+		return
+	}
 	if err != nil {
-		log.Errorf("Failed to delete file: %s. Error: %+v", filePath, err)
+		log.Errorf("Failed to delete file: %s. Error: %+v", fileName, err)
 		response.WriteHeader(http.StatusInternalServerError)
 		fs.WriteResponseBody(response, err.Error())
 		return
 	}
+	if !found {
+		response.WriteHeader(http.StatusOK)
+		fs.WriteResponseBody(response, "File not found. Already deleted.")
+		return
+	}
+	fs.awaitReplication(ctx, response, replicated)
 
 	// Write successful response
-	delete(fs.knownFiles, fileName)
 	response.WriteHeader(http.StatusOK)
 }
 
-func (fs *FileServer) CanTakeConnection() bool {
-	// Throttle if > maxConnections
-	fs.connLock.RLock()
-	defer fs.connLock.RUnlock()
+// openFile opens fileName for reading. Its in-process lock is held until release is called, once the caller is
+// done with file.
+func (fs *FileServer) openFile(ctx context.Context, fileName string) (io.ReadCloser, ObjectMeta, func(), error) {
+	// Mark file in process so other FS ops for this file wait behind it
+	fs.waitForOpenInProcess(ctx, fileName)
+	release := func() { fs.removeInProcessLock(fileName) }
+
+	// Read file from FS. Open stats the file it opened once, files other file servers wrote are found in the shared
+	// index.
+	_, span := startSpan(ctx, "disk.open", attribute.String("file.name", fileName))
+	file, meta, err := fs.storage.Open(fileName)
+	endSpan(span, err)
+	if errors.Is(err, ErrObjectNotFound) {
+		log.Errorf("File not found err: %+v", err)
+	}
+	if err != nil {
+		release()
+		return nil, meta, nil, err
+	}
+	return file, meta, release, nil
+}
+
+// statFile returns fileName's metadata, waiting for any write to it in progress.
+func (fs *FileServer) statFile(ctx context.Context, fileName string) (ObjectMeta, error) {
+	fs.waitForOpenInProcess(ctx, fileName)
+	defer fs.removeInProcessLock(fileName)
+	return fs.storage.Stat(fileName)
+}
+
+// writeFile stores body as fileName under its in-process lock and publishes the change. Returns the seq replicas
+// have to apply before the write is acknowledged.
+func (fs *FileServer) writeFile(ctx context.Context, fileName string, body io.Reader, size int64) (ObjectMeta, uint64, error) {
+	return fs.writeFileWith(ctx, fileName, body, size, CreateOptions{})
+}
+
+// writeFileWith is writeFile recording opts with the new version. Fails with ErrRetained before body is read if the
+// current version is retained.
+func (fs *FileServer) writeFileWith(ctx context.Context, fileName string, body io.Reader, size int64, opts CreateOptions) (ObjectMeta, uint64, error) {
+	if err := authorizeRetention(ctx, fileName, nil, opts.Retention); err != nil {
+		return ObjectMeta{}, 0, err
+	}
+
+	// Mark file in process so other FS ops for this file wait behind it
+	fs.waitForOpenInProcess(ctx, fileName)
+	defer fs.removeInProcessLock(fileName)
+
+	current, err := fs.storage.Stat(fileName)
+	if err != nil {
+		return fs.storeFile(ctx, fileName, body, size, ObjectMeta{}, opts)
+	}
+	if err := checkRetention(ctx, current); err != nil {
+		return current, 0, err
+	}
+	return fs.storeFile(ctx, fileName, body, size, current, opts)
+}
+
+// storeFile stores body as fileName with opts, replacing previous, zero if there's no such file. The change is audited
+// and published. The caller holds fileName's in-process lock.
+func (fs *FileServer) storeFile(ctx context.Context, fileName string, body io.Reader, size int64, previous ObjectMeta, opts CreateOptions) (ObjectMeta, uint64, error) {
+	// Copy data
+	_, span := startSpan(ctx, "disk.copy", attribute.String("file.name", fileName), attribute.Int64("file.size", size))
+	meta, err := fs.storage.Create(fileName, body, opts)
+	endSpan(span, err)
+	if err != nil {
+		return meta, 0, err
+	}
+	return meta, fs.stored(ctx, previous, meta), nil
+}
+
+// stored audits and publishes meta's new version, replacing previous, zero if there was no such file. Returns the seq
+// replicas have to apply before the write is acknowledged.
+func (fs *FileServer) stored(ctx context.Context, previous ObjectMeta, meta ObjectMeta) uint64 {
+	eventType := EventCreate
+	if previous.Name != "" {
+		eventType = EventUpdate
+	}
+	fs.audit(ctx, eventType, previous, meta)
 
-	return fs.connections < maxConnections
+	return fs.publish(eventType, meta, true)
 }
 
-func (fs *FileServer) IncrementConnection() {
-	fs.connLock.Lock()
-	fs.connections = fs.connections + 1
-	fs.connLock.Unlock()
+// deleteFile removes fileName under its in-process lock and returns whether it existed and the seq replicas have to
+// apply before the delete is acknowledged.
+func (fs *FileServer) deleteFile(ctx context.Context, fileName string) (bool, uint64, error) {
+	// Mark file in process so other FS ops for this file wait behind it
+	fs.waitForOpenInProcess(ctx, fileName)
+	defer fs.removeInProcessLock(fileName)
+
+	_, span := startSpan(ctx, "disk.stat", attribute.String("file.name", fileName))
+	meta, err := fs.storage.Stat(fileName)
+	span.End()
+	if err != nil {
+		return false, 0, nil
+	}
+	if err := checkRetention(ctx, meta); err != nil {
+		return true, 0, err
+	}
+
+	// Open file for writing
+	_, span = startSpan(ctx, "disk.remove", attribute.String("file.name", fileName))
+	err = fs.storage.Remove(fileName)
+	endSpan(span, err)
+	if err != nil {
+		return true, 0, err
+	}
+
+	fs.audit(ctx, EventDelete, meta, ObjectMeta{})
+
+	return true, fs.publish(EventDelete, ObjectMeta{Name: fileName}, true), nil
 }
 
-func (fs *FileServer) DecrementConnection() {
-	fs.connLock.Lock()
-	fs.connections = fs.connections - 1
-	fs.connLock.Unlock()
+// validFileName rejects names that would reach into the server's own state in the data dir.
+func validFileName(fileName string) bool {
+	return fileName != reservedDir && fileName != eventsPath && fileName != "." && fileName != ".."
 }
 
 func (fs *FileServer) WriteResponseBody(response http.ResponseWriter, message string) {
@@ -284,22 +700,22 @@ func (fs *FileServer) WriteResponseBody(response http.ResponseWriter, message st
 	}
 }
 
-func (fs *FileServer) waitForOpenInProcess(fileName string) {
-	jitter := rand.Intn(25)
+// waitForOpenInProcess takes fileName's in-process lock, the per-file lock every op on a file holds, waiting until
+// whoever holds it releases it.
+func (fs *FileServer) waitForOpenInProcess(ctx context.Context, fileName string) {
+	_, span := startSpan(ctx, "fileserver.lock_wait", attribute.String("file.name", fileName))
+	defer span.End()
+	jitter := 1 + rand.Intn(25)
 
-	fs.inProcessLock.RLock()
-	fileInProcess := fs.inProcess.Has(fileName)
-	fs.inProcessLock.RUnlock()
-	for fileInProcess {
+	// Checked and marked under one lock, so two waiters can't both see the file free.
+	fs.inProcessLock.Lock()
+	for fs.inProcess.Has(fileName) {
+		fs.inProcessLock.Unlock()
 		time.Sleep(time.Millisecond * time.Duration(jitter))
-		fs.inProcessLock.RLock()
-		fileInProcess = fs.inProcess.Has(fileName)
-		fs.inProcessLock.RUnlock()
+		fs.inProcessLock.Lock()
 	}
-
-	fs.inProcessLock.Lock()
-	defer fs.inProcessLock.Unlock()
 	fs.inProcess.Add(fileName)
+	fs.inProcessLock.Unlock()
 }
 
 func (fs *FileServer) removeInProcessLock(fileName string) {
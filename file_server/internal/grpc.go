@@ -0,0 +1,459 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/mancej/fileserver-challenge/file_server/fileserverpb"
+)
+
+const (
+	grpcChunkSize = 64 * 1024
+	// Batch gets answer with the whole file in one message, which has to stay under gRPC's default 4 MiB limit.
+	grpcMaxBatchGetSize = 3 * 1024 * 1024
+)
+
+type GRPCConfig struct {
+	Listen []string // Addresses the gRPC API is served on, same schemes as ListenConfig. Empty disables it
+}
+
+// newGRPCServer serves the gRPC API. tlsConfig is the HTTP server's, nil when TLS is off, so certificate reloads and
+// client auth apply to both.
+func (fs *FileServer) newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(fs.grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(fs.grpcStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig.Clone())))
+	}
+	server := grpc.NewServer(opts...)
+	fileserverpb.RegisterFileServiceServer(server, &grpcFileService{fs: fs})
+	return server
+}
+
+// grpcFileService mirrors the HTTP API over gRPC. Calls are authorized and take connection slots the same way
+// requests do, so both APIs share the connection limit.
+type grpcFileService struct {
+	fileserverpb.UnimplementedFileServiceServer
+	fs *FileServer
+}
+
+func (s *grpcFileService) Stat(ctx context.Context, in *fileserverpb.StatRequest) (*fileserverpb.FileInfo, error) {
+	ctx, release, err := s.begin(ctx, PermissionRead, in.Name, PriorityHigh)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	meta, err := s.fs.statFile(ctx, in.Name)
+	if err != nil {
+		return nil, grpcFileError(in.Name, err)
+	}
+	return grpcFileInfo(meta), nil
+}
+
+func (s *grpcFileService) Delete(ctx context.Context, in *fileserverpb.DeleteRequest) (*fileserverpb.DeleteResponse, error) {
+	ctx, release, err := s.begin(ctx, PermissionDelete, in.Name, PriorityHigh)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	found, replicated, err := s.fs.deleteFile(ctx, in.Name)
+	if err != nil {
+		return nil, grpcFileError(in.Name, err)
+	}
+	s.awaitReplication(ctx, replicated)
+	return &fileserverpb.DeleteResponse{Found: found}, nil
+}
+
+func (s *grpcFileService) Put(stream fileserverpb.FileService_PutServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no file name provided")
+	}
+	if err != nil {
+		return err
+	}
+
+	// The size isn't known up front, like a chunked HTTP upload.
+	ctx, release, err := s.begin(stream.Context(), PermissionWrite, first.Name, PriorityLow)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	meta, replicated, err := s.fs.writeFile(ctx, first.Name, &grpcPutBody{stream: stream, pending: first.Data}, -1)
+	if err != nil {
+		return grpcFileError(first.Name, err)
+	}
+	s.awaitReplication(ctx, replicated)
+	return stream.SendAndClose(grpcFileInfo(meta))
+}
+
+func (s *grpcFileService) Get(in *fileserverpb.GetRequest, stream fileserverpb.FileService_GetServer) error {
+	ctx, release, err := s.begin(stream.Context(), PermissionRead, in.Name, s.fs.getPriority(in.Name))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	file, meta, releaseFile, err := s.fs.openFile(ctx, in.Name)
+	if err != nil {
+		return grpcFileError(in.Name, err)
+	}
+	defer releaseFile()
+	defer file.Close()
+	body, err := newDecoder(meta.Encoding, file)
+	if err != nil {
+		return grpcFileError(in.Name, err)
+	}
+	defer body.Close()
+
+	if err := stream.Send(&fileserverpb.GetResponse{Info: grpcFileInfo(meta)}); err != nil {
+		return err
+	}
+	_, span := startSpan(ctx, "response.write")
+	written, err := io.CopyBuffer(&grpcGetWriter{stream: stream}, body, make([]byte, grpcChunkSize))
+	endSpan(span, err)
+	if err != nil {
+		return grpcFileError(in.Name, err)
+	}
+	if written != meta.Size {
+		log.Errorf("gRPC: invalid number of bytes sent for %s. Expected %d, got %d", in.Name, meta.Size, written)
+		return status.Error(codes.DataLoss, "data write corruption, please retry")
+	}
+	return nil
+}
+
+// Batch answers each operation in turn. Every operation is authorized and admitted on its own, a failure is
+// reported in its response and the stream goes on.
+func (s *grpcFileService) Batch(stream fileserverpb.FileService_BatchServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		out, err := s.batchOp(stream.Context(), in)
+		if err != nil {
+			st := status.Convert(err)
+			out = &fileserverpb.BatchResponse{Code: int32(st.Code()), Message: st.Message()}
+		}
+		out.Id = in.Id
+		if err := stream.Send(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *grpcFileService) batchOp(ctx context.Context, in *fileserverpb.BatchRequest) (*fileserverpb.BatchResponse, error) {
+	switch op := in.Op.(type) {
+	case *fileserverpb.BatchRequest_Stat:
+		name := op.Stat.GetName()
+		info, err := s.batchCall(ctx, PermissionRead, name, PriorityHigh, func(ctx context.Context) (*fileserverpb.FileInfo, error) {
+			meta, err := s.fs.statFile(ctx, name)
+			if err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			return grpcFileInfo(meta), nil
+		})
+		return &fileserverpb.BatchResponse{Info: info}, err
+	case *fileserverpb.BatchRequest_Get:
+		name := op.Get.GetName()
+		var data []byte
+		info, err := s.batchCall(ctx, PermissionRead, name, s.fs.getPriority(name), func(ctx context.Context) (*fileserverpb.FileInfo, error) {
+			file, meta, release, err := s.fs.openFile(ctx, name)
+			if err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			defer release()
+			defer file.Close()
+			if meta.Size > grpcMaxBatchGetSize {
+				return nil, status.Errorf(codes.FailedPrecondition, "%s is larger than %d bytes, use Get", name, grpcMaxBatchGetSize)
+			}
+			body, err := newDecoder(meta.Encoding, file)
+			if err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			defer body.Close()
+			if data, err = io.ReadAll(body); err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			return grpcFileInfo(meta), nil
+		})
+		return &fileserverpb.BatchResponse{Info: info, Data: data}, err
+	case *fileserverpb.BatchRequest_Put:
+		name, data := op.Put.GetName(), op.Put.GetData()
+		priority := PriorityLow
+		if int64(len(data)) <= s.fs.cfg.Admission.SmallFileThreshold {
+			priority = PriorityNormal
+		}
+		info, err := s.batchCall(ctx, PermissionWrite, name, priority, func(ctx context.Context) (*fileserverpb.FileInfo, error) {
+			meta, _, err := s.fs.writeFile(ctx, name, bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			return grpcFileInfo(meta), nil
+		})
+		return &fileserverpb.BatchResponse{Info: info}, err
+	case *fileserverpb.BatchRequest_Delete:
+		name := op.Delete.GetName()
+		var found bool
+		_, err := s.batchCall(ctx, PermissionDelete, name, PriorityHigh, func(ctx context.Context) (*fileserverpb.FileInfo, error) {
+			var err error
+			if found, _, err = s.fs.deleteFile(ctx, name); err != nil {
+				return nil, grpcFileError(name, err)
+			}
+			return nil, nil
+		})
+		return &fileserverpb.BatchResponse{Found: found}, err
+	default:
+		return nil, status.Error(codes.InvalidArgument, "no operation set")
+	}
+}
+
+// batchCall runs op holding a connection slot. Writes aren't held back for sync replication, a batch is answered as
+// soon as the primary has them.
+func (s *grpcFileService) batchCall(ctx context.Context, permission Permission, fileName string, priority Priority, op func(context.Context) (*fileserverpb.FileInfo, error)) (*fileserverpb.FileInfo, error) {
+	ctx, request, err := s.authorize(ctx, permission, fileName)
+	if err != nil {
+		return nil, err
+	}
+	release, rateLimitHeader, err := s.admit(ctx, request, priority)
+	if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry after %ss", rateLimitHeader.Get("Retry-After"))
+	}
+	defer release()
+	return op(ctx)
+}
+
+// begin authorizes a call for permission on fileName and takes a connection slot for it. Throttled calls fail with
+// RESOURCE_EXHAUSTED, the rate limit headers an HTTP client would have got are sent as trailers.
+func (s *grpcFileService) begin(ctx context.Context, permission Permission, fileName string, priority Priority) (context.Context, func(), error) {
+	ctx, request, err := s.authorize(ctx, permission, fileName)
+	if err != nil {
+		return ctx, nil, err
+	}
+	release, rateLimitHeader, err := s.admit(ctx, request, priority)
+	if err != nil {
+		_ = grpc.SetTrailer(ctx, grpcMetadata(rateLimitHeader))
+		return ctx, nil, status.Error(codes.ResourceExhausted, "too many requests, slow down")
+	}
+	return ctx, release, nil
+}
+
+// authorize checks fileName and the call's credentials. Credentials are read from metadata the way the HTTP API reads
+// them from headers, so x-api-key and Basic authorization work. Signed requests don't, there's no HTTP request to sign.
+func (s *grpcFileService) authorize(ctx context.Context, permission Permission, fileName string) (context.Context, *http.Request, error) {
+	if fileName == "" {
+		return ctx, nil, status.Error(codes.InvalidArgument, "file name is empty")
+	}
+	if !validFileName(fileName) || len(fileName) > 255 {
+		return ctx, nil, status.Error(codes.InvalidArgument, "invalid file name")
+	}
+	if permission != PermissionRead && s.fs.replica != nil {
+		return ctx, nil, status.Error(codes.FailedPrecondition, "this file server is a read-only replica")
+	}
+
+	request := grpcHTTPRequest(ctx)
+	// Calls are audited under the x-request-id they're sent with, or a fresh ID.
+	ctx, _ = withRequestInfo(ctx, request)
+	if len(s.fs.authenticators) == 0 {
+		return ctx, request, nil
+	}
+	principal, err := s.fs.authenticate(request)
+	if err != nil {
+		s.fs.metrics.authFailures.Inc(authFailureReason(err))
+		return ctx, nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if !principal.Allows(permission, fileName) {
+		s.fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+		return ctx, nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	ctx = withPrincipal(ctx, principal)
+	return ctx, request.WithContext(ctx), nil
+}
+
+// admit takes a connection slot the way HTTP requests do and simulates the same latency. Returns the rate limit
+// headers for the response if the call should be throttled.
+func (s *grpcFileService) admit(ctx context.Context, request *http.Request, priority Priority) (func(), http.Header, error) {
+	client, retryAfter, err := s.fs.admit(ctx, request, priority)
+	if err != nil {
+		header := http.Header{}
+		s.fs.admission.setRateLimitHeaders(header, retryAfter)
+		return nil, header, err
+	}
+	acquiredAt := time.Now()
+	s.fs.SimulateLatency(ctx)
+	return func() { s.fs.releaseConnection(client, acquiredAt) }, nil, nil
+}
+
+func (s *grpcFileService) awaitReplication(ctx context.Context, seq uint64) {
+	if replicationStatus := s.fs.syncReplication(ctx, seq); replicationStatus != "" {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(replicationStatusHeader), replicationStatus))
+	}
+}
+
+// grpcHTTPRequest builds a request carrying the call's metadata as headers and its peer as the remote address, for
+// the authenticators and the client limiter.
+func grpcHTTPRequest(ctx context.Context) *http.Request {
+	method, _ := grpc.Method(ctx)
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, http.NoBody)
+	request.Header = grpcHeader(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		request.RemoteAddr = p.Addr.String()
+	}
+	return request
+}
+
+func grpcHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+func grpcMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range header {
+		md.Append(strings.ToLower(key), values...)
+	}
+	return md
+}
+
+func grpcFileInfo(meta ObjectMeta) *fileserverpb.FileInfo {
+	return &fileserverpb.FileInfo{
+		Name:            meta.Name,
+		Size:            meta.Size,
+		Etag:            meta.ETag(),
+		ModTimeUnixNano: meta.ModTime.UnixNano(),
+	}
+}
+
+// grpcFileError maps a storage error to a status, passing through statuses the stream itself failed with.
+func grpcFileError(fileName string, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		return status.Error(codes.NotFound, "file not found")
+	case errors.Is(err, ErrRetained):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	log.Errorf("gRPC: failed on file %s. Error: %+v", fileName, err)
+	return status.Error(codes.Internal, err.Error())
+}
+
+// grpcPutBody reads a Put stream's data. A stream that fails before the client closes it fails the read, so the
+// partial upload isn't stored.
+type grpcPutBody struct {
+	stream  fileserverpb.FileService_PutServer
+	pending []byte
+}
+
+func (b *grpcPutBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		in, err := b.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		b.pending = in.Data
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+type grpcGetWriter struct {
+	stream fileserverpb.FileService_GetServer
+}
+
+func (w *grpcGetWriter) Write(p []byte) (int, error) {
+	// Sent as is, it's marshaled into the frame before Send returns.
+	if err := w.stream.Send(&fileserverpb.GetResponse{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (fs *FileServer) grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, span := startGRPCSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	fs.endGRPCSpan(span, info.FullMethod, err)
+	return resp, err
+}
+
+func (fs *FileServer) grpcStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startGRPCSpan(stream.Context(), info.FullMethod)
+	err := handler(srv, &grpcServerStream{ServerStream: stream, ctx: ctx})
+	fs.endGRPCSpan(span, info.FullMethod, err)
+	return err
+}
+
+// startGRPCSpan is traceMiddleware for gRPC calls: it continues a trace passed in traceparent metadata.
+func startGRPCSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(grpcHeader(ctx)))
+	service, method := path.Split(strings.TrimPrefix(fullMethod, "/"))
+	return tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(strings.TrimSuffix(service, "/")), semconv.RPCMethod(method)),
+	)
+}
+
+func (fs *FileServer) endGRPCSpan(span trace.Span, fullMethod string, err error) {
+	code := status.Code(err)
+	fs.metrics.grpcRequests.Inc(path.Base(fullMethod), code.String())
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+	span.End()
+}
+
+// grpcServerStream hands the handler the context carrying the call's span.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
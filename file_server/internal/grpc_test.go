@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/mancej/fileserver-challenge/file_server/fileserverpb"
+)
+
+// newTestFileServer creates a file server configured from the environment, storing files in a temporary directory.
+func newTestFileServer(t *testing.T) *FileServer {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("AUDIT_ENABLED", "false")
+	fs, err := NewFileServer(LoadConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fs.storage.Index().Close() })
+	return fs
+}
+
+// newGRPCTestServer serves a file server's gRPC API on an in-memory listener.
+func newGRPCTestServer(t *testing.T) (*FileServer, fileserverpb.FileServiceClient) {
+	t.Helper()
+	fs := newTestFileServer(t)
+	listener := bufconn.Listen(1024 * 1024)
+	server := fs.newGRPCServer(nil)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return fs, fileserverpb.NewFileServiceClient(conn)
+}
+
+func grpcPut(t *testing.T, client fileserverpb.FileServiceClient, name string, chunks ...[]byte) *fileserverpb.FileInfo {
+	t.Helper()
+	stream, err := client.Put(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&fileserverpb.PutRequest{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(&fileserverpb.PutRequest{Data: chunk}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("put %s: %v", name, err)
+	}
+	return info
+}
+
+func TestGRPCPutGetStat(t *testing.T) {
+	_, client := newGRPCTestServer(t)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), grpcChunkSize/8)
+	put := grpcPut(t, client, "a", data[:1000], data[1000:])
+	if put.GetName() != "a" || put.GetSize() != int64(len(data)) || put.GetEtag() == "" {
+		t.Fatalf("put answered %v", put)
+	}
+
+	stat, err := client.Stat(ctx, &fileserverpb.StatRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.GetSize() != put.GetSize() || stat.GetEtag() != put.GetEtag() || stat.GetModTimeUnixNano() != put.GetModTimeUnixNano() {
+		t.Errorf("stat = %v, want %v", stat, put)
+	}
+	if _, err := client.Stat(ctx, &fileserverpb.StatRequest{Name: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("stat of a missing file = %v, want NotFound", err)
+	}
+	if _, err := client.Stat(ctx, &fileserverpb.StatRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("stat without a name = %v, want InvalidArgument", err)
+	}
+
+	stream, err := client.Get(ctx, &fileserverpb.GetRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetInfo().GetEtag() != put.GetEtag() || len(first.GetData()) != 0 {
+		t.Errorf("first get message = info %v with %d bytes, want the info alone", first.GetInfo(), len(first.GetData()))
+	}
+	var got []byte
+	chunks := 0
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.GetInfo() != nil {
+			t.Error("info sent after the first message")
+		}
+		got = append(got, in.GetData()...)
+		chunks++
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want the %d put", len(got), len(data))
+	}
+	if chunks < 2 {
+		t.Errorf("file sent in %d chunks, want it split", chunks)
+	}
+}
+
+func TestGRPCBatch(t *testing.T) {
+	_, client := newGRPCTestServer(t)
+	stream, err := client.Batch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []*fileserverpb.BatchRequest{
+		{Id: "put", Op: &fileserverpb.BatchRequest_Put{Put: &fileserverpb.PutFile{Name: "a", Data: []byte("batched")}}},
+		{Id: "stat", Op: &fileserverpb.BatchRequest_Stat{Stat: &fileserverpb.StatRequest{Name: "a"}}},
+		{Id: "get", Op: &fileserverpb.BatchRequest_Get{Get: &fileserverpb.GetRequest{Name: "a"}}},
+		{Id: "missing", Op: &fileserverpb.BatchRequest_Get{Get: &fileserverpb.GetRequest{Name: "missing"}}},
+		{Id: "delete", Op: &fileserverpb.BatchRequest_Delete{Delete: &fileserverpb.DeleteRequest{Name: "a"}}},
+		{Id: "deleted", Op: &fileserverpb.BatchRequest_Delete{Delete: &fileserverpb.DeleteRequest{Name: "a"}}},
+		{Id: "empty"},
+	}
+	for _, request := range requests {
+		if err := stream.Send(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]*fileserverpb.BatchResponse{}
+	for i := 0; ; i++ {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(requests) || response.GetId() != requests[i].GetId() {
+			t.Fatalf("response %d is for %q, want them in the order sent", i, response.GetId())
+		}
+		responses[response.GetId()] = response
+	}
+	if len(responses) != len(requests) {
+		t.Fatalf("got %d responses to %d requests", len(responses), len(requests))
+	}
+
+	put, stat, get := responses["put"], responses["stat"], responses["get"]
+	if put.GetCode() != 0 || put.GetInfo().GetSize() != 7 {
+		t.Errorf("put = %v", put)
+	}
+	if stat.GetCode() != 0 || stat.GetInfo().GetEtag() != put.GetInfo().GetEtag() {
+		t.Errorf("stat = %v, want the put's info", stat)
+	}
+	if get.GetCode() != 0 || string(get.GetData()) != "batched" {
+		t.Errorf("get = %v, want the put's data", get)
+	}
+	if missing := responses["missing"]; codes.Code(missing.GetCode()) != codes.NotFound || missing.GetMessage() == "" {
+		t.Errorf("get of a missing file = %v, want NotFound", missing)
+	}
+	if !responses["delete"].GetFound() || responses["deleted"].GetFound() || responses["deleted"].GetCode() != 0 {
+		t.Errorf("deletes = %v then %v, want found then not found", responses["delete"], responses["deleted"])
+	}
+	if empty := responses["empty"]; codes.Code(empty.GetCode()) != codes.InvalidArgument {
+		t.Errorf("request without an operation = %v, want InvalidArgument", empty)
+	}
+}
+
+// gRPC calls and HTTP requests take slots from the same pool.
+func TestGRPCSharesConnectionLimit(t *testing.T) {
+	fs, client := newGRPCTestServer(t)
+	ctx := context.Background()
+	grpcPut(t, client, "a", []byte("data"))
+
+	// A Put holds its slot from the first message until the stream closes.
+	streams := make([]fileserverpb.FileService_PutClient, maxConnections)
+	for i := range streams {
+		stream, err := client.Put(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&fileserverpb.PutRequest{Name: fmt.Sprintf("held-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+	}
+	// Slots are taken once the calls are admitted, wait for the last.
+	for deadline := time.Now().Add(5 * time.Second); fs.admission.Stats().InUse < maxConnections; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d slots taken", fs.admission.Stats().InUse, maxConnections)
+		}
+	}
+
+	if _, err := client.Stat(ctx, &fileserverpb.StatRequest{Name: "a"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("stat with every slot taken = %v, want ResourceExhausted", err)
+	}
+	response := httptest.NewRecorder()
+	fs.HandleHead(response, httptest.NewRequest(http.MethodHead, "/api/fileserver/a", nil), httprouter.Params{{Key: "filename", Value: "a"}})
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("HTTP request with every slot taken got %d, want 429", response.Code)
+	}
+
+	for _, stream := range streams {
+		if _, err := stream.CloseAndRecv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Stat(ctx, &fileserverpb.StatRequest{Name: "a"}); err != nil {
+		t.Errorf("stat once the slots are released = %v", err)
+	}
+	response = httptest.NewRecorder()
+	fs.HandleHead(response, httptest.NewRequest(http.MethodHead, "/api/fileserver/a", nil), httprouter.Params{{Key: "filename", Value: "a"}})
+	if response.Code != http.StatusOK {
+		t.Errorf("HTTP request once the slots are released got %d, want 200", response.Code)
+	}
+}
@@ -0,0 +1,671 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FsyncAlways = "always"
+	FsyncBatch  = "batch"
+	FsyncNone   = "none"
+
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+	lockFile     = "lock"
+
+	journalOpPut    = "put"
+	journalOpDelete = "delete"
+)
+
+type JournalConfig struct {
+	Dir           string        // Where the journal and snapshots live. Defaults to .fileserver/journal in the data dir, shared by every file server using it.
+	Fsync         string        // always syncs every record before acknowledging it, batch every BatchInterval, none leaves it to the OS
+	BatchInterval time.Duration // How often batch mode syncs
+	SnapshotEvery int           // Records appended before the index is snapshotted and the journal replaced
+}
+
+type journalRecord struct {
+	Seq  uint64     `json:"seq"`
+	Op   string     `json:"op"`
+	Name string     `json:"name"`
+	Meta ObjectMeta `json:"meta"`
+}
+
+type indexSnapshot struct {
+	Seq     uint64                `json:"seq"`
+	Objects map[string]ObjectMeta `json:"objects"`
+}
+
+// indexRepair returns the version of name the index should keep for its file on disk, or false to drop the entry.
+type indexRepair func(name string, current ObjectMeta, indexed bool, versions []ObjectMeta, thorough bool) (ObjectMeta, bool, error)
+
+// MetaIndex is the journaled name -> metadata index shared by every file server using the data dir. Changes are made
+// under an exclusive flock on the journal dir, other processes catch up under a shared one.
+type MetaIndex struct {
+	cfg           JournalConfig
+	repair        indexRepair // Nil until SetRepair
+	lock          *os.File    // flocked around every access to the journal and snapshot
+	commit        sync.Mutex  // Serializes this process' use of the flock, which is shared by every goroutine
+	journal       *os.File    // The following fields are only used with commit held
+	offset        int64       // End of the last record applied from journal
+	seq           uint64
+	sinceSnapshot int // Records in journal
+	snapshotting  bool
+	dirty         bool
+	objects       map[string]ObjectMeta   // The following fields are guarded by mutex, and only changed with commit held
+	versions      map[string][]ObjectMeta // Versions of names changed since the last snapshot, see Versions
+	blobs         map[string]*blobRefs    // Names pointing at each blob, for content-addressed storage
+	mutex         sync.Mutex
+}
+
+// blobRefs counts the names pointing at a blob. meta is one of them, which describes how the blob is stored.
+type blobRefs struct {
+	meta ObjectMeta
+	refs int
+}
+
+// IndexTx is the index as seen by the function Update runs, holding the exclusive lock.
+type IndexTx struct {
+	m *MetaIndex
+}
+
+func OpenMetaIndex(cfg JournalConfig) (*MetaIndex, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal dir %s: %w", cfg.Dir, err)
+	}
+	switch cfg.Fsync {
+	case FsyncAlways, FsyncBatch, FsyncNone:
+	default:
+		return nil, fmt.Errorf("unknown journal fsync policy: %s", cfg.Fsync)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(cfg.Dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index := &MetaIndex{cfg: cfg, lock: lock}
+	err = index.locked(syscall.LOCK_EX, func() error {
+		return index.reload(true)
+	})
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	log.Infof("Loaded index with %d entries, replayed %d journal records", index.Len(), index.sinceSnapshot)
+
+	if cfg.Fsync == FsyncBatch && cfg.BatchInterval > 0 {
+		go index.syncEvery(cfg.BatchInterval)
+	}
+	return index, nil
+}
+
+// SetRepair sets how entries that may not match their file are checked, and checks those changed since the snapshot.
+func (m *MetaIndex) SetRepair(repair indexRepair) error {
+	return m.Update(func(tx IndexTx) error {
+		m.repair = repair
+		return m.repairVersions(true, true)
+	})
+}
+
+func (m *MetaIndex) Get(name string) (ObjectMeta, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	meta, ok := m.objects[name]
+	return meta, ok
+}
+
+// Versions returns every version name had since the last snapshot, oldest first.
+func (m *MetaIndex) Versions(name string) []ObjectMeta {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]ObjectMeta(nil), m.versions[name]...)
+}
+
+// Range calls fn for every entry until fn returns false. fn must not call back into the index.
+func (m *MetaIndex) Range(fn func(name string, meta ObjectMeta) bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for name, meta := range m.objects {
+		if !fn(name, meta) {
+			return
+		}
+	}
+}
+
+// Dir is where the journal and snapshots live.
+func (m *MetaIndex) Dir() string {
+	return m.cfg.Dir
+}
+
+// Seq is the seq of the last change applied to this process' copy of the index.
+func (m *MetaIndex) Seq() uint64 {
+	m.commit.Lock()
+	defer m.commit.Unlock()
+	return m.seq
+}
+
+func (m *MetaIndex) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.objects)
+}
+
+// Refresh catches up on changes other processes made to the index.
+func (m *MetaIndex) Refresh() error {
+	return m.locked(syscall.LOCK_SH, func() error {
+		return m.catchUp(false)
+	})
+}
+
+// Update catches up and runs fn with the exclusive lock held. Changes fn makes through tx, and to the files they
+// describe, appear to other processes all at once when it returns. A journaled change stays made if fn fails.
+func (m *MetaIndex) Update(fn func(tx IndexTx) error) error {
+	snapshotDue := false
+	err := m.locked(syscall.LOCK_EX, func() error {
+		if err := m.catchUp(true); err != nil {
+			return err
+		}
+		err := fn(IndexTx{m: m})
+		if m.cfg.SnapshotEvery > 0 && m.sinceSnapshot >= m.cfg.SnapshotEvery && !m.snapshotting {
+			m.snapshotting, snapshotDue = true, true
+		}
+		return err
+	})
+	if snapshotDue {
+		if err := m.snapshot(); err != nil {
+			// The records are already journaled, a failed snapshot only means a longer replay.
+			log.Errorf("Failed to snapshot index: %+v", err)
+		}
+	}
+	return err
+}
+
+// Put records meta. Once it returns, the record is as durable as the fsync policy makes it.
+func (m *MetaIndex) Put(meta ObjectMeta) error {
+	return m.Update(func(tx IndexTx) error {
+		return tx.Put(meta)
+	})
+}
+
+func (m *MetaIndex) Delete(name string) error {
+	return m.Update(func(tx IndexTx) error {
+		return tx.Delete(name)
+	})
+}
+
+// Sync flushes appended records to disk regardless of the fsync policy.
+func (m *MetaIndex) Sync() error {
+	m.commit.Lock()
+	defer m.commit.Unlock()
+	return m.sync()
+}
+
+func (m *MetaIndex) Close() error {
+	m.commit.Lock()
+	defer m.commit.Unlock()
+	err := m.sync()
+	if closeErr := m.journal.Close(); err == nil {
+		err = closeErr
+	}
+	_ = m.lock.Close()
+	return err
+}
+
+func (tx IndexTx) Get(name string) (ObjectMeta, bool) {
+	return tx.m.Get(name)
+}
+
+func (tx IndexTx) Range(fn func(name string, meta ObjectMeta) bool) {
+	tx.m.Range(fn)
+}
+
+// Blob returns one of the names pointing at blob and how many do.
+func (tx IndexTx) Blob(blob string) (ObjectMeta, int) {
+	tx.m.mutex.Lock()
+	defer tx.m.mutex.Unlock()
+	if refs, ok := tx.m.blobs[blob]; ok {
+		return refs.meta, refs.refs
+	}
+	return ObjectMeta{}, 0
+}
+
+func (tx IndexTx) Put(meta ObjectMeta) error {
+	return tx.m.append(journalRecord{Op: journalOpPut, Name: meta.Name, Meta: meta})
+}
+
+func (tx IndexTx) Delete(name string) error {
+	return tx.m.append(journalRecord{Op: journalOpDelete, Name: name})
+}
+
+// locked runs fn holding commit and the flock in mode.
+func (m *MetaIndex) locked(mode int, fn func() error) error {
+	m.commit.Lock()
+	defer m.commit.Unlock()
+	if err := syscall.Flock(int(m.lock.Fd()), mode); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", m.cfg.Dir, err)
+	}
+	defer syscall.Flock(int(m.lock.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// append journals record. Must be called holding the exclusive lock, caught up.
+func (m *MetaIndex) append(record journalRecord) error {
+	record.Seq = m.seq + 1
+	line, err := encodeJournalRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = m.journal.WriteAt(line, m.offset)
+	m.dirty = true
+	if err == nil && m.cfg.Fsync == FsyncAlways {
+		err = m.sync()
+	}
+	if err != nil {
+		// The caller treats the change as not made, so the record mustn't survive to be replayed. Cut it, along with
+		// any partial write, so later records aren't appended after it.
+		_ = m.journal.Truncate(m.offset)
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+
+	m.offset += int64(len(line))
+	m.seq = record.Seq
+	m.sinceSnapshot++
+	m.apply(record)
+	return nil
+}
+
+func (m *MetaIndex) apply(record journalRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous, existed := m.objects[record.Name]
+	if _, seen := m.versions[record.Name]; !seen {
+		m.versions[record.Name] = nil
+		if existed {
+			m.versions[record.Name] = append(m.versions[record.Name], previous)
+		}
+	}
+	if existed {
+		m.unref(previous)
+	}
+	switch record.Op {
+	case journalOpPut:
+		m.objects[record.Name] = record.Meta
+		m.versions[record.Name] = append(m.versions[record.Name], record.Meta)
+		m.ref(record.Meta)
+	case journalOpDelete:
+		delete(m.objects, record.Name)
+	}
+}
+
+// ref and unref must be called with the mutex held.
+func (m *MetaIndex) ref(meta ObjectMeta) {
+	if meta.Blob == "" {
+		return
+	}
+	refs, ok := m.blobs[meta.Blob]
+	if !ok {
+		refs = &blobRefs{}
+		m.blobs[meta.Blob] = refs
+	}
+	// The newest, e.g. with the envelope a rewrap just put on every name.
+	refs.meta = meta
+	refs.refs++
+}
+
+func (m *MetaIndex) unref(meta ObjectMeta) {
+	refs, ok := m.blobs[meta.Blob]
+	if !ok {
+		return
+	}
+	refs.refs--
+	if refs.refs <= 0 {
+		delete(m.blobs, meta.Blob)
+	}
+}
+
+// repairVersions runs repair over every name changed since the last snapshot, journaling the corrections if journal,
+// applying them in memory only otherwise. Must be called holding the exclusive lock.
+func (m *MetaIndex) repairVersions(thorough bool, journal bool) error {
+	if m.repair == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	changed := make(map[string][]ObjectMeta, len(m.versions))
+	for name, versions := range m.versions {
+		changed[name] = versions
+	}
+	m.mutex.Unlock()
+
+	for name, versions := range changed {
+		current, indexed := m.Get(name)
+		keep, ok, err := m.repair(name, current, indexed, versions, thorough)
+		if err != nil {
+			return err
+		}
+		var record journalRecord
+		switch {
+		case ok && (!indexed || !sameVersion(keep, current)):
+			record = journalRecord{Op: journalOpPut, Name: name, Meta: keep}
+		case !ok && indexed:
+			record = journalRecord{Op: journalOpDelete, Name: name}
+		default:
+			continue
+		}
+		if journal {
+			if err := m.append(record); err != nil {
+				return err
+			}
+		} else {
+			m.apply(record)
+		}
+	}
+	return nil
+}
+
+// snapshot writes the whole index and starts a new journal holding only the records appended meanwhile. The index is
+// copied holding the exclusive lock, but written without it.
+func (m *MetaIndex) snapshot() error {
+	defer func() {
+		m.commit.Lock()
+		m.snapshotting = false
+		m.commit.Unlock()
+	}()
+
+	var state indexSnapshot
+	var journal *os.File
+	var offset int64
+	err := m.locked(syscall.LOCK_EX, func() error {
+		if err := m.catchUp(true); err != nil {
+			return err
+		}
+		// Whatever the snapshot folds in can't be rolled back afterwards, check it first.
+		if err := m.repairVersions(false, false); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		state = indexSnapshot{Seq: m.seq, Objects: maps.Clone(m.objects)}
+		m.mutex.Unlock()
+		journal, offset = m.journal, m.offset
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTempDurable(filepath.Join(m.cfg.Dir, snapshotFile), data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return m.locked(syscall.LOCK_EX, func() error {
+		if err := m.catchUp(true); err != nil {
+			return err
+		}
+		if m.journal != journal {
+			// Another process snapshotted meanwhile, a newer state than this one.
+			return nil
+		}
+		tail := make([]byte, m.offset-offset)
+		if _, err := m.journal.ReadAt(tail, offset); err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		// The snapshot must be on disk before the records it replaces are dropped, whatever the fsync policy.
+		if err := os.Rename(tmp, filepath.Join(m.cfg.Dir, snapshotFile)); err != nil {
+			return err
+		}
+		if err := syncDir(m.cfg.Dir); err != nil {
+			return err
+		}
+		// A new file rather than truncating this one, so other processes notice it was replaced and reload the snapshot.
+		if err := writeFileDurable(filepath.Join(m.cfg.Dir, journalFile), tail); err != nil {
+			return err
+		}
+		replaced, err := os.OpenFile(filepath.Join(m.cfg.Dir, journalFile), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		_ = m.journal.Close()
+		m.journal = replaced
+		m.offset = int64(len(tail))
+		m.dirty = false
+
+		// Only names the new journal changes can still be rolled back.
+		versions := map[string][]ObjectMeta{}
+		m.sinceSnapshot = 0
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		for _, line := range bytes.SplitAfter(tail, []byte("\n")) {
+			if record, err := decodeJournalRecord(line); err == nil {
+				versions[record.Name] = m.versions[record.Name]
+				m.sinceSnapshot++
+			}
+		}
+		m.versions = versions
+		return nil
+	})
+}
+
+func (m *MetaIndex) sync() error {
+	if !m.dirty {
+		return nil
+	}
+	if err := m.journal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	m.dirty = false
+	return nil
+}
+
+func (m *MetaIndex) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.Sync(); err != nil {
+			log.Errorf("Batched journal sync failed: %+v", err)
+		}
+	}
+}
+
+// catchUp applies records appended since the last call, reloading everything if another process snapshotted the
+// index in the meantime. Must be called holding the lock, exclusive can truncate a torn tail left by a crash.
+func (m *MetaIndex) catchUp(exclusive bool) error {
+	current, err := os.Stat(filepath.Join(m.cfg.Dir, journalFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat journal: %w", err)
+	}
+	opened, openErr := m.journal.Stat()
+	if err != nil || openErr != nil || !os.SameFile(current, opened) {
+		return m.reload(exclusive)
+	}
+	return m.replay(exclusive)
+}
+
+// reload loads the snapshot and replays the journal after it.
+func (m *MetaIndex) reload(exclusive bool) error {
+	snapshot, err := m.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(filepath.Join(m.cfg.Dir, journalFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	if m.journal != nil {
+		if err := m.sync(); err != nil {
+			log.Errorf("Failed to sync the replaced journal: %+v", err)
+		}
+		_ = m.journal.Close()
+	}
+	m.journal = journal
+	m.offset = 0
+	m.sinceSnapshot = 0
+	m.dirty = false
+	m.seq = snapshot.Seq
+
+	m.mutex.Lock()
+	m.objects = snapshot.Objects
+	if m.objects == nil {
+		m.objects = map[string]ObjectMeta{}
+	}
+	m.versions = map[string][]ObjectMeta{}
+	m.blobs = map[string]*blobRefs{}
+	for _, meta := range m.objects {
+		m.ref(meta)
+	}
+	m.mutex.Unlock()
+	return m.replay(exclusive)
+}
+
+func (m *MetaIndex) loadSnapshot() (indexSnapshot, error) {
+	var snapshot indexSnapshot
+	data, err := os.ReadFile(filepath.Join(m.cfg.Dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read index snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("failed to parse index snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// replay applies journal records after offset, stopping at a torn one. With the exclusive lock it's truncated away.
+func (m *MetaIndex) replay(exclusive bool) error {
+	reader := bufio.NewReader(io.NewSectionReader(m.journal, m.offset, math.MaxInt64-m.offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		record, decodeErr := decodeJournalRecord(line)
+		if decodeErr != nil {
+			if !exclusive {
+				break
+			}
+			log.Warnf("Dropping torn journal tail at offset %d: %v", m.offset, decodeErr)
+			if err := m.journal.Truncate(m.offset); err != nil {
+				return fmt.Errorf("failed to truncate journal: %w", err)
+			}
+			break
+		}
+		m.offset += int64(len(line))
+		m.sinceSnapshot++
+		// Records at or below the snapshot's seq were already in it, the process died before replacing the journal.
+		if record.Seq <= m.seq {
+			continue
+		}
+		m.apply(record)
+		m.seq = record.Seq
+	}
+	return nil
+}
+
+// sameVersion reports whether a and b describe the same version of a file.
+func sameVersion(a ObjectMeta, b ObjectMeta) bool {
+	return a.Checksum == b.Checksum && a.StoredSize == b.StoredSize && a.ModTime.Equal(b.ModTime) && a.Blob == b.Blob
+}
+
+// Records are "<crc32 of json, hex> <json>\n".
+func encodeJournalRecord(record journalRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeJournalRecord(line []byte) (journalRecord, error) {
+	var record journalRecord
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		return record, errors.New("incomplete record")
+	}
+	checksum, data, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found {
+		return record, errors.New("malformed record")
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) != string(checksum) {
+		return record, errors.New("checksum mismatch")
+	}
+	err := json.Unmarshal(data, &record)
+	return record, err
+}
+
+// lockDir takes an exclusive flock on dir, held until the returned file is closed, so two processes can't share it.
+func lockDir(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("%s is in use by another process: %w", dir, err)
+	}
+	return lock, nil
+}
+
+// writeFileDurable is writeFileAtomic with the data and the rename synced to disk before it returns.
+func writeFileDurable(path string, data []byte) error {
+	tmp, err := writeTempDurable(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeTempDurable writes data to a synced temp file next to path and returns its name.
+func writeTempDurable(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
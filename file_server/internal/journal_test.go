@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Snapshots are written without the lock, while the other index keeps appending. None of its records may be lost.
+func TestSnapshotKeepsConcurrentRecords(t *testing.T) {
+	cfg := JournalConfig{Dir: t.TempDir(), Fsync: FsyncNone, SnapshotEvery: 7}
+	var indexes []*MetaIndex
+	for i := 0; i < 2; i++ {
+		index, err := OpenMetaIndex(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	const puts = 200
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func(i int, index *MetaIndex) {
+			defer wg.Done()
+			for n := 0; n < puts; n++ {
+				meta := ObjectMeta{Name: fmt.Sprintf("%d-%d", i, n), Size: int64(n), ModTime: time.Unix(int64(n), 0).UTC()}
+				if err := index.Put(meta); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := index.Delete(fmt.Sprintf("%d-0", i)); err != nil {
+				t.Error(err)
+			}
+		}(i, index)
+	}
+	wg.Wait()
+	for _, index := range indexes {
+		if err := index.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := OpenMetaIndex(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if want := 2 * (puts - 1); reopened.Len() != want {
+		t.Errorf("reopened index has %d entries, want %d", reopened.Len(), want)
+	}
+	for i := range indexes {
+		if _, ok := reopened.Get(fmt.Sprintf("%d-0", i)); ok {
+			t.Errorf("%d-0 was deleted but is indexed", i)
+		}
+		if meta, ok := reopened.Get(fmt.Sprintf("%d-%d", i, puts-1)); !ok || meta.Size != puts-1 {
+			t.Errorf("last put of %d = %+v, %t", i, meta, ok)
+		}
+	}
+	if reopened.Seq() != 2*puts+2 {
+		t.Errorf("seq = %d, want one per record", reopened.Seq())
+	}
+	if reopened.sinceSnapshot >= cfg.SnapshotEvery+puts {
+		t.Errorf("%d records replayed, the journal wasn't replaced", reopened.sinceSnapshot)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(cfg.Dir, snapshotFile+".*")); len(temps) > 0 {
+		t.Errorf("snapshot temp files left behind: %v", temps)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Dir, snapshotFile)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LayoutFlat    = "flat"
+	LayoutSharded = "sharded"
+
+	objectsDir     = "objects"
+	maxLayoutDepth = 4
+)
+
+type LayoutConfig struct {
+	Mode  string // flat keeps files in the data dir under their names, sharded hashes names into fan-out dirs under Root
+	Root  string // Where the sharded layout keeps files, defaults to .fileserver/objects in the data dir
+	Depth int    // Levels of fan-out dirs, each named after the next byte of the SHA-256 of the name
+}
+
+// layout maps file names to where disk storage keeps them. While a data dir is migrated to the sharded layout, indexed
+// files still in the flat one are found there. Anything else in the data dir isn't the file server's.
+type layout struct {
+	flatDir string // The data dir
+	root    string // Empty for the flat layout
+	depth   int
+	indexed func(name string) bool // Set by the storage for the sharded layout
+}
+
+func newLayout(dataDir string, cfg LayoutConfig) (layout, error) {
+	switch cfg.Mode {
+	case LayoutFlat, "":
+		return layout{flatDir: dataDir}, nil
+	case LayoutSharded:
+	default:
+		return layout{}, fmt.Errorf("unknown storage layout: %s", cfg.Mode)
+	}
+	if cfg.Depth < 1 || cfg.Depth > maxLayoutDepth {
+		return layout{}, fmt.Errorf("storage layout depth must be between 1 and %d, got %d", maxLayoutDepth, cfg.Depth)
+	}
+	root := cfg.Root
+	if root == "" {
+		root = filepath.Join(dataDir, reservedDir, objectsDir)
+	}
+	// Files are written to .fileserver/tmp and renamed into place, which only works on the same filesystem.
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return layout{}, fmt.Errorf("failed to create %s: %w", root, err)
+	}
+	return layout{flatDir: dataDir, root: root, depth: cfg.Depth}, nil
+}
+
+func (l layout) sharded() bool {
+	return l.root != ""
+}
+
+// path returns where name is written.
+func (l layout) path(name string) string {
+	if !l.sharded() {
+		return l.flatPath(name)
+	}
+	sum := sha256.Sum256([]byte(name))
+	digest := hex.EncodeToString(sum[:l.depth])
+	parts := make([]string, 0, l.depth+2)
+	parts = append(parts, l.root)
+	for i := 0; i < l.depth; i++ {
+		parts = append(parts, digest[i*2:i*2+2])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+func (l layout) flatPath(name string) string {
+	return filepath.Join(l.flatDir, name)
+}
+
+// locate returns where name is: path(name), unless only a not yet migrated flat copy exists.
+func (l layout) locate(name string) string {
+	path := l.path(name)
+	if !l.sharded() {
+		return path
+	}
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) && l.indexed(name) {
+		if stat, err := os.Lstat(l.flatPath(name)); err == nil && stat.Mode().IsRegular() {
+			return l.flatPath(name)
+		}
+	}
+	return path
+}
+
+// names lists every file in the layout, including indexed files still in the flat layout.
+func (l layout) names() ([]string, error) {
+	flat, err := l.flatNames()
+	if err != nil || !l.sharded() {
+		return flat, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	err = filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(l.root, path)
+		level := strings.Count(rel, string(filepath.Separator))
+		if entry.IsDir() && level >= l.depth {
+			return filepath.SkipDir
+		}
+		if entry.Type().IsRegular() && level == l.depth {
+			names = append(names, entry.Name())
+			seen[entry.Name()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range flat {
+		if !seen[name] && l.indexed(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// flatNames lists the files directly in the data dir.
+func (l layout) flatNames() ([]string, error) {
+	entries, err := os.ReadDir(l.flatDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && validFileName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// MigrateLayout moves flat files into the sharded layout, each under the index's exclusive lock. If indexedOnly, files
+// no file server wrote are left where they are.
+func (d *DiskStorage) MigrateLayout(indexedOnly bool, dryRun bool) (int, error) {
+	if !d.layout.sharded() {
+		return 0, errors.New("nothing to migrate, the storage layout is flat")
+	}
+	names, err := d.layout.flatNames()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, name := range names {
+		if _, indexed := d.index.Get(name); indexedOnly && !indexed {
+			continue
+		}
+		target := d.layout.path(name)
+		if dryRun {
+			if _, err := os.Lstat(target); err != nil {
+				moved++
+			}
+			continue
+		}
+		err := d.index.Update(func(IndexTx) error {
+			if _, err := os.Lstat(target); err == nil {
+				// Written since the layout changed and the flat copy somehow survived. The sharded one is served.
+				log.Warnf("Migration: %s is in both layouts, leaving the stale flat copy in place", name)
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(d.layout.flatPath(name), target); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// Replaced or removed by a file server since it was listed.
+					return nil
+				}
+				return fmt.Errorf("failed to move %s, the layout root must be on the same filesystem as the data dir: %w", name, err)
+			}
+			moved++
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+	}
+	if !dryRun && moved > 0 {
+		if err := syncDir(d.layout.flatDir); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// The sharded layout only falls back to the flat one for files a file server indexed, not whatever else is in the
+// data dir.
+func TestShardedLayoutFlatFallback(t *testing.T) {
+	dir := t.TempDir()
+	flat, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := flat.Create("indexed", bytes.NewReader([]byte("indexed")), CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = flat.index.Close()
+	if err := os.WriteFile(filepath.Join(dir, "unindexed"), []byte("someone else's"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testStorageConfig(dir)
+	cfg.Layout = LayoutConfig{Mode: LayoutSharded, Depth: 2}
+	sharded, err := NewDiskStorage(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.index.Close()
+
+	if _, err := sharded.Stat("indexed"); err != nil {
+		t.Errorf("stat of an indexed flat file = %v", err)
+	}
+	if _, err := sharded.Stat("unindexed"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("stat of an unindexed flat file = %v, want ErrObjectNotFound", err)
+	}
+	objects, err := sharded.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Name != "indexed" {
+		t.Errorf("listed %+v, want only the indexed file", objects)
+	}
+	if adopted, err := sharded.Adopt(10); err != nil || len(adopted) != 0 {
+		t.Errorf("adopted %v, %v, want nothing from the flat layout", adopted, err)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		indexedOnly bool
+		dryRun      bool
+		wantMoved   int
+		wantSharded []string // Names in the sharded layout afterwards, b always is
+	}{
+		{"dry run of indexed files", true, true, 1, nil},
+		{"dry run", false, true, 2, nil},
+		{"indexed files", true, false, 1, []string{"a"}},
+		{"every file", false, false, 2, []string{"a", "unindexed"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			flat, err := NewDiskStorage(testStorageConfig(dir), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			createAll(t, flat, map[string]string{"a": "a", "b": "old b"})
+			_ = flat.index.Close()
+			if err := os.WriteFile(filepath.Join(dir, "unindexed"), []byte("unindexed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := testStorageConfig(dir)
+			cfg.Layout = LayoutConfig{Mode: LayoutSharded, Depth: 2}
+			sharded, err := NewDiskStorage(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sharded.index.Close()
+			// Written since the layout changed, with a flat copy that somehow survived. It's stale and left alone.
+			createAll(t, sharded, map[string]string{"b": "new b"})
+			if err := os.WriteFile(sharded.layout.flatPath("b"), []byte("old b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			moved, err := sharded.MigrateLayout(test.indexedOnly, test.dryRun)
+			if err != nil || moved != test.wantMoved {
+				t.Fatalf("moved %d, %v, want %d", moved, err, test.wantMoved)
+			}
+			for _, name := range []string{"a", "unindexed"} {
+				_, err := os.Lstat(sharded.layout.path(name))
+				if inSharded := err == nil; inSharded != slices.Contains(test.wantSharded, name) {
+					t.Errorf("%s in the sharded layout %t, want %t", name, inSharded, !inSharded)
+				}
+				if _, err := os.Lstat(sharded.layout.flatPath(name)); (err == nil) == slices.Contains(test.wantSharded, name) {
+					t.Errorf("%s in the flat layout %t, want %t", name, err == nil, err != nil)
+				}
+			}
+			if _, err := os.Lstat(sharded.layout.flatPath("b")); err != nil {
+				t.Errorf("stale flat copy of b: %v", err)
+			}
+			for name, body := range map[string]string{"a": "a", "b": "new b"} {
+				if got := readBody(t, sharded, name); got != body {
+					t.Errorf("%s: got %q, want %q", name, got, body)
+				}
+			}
+
+			if !test.dryRun {
+				if moved, err := sharded.MigrateLayout(test.indexedOnly, false); err != nil || moved != 0 {
+					t.Errorf("migrating again moved %d, %v, want nothing", moved, err)
+				}
+			}
+		})
+	}
+
+	flat, err := NewDiskStorage(testStorageConfig(t.TempDir()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flat.index.Close()
+	if _, err := flat.MigrateLayout(false, false); err == nil {
+		t.Error("migrated a flat layout")
+	}
+}
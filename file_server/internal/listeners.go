@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	listenSchemeTCP     = "tcp"
+	listenSchemeUnix    = "unix"
+	listenSchemeSystemd = "systemd"
+
+	// First file descriptor passed by systemd socket activation, see sd_listen_fds(3).
+	systemdListenFDsStart = 3
+)
+
+type ListenConfig struct {
+	// Addresses to serve on, e.g. tcp://:1234, unix:///run/fileserver.sock or systemd:// for every socket passed
+	// in by systemd socket activation.
+	Addresses      []string
+	UnixSocketMode os.FileMode // Permissions applied to unix socket files
+}
+
+// openListeners opens every configured address. Already opened listeners are closed if a later one fails.
+func openListeners(cfg ListenConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range cfg.Addresses {
+		opened, err := openListener(address, cfg.UnixSocketMode)
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, opened...)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listen addresses configured")
+	}
+	return listeners, nil
+}
+
+func openListener(address string, unixSocketMode os.FileMode) ([]net.Listener, error) {
+	scheme, target, found := strings.Cut(address, "://")
+	if !found {
+		// Bare host:port, e.g. :1234
+		scheme, target = listenSchemeTCP, address
+	}
+
+	switch scheme {
+	case listenSchemeTCP:
+		listener, err := net.Listen("tcp", target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+		}
+		log.Infof("Listening on tcp %s", listener.Addr())
+		return []net.Listener{listener}, nil
+	case listenSchemeUnix:
+		listener, err := listenUnix(target, unixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Listening on unix socket %s", target)
+		return []net.Listener{listener}, nil
+	case listenSchemeSystemd:
+		return systemdListeners()
+	default:
+		return nil, fmt.Errorf("unsupported listen address: %s", address)
+	}
+}
+
+// listenUnix listens on a unix socket at path, removing a stale socket left behind by a previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace %s, it exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on unix socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// systemdListeners returns the sockets handed over by systemd socket activation (LISTEN_PID/LISTEN_FDS).
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("systemd listener requested but LISTEN_PID does not match this process")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, errors.New("systemd listener requested but LISTEN_FDS is not set")
+	}
+
+	// Don't let children think the sockets were meant for them.
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		// FileListener dups the descriptor, the original isn't needed either way.
+		_ = file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d is not a listening socket: %w", fd, err)
+		}
+		log.Infof("Listening on inherited systemd socket %s", listener.Addr())
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenListeners(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		addresses []string
+		want      []string // Network of each opened listener, nil if opening should fail
+	}{
+		{"bare address", []string{"127.0.0.1:0"}, []string{"tcp"}},
+		{"tcp", []string{"tcp://127.0.0.1:0"}, []string{"tcp"}},
+		{"unix", []string{"unix://" + filepath.Join(dir, "unix.sock")}, []string{"unix"}},
+		{"several", []string{"tcp://127.0.0.1:0", "unix://" + filepath.Join(dir, "several.sock")}, []string{"tcp", "unix"}},
+		{"unsupported scheme", []string{"udp://127.0.0.1:0"}, nil},
+		{"no addresses", nil, nil},
+		{"later failure", []string{"unix://" + filepath.Join(dir, "closed.sock"), "udp://127.0.0.1:0"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listeners, err := openListeners(ListenConfig{Addresses: test.addresses, UnixSocketMode: 0660})
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("opened %d listeners, want an error", len(listeners))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, listener := range listeners {
+				got = append(got, listener.Addr().Network())
+				_ = listener.Close()
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got listeners %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Listeners opened before the failing address are closed, which removes their socket file.
+	if _, err := os.Lstat(filepath.Join(dir, "closed.sock")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket of a listener opened before the failure still exists: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("socket mode", func(t *testing.T) {
+		path := filepath.Join(dir, "mode.sock")
+		listener, err := listenUnix(path, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+			t.Errorf("got %v, %v, want mode 0600", stat.Mode().Perm(), err)
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep the socket file around, as a crashed process would.
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = stale.Close()
+
+		listener, err := listenUnix(path, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if listener, err := listenUnix(path, 0660); err == nil {
+			_ = listener.Close()
+			t.Fatal("replaced a regular file with a socket")
+		}
+		if data, _ := os.ReadFile(path); string(data) != "data" {
+			t.Errorf("regular file was modified, got %q", data)
+		}
+	})
+}
+
+func TestSystemdListenersEnv(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{"no env", "", ""},
+		{"other process", strconv.Itoa(os.Getpid() + 1), "1"},
+		{"no fds", pid, ""},
+		{"zero fds", pid, "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", test.pid)
+			t.Setenv("LISTEN_FDS", test.fds)
+			if listeners, err := openListeners(ListenConfig{Addresses: []string{"systemd://"}}); err == nil {
+				t.Errorf("opened %d listeners, want an error", len(listeners))
+			}
+		})
+	}
+}
+
+// TestSystemdListeners re-runs the test binary with a socket at fd 3, as systemd socket activation passes it.
+func TestSystemdListeners(t *testing.T) {
+	if os.Getenv("SYSTEMD_LISTENER_HELPER") != "" {
+		systemdListenerHelper()
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$")
+	helper.Env = append(os.Environ(), "SYSTEMD_LISTENER_HELPER=1", "LISTEN_FDS=1")
+	helper.ExtraFiles = []*os.File{file}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The helper answers one connection on the inherited socket with the env it was left with.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply := make([]byte, 64)
+	n, _ := conn.Read(reply)
+	if err := helper.Wait(); err != nil {
+		t.Fatalf("helper failed: %v", err)
+	}
+	if got := string(reply[:n]); got != "ok LISTEN_PID= LISTEN_FDS=" {
+		t.Errorf("got %q from the inherited socket", got)
+	}
+}
+
+func systemdListenerHelper() {
+	// systemd sets LISTEN_PID after forking, once the child's pid is known.
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := openListeners(ListenConfig{Addresses: []string{"systemd://"}})
+	if err != nil || len(listeners) != 1 {
+		os.Exit(1)
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	_, _ = conn.Write([]byte("ok LISTEN_PID=" + os.Getenv("LISTEN_PID") + " LISTEN_FDS=" + os.Getenv("LISTEN_FDS")))
+	_ = conn.Close()
+	os.Exit(0)
+}
@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Metrics is a small registry rendered in the Prometheus text exposition format. Counters are updated as events
+// happen, gauges are sampled from their owners at scrape time.
+type Metrics struct {
+	counters []*CounterVec
+	gauges   []*GaugeFunc
+	lock     sync.Mutex
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // Keyed by label values joined with \xff
+	lock   sync.Mutex
+}
+
+// Sample is a single labelled gauge value.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []Sample
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// NewCounter registers a counter with the given label names.
+func (m *Metrics) NewCounter(name string, help string, labels ...string) *CounterVec {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	counter := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	m.counters = append(m.counters, counter)
+	return counter
+}
+
+// NewGauge registers a gauge whose samples are produced by collect on every scrape.
+func (m *Metrics) NewGauge(name string, help string, collect func() []Sample, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.gauges = append(m.gauges, &GaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.lock.Lock()
+	c.values[strings.Join(labelValues, "\xff")] += value
+	c.lock.Unlock()
+}
+
+// HandleMetrics serves all registered metrics.
+func (m *Metrics) HandleMetrics(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m.lock.Lock()
+	counters := append([]*CounterVec(nil), m.counters...)
+	gauges := append([]*GaugeFunc(nil), m.gauges...)
+	m.lock.Unlock()
+
+	var out strings.Builder
+	for _, counter := range counters {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		counter.lock.Lock()
+		keys := make([]string, 0, len(counter.values))
+		for key := range counter.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var labelValues []string
+			if len(counter.labels) > 0 {
+				labelValues = strings.Split(key, "\xff")
+			}
+			writeSample(&out, counter.name, counter.labels, labelValues, counter.values[key])
+		}
+		counter.lock.Unlock()
+	}
+
+	for _, gauge := range gauges {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, sample := range gauge.collect() {
+			writeSample(&out, gauge.name, gauge.labels, sample.Labels, sample.Value)
+		}
+	}
+
+	_, _ = response.Write([]byte(out.String()))
+}
+
+func writeSample(out *strings.Builder, name string, labels []string, labelValues []string, value float64) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			labelValue := ""
+			if i < len(labelValues) {
+				labelValue = labelValues[i]
+			}
+			fmt.Fprintf(out, "%s=%q", label, labelValue)
+		}
+		out.WriteString("}")
+	}
+	fmt.Fprintf(out, " %g\n", value)
+}
+
+// serverMetrics holds the file server's own metrics.
+type serverMetrics struct {
+	registry     *Metrics
+	requests     *CounterVec
+	throttled    *CounterVec
+	authFailures *CounterVec
+
+	scrubRuns        *CounterVec
+	scrubCorrupt     *CounterVec
+	scrubQuarantined *CounterVec
+	scrubReconciled  *CounterVec
+
+	decryptionFailures *CounterVec
+
+	watchEvents *CounterVec
+	watchDrift  *CounterVec
+
+	eventsPublished         *CounterVec
+	eventSubscribersDropped *CounterVec
+
+	webhookDeliveries *CounterVec
+
+	replicationShipped      *CounterVec
+	replicationFailures     *CounterVec
+	replicationResyncs      *CounterVec
+	replicationSyncTimeouts *CounterVec
+	replicaApplied          *CounterVec
+
+	s3Requests     *CounterVec
+	webdavRequests *CounterVec
+	grpcRequests   *CounterVec
+
+	auditRecords  *CounterVec
+	auditFailures *CounterVec
+}
+
+func newServerMetrics(fs *FileServer) *serverMetrics {
+	registry := NewMetrics()
+	sm := &serverMetrics{
+		registry:     registry,
+		requests:     registry.NewCounter("fileserver_client_requests_total", "Requests received per client.", "client"),
+		throttled:    registry.NewCounter("fileserver_client_throttled_total", "Requests rejected with 429 per client and reason.", "client", "reason"),
+		authFailures: registry.NewCounter("fileserver_auth_failures_total", "Requests rejected with 401 or 403 by reason.", "reason"),
+
+		scrubRuns:        registry.NewCounter("fileserver_scrub_runs_total", "Scrubber runs."),
+		scrubCorrupt:     registry.NewCounter("fileserver_scrub_corrupt_total", "Files that failed checksum verification."),
+		scrubQuarantined: registry.NewCounter("fileserver_scrub_quarantined_total", "Corrupt files moved to quarantine."),
+		scrubReconciled:  registry.NewCounter("fileserver_scrub_reconciled_total", "Index entries fixed up by the scrubber, by kind.", "kind"),
+
+		decryptionFailures: registry.NewCounter("fileserver_decryption_failures_total", "Reads of encrypted files that failed authentication."),
+
+		watchEvents: registry.NewCounter("fileserver_watch_events_total", "Journal dir change events that caught the index up, by op.", "op"),
+		watchDrift:  registry.NewCounter("fileserver_watch_drift_total", "Index records a periodic catch up applied while change events were live, by kind.", "kind"),
+
+		eventsPublished:         registry.NewCounter("fileserver_events_published_total", "File events published to the event stream, by type.", "type"),
+		eventSubscribersDropped: registry.NewCounter("fileserver_event_subscribers_dropped_total", "Event stream subscribers disconnected for falling behind."),
+
+		webhookDeliveries: registry.NewCounter("fileserver_webhook_deliveries_total", "Webhook delivery attempts by receiver and result: success, retry or dead_letter.", "target", "result"),
+
+		replicationShipped:      registry.NewCounter("fileserver_replication_shipped_total", "Objects shipped to replicas, by replica and op.", "replica", "op"),
+		replicationFailures:     registry.NewCounter("fileserver_replication_failures_total", "Failed replication requests, by replica.", "replica"),
+		replicationResyncs:      registry.NewCounter("fileserver_replication_resyncs_total", "Full manifest resyncs completed, by replica.", "replica"),
+		replicationSyncTimeouts: registry.NewCounter("fileserver_replication_sync_timeouts_total", "Sync mode writes acknowledged before every replica applied them."),
+		replicaApplied:          registry.NewCounter("fileserver_replica_applied_total", "Changes applied from the primary, by op.", "op"),
+
+		s3Requests:     registry.NewCounter("fileserver_s3_requests_total", "S3 API requests by operation and result: OK or the S3 error code.", "op", "result"),
+		webdavRequests: registry.NewCounter("fileserver_webdav_requests_total", "WebDAV requests by method and status code.", "method", "status"),
+		grpcRequests:   registry.NewCounter("fileserver_grpc_requests_total", "gRPC calls by method and status code.", "method", "code"),
+
+		auditRecords:  registry.NewCounter("fileserver_audit_records_total", "Changes recorded in the audit log, by action.", "action"),
+		auditFailures: registry.NewCounter("fileserver_audit_failures_total", "Changes made that couldn't be recorded in the audit log."),
+	}
+
+	registry.NewGauge("fileserver_connections_in_use", "Connection slots currently held.", func() []Sample {
+		return []Sample{{Value: float64(fs.admission.Stats().InUse)}}
+	})
+	registry.NewGauge("fileserver_connections_limit", "Maximum connection slots.", func() []Sample {
+		return []Sample{{Value: float64(fs.admission.Stats().Limit)}}
+	})
+	registry.NewGauge("fileserver_admission_queue_depth", "Requests waiting for a connection slot.", func() []Sample {
+		return []Sample{{Value: float64(fs.admission.Stats().Queued)}}
+	})
+	registry.NewGauge("fileserver_client_in_flight", "Connection slots currently held per client.", func() []Sample {
+		var samples []Sample
+		for client, count := range fs.admission.ClientInFlight() {
+			samples = append(samples, Sample{Labels: []string{client}, Value: float64(count)})
+		}
+		return samples
+	}, "client")
+	registry.NewGauge("fileserver_client_rate_limit", "Configured requests/sec per client, * is the default. 0 is unlimited.", func() []Sample {
+		var samples []Sample
+		for client, rate := range fs.clients.Limits() {
+			samples = append(samples, Sample{Labels: []string{client}, Value: rate})
+		}
+		return samples
+	}, "client")
+	registry.NewGauge("fileserver_client_concurrency_limit", "Maximum connection slots per client. 0 is unlimited.", func() []Sample {
+		return []Sample{{Value: float64(fs.cfg.RateLimit.MaxConcurrency)}}
+	})
+	registry.NewGauge("fileserver_client_weight", "Fair scheduling weight per client.", func() []Sample {
+		var samples []Sample
+		for client, weight := range fs.cfg.RateLimit.Weights {
+			samples = append(samples, Sample{Labels: []string{client}, Value: weight})
+		}
+		return samples
+	}, "client")
+
+	registry.NewGauge("fileserver_index_entries", "Files described by the metadata index.", func() []Sample {
+		return []Sample{{Value: float64(fs.storage.Index().Len())}}
+	})
+	registry.NewGauge("fileserver_event_subscribers", "Open event stream connections.", func() []Sample {
+		return []Sample{{Value: float64(fs.events.Subscribers())}}
+	})
+	registry.NewGauge("fileserver_webhook_queue_depth", "Events waiting to be delivered, per webhook receiver.", func() []Sample {
+		if fs.webhooks == nil {
+			return nil
+		}
+		var samples []Sample
+		for target, depth := range fs.webhooks.QueueDepths() {
+			samples = append(samples, Sample{Labels: []string{target}, Value: float64(depth)})
+		}
+		return samples
+	}, "target")
+	registry.NewGauge("fileserver_replication_lag_events", "Changes a replica has yet to apply. On replicas, the lag behind the primary.", func() []Sample {
+		if fs.replica != nil {
+			lagEvents, _ := fs.replica.lag()
+			return []Sample{{Labels: []string{"self"}, Value: float64(lagEvents)}}
+		}
+		if fs.replicator == nil {
+			return nil
+		}
+		var samples []Sample
+		for _, status := range fs.replicator.Status() {
+			samples = append(samples, Sample{Labels: []string{status.URL}, Value: float64(status.LagEvents)})
+		}
+		return samples
+	}, "replica")
+	registry.NewGauge("fileserver_replication_lag_seconds", "How long a replica has been behind. On replicas, the time since the primary was last heard from.", func() []Sample {
+		if fs.replica != nil {
+			_, sinceContact := fs.replica.lag()
+			return []Sample{{Labels: []string{"self"}, Value: sinceContact.Seconds()}}
+		}
+		if fs.replicator == nil {
+			return nil
+		}
+		var samples []Sample
+		for _, status := range fs.replicator.Status() {
+			samples = append(samples, Sample{Labels: []string{status.URL}, Value: status.LagSeconds})
+		}
+		return samples
+	}, "replica")
+	registry.NewGauge("fileserver_replication_replica_up", "1 if the last request to the replica succeeded.", func() []Sample {
+		if fs.replicator == nil {
+			return nil
+		}
+		var samples []Sample
+		for _, status := range fs.replicator.Status() {
+			up := 0.0
+			if status.Healthy {
+				up = 1
+			}
+			samples = append(samples, Sample{Labels: []string{status.URL}, Value: up})
+		}
+		return samples
+	}, "replica")
+	registry.NewGauge("fileserver_index_staleness_seconds", "How far the index may lag other file servers' writes. 0 while change events are applied live.", func() []Sample {
+		return []Sample{{Value: fs.watcher.Staleness().Seconds()}}
+	})
+	registry.NewGauge("fileserver_watch_mode", "How the index is kept in step with other file servers' writes, 1 for the active mode.", func() []Sample {
+		return []Sample{{Labels: []string{fs.watcher.Mode()}, Value: 1}}
+	}, "mode")
+	registry.NewGauge("fileserver_scrub_last_run_timestamp_seconds", "Unix time the last scrub started, 0 if none has run.", func() []Sample {
+		if report := fs.scrubber.lastReport(); report != nil {
+			return []Sample{{Value: float64(report.StartedAt.Unix())}}
+		}
+		return []Sample{{Value: 0}}
+	})
+	registry.NewGauge("fileserver_scrub_last_corrupt_files", "Corrupt files found by the last scrub.", func() []Sample {
+		if report := fs.scrubber.lastReport(); report != nil {
+			return []Sample{{Value: float64(len(report.Corrupt))}}
+		}
+		return []Sample{{Value: 0}}
+	})
+
+	if cas, ok := fs.storage.(*CASStorage); ok {
+		registry.NewGauge("fileserver_cas_names", "File names stored.", func() []Sample {
+			return []Sample{{Value: float64(cas.Stats().Names)}}
+		})
+		registry.NewGauge("fileserver_cas_blobs", "Distinct bodies referenced by at least one name.", func() []Sample {
+			return []Sample{{Value: float64(cas.Stats().Blobs)}}
+		})
+		registry.NewGauge("fileserver_cas_logical_bytes", "Bytes that would be stored without deduplication.", func() []Sample {
+			return []Sample{{Value: float64(cas.Stats().LogicalSize)}}
+		})
+		registry.NewGauge("fileserver_cas_stored_bytes", "Bytes stored in referenced blobs.", func() []Sample {
+			return []Sample{{Value: float64(cas.Stats().StoredSize)}}
+		})
+	}
+
+	return sm
+}
+
+func throttleReason(err error) string {
+	switch err {
+	case ErrClientThrottle:
+		return "rate_limit"
+	case ErrClientBusy:
+		return "client_concurrency"
+	case ErrQueueTimeout:
+		return "queue_timeout"
+	case ErrQueueFull:
+		return "queue_full"
+	default:
+		return "canceled"
+	}
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sizeHeader carries a file's size after an append or partial write.
+const sizeHeader = "X-FS-Size"
+
+var (
+	ErrPreconditionFailed  = errors.New("file does not match If-Match")
+	ErrRangeNotSatisfiable = errors.New("range does not fit the file")
+)
+
+// partialWrite is Length bytes of Body to write at Offset into an existing file.
+type partialWrite struct {
+	Offset  int64 // Negative to append
+	Length  int64 // Negative if unknown, appends only
+	Total   int64 // Size the file has to end up with, negative for any
+	IfMatch string
+	Body    io.Reader
+}
+
+// HandlePost appends the body to an existing file with POST ?append, the only operation POST supports.
+func (fs *FileServer) HandlePost(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	if _, ok := request.URL.Query()["append"]; !ok {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "POST only supports ?append.")
+		return
+	}
+	fs.handlePartialWrite(response, request, params, partialWrite{Offset: -1, Length: -1, Total: -1})
+}
+
+// HandlePatch overwrites the byte range in the Content-Range header, e.g. bytes 100-199/*, with the body. The range
+// may extend the file but not start past its end.
+func (fs *FileServer) HandlePatch(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	write, err := parseContentRange(request.Header.Get("Content-Range"))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("Invalid Content-Range, %s.", err))
+		return
+	}
+	if request.ContentLength >= 0 && request.Header.Get("Content-Encoding") == "" && request.ContentLength != write.Length {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Content-Length does not match Content-Range.")
+		return
+	}
+	fs.handlePartialWrite(response, request, params, write)
+}
+
+func (fs *FileServer) handlePartialWrite(response http.ResponseWriter, request *http.Request, params httprouter.Params, write partialWrite) {
+	ctx := request.Context()
+	fileName := params.ByName("filename")
+	client, ok := fs.takeConnection(ctx, response, request, fs.putPriority(request))
+	if !ok {
+		return
+	}
+	defer fs.releaseConnection(client, time.Now())
+	fs.SimulateLatency(ctx)
+
+	defer request.Body.Close()
+
+	if fileName == "" {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "No file name provided")
+		return
+	}
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
+		return
+	}
+
+	// Like PUT, bodies may be sent compressed. The range counts decoded bytes.
+	var body io.Reader = &lengthVerifier{Reader: request.Body, expected: request.ContentLength}
+	if contentEncoding := request.Header.Get("Content-Encoding"); contentEncoding != "" {
+		decoder, err := newDecoder(strings.ToLower(contentEncoding), body)
+		if err != nil {
+			response.WriteHeader(http.StatusUnsupportedMediaType)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+	if write.Length >= 0 {
+		body = &lengthVerifier{Reader: body, expected: write.Length}
+	}
+	write.Body = body
+	write.IfMatch = request.Header.Get("If-Match")
+
+	ctx = fs.governanceBypass(ctx, request.Header.Get(bypassGovernanceHeader), fileName)
+	meta, replicated, err := fs.writePartial(ctx, fileName, write)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		response.WriteHeader(http.StatusNotFound)
+		fs.WriteResponseBody(response, "File not found.")
+		return
+	case errors.Is(err, ErrRetained):
+		fs.writeRetained(response, err)
+		return
+	case errors.Is(err, ErrPreconditionFailed):
+		if etag := meta.ETag(); etag != "" {
+			response.Header().Set("ETag", etag)
+		}
+		response.WriteHeader(http.StatusPreconditionFailed)
+		fs.WriteResponseBody(response, "File does not match If-Match.")
+		return
+	case errors.Is(err, ErrRangeNotSatisfiable):
+		response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+		response.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	case errors.Is(err, ErrSignatureMismatch):
+		fs.metrics.authFailures.Inc(authFailureReason(err))
+		response.WriteHeader(http.StatusUnauthorized)
+		fs.WriteResponseBody(response, "Body does not match signed payload hash.")
+		return
+	case errors.Is(err, ErrShortBody):
+		log.Errorf("Invalid number of bytes written for file: %s. Error: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, "Write corruption, please retry.")
+		return
+	case err != nil:
+		log.Errorf("Failed to write file bytes for file: %s. Error: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	fs.awaitReplication(ctx, response, replicated)
+
+	response.Header().Set("ETag", meta.ETag())
+	response.Header().Set(sizeHeader, strconv.FormatInt(meta.Size, 10))
+	response.WriteHeader(http.StatusOK)
+}
+
+// writePartial applies write to fileName under its in-process lock, in place if storage can, or by rewriting the file.
+func (fs *FileServer) writePartial(ctx context.Context, fileName string, write partialWrite) (ObjectMeta, uint64, error) {
+	fs.waitForOpenInProcess(ctx, fileName)
+	defer fs.removeInProcessLock(fileName)
+
+	// Only opened if it has to be rewritten, an open file isn't written in place.
+	meta, err := fs.storage.Stat(fileName)
+	if err != nil {
+		return ObjectMeta{}, 0, err
+	}
+
+	if err := checkRetention(ctx, meta); err != nil {
+		return meta, 0, err
+	}
+	if write.IfMatch != "" && !etagMatches(write.IfMatch, meta.ETag()) {
+		return meta, 0, ErrPreconditionFailed
+	}
+	size := meta.Size + write.Length
+	if write.Offset >= 0 {
+		if write.Offset > meta.Size {
+			return meta, 0, ErrRangeNotSatisfiable
+		}
+		size = max(meta.Size, write.Offset+write.Length)
+	}
+	if write.Total >= 0 && (write.Length < 0 || write.Total != size) {
+		return meta, 0, ErrRangeNotSatisfiable
+	}
+
+	_, span := startSpan(ctx, "disk.write_at", attribute.String("file.name", fileName), attribute.Int64("file.offset", write.Offset))
+	updated, err := fs.storage.WriteAt(fileName, meta, write.Offset, write.Body)
+	if errors.Is(err, ErrNotInPlace) {
+		span.End()
+	} else {
+		endSpan(span, err)
+		if err != nil {
+			return updated, 0, err
+		}
+		return updated, fs.stored(ctx, meta, updated), nil
+	}
+
+	_, span = startSpan(ctx, "disk.open", attribute.String("file.name", fileName))
+	stored, opened, err := fs.storage.Open(fileName)
+	endSpan(span, err)
+	if err != nil {
+		return ObjectMeta{}, 0, err
+	}
+	defer stored.Close()
+	if !sameVersion(opened, meta) {
+		// Replaced by another file server since.
+		return opened, 0, ErrPreconditionFailed
+	}
+	current, err := newDecoder(meta.Encoding, stored)
+	if err != nil {
+		return meta, 0, err
+	}
+	defer current.Close()
+	content := io.MultiReader(current, write.Body)
+	if write.Offset >= 0 {
+		content = io.MultiReader(io.LimitReader(current, write.Offset), write.Body, &skipReader{Reader: current, skip: write.Length})
+	}
+	if write.Length < 0 {
+		size = -1
+	}
+	return fs.storeFile(ctx, fileName, content, size, meta, CreateOptions{Retention: meta.Retention})
+}
+
+// skipReader discards the first skip bytes of Reader.
+type skipReader struct {
+	io.Reader
+	skip int64
+}
+
+func (r *skipReader) Read(p []byte) (int, error) {
+	if r.skip > 0 {
+		_, err := io.CopyN(io.Discard, r.Reader, r.skip)
+		r.skip = 0
+		if err != nil {
+			// io.EOF if the range runs past the end of the current bytes.
+			return 0, err
+		}
+	}
+	return r.Reader.Read(p)
+}
+
+// parseContentRange parses a Content-Range header of the form bytes <first>-<last>/<total or *>.
+func parseContentRange(header string) (partialWrite, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return partialWrite{}, errors.New("must be bytes <first>-<last>/<total or *>")
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	first, last, rangeOK := strings.Cut(span, "-")
+	if !ok || !rangeOK {
+		return partialWrite{}, errors.New("must be bytes <first>-<last>/<total or *>")
+	}
+	write := partialWrite{Total: -1}
+	var err error
+	if write.Offset, err = strconv.ParseInt(first, 10, 64); err != nil || write.Offset < 0 {
+		return partialWrite{}, fmt.Errorf("invalid first byte %q", first)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < write.Offset {
+		return partialWrite{}, fmt.Errorf("invalid last byte %q", last)
+	}
+	write.Length = end - write.Offset + 1
+	if total != "*" {
+		if write.Total, err = strconv.ParseInt(total, 10, 64); err != nil || write.Total <= end {
+			return partialWrite{}, fmt.Errorf("invalid total %q", total)
+		}
+	}
+	return write, nil
+}
+
+// etagMatches reports whether an If-Match header value matches etag. Only strong tags match, an object without an
+// ETag only matches *.
+func etagMatches(ifMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (etag != "" && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	presignExpiresParam   = "X-FS-Expires"
+	presignSignatureParam = "X-FS-Signature"
+
+	presignedPrincipal = "presigned-url"
+)
+
+var (
+	ErrPresignExpired = errors.New("pre-signed url has expired")
+	ErrPresignInvalid = errors.New("pre-signed url signature is invalid")
+)
+
+type PresignConfig struct {
+	Secret  string        // HMAC key URLs are signed with. Must be shared by every server that should accept them.
+	BaseURL string        // Scheme and host issued URLs point at. Defaults to the host the issuing request came in on.
+	MaxTTL  time.Duration // Longest lifetime a URL can be issued for
+}
+
+// URLSigner issues and verifies time-limited URLs granting one method on one file.
+type URLSigner struct {
+	cfg    PresignConfig
+	secret []byte
+	now    func() time.Time
+}
+
+func NewURLSigner(cfg PresignConfig) (*URLSigner, error) {
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate pre-sign secret: %w", err)
+		}
+		log.Warnf("PRESIGN_SECRET is not set, pre-signed URLs will only be valid on this instance until it restarts.")
+	}
+	return &URLSigner{cfg: cfg, secret: secret, now: time.Now}, nil
+}
+
+// Presign returns the path and query granting method on fileName until expires.
+func (s *URLSigner) Presign(method string, fileName string, expires time.Time) string {
+	query := url.Values{}
+	query.Set(presignExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(presignSignatureParam, s.sign(method, presignPath(fileName), expires.Unix()))
+	return fmt.Sprintf("/api/fileserver/%s?%s", url.PathEscape(fileName), query.Encode())
+}
+
+// presignPath is the only path a URL pre-signed for fileName is valid on.
+func presignPath(fileName string) string {
+	return "/api/fileserver/" + fileName
+}
+
+// Verify checks request carries a valid, unexpired signature for its method and fileName's route. Returns
+// ErrNoCredentials if the request isn't pre-signed at all.
+func (s *URLSigner) Verify(request *http.Request, fileName string) error {
+	query := request.URL.Query()
+	signature := query.Get(presignSignatureParam)
+	if signature == "" {
+		return ErrNoCredentials
+	}
+
+	expires, err := strconv.ParseInt(query.Get(presignExpiresParam), 10, 64)
+	if err != nil {
+		return ErrPresignInvalid
+	}
+
+	// Other routes taking a file name, e.g. retention's, don't accept the file's URLs.
+	if request.URL.Path != presignPath(fileName) {
+		return ErrPresignInvalid
+	}
+	expected := s.sign(request.Method, request.URL.Path, expires)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrPresignInvalid
+	}
+	if s.now().Unix() > expires {
+		return ErrPresignExpired
+	}
+	return nil
+}
+
+func (s *URLSigner) sign(method string, path string, expires int64) string {
+	stringToSign := strings.Join([]string{method, path, strconv.FormatInt(expires, 10)}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.secret, []byte(stringToSign)))
+}
+
+type presignRequest struct {
+	FileName  string `json:"filename"`
+	Method    string `json:"method"`
+	ExpiresIn string `json:"expires_in"` // Go duration, e.g. 15m
+}
+
+type presignResponse struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Expires time.Time `json:"expires"`
+}
+
+// HandlePresign issues a pre-signed URL. When auth is enabled the caller must hold the permission the URL grants.
+func (fs *FileServer) HandlePresign(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	defer request.Body.Close()
+
+	var body presignRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid JSON body.")
+		return
+	}
+
+	var permission Permission
+	switch body.Method {
+	case http.MethodGet:
+		permission = PermissionRead
+	case http.MethodPut:
+		permission = PermissionWrite
+	default:
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Only GET and PUT URLs can be pre-signed.")
+		return
+	}
+
+	ttl, err := time.ParseDuration(body.ExpiresIn)
+	if body.FileName == "" || !validFileName(body.FileName) || err != nil || ttl <= 0 || ttl > fs.cfg.Presign.MaxTTL {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("A filename and an expires_in between 0 and %s are required.", fs.cfg.Presign.MaxTTL))
+		return
+	}
+
+	if len(fs.authenticators) > 0 {
+		principal, err := fs.authenticate(request)
+		if err != nil {
+			fs.metrics.authFailures.Inc(authFailureReason(err))
+			response.WriteHeader(http.StatusUnauthorized)
+			fs.WriteResponseBody(response, "Unauthorized.")
+			return
+		}
+		if !principal.Allows(permission, body.FileName) {
+			fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+			response.WriteHeader(http.StatusForbidden)
+			fs.WriteResponseBody(response, "Forbidden.")
+			return
+		}
+	}
+
+	baseURL := fs.cfg.Presign.BaseURL
+	if baseURL == "" {
+		scheme := "http"
+		if request.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s", scheme, request.Host)
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(presignResponse{
+		URL:     strings.TrimSuffix(baseURL, "/") + fs.signer.Presign(body.Method, body.FileName, expires),
+		Method:  body.Method,
+		Expires: expires.UTC(),
+	})
+	if err != nil {
+		log.Errorf("Failed to write presign response: %+v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withKeys enables auth with keys for servers created afterwards in the test.
+func withKeys(t *testing.T, keys ...APIKey) {
+	t.Helper()
+	data, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTH_ENABLED", "true")
+	t.Setenv("AUTH_KEYS_FILE", path)
+}
+
+func TestPresignedURLScope(t *testing.T) {
+	withKeys(t, APIKey{ID: "admin", Secret: "secret", Permissions: []Permission{PermissionRead, PermissionWrite, PermissionManageRetention}})
+	t.Setenv("PRESIGN_SECRET", "presign")
+	fs := newTestFileServer(t)
+	router := fs.newRouter()
+
+	expires := time.Now().Add(time.Hour)
+	put := fs.signer.Presign(http.MethodPut, "a", expires)
+	get := fs.signer.Presign(http.MethodGet, "a", expires)
+	query := func(url string) string { return url[strings.Index(url, "?"):] }
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   int
+	}{
+		{"put on the file", http.MethodPut, put, http.StatusCreated},
+		{"get on the file", http.MethodGet, get, http.StatusOK},
+		{"put on the file's retention", http.MethodPut, "/admin/retention/a" + query(put), http.StatusForbidden},
+		{"get on the file's retention", http.MethodGet, "/admin/retention/a" + query(get), http.StatusForbidden},
+		{"get on events for the file", http.MethodGet, "/api/fileserver/_events" + query(get) + "&prefix=a", http.StatusForbidden},
+		{"put on another file", http.MethodPut, "/api/fileserver/b" + query(put), http.StatusForbidden},
+		{"get signed url used to delete", http.MethodDelete, get, http.StatusForbidden},
+		{"expired", http.MethodGet, fs.signer.Presign(http.MethodGet, "a", time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"tampered", http.MethodGet, strings.Replace(get, "X-FS-Signature=", "X-FS-Signature=0", 1), http.StatusForbidden},
+		{"not signed", http.MethodGet, "/api/fileserver/a", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(test.method, test.url, strings.NewReader(`{"mode":"governance","retain_until":"2100-01-01T00:00:00Z"}`)))
+			if response.Code != test.want {
+				t.Errorf("%s %s got %d: %s, want %d", test.method, test.url, response.Code, response.Body, test.want)
+			}
+		})
+	}
+}
+
+func TestPresignRejectsReservedNames(t *testing.T) {
+	fs := newTestFileServer(t)
+	for _, name := range []string{"", eventsPath, reservedDir, ".."} {
+		response := httptest.NewRecorder()
+		body, _ := json.Marshal(presignRequest{FileName: name, Method: http.MethodGet, ExpiresIn: "1m"})
+		fs.HandlePresign(response, httptest.NewRequest(http.MethodPost, "/admin/presign", strings.NewReader(string(body))), nil)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("presigning %q got %d, want 400", name, response.Code)
+		}
+	}
+}
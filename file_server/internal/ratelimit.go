@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ClientKeyIP     = "ip"
+	ClientKeyHeader = "header"
+	ClientKeyAPIKey = "api_key"
+
+	apiKeyHeader = "X-API-Key"
+
+	// Buckets untouched for this long are full again and can be dropped.
+	bucketIdleExpiry = time.Minute * 10
+)
+
+type RateLimitConfig struct {
+	KeySource         string             // ip, header or api_key (authenticated key id, else ip). Selects what identifies a client.
+	KeyHeader         string             // Header holding the client id when KeySource is header
+	RequestsPerSecond float64            // Sustained requests/sec per client. 0 disables rate limiting.
+	Burst             int                // Maximum requests a client can make at once after being idle
+	MaxConcurrency    int                // Maximum connection slots one client can hold at once. 0 disables the cap.
+	Weights           map[string]float64 // Fair share weight per client id. Clients not listed have weight 1.
+	ClientOverrides   map[string]float64 // Requests/sec per client id, overriding RequestsPerSecond
+}
+
+// ClientLimiter identifies the client behind a request and applies per-client token bucket rate limits and
+// concurrency caps. Slot scheduling across clients is done by the AdmissionController using the client weights.
+type ClientLimiter struct {
+	cfg     RateLimitConfig
+	buckets map[string]*tokenBucket
+	lock    sync.Mutex
+	lastGC  time.Time
+}
+
+type tokenBucket struct {
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastSeen time.Time
+}
+
+func NewClientLimiter(cfg RateLimitConfig) *ClientLimiter {
+	return &ClientLimiter{
+		cfg:     cfg,
+		buckets: map[string]*tokenBucket{},
+		lastGC:  time.Now(),
+	}
+}
+
+// ClientID returns the id requests are grouped by for limiting and fair scheduling.
+func (cl *ClientLimiter) ClientID(request *http.Request) string {
+	switch cl.cfg.KeySource {
+	case ClientKeyHeader:
+		if id := request.Header.Get(cl.cfg.KeyHeader); id != "" {
+			return id
+		}
+	case ClientKeyAPIKey:
+		// Only the authenticated key's id, never the header. The secret would end up in metrics and traces, and with
+		// auth off any caller could rotate it for fresh buckets.
+		if principal := PrincipalFromContext(request.Context()); principal != nil {
+			return principal.KeyID
+		}
+	}
+
+	return remoteIP(request)
+}
+
+// Allow takes a token from client's bucket. If none is available it returns false and how long until one is.
+func (cl *ClientLimiter) Allow(client string) (bool, time.Duration) {
+	rate := cl.rateFor(client)
+	if rate <= 0 {
+		return true, 0
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	now := time.Now()
+	cl.gcBuckets(now)
+
+	bucket, ok := cl.buckets[client]
+	if !ok {
+		burst := math.Max(float64(cl.cfg.Burst), 1)
+		bucket = &tokenBucket{tokens: burst, rate: rate, burst: burst, lastSeen: now}
+		cl.buckets[client] = bucket
+	}
+
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*bucket.rate)
+	bucket.lastSeen = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+	return false, wait
+}
+
+// UnderConcurrencyCap reports whether client may take another slot while holding inFlight.
+func (cl *ClientLimiter) UnderConcurrencyCap(client string, inFlight int) bool {
+	return cl.cfg.MaxConcurrency <= 0 || inFlight < cl.cfg.MaxConcurrency
+}
+
+// Weight returns client's share of the connection slots relative to other clients.
+func (cl *ClientLimiter) Weight(client string) float64 {
+	if weight, ok := cl.cfg.Weights[client]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Limits returns the configured requests/sec for every client with an explicit override or weight, plus the
+// default under the "*" key.
+func (cl *ClientLimiter) Limits() map[string]float64 {
+	limits := map[string]float64{"*": cl.cfg.RequestsPerSecond}
+	for client := range cl.cfg.Weights {
+		limits[client] = cl.rateFor(client)
+	}
+	for client, rate := range cl.cfg.ClientOverrides {
+		limits[client] = rate
+	}
+	return limits
+}
+
+func (cl *ClientLimiter) rateFor(client string) float64 {
+	if rate, ok := cl.cfg.ClientOverrides[client]; ok {
+		return rate
+	}
+	return cl.cfg.RequestsPerSecond
+}
+
+// gcBuckets drops idle buckets so one-off clients don't accumulate forever. Caller must hold lock.
+func (cl *ClientLimiter) gcBuckets(now time.Time) {
+	if now.Sub(cl.lastGC) < bucketIdleExpiry {
+		return
+	}
+	for client, bucket := range cl.buckets {
+		if now.Sub(bucket.lastSeen) > bucketIdleExpiry {
+			delete(cl.buckets, client)
+		}
+	}
+	cl.lastGC = now
+}
+
+func remoteIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// ParseClientValues parses a comma separated list of client:value pairs, e.g. "svc-a:2,svc-b:0.5".
+// Malformed entries are skipped.
+func ParseClientValues(raw string) map[string]float64 {
+	values := map[string]float64{}
+	for _, entry := range strings.Split(raw, ",") {
+		client, value, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || client == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		values[client] = parsed
+	}
+	return values
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClientLimiterAllow(t *testing.T) {
+	limiter := NewClientLimiter(RateLimitConfig{RequestsPerSecond: 10, Burst: 2, ClientOverrides: map[string]float64{"unlimited": 0, "slow": 1}})
+	tests := []struct {
+		client   string
+		requests int
+		allowed  int
+		wait     time.Duration // Roughly how long until the next token once throttled
+	}{
+		{"a", 3, 2, 100 * time.Millisecond},
+		{"b", 2, 2, 0}, // Own bucket, unaffected by a
+		{"slow", 3, 2, time.Second},
+		{"unlimited", 50, 50, 0},
+	}
+	for _, test := range tests {
+		allowed, wait := 0, time.Duration(0)
+		for i := 0; i < test.requests; i++ {
+			ok, retryAfter := limiter.Allow(test.client)
+			if ok {
+				allowed++
+			} else {
+				wait = retryAfter
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: %d of %d requests allowed, want %d", test.client, allowed, test.requests, test.allowed)
+		}
+		if wait > test.wait || wait < test.wait*9/10 {
+			t.Errorf("%s: told to wait %s, want about %s", test.client, wait, test.wait)
+		}
+	}
+
+	// Tokens come back at the configured rate.
+	time.Sleep(110 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("a wasn't allowed once a token was due")
+	}
+}
+
+func TestClientID(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       RateLimitConfig
+		header    string
+		principal *Principal
+		want      string
+	}{
+		{"ip", RateLimitConfig{KeySource: ClientKeyIP}, "svc-a", nil, "192.0.2.1"},
+		{"header", RateLimitConfig{KeySource: ClientKeyHeader, KeyHeader: "X-Client-ID"}, "svc-a", nil, "svc-a"},
+		{"missing header", RateLimitConfig{KeySource: ClientKeyHeader, KeyHeader: "X-Client-ID"}, "", nil, "192.0.2.1"},
+		{"api key", RateLimitConfig{KeySource: ClientKeyAPIKey}, "", &Principal{KeyID: "key-1"}, "key-1"},
+		{"unauthenticated api key", RateLimitConfig{KeySource: ClientKeyAPIKey}, "", nil, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/api/fileserver/a", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		if test.header != "" {
+			request.Header.Set("X-Client-ID", test.header)
+		}
+		if test.principal != nil {
+			request = request.WithContext(withPrincipal(request.Context(), test.principal))
+		}
+		if got := NewClientLimiter(test.cfg).ClientID(request); got != test.want {
+			t.Errorf("%s: client id = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientConcurrencyCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AdmissionConfig
+		wantErr error
+	}{
+		{"rejected without a queue", AdmissionConfig{}, ErrClientBusy},
+		{"times out queued", AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 5, MaxQueueWait: 20 * time.Millisecond}, ErrQueueTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac := newTestAdmission(4, test.cfg, RateLimitConfig{MaxConcurrency: 1})
+			if err := ac.Acquire(context.Background(), "a", PriorityNormal); err != nil {
+				t.Fatal(err)
+			}
+			if err := ac.Acquire(context.Background(), "a", PriorityNormal); !errors.Is(err, test.wantErr) {
+				t.Errorf("second slot for a = %v, want %v", err, test.wantErr)
+			}
+			if err := ac.Acquire(context.Background(), "b", PriorityNormal); err != nil {
+				t.Errorf("b blocked by a's cap: %v", err)
+			}
+		})
+	}
+}
+
+// Queued requests of one priority are admitted in weighted fair order, not the order they arrived in.
+func TestAdmissionFairness(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		arrived []string
+		want    []string
+	}{
+		{"burst doesn't starve others", nil,
+			[]string{"burst/1", "burst/2", "burst/3", "other/1"},
+			[]string{"burst/1", "other/1", "burst/2", "burst/3"}},
+		{"weighted", map[string]float64{"heavy": 2},
+			[]string{"heavy/1", "heavy/2", "heavy/3", "light/1", "light/2"},
+			[]string{"heavy/1", "heavy/2", "light/1", "heavy/3", "light/2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac := newTestAdmission(1, AdmissionConfig{QueueEnabled: true, MaxQueueDepth: 10, MaxQueueWait: 5 * time.Second}, RateLimitConfig{Weights: test.weights})
+			if !ac.TryAcquire("holder") {
+				t.Fatal("first slot wasn't free")
+			}
+			admitted := make(chan string, len(test.arrived))
+			for _, name := range test.arrived {
+				enqueue(t, ac, name, PriorityNormal, admitted)
+			}
+			if order := admittedOrder(t, ac, "holder", len(test.arrived), admitted); !slices.Equal(order, test.want) {
+				t.Errorf("admitted %v, want %v", order, test.want)
+			}
+		})
+	}
+}
+
+func TestParseClientValues(t *testing.T) {
+	got := ParseClientValues("svc-a:2, svc-b:0.5,broken,:3,svc-c:x")
+	want := map[string]float64{"svc-a": 2, "svc-b": 0.5}
+	if len(got) != len(want) || got["svc-a"] != 2 || got["svc-b"] != 0.5 {
+		t.Errorf("parsed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,683 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ReplicationRoleStandalone = "standalone"
+	ReplicationRolePrimary    = "primary"
+	ReplicationRoleReplica    = "replica"
+
+	ReplicationModeAsync = "async"
+	ReplicationModeSync  = "sync"
+
+	replicationTokenHeader      = "X-FS-Replication-Token"
+	replicationEpochHeader      = "X-FS-Replication-Epoch"
+	replicationSeqHeader        = "X-FS-Replication-Seq"         // Primary event the request brings the replica up to
+	replicationPrimarySeqHeader = "X-FS-Replication-Primary-Seq" // Latest event the primary has published
+	replicationBootHeader       = "X-FS-Replication-Boot"        // Changes every time the replica starts
+	replicationMD5Header        = "X-FS-Replication-MD5"         // MD5 the primary recorded, kept for multipart uploads' ETags
+	replicationStatusHeader     = "X-FS-Replication"             // On sync mode writes: synced, or pending if a replica timed out
+
+	replicationMaxBackoff = 30 * time.Second
+)
+
+type ReplicationConfig struct {
+	Role              string        // standalone, primary or replica
+	Mode              string        // async or sync. In sync mode writes wait for every replica to apply them.
+	Replicas          []string      // Base URLs of the replicas, primary only
+	PrimaryURL        string        // Base URL of the primary, replicas redirect writes there
+	Secret            string        // Shared token replication requests carry
+	SyncTimeout       time.Duration // How long a sync mode write waits for replicas before answering anyway
+	QueueSize         int           // Changes buffered per replica before it falls back to a full resync
+	HeartbeatInterval time.Duration // Idle replicas are pinged this often, to measure lag and notice restarts
+}
+
+// ManifestEntry is one object in a replica's manifest, compared against the primary's to find what to resync.
+type ManifestEntry struct {
+	Name      string     `json:"name"`
+	ETag      string     `json:"etag,omitempty"`
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// ReplicaStatus is the primary's view of one replica.
+type ReplicaStatus struct {
+	URL         string     `json:"url"`
+	Healthy     bool       `json:"healthy"`
+	AckedSeq    uint64     `json:"acked_seq"`
+	LagEvents   uint64     `json:"lag_events"`
+	LagSeconds  float64    `json:"lag_seconds"`
+	Resyncing   bool       `json:"resyncing"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// ReplicationStatus is served on GET /admin/replication. Primaries list their replicas, replicas report how far
+// behind the primary they are.
+type ReplicationStatus struct {
+	Role       string          `json:"role"`
+	Mode       string          `json:"mode,omitempty"`
+	Epoch      string          `json:"epoch,omitempty"`
+	Seq        uint64          `json:"seq,omitempty"`
+	Replicas   []ReplicaStatus `json:"replicas,omitempty"`
+	PrimaryURL string          `json:"primary_url,omitempty"`
+	AppliedSeq uint64          `json:"applied_seq,omitempty"`
+	PrimarySeq uint64          `json:"primary_seq,omitempty"`
+	LagEvents  uint64          `json:"lag_events,omitempty"`
+	// Seconds since the primary was last heard from, replicas only
+	LastContactSeconds float64 `json:"last_contact_seconds,omitempty"`
+}
+
+// Replicator ships each changed name's current state to every replica, from a per-replica queue and worker.
+type Replicator struct {
+	cfg      ReplicationConfig
+	storage  Storage
+	epoch    string
+	client   *http.Client
+	replicas []*replicaShipper
+	metrics  *serverMetrics
+}
+
+type replicaShipper struct {
+	url         string
+	pending     []FileEvent
+	latest      uint64 // Seq of the newest enqueued change
+	acked       uint64 // Seq the replica is known to have applied everything up to
+	behindSince time.Time
+	resync      bool
+	boot        string // Boot id of the replica process the last resync was against
+	healthy     bool
+	lastContact time.Time
+	lastError   string
+	wake        chan struct{}
+	ackedChange chan struct{} // Closed and replaced whenever acked moves
+	mutex       sync.Mutex
+}
+
+func NewReplicator(cfg ReplicationConfig, storage Storage, epoch string) (*Replicator, error) {
+	if cfg.Mode != ReplicationModeAsync && cfg.Mode != ReplicationModeSync {
+		return nil, fmt.Errorf("unknown replication mode %q, expected %s or %s", cfg.Mode, ReplicationModeAsync, ReplicationModeSync)
+	}
+	r := &Replicator{cfg: cfg, storage: storage, epoch: epoch, client: &http.Client{}}
+	for _, rawURL := range cfg.Replicas {
+		if _, err := url.ParseRequestURI(rawURL); err != nil {
+			return nil, fmt.Errorf("invalid replica url %q: %w", rawURL, err)
+		}
+		r.replicas = append(r.replicas, &replicaShipper{
+			url:         strings.TrimSuffix(rawURL, "/"),
+			resync:      true, // Whatever the replica has is from before this primary started
+			wake:        make(chan struct{}, 1),
+			ackedChange: make(chan struct{}),
+		})
+	}
+	return r, nil
+}
+
+// Start runs one shipping worker per replica.
+func (r *Replicator) Start(metrics *serverMetrics) {
+	r.metrics = metrics
+	for _, replica := range r.replicas {
+		go r.run(replica)
+	}
+}
+
+// Enqueue queues event for every replica. Callers enqueue in seq order, under fileLock.
+func (r *Replicator) Enqueue(event FileEvent) {
+	for _, replica := range r.replicas {
+		replica.mutex.Lock()
+		replica.latest = event.Seq
+		if replica.behindSince.IsZero() {
+			replica.behindSince = time.Now()
+		}
+		if len(replica.pending) >= r.cfg.QueueSize {
+			// Too far behind to keep every change, diff manifests once it's reachable again.
+			if !replica.resync {
+				log.Warnf("Replication queue for %s is full, falling back to a full resync", replica.url)
+			}
+			replica.pending, replica.resync = nil, true
+		} else if !replica.resync {
+			replica.pending = append(replica.pending, event)
+		}
+		replica.mutex.Unlock()
+
+		select {
+		case replica.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Await waits until every replica has applied seq, or until SyncTimeout. Returns false if one didn't make it in time.
+func (r *Replicator) Await(ctx context.Context, seq uint64) bool {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.SyncTimeout)
+	defer cancel()
+	for _, replica := range r.replicas {
+		for {
+			replica.mutex.Lock()
+			acked, changed := replica.acked, replica.ackedChange
+			replica.mutex.Unlock()
+			if acked >= seq {
+				break
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *Replicator) Status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(r.replicas))
+	for _, replica := range r.replicas {
+		replica.mutex.Lock()
+		status := ReplicaStatus{
+			URL:       replica.url,
+			Healthy:   replica.healthy,
+			AckedSeq:  replica.acked,
+			Resyncing: replica.resync,
+			LastError: replica.lastError,
+		}
+		if !replica.lastContact.IsZero() {
+			lastContact := replica.lastContact
+			status.LastContact = &lastContact
+		}
+		if replica.latest > replica.acked {
+			status.LagEvents = replica.latest - replica.acked
+		}
+		if !replica.behindSince.IsZero() {
+			status.LagSeconds = time.Since(replica.behindSince).Seconds()
+		}
+		replica.mutex.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (r *Replicator) run(replica *replicaShipper) {
+	backoff := time.Duration(0)
+	for {
+		replica.mutex.Lock()
+		resync := replica.resync
+		var event *FileEvent
+		if !resync && len(replica.pending) > 0 {
+			event = &replica.pending[0]
+		}
+		replica.mutex.Unlock()
+
+		var err error
+		switch {
+		case resync:
+			err = r.resync(replica)
+		case event != nil:
+			err = r.ship(replica, event.Name, event.Seq)
+			if err == nil {
+				replica.mutex.Lock()
+				replica.pending = replica.pending[1:]
+				replica.mutex.Unlock()
+				r.ack(replica, event.Seq)
+			}
+		default:
+			select {
+			case <-replica.wake:
+				continue
+			case <-time.After(r.cfg.HeartbeatInterval):
+				err = r.heartbeat(replica)
+			}
+		}
+
+		replica.mutex.Lock()
+		replica.healthy = err == nil
+		if err != nil {
+			replica.lastError = err.Error()
+		}
+		replica.mutex.Unlock()
+		if err == nil {
+			backoff = 0
+			continue
+		}
+
+		r.metrics.replicationFailures.Inc(replica.url)
+		backoff = min(max(backoff*2, 100*time.Millisecond), replicationMaxBackoff)
+		log.Warnf("Replication to %s failed, retrying in %s: %v", replica.url, backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+func (r *Replicator) ack(replica *replicaShipper, seq uint64) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if seq > replica.acked {
+		replica.acked = seq
+	}
+	if replica.acked >= replica.latest {
+		replica.behindSince = time.Time{}
+	}
+	close(replica.ackedChange)
+	replica.ackedChange = make(chan struct{})
+}
+
+// resync diffs the replica's manifest against local storage and ships every name that differs.
+func (r *Replicator) resync(replica *replicaShipper) error {
+	replica.mutex.Lock()
+	seq := replica.latest
+	replica.pending, replica.resync = nil, false
+	replica.mutex.Unlock()
+
+	err := r.diff(replica, seq)
+	if err != nil {
+		replica.mutex.Lock()
+		replica.resync = true
+		replica.mutex.Unlock()
+		return fmt.Errorf("resync failed: %w", err)
+	}
+	r.metrics.replicationResyncs.Inc(replica.url)
+	r.ack(replica, seq)
+	return nil
+}
+
+func (r *Replicator) diff(replica *replicaShipper, seq uint64) error {
+	response, err := r.send(replica, http.MethodGet, "/replication/manifest", seq, nil, nil)
+	if err != nil {
+		return err
+	}
+	var manifest []ManifestEntry
+	err = json.NewDecoder(response.Body).Decode(&manifest)
+	_ = response.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	replica.mutex.Lock()
+	replica.boot = response.Header.Get(replicationBootHeader)
+	replica.mutex.Unlock()
+
+	objects, err := r.storage.List()
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]ManifestEntry, len(manifest))
+	for _, entry := range manifest {
+		remote[entry.Name] = entry
+	}
+
+	shipped := 0
+	for _, meta := range objects {
+		entry, found := remote[meta.Name]
+		delete(remote, meta.Name)
+		if found && entry.ETag != "" && entry.ETag == meta.ETag() && sameRetention(entry.Retention, meta.Retention) {
+			continue
+		}
+		if err := r.ship(replica, meta.Name, seq); err != nil {
+			return err
+		}
+		shipped++
+	}
+	for name := range remote {
+		if err := r.ship(replica, name, seq); err != nil {
+			return err
+		}
+		shipped++
+	}
+	log.Infof("Resynced %s, shipped %d of %d objects", replica.url, shipped, len(objects))
+	return nil
+}
+
+// ship sends name's current state: its data and retention, or a delete if it no longer exists.
+func (r *Replicator) ship(replica *replicaShipper, name string, seq uint64) error {
+	path := "/replication/objects/" + url.PathEscape(name)
+	file, meta, err := r.storage.Open(name)
+	if errors.Is(err, ErrObjectNotFound) {
+		response, err := r.send(replica, http.MethodDelete, path, seq, nil, nil)
+		if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+		r.metrics.replicationShipped.Inc(replica.url, EventDelete)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Stored bytes go out as is, the replica decodes them and applies its own compression settings.
+	response, err := r.send(replica, http.MethodPut, path, seq, file, func(request *http.Request) {
+		request.ContentLength = meta.StoredSize
+		if meta.Encoding != EncodingIdentity {
+			request.Header.Set("Content-Encoding", meta.Encoding)
+		}
+		if meta.MD5 != "" {
+			request.Header.Set(replicationMD5Header, meta.MD5)
+		}
+		if meta.Retention != nil {
+			retention, _ := json.Marshal(meta.Retention)
+			request.Header.Set(replicaRetentionHeader, string(retention))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	r.metrics.replicationShipped.Inc(replica.url, "put")
+	return nil
+}
+
+func (r *Replicator) heartbeat(replica *replicaShipper) error {
+	replica.mutex.Lock()
+	seq := replica.acked
+	replica.mutex.Unlock()
+	response, err := r.send(replica, http.MethodPost, "/replication/heartbeat", seq, nil, nil)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	return nil
+}
+
+// send makes a replication request and returns the response if it succeeded. A response from a replica process
+// other than the one last resynced means it restarted and may have missed changes, so it's flagged for a resync.
+func (r *Replicator) send(replica *replicaShipper, method string, path string, seq uint64, body io.Reader, prepare func(*http.Request)) (*http.Response, error) {
+	request, err := http.NewRequest(method, replica.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(replicationTokenHeader, r.cfg.Secret)
+	request.Header.Set(replicationEpochHeader, r.epoch)
+	request.Header.Set(replicationSeqHeader, strconv.FormatUint(seq, 10))
+	replica.mutex.Lock()
+	request.Header.Set(replicationPrimarySeqHeader, strconv.FormatUint(replica.latest, 10))
+	replica.mutex.Unlock()
+	if prepare != nil {
+		prepare(request)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("replica responded %s: %s", response.Status, message)
+	}
+
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	replica.lastContact = time.Now()
+	if boot := response.Header.Get(replicationBootHeader); replica.boot != "" && boot != replica.boot {
+		log.Warnf("Replica %s restarted, resyncing", replica.url)
+		replica.boot, replica.resync = boot, true
+	}
+	return response, nil
+}
+
+// replicaState is what a replica knows about its primary.
+type replicaState struct {
+	boot        string
+	epoch       string
+	applied     uint64
+	primarySeq  uint64
+	lastContact time.Time
+	mutex       sync.Mutex
+}
+
+func newReplicaState() *replicaState {
+	boot := make([]byte, 8)
+	_, _ = rand.Read(boot)
+	return &replicaState{boot: hex.EncodeToString(boot)}
+}
+
+// contact records the primary's position from a replication request. seq only counts as applied once the request
+// has been, so it's recorded by the caller after that.
+func (s *replicaState) contact(request *http.Request, applied bool) {
+	seq, _ := strconv.ParseUint(request.Header.Get(replicationSeqHeader), 10, 64)
+	primarySeq, _ := strconv.ParseUint(request.Header.Get(replicationPrimarySeqHeader), 10, 64)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if epoch := request.Header.Get(replicationEpochHeader); epoch != s.epoch {
+		// The primary restarted, its sequence numbers started over.
+		s.epoch, s.applied, s.primarySeq = epoch, 0, 0
+	}
+	if applied && seq > s.applied {
+		s.applied = seq
+	}
+	if primarySeq > s.primarySeq {
+		s.primarySeq = primarySeq
+	}
+	s.lastContact = time.Now()
+}
+
+func (s *replicaState) lag() (uint64, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events uint64
+	if s.primarySeq > s.applied {
+		events = s.primarySeq - s.applied
+	}
+	if s.lastContact.IsZero() {
+		return events, 0
+	}
+	return events, time.Since(s.lastContact)
+}
+
+// replicate queues a committed write for the replicas and returns the seq to wait for, 0 if there's nothing to wait
+// for. Called under fileLock so writes are queued in the order they were published.
+func (fs *FileServer) replicate(event FileEvent) uint64 {
+	if fs.replicator == nil {
+		return 0
+	}
+	fs.replicator.Enqueue(event)
+	if fs.cfg.Replication.Mode != ReplicationModeSync {
+		return 0
+	}
+	return event.Seq
+}
+
+// awaitReplication holds a sync mode write's response until the replicas have it. The write is already durable on
+// the primary, so a replica timing out doesn't fail it, the response says it's still pending instead.
+func (fs *FileServer) awaitReplication(ctx context.Context, response http.ResponseWriter, seq uint64) {
+	if replicationStatus := fs.syncReplication(ctx, seq); replicationStatus != "" {
+		response.Header().Set(replicationStatusHeader, replicationStatus)
+	}
+}
+
+// syncReplication is awaitReplication for APIs that report it their own way. Returns synced, pending, or "" if there
+// was nothing to wait for.
+func (fs *FileServer) syncReplication(ctx context.Context, seq uint64) string {
+	if seq == 0 {
+		return ""
+	}
+	if fs.replicator.Await(ctx, seq) {
+		return "synced"
+	}
+	fs.metrics.replicationSyncTimeouts.Inc()
+	return "pending"
+}
+
+// primaryOnly redirects writes sent to a replica to the primary, or rejects them if it isn't known.
+func (fs *FileServer) primaryOnly(handle httprouter.Handle) httprouter.Handle {
+	if fs.cfg.Replication.Role != ReplicationRoleReplica {
+		return handle
+	}
+	return func(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+		if fs.cfg.Replication.PrimaryURL == "" {
+			response.Header().Set("Allow", "GET")
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			fs.WriteResponseBody(response, "This file server is a read-only replica.")
+			return
+		}
+		http.Redirect(response, request, strings.TrimSuffix(fs.cfg.Replication.PrimaryURL, "/")+request.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// replicationAuth only lets requests carrying the replication secret through. Tokens are compared by hash, so the
+// comparison takes as long whatever their length.
+func (fs *FileServer) replicationAuth(handle httprouter.Handle) httprouter.Handle {
+	secret := sha256.Sum256([]byte(fs.cfg.Replication.Secret))
+	return func(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		token := sha256.Sum256([]byte(request.Header.Get(replicationTokenHeader)))
+		if subtle.ConstantTimeCompare(secret[:], token[:]) != 1 {
+			fs.metrics.authFailures.Inc("replication_token")
+			response.WriteHeader(http.StatusUnauthorized)
+			fs.WriteResponseBody(response, "Invalid replication token.")
+			return
+		}
+		response.Header().Set(replicationBootHeader, fs.replica.boot)
+		handle(response, request, params)
+	}
+}
+
+// HandleReplicaPut applies a shipped object on a replica.
+func (fs *FileServer) HandleReplicaPut(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ctx := request.Context()
+	fileName := params.ByName("filename")
+	defer request.Body.Close()
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
+		return
+	}
+	fs.replica.contact(request, false)
+
+	var body io.Reader = &lengthVerifier{Reader: request.Body, expected: request.ContentLength}
+	if contentEncoding := request.Header.Get("Content-Encoding"); contentEncoding != "" {
+		decoder, err := newDecoder(contentEncoding, body)
+		if err != nil {
+			response.WriteHeader(http.StatusUnsupportedMediaType)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+
+	var retention *Retention
+	if header := request.Header.Get(replicaRetentionHeader); header != "" {
+		if err := json.Unmarshal([]byte(header), &retention); err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			fs.WriteResponseBody(response, fmt.Sprintf("Invalid retention: %s", err))
+			return
+		}
+	}
+
+	// The primary already enforced retention, replicas follow whatever it stored.
+	ctx = withRetentionBypass(ctx, bypassAll)
+	if _, _, err := fs.writeFileWith(ctx, fileName, body, request.ContentLength, CreateOptions{Retention: retention, MD5: request.Header.Get(replicationMD5Header)}); err != nil {
+		log.Errorf("Failed to apply replicated file %s: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+
+	fs.replica.contact(request, true)
+	fs.metrics.replicaApplied.Inc("put")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// HandleReplicaDelete applies a shipped delete on a replica.
+func (fs *FileServer) HandleReplicaDelete(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	fileName := params.ByName("filename")
+	if !validFileName(fileName) {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, "Invalid file name.")
+		return
+	}
+	fs.replica.contact(request, false)
+
+	fs.waitForOpenInProcess(request.Context(), fileName)
+	defer fs.removeInProcessLock(fileName)
+
+	meta, err := fs.storage.Stat(fileName)
+	if err == nil {
+		err = fs.storage.Remove(fileName)
+	}
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		log.Errorf("Failed to apply replicated delete of %s: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+
+	if err == nil {
+		fs.audit(request.Context(), EventDelete, meta, ObjectMeta{})
+	}
+	if err == nil {
+		fs.publish(EventDelete, ObjectMeta{Name: fileName}, false)
+	}
+
+	fs.replica.contact(request, true)
+	fs.metrics.replicaApplied.Inc(EventDelete)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// HandleReplicaManifest lists what a replica holds, for the primary to diff against.
+func (fs *FileServer) HandleReplicaManifest(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	fs.replica.contact(request, false)
+	objects, err := fs.storage.List()
+	if err != nil {
+		log.Errorf("Failed to list objects for the replication manifest: %+v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	manifest := make([]ManifestEntry, 0, len(objects))
+	for _, meta := range objects {
+		manifest = append(manifest, ManifestEntry{Name: meta.Name, ETag: meta.ETag(), Retention: meta.Retention})
+	}
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(manifest); err != nil {
+		log.Errorf("Failed to write replication manifest: %+v", err)
+	}
+}
+
+// HandleReplicaHeartbeat tells an idle replica how far the primary is and that it has everything up to the seq sent.
+func (fs *FileServer) HandleReplicaHeartbeat(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	fs.replica.contact(request, true)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// HandleReplicationStatus reports this server's role and replication lag.
+func (fs *FileServer) HandleReplicationStatus(response http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	status := ReplicationStatus{Role: fs.cfg.Replication.Role}
+	switch {
+	case fs.replicator != nil:
+		status.Epoch, status.Seq = fs.events.Position()
+		status.Mode = fs.cfg.Replication.Mode
+		status.Replicas = fs.replicator.Status()
+	case fs.replica != nil:
+		lagEvents, sinceContact := fs.replica.lag()
+		fs.replica.mutex.Lock()
+		status.Epoch, status.AppliedSeq, status.PrimarySeq = fs.replica.epoch, fs.replica.applied, fs.replica.primarySeq
+		fs.replica.mutex.Unlock()
+		status.PrimaryURL = fs.cfg.Replication.PrimaryURL
+		status.LagEvents, status.LastContactSeconds = lagEvents, sinceContact.Seconds()
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		log.Errorf("Failed to write replication status: %+v", err)
+	}
+}
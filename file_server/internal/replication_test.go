@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplicationSecret = "replication-secret"
+
+// newTestReplica serves a replica whose writes redirect to primaryURL.
+func newTestReplica(t *testing.T, primaryURL string) (*FileServer, *httptest.Server) {
+	t.Helper()
+	t.Setenv("REPLICATION_ROLE", ReplicationRoleReplica)
+	t.Setenv("REPLICATION_SECRET", testReplicationSecret)
+	t.Setenv("REPLICATION_PRIMARY_URL", primaryURL)
+	replica := newTestFileServer(t)
+	server := httptest.NewServer(replica.newRouter())
+	t.Cleanup(server.Close)
+	return replica, server
+}
+
+func TestReplication(t *testing.T) {
+	replica, replicaServer := newTestReplica(t, "http://primary.invalid")
+	// Left over from an earlier primary, only same matches what the new one has.
+	createAll(t, replica.storage, map[string]string{"stale": "old body", "same": "same body", "kept": "old body"})
+	same, _ := replica.storage.Stat("same")
+
+	t.Setenv("REPLICATION_ROLE", ReplicationRolePrimary)
+	t.Setenv("REPLICATION_REPLICAS", replicaServer.URL)
+	t.Setenv("REPLICATION_MODE", ReplicationModeSync)
+	// Idle replicas aren't pinged during the test.
+	t.Setenv("REPLICATION_HEARTBEAT_INTERVAL", "1h")
+	primary := newTestFileServer(t)
+	createAll(t, primary.storage, map[string]string{"same": "same body", "kept": "new body"})
+	primary.replicator.Start(primary.metrics)
+
+	// The first thing shipped is a resync against the replica's manifest.
+	resynced := waitFor(5*time.Second, func() bool {
+		_, err := replica.storage.Stat("stale")
+		return errors.Is(err, ErrObjectNotFound)
+	})
+	if !resynced {
+		t.Fatal("resync didn't remove a name the primary doesn't have")
+	}
+	if got := readBody(t, replica.storage, "kept"); got != "new body" {
+		t.Errorf("got kept %q after resync, want the primary's body", got)
+	}
+	if meta, _ := replica.storage.Stat("same"); !meta.ModTime.Equal(same.ModTime) {
+		t.Error("resync shipped a name the replica already had")
+	}
+
+	router := primary.newRouter()
+	steps := []struct {
+		method   string
+		name     string
+		body     string
+		wantBody string // Empty if the replica shouldn't have the name
+	}{
+		{http.MethodPut, "pub-a", "first", "first"},
+		{http.MethodPut, "pub-a", "second", "second"},
+		{http.MethodPut, "pub-b", "other", "other"},
+		{http.MethodDelete, "pub-a", "", ""},
+	}
+	for _, step := range steps {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(step.method, "/api/fileserver/"+step.name, strings.NewReader(step.body)))
+		if response.Code >= 300 || response.Header().Get(replicationStatusHeader) != "synced" {
+			t.Fatalf("%s %s: got %d with replication %q, want it synced", step.method, step.name, response.Code, response.Header().Get(replicationStatusHeader))
+		}
+		// Sync mode writes are answered once the replica applied them.
+		if step.wantBody == "" {
+			if _, err := replica.storage.Stat(step.name); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("%s %s: replica still has it: %v", step.method, step.name, err)
+			}
+		} else if got := readBody(t, replica.storage, step.name); got != step.wantBody {
+			t.Errorf("%s %s: replica has %q, want %q", step.method, step.name, got, step.wantBody)
+		}
+	}
+
+	_, seq := primary.events.Position()
+	if status := primary.replicator.Status()[0]; !status.Healthy || status.AckedSeq != seq || status.LagEvents != 0 || status.Resyncing {
+		t.Errorf("got replica status %+v, want healthy and acked up to %d", status, seq)
+	}
+}
+
+func TestReplicaRequests(t *testing.T) {
+	replica, replicaServer := newTestReplica(t, "http://primary.invalid")
+	createAll(t, replica.storage, map[string]string{"b": "body", "a": "body"})
+	router := replica.newRouter()
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"write redirected to the primary", http.MethodPut, "/api/fileserver/a?x=1", "", http.StatusTemporaryRedirect, "http://primary.invalid/api/fileserver/a?x=1"},
+		{"delete redirected to the primary", http.MethodDelete, "/api/fileserver/a", "", http.StatusTemporaryRedirect, "http://primary.invalid/api/fileserver/a"},
+		{"read served locally", http.MethodGet, "/api/fileserver/a", "", http.StatusOK, ""},
+		{"manifest without token", http.MethodGet, "/replication/manifest", "", http.StatusUnauthorized, ""},
+		{"manifest with wrong token", http.MethodGet, "/replication/manifest", "wrong", http.StatusUnauthorized, ""},
+		{"shipped put with wrong token", http.MethodPut, "/replication/objects/a", "wrong", http.StatusUnauthorized, ""},
+		{"manifest", http.MethodGet, "/replication/manifest", testReplicationSecret, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader("new body"))
+			if test.token != "" {
+				request.Header.Set(replicationTokenHeader, test.token)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != test.wantStatus || response.Header().Get("Location") != test.wantLocation {
+				t.Errorf("got %d to %q, want %d to %q", response.Code, response.Header().Get("Location"), test.wantStatus, test.wantLocation)
+			}
+		})
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, replicaServer.URL+"/replication/manifest", nil)
+	request.Header.Set(replicationTokenHeader, testReplicationSecret)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var manifest []ManifestEntry
+	if err := json.NewDecoder(response.Body).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range manifest {
+		names = append(names, entry.Name)
+		if entry.ETag == "" {
+			t.Errorf("manifest entry %s has no etag", entry.Name)
+		}
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"a", "b"}) || response.Header.Get(replicationBootHeader) == "" {
+		t.Errorf("got manifest %v with boot %q, want a and b", names, response.Header.Get(replicationBootHeader))
+	}
+	if got := readBody(t, replica.storage, "a"); got != "body" {
+		t.Errorf("rejected requests changed a to %q", got)
+	}
+}
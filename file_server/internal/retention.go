@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// RetentionGovernance blocks overwrites and deletes, except by keys holding PermissionBypassGovernance on a server
+	// that allows bypassing.
+	RetentionGovernance = "governance"
+	// RetentionCompliance blocks overwrites and deletes by anyone. It can be extended but not shortened or removed.
+	RetentionCompliance = "compliance"
+
+	retentionModeHeader    = "X-FS-Retention-Mode"
+	retainUntilHeader      = "X-FS-Retain-Until"
+	legalHoldHeader        = "X-FS-Legal-Hold"
+	bypassGovernanceHeader = "X-FS-Bypass-Governance"
+	replicaRetentionHeader = "X-FS-Replication-Retention"
+)
+
+var (
+	ErrRetained = errors.New("file is under retention")
+	// ErrRetentionUnsupported is returned for files other processes wrote, which have no metadata to keep it in.
+	ErrRetentionUnsupported = errors.New("retention can only be set on files written through the file server")
+)
+
+type RetentionConfig struct {
+	// Lets keys holding PermissionBypassGovernance overwrite and delete files under governance retention by sending
+	// X-FS-Bypass-Governance: true. Off, governance retention binds everyone like compliance retention does.
+	GovernanceBypass bool
+}
+
+// Retention is a file's write-once settings, kept in its metadata. A file can't be overwritten or deleted while it's
+// under legal hold or before RetainUntil.
+type Retention struct {
+	Mode        string    `json:"mode,omitempty"` // governance or compliance, set with RetainUntil
+	RetainUntil time.Time `json:"retain_until"`
+	LegalHold   bool      `json:"legal_hold,omitempty"`
+}
+
+type retentionBypass int
+
+const (
+	bypassNone retentionBypass = iota
+	bypassGovernance
+	// bypassAll is for replicas, which apply whatever their primary already allowed.
+	bypassAll
+)
+
+type retentionBypassKey struct{}
+
+func withRetentionBypass(ctx context.Context, bypass retentionBypass) context.Context {
+	return context.WithValue(ctx, retentionBypassKey{}, bypass)
+}
+
+func retentionBypassFrom(ctx context.Context) retentionBypass {
+	bypass, _ := ctx.Value(retentionBypassKey{}).(retentionBypass)
+	return bypass
+}
+
+// validate checks r describes a consistent setting. Mode and RetainUntil go together.
+func (r *Retention) validate() error {
+	switch r.Mode {
+	case "":
+		if !r.RetainUntil.IsZero() {
+			return errors.New("retain until needs a retention mode")
+		}
+	case RetentionGovernance, RetentionCompliance:
+		if r.RetainUntil.IsZero() {
+			return fmt.Errorf("%s mode needs a retain until time", r.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown retention mode %q, must be %s or %s", r.Mode, RetentionGovernance, RetentionCompliance)
+	}
+	return nil
+}
+
+// retained reports whether RetainUntil hasn't passed yet.
+func (r *Retention) retained(now time.Time) bool {
+	return r != nil && r.Mode != "" && now.Before(r.RetainUntil)
+}
+
+// blocks returns why the file r belongs to can't be overwritten or deleted, nil if it can.
+func (r *Retention) blocks(now time.Time, bypass retentionBypass) error {
+	switch {
+	case r == nil || bypass == bypassAll:
+		return nil
+	case r.LegalHold:
+		return fmt.Errorf("%w: legal hold", ErrRetained)
+	case !r.retained(now):
+		return nil
+	case r.Mode == RetentionGovernance && bypass == bypassGovernance:
+		return nil
+	}
+	return fmt.Errorf("%w: %s mode until %s", ErrRetained, r.Mode, r.RetainUntil.Format(time.RFC3339))
+}
+
+// allowsChange returns why r can't be replaced by next, nil if it can.
+func (r *Retention) allowsChange(next *Retention, now time.Time, bypass retentionBypass) error {
+	if !r.retained(now) || bypass == bypassAll {
+		return nil
+	}
+	if r.Mode == RetentionGovernance && bypass == bypassGovernance {
+		return nil
+	}
+	extended := next != nil && !next.RetainUntil.Before(r.RetainUntil)
+	if extended && (next.Mode == RetentionCompliance || r.Mode == RetentionGovernance) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s mode until %s can only be extended", ErrRetained, r.Mode, r.RetainUntil.Format(time.RFC3339))
+}
+
+// loosens reports whether replacing r with next places or lifts a legal hold, or ends a retention period in force
+// sooner.
+func (r *Retention) loosens(next *Retention, now time.Time) bool {
+	if r.held() != next.held() {
+		return true
+	}
+	return r.retained(now) && (next == nil || next.RetainUntil.Before(r.RetainUntil))
+}
+
+func (r *Retention) held() bool {
+	return r != nil && r.LegalHold
+}
+
+func sameRetention(a *Retention, b *Retention) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Mode == b.Mode && a.RetainUntil.Equal(b.RetainUntil) && a.LegalHold == b.LegalHold
+}
+
+// checkRetention returns ErrRetained if meta's file can't be overwritten or deleted by the caller of ctx.
+func checkRetention(ctx context.Context, meta ObjectMeta) error {
+	return meta.Retention.blocks(time.Now(), retentionBypassFrom(ctx))
+}
+
+// governanceBypass marks ctx to bypass governance retention on fileName if the request asks to, the server allows it
+// and the caller holds PermissionBypassGovernance, or auth is off. Otherwise governance binds as usual.
+func (fs *FileServer) governanceBypass(ctx context.Context, requested string, fileName string) context.Context {
+	if bypass, _ := strconv.ParseBool(requested); !bypass || !fs.cfg.Retention.GovernanceBypass {
+		return ctx
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil && !principal.Allows(PermissionBypassGovernance, fileName) {
+		return ctx
+	}
+	return withRetentionBypass(ctx, bypassGovernance)
+}
+
+// authorizeRetention returns ErrForbidden if replacing current with next loosens it and the caller of ctx doesn't hold
+// PermissionManageRetention on fileName. Anyone may if auth is off.
+func authorizeRetention(ctx context.Context, fileName string, current *Retention, next *Retention) error {
+	if !current.loosens(next, time.Now()) {
+		return nil
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil && !principal.Allows(PermissionManageRetention, fileName) {
+		return fmt.Errorf("%w: legal holds and shortening retention need the %s permission", ErrForbidden, PermissionManageRetention)
+	}
+	return nil
+}
+
+// parseRetentionHeaders reads the retention to set on an upload, nil if the request sets none.
+func parseRetentionHeaders(header http.Header) (*Retention, error) {
+	mode, until, hold := header.Get(retentionModeHeader), header.Get(retainUntilHeader), header.Get(legalHoldHeader)
+	if mode == "" && until == "" && hold == "" {
+		return nil, nil
+	}
+	retention := &Retention{Mode: strings.ToLower(mode)}
+	if until != "" {
+		retainUntil, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time", retainUntilHeader)
+		}
+		retention.RetainUntil = retainUntil.UTC()
+	}
+	switch strings.ToLower(hold) {
+	case "", "off":
+	case "on":
+		retention.LegalHold = true
+	default:
+		return nil, fmt.Errorf("%s must be on or off", legalHoldHeader)
+	}
+	return retention, retention.validate()
+}
+
+// setRetentionHeaders describes meta's retention in response headers.
+func setRetentionHeaders(header http.Header, meta ObjectMeta) {
+	if meta.Retention == nil {
+		return
+	}
+	if meta.Retention.Mode != "" {
+		header.Set(retentionModeHeader, meta.Retention.Mode)
+		header.Set(retainUntilHeader, meta.Retention.RetainUntil.Format(time.RFC3339))
+	}
+	if meta.Retention.LegalHold {
+		header.Set(legalHoldHeader, "on")
+	}
+}
+
+// setRetention replaces fileName's retention under its in-process lock, and audits and publishes the change.
+func (fs *FileServer) setRetention(ctx context.Context, fileName string, retention *Retention) (ObjectMeta, uint64, error) {
+	fs.waitForOpenInProcess(ctx, fileName)
+	defer fs.removeInProcessLock(fileName)
+
+	meta, err := fs.storage.Stat(fileName)
+	if err != nil {
+		return meta, 0, err
+	}
+	if err := meta.Retention.allowsChange(retention, time.Now(), retentionBypassFrom(ctx)); err != nil {
+		return meta, 0, err
+	}
+	if err := authorizeRetention(ctx, fileName, meta.Retention, retention); err != nil {
+		return meta, 0, err
+	}
+
+	_, span := startSpan(ctx, "disk.set_retention", attribute.String("file.name", fileName))
+	updated, err := fs.storage.SetRetention(fileName, retention)
+	endSpan(span, err)
+	if err != nil {
+		return meta, 0, err
+	}
+	fs.audit(ctx, EventMetadata, meta, updated)
+
+	return updated, fs.publish(EventMetadata, updated, true), nil
+}
+
+// HandleGetRetention returns a file's retention settings as JSON.
+func (fs *FileServer) HandleGetRetention(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	meta, err := fs.statFile(request.Context(), params.ByName("filename"))
+	if errors.Is(err, ErrObjectNotFound) {
+		response.WriteHeader(http.StatusNotFound)
+		fs.WriteResponseBody(response, "File not found.")
+		return
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	fs.writeRetention(response, meta)
+}
+
+// HandlePutRetention replaces a file's retention settings with the JSON body.
+func (fs *FileServer) HandlePutRetention(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var retention Retention
+	if err := json.NewDecoder(request.Body).Decode(&retention); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("Invalid retention: %s", err))
+		return
+	}
+	if err := retention.validate(); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("Invalid retention: %s", err))
+		return
+	}
+	next := &retention
+	if retention == (Retention{}) {
+		next = nil
+	} else {
+		next.RetainUntil = next.RetainUntil.UTC()
+	}
+
+	fileName := params.ByName("filename")
+	ctx := fs.governanceBypass(request.Context(), request.Header.Get(bypassGovernanceHeader), fileName)
+	meta, replicated, err := fs.setRetention(ctx, fileName, next)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		response.WriteHeader(http.StatusNotFound)
+		fs.WriteResponseBody(response, "File not found.")
+		return
+	case errors.Is(err, ErrRetained):
+		fs.writeRetained(response, err)
+		return
+	case errors.Is(err, ErrForbidden):
+		fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+		response.WriteHeader(http.StatusForbidden)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	case errors.Is(err, ErrRetentionUnsupported):
+		response.WriteHeader(http.StatusConflict)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	case err != nil:
+		log.Errorf("Failed to set retention of %s: %+v", fileName, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	fs.awaitReplication(ctx, response, replicated)
+	fs.writeRetention(response, meta)
+}
+
+func (fs *FileServer) writeRetention(response http.ResponseWriter, meta ObjectMeta) {
+	retention := meta.Retention
+	if retention == nil {
+		retention = &Retention{}
+	}
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(retention); err != nil {
+		log.Errorf("Failed to write retention: %+v", err)
+	}
+}
+
+// writeRetained is the response for a write or delete blocked by retention.
+func (fs *FileServer) writeRetained(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusForbidden)
+	fs.WriteResponseBody(response, fmt.Sprintf("Forbidden, %s.", err))
+}
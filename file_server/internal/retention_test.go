@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetentionChangesNeedingPermission(t *testing.T) {
+	now := time.Now()
+	governance := &Retention{Mode: RetentionGovernance, RetainUntil: now.Add(time.Hour)}
+	expired := &Retention{Mode: RetentionGovernance, RetainUntil: now.Add(-time.Hour)}
+	held := &Retention{LegalHold: true}
+	cases := []struct {
+		name    string
+		current *Retention
+		next    *Retention
+		loosens bool
+	}{
+		{"set", nil, governance, false},
+		{"extend", governance, &Retention{Mode: RetentionGovernance, RetainUntil: now.Add(2 * time.Hour)}, false},
+		{"shorten", governance, &Retention{Mode: RetentionGovernance, RetainUntil: now.Add(time.Minute)}, true},
+		{"remove", governance, nil, true},
+		{"remove expired", expired, nil, false},
+		{"place hold", nil, held, true},
+		{"lift hold", held, &Retention{}, true},
+		{"keep hold", held, &Retention{LegalHold: true, Mode: RetentionCompliance, RetainUntil: now.Add(time.Hour)}, false},
+	}
+	writer := &Principal{KeyID: "writer", Permissions: []Permission{PermissionWrite}}
+	manager := &Principal{KeyID: "manager", Permissions: []Permission{PermissionWrite, PermissionManageRetention}}
+	for _, c := range cases {
+		if loosens := c.current.loosens(c.next, now); loosens != c.loosens {
+			t.Errorf("%s: loosens = %v, want %v", c.name, loosens, c.loosens)
+		}
+		err := authorizeRetention(withPrincipal(context.Background(), writer), "a", c.current, c.next)
+		if forbidden := errors.Is(err, ErrForbidden); forbidden != c.loosens {
+			t.Errorf("%s: write only key got %v", c.name, err)
+		}
+		if err := authorizeRetention(withPrincipal(context.Background(), manager), "a", c.current, c.next); err != nil {
+			t.Errorf("%s: key with %s got %v", c.name, PermissionManageRetention, err)
+		}
+	}
+}
+
+// Retention set on upload is journaled with the data, a crash can't leave the new version unretained.
+func TestCreateJournalsRetentionWithData(t *testing.T) {
+	storage, err := NewDiskStorage(testStorageConfig(t.TempDir()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+
+	retention := &Retention{LegalHold: true}
+	before := storage.index.Seq()
+	meta, err := storage.Create("a", bytes.NewReader([]byte("held")), CreateOptions{Retention: retention})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := storage.index.Seq() - before; records != 1 {
+		t.Errorf("create journaled %d records, want 1", records)
+	}
+	if !meta.Retention.held() {
+		t.Errorf("created %+v, want it held", meta)
+	}
+	if indexed, _ := storage.index.Get("a"); !indexed.Retention.held() {
+		t.Errorf("indexed %+v, want it held", indexed)
+	}
+}
@@ -0,0 +1,903 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// S3 requests are served path style under this prefix, e.g. PUT /s3/<bucket>/<key>.
+	s3PathPrefix = "/s3"
+	// An object's file name is its bucket, this separator and its escaped key, so a bucket is a top-level prefix of
+	// the file names the rest of the API sees. Bucket names can't contain it.
+	s3BucketSeparator = "~"
+	s3Namespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys         = 1000
+	s3MaxPartNumber   = 10000
+	s3TimeFormat      = "2006-01-02T15:04:05.000Z"
+	// Like X-FS-Bypass-Governance, for S3 clients.
+	s3BypassGovernanceHeader = "x-amz-bypass-governance-retention"
+
+	multipartDir    = "multipart"
+	multipartExpiry = 7 * 24 * time.Hour // Uploads neither completed nor aborted are removed after this long
+)
+
+type S3Config struct {
+	Enabled bool // Serve the S3 compatible API under /s3
+}
+
+var (
+	errBadDigest = errors.New("body does not match Content-MD5")
+
+	s3BucketPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	s3UploadIDFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	// S3 keys and WebDAV paths may contain slashes, file names can't. Both escape them the same way, so a key with
+	// slashes shows up as a file in folders over WebDAV.
+	slashEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	slashUnescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+)
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Namespace             string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName   xml.Name `xml:"InitiateMultipartUploadResult"`
+	Namespace string   `xml:"xmlns,attr"`
+	Bucket    string   `xml:"Bucket"`
+	Key       string   `xml:"Key"`
+	UploadID  string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName   xml.Name `xml:"CompleteMultipartUploadResult"`
+	Namespace string   `xml:"xmlns,attr"`
+	Location  string   `xml:"Location"`
+	Bucket    string   `xml:"Bucket"`
+	Key       string   `xml:"Key"`
+	ETag      string   `xml:"ETag"`
+}
+
+// multipartUpload is persisted in an upload's dir so uploads survive restarts.
+type multipartUpload struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+// multipartPartKey is kept beside a part stored encrypted, as <part>.key.
+type multipartPartKey struct {
+	Envelope *Envelope `json:"envelope"`
+	Size     int64     `json:"size"` // Of the part's plaintext
+}
+
+// s3ObjectName maps an S3 object to the file it's stored as.
+func s3ObjectName(bucket string, key string) string {
+	return bucket + s3BucketSeparator + slashEscaper.Replace(key)
+}
+
+// s3Key is the inverse of s3ObjectName for objects in bucket. ok is false for files outside it.
+func s3Key(bucket string, fileName string) (string, bool) {
+	escaped, found := strings.CutPrefix(fileName, bucket+s3BucketSeparator)
+	if !found {
+		return "", false
+	}
+	return slashUnescaper.Replace(escaped), true
+}
+
+// HandleS3 serves PutObject, GetObject, HeadObject, DeleteObject, ListObjectsV2 and multipart uploads.
+func (fs *FileServer) HandleS3(response http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	response.Header().Set("x-amz-request-id", newS3RequestID())
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(params.ByName("path"), "/"), "/")
+	query := request.URL.Query()
+
+	if bucket == "" {
+		fs.s3Fail(response, request, http.StatusNotImplemented, "NotImplemented", "Listing buckets is not supported.")
+		return
+	}
+	if !s3BucketPattern.MatchString(bucket) {
+		fs.s3Fail(response, request, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+		return
+	}
+
+	if key == "" {
+		switch {
+		case request.Method == http.MethodGet && query.Get("list-type") == "2":
+			fs.s3ListObjects(response, request, bucket)
+		case request.Method == http.MethodHead, request.Method == http.MethodPut && len(query) == 0:
+			// HeadBucket and CreateBucket. Any valid bucket name exists.
+			fs.metrics.s3Requests.Inc("bucket", "OK")
+			response.WriteHeader(http.StatusOK)
+		default:
+			fs.s3Fail(response, request, http.StatusNotImplemented, "NotImplemented", "This bucket operation is not supported.")
+		}
+		return
+	}
+
+	fileName := s3ObjectName(bucket, key)
+	if len(fileName) > 255 {
+		fs.s3Fail(response, request, http.StatusBadRequest, "KeyTooLongError", "Your key is too long.")
+		return
+	}
+	if request.Method != http.MethodGet && request.Method != http.MethodHead && fs.replica != nil {
+		fs.s3Fail(response, request, http.StatusMethodNotAllowed, "MethodNotAllowed",
+			fmt.Sprintf("This file server is a read-only replica, send writes to %s.", fs.cfg.Replication.PrimaryURL))
+		return
+	}
+
+	switch {
+	case request.Method == http.MethodPost && query.Has("uploads"):
+		fs.s3CreateMultipartUpload(response, request, bucket, key, fileName)
+	case request.Method == http.MethodPut && query.Has("uploadId"):
+		fs.s3UploadPart(response, request, bucket, key, fileName)
+	case request.Method == http.MethodPost && query.Has("uploadId"):
+		fs.s3CompleteMultipartUpload(response, request, bucket, key, fileName)
+	case request.Method == http.MethodDelete && query.Has("uploadId"):
+		fs.s3AbortMultipartUpload(response, request, bucket, key, fileName)
+	case len(query) > 0 && !query.Has("versionId") && !query.Has("x-id"):
+		// Sub-resources like ?acl or ?tagging.
+		fs.s3Fail(response, request, http.StatusNotImplemented, "NotImplemented", "This object operation is not supported.")
+	case request.Method == http.MethodPut && request.Header.Get("X-Amz-Copy-Source") != "":
+		fs.s3Fail(response, request, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported.")
+	case request.Method == http.MethodPut:
+		fs.s3PutObject(response, request, fileName)
+	case request.Method == http.MethodGet:
+		fs.s3GetObject(response, request, fileName)
+	case request.Method == http.MethodHead:
+		fs.s3HeadObject(response, request, fileName)
+	case request.Method == http.MethodDelete:
+		fs.s3DeleteObject(response, request, fileName)
+	default:
+		fs.s3Fail(response, request, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+func (fs *FileServer) s3PutObject(response http.ResponseWriter, request *http.Request, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionWrite, fileName, fs.putPriority(request))
+	if !ok {
+		return
+	}
+	defer release()
+	defer request.Body.Close()
+
+	// Stored as sent. S3 keeps Content-Encoding as metadata rather than decoding, which isn't supported here.
+	body := fs.s3Body(request)
+	ctx := fs.governanceBypass(request.Context(), request.Header.Get(s3BypassGovernanceHeader), fileName)
+	meta, replicated, err := fs.writeFile(ctx, fileName, body, request.ContentLength)
+	if err != nil {
+		fs.s3WriteFailed(response, request, fileName, err)
+		return
+	}
+	fs.awaitReplication(request.Context(), response, replicated)
+
+	fs.metrics.s3Requests.Inc("PutObject", "OK")
+	response.Header().Set("ETag", meta.S3ETag())
+	response.WriteHeader(http.StatusOK)
+}
+
+func (fs *FileServer) s3GetObject(response http.ResponseWriter, request *http.Request, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionRead, fileName, fs.getPriority(fileName))
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, meta, releaseFile, err := fs.openFile(request.Context(), fileName)
+	if errors.Is(err, ErrObjectNotFound) {
+		fs.s3Fail(response, request, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if err != nil {
+		log.Errorf("S3: failed to open %s: %+v", fileName, err)
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer releaseFile()
+	defer file.Close()
+
+	// Always served decoded, S3 clients don't negotiate encodings.
+	var body io.Reader = file
+	if meta.Encoding != EncodingIdentity {
+		decoder, err := newDecoder(meta.Encoding, file)
+		if err != nil {
+			log.Errorf("S3: failed to decode %s: %+v", fileName, err)
+			fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+
+	start, length, partial, ok := parseByteRange(request.Header.Get("Range"), meta.Size)
+	if !ok {
+		response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+		fs.s3Fail(response, request, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable.")
+		return
+	}
+	if start > 0 {
+		seeker, seekable := body.(io.Seeker)
+		if seekable {
+			_, err = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, body, start)
+		}
+		if err != nil {
+			log.Errorf("S3: failed to skip to offset %d of %s: %+v", start, fileName, err)
+			fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+	}
+
+	s3ObjectHeaders(response, meta)
+	response.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		response.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, meta.Size))
+		status = http.StatusPartialContent
+	}
+	response.WriteHeader(status)
+	fs.metrics.s3Requests.Inc("GetObject", "OK")
+
+	// Headers are out, a failure from here on can only cut the response short.
+	if written, err := io.CopyN(response, body, length); err != nil {
+		log.Errorf("S3: get of %s failed after %d of %d bytes: %+v", fileName, written, length, err)
+	}
+}
+
+func (fs *FileServer) s3HeadObject(response http.ResponseWriter, request *http.Request, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionRead, fileName, PriorityHigh)
+	if !ok {
+		return
+	}
+	defer release()
+
+	meta, err := fs.statFile(request.Context(), fileName)
+	if errors.Is(err, ErrObjectNotFound) {
+		fs.s3Fail(response, request, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if err != nil {
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	s3ObjectHeaders(response, meta)
+	response.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	fs.metrics.s3Requests.Inc("HeadObject", "OK")
+	response.WriteHeader(http.StatusOK)
+}
+
+func (fs *FileServer) s3DeleteObject(response http.ResponseWriter, request *http.Request, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionDelete, fileName, PriorityHigh)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx := fs.governanceBypass(request.Context(), request.Header.Get(s3BypassGovernanceHeader), fileName)
+	_, replicated, err := fs.deleteFile(ctx, fileName)
+	if errors.Is(err, ErrRetained) {
+		fs.s3Fail(response, request, http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock.")
+		return
+	}
+	if err != nil {
+		log.Errorf("S3: failed to delete %s: %+v", fileName, err)
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	fs.awaitReplication(request.Context(), response, replicated)
+
+	// Deleting a key that doesn't exist succeeds too.
+	fs.metrics.s3Requests.Inc("DeleteObject", "OK")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (fs *FileServer) s3ListObjects(response http.ResponseWriter, request *http.Request, bucket string) {
+	query := request.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	request, release, ok := fs.s3Begin(response, request, PermissionRead, s3ObjectName(bucket, prefix), PriorityNormal)
+	if !ok {
+		return
+	}
+	defer release()
+
+	maxKeys := s3MaxKeys
+	if raw := query.Get("max-keys"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			fs.s3Fail(response, request, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer.")
+			return
+		}
+		maxKeys = min(parsed, s3MaxKeys)
+	}
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			fs.s3Fail(response, request, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect.")
+			return
+		}
+		after = string(decoded)
+	}
+
+	objects, err := fs.storage.List()
+	if err != nil {
+		log.Errorf("S3: failed to list %s: %+v", bucket, err)
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	keys := make(map[string]ObjectMeta)
+	for _, meta := range objects {
+		if key, ok := s3Key(bucket, meta.Name); ok && strings.HasPrefix(key, prefix) {
+			keys[key] = meta
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	encode := func(value string) string { return value }
+	result := s3ListBucketResult{
+		Namespace:         s3Namespace,
+		Name:              bucket,
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+		result.EncodingType = "url"
+	}
+	result.Prefix, result.Delimiter, result.StartAfter = encode(prefix), encode(delimiter), encode(query.Get("start-after"))
+
+	last := ""
+	for _, key := range sorted {
+		// Keys under a common prefix roll up into it, so they're listed once.
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+		} else {
+			meta := keys[key]
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(key),
+				LastModified: meta.ModTime.UTC().Format(s3TimeFormat),
+				ETag:         meta.S3ETag(),
+				Size:         meta.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		last = entry
+		result.KeyCount++
+	}
+
+	fs.metrics.s3Requests.Inc("ListObjectsV2", "OK")
+	fs.s3WriteXML(response, http.StatusOK, result)
+}
+
+func (fs *FileServer) s3CreateMultipartUpload(response http.ResponseWriter, request *http.Request, bucket string, key string, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionWrite, fileName, PriorityNormal)
+	if !ok {
+		return
+	}
+	defer release()
+
+	fs.expireMultipartUploads()
+	uploadID := newMultipartUploadID()
+	dir := fs.multipartDir(uploadID)
+	data, err := json.Marshal(multipartUpload{Bucket: bucket, Key: key, Initiated: time.Now().UTC()})
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, "upload.json"), dir, data)
+	}
+	if err != nil {
+		log.Errorf("S3: failed to create multipart upload for %s: %+v", fileName, err)
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	fs.metrics.s3Requests.Inc("CreateMultipartUpload", "OK")
+	fs.s3WriteXML(response, http.StatusOK, s3InitiateMultipartUploadResult{Namespace: s3Namespace, Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+// s3UploadPart stores a part as <part number>-<md5>.part in the upload's dir, so parts are found by their ETags.
+func (fs *FileServer) s3UploadPart(response http.ResponseWriter, request *http.Request, bucket string, key string, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionWrite, fileName, fs.putPriority(request))
+	if !ok {
+		return
+	}
+	defer release()
+	defer request.Body.Close()
+
+	partNumber, err := strconv.Atoi(request.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		fs.s3Fail(response, request, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000.")
+		return
+	}
+	dir, ok := fs.s3Upload(response, request, bucket, key)
+	if !ok {
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	digest := md5.New()
+	var dst io.Writer = tmp
+	var encrypter io.WriteCloser
+	var envelope *Envelope
+	if fs.keyring.Encrypting() {
+		encrypter, envelope, err = fs.keyring.NewWriter(tmp)
+		dst = encrypter
+	}
+	var size int64
+	if err == nil {
+		size, err = io.Copy(io.MultiWriter(dst, digest), fs.s3Body(request))
+	}
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	etag := hex.EncodeToString(digest.Sum(nil))
+	partPath := filepath.Join(dir, fmt.Sprintf("%05d-%s.part", partNumber, etag))
+	if err == nil && envelope != nil {
+		// The key goes first, a part is never in place without the key to read it.
+		var data []byte
+		if data, err = json.Marshal(multipartPartKey{Envelope: envelope, Size: size}); err == nil {
+			err = writeFileAtomic(partPath+".key", dir, data)
+		}
+	} else if err == nil {
+		// Left by an encrypted upload of the same part.
+		err = os.Remove(partPath + ".key")
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), partPath)
+	}
+	if err != nil {
+		fs.s3WriteFailed(response, request, fileName, err)
+		return
+	}
+
+	fs.metrics.s3Requests.Inc("UploadPart", "OK")
+	response.Header().Set("ETag", `"`+etag+`"`)
+	response.WriteHeader(http.StatusOK)
+}
+
+func (fs *FileServer) s3CompleteMultipartUpload(response http.ResponseWriter, request *http.Request, bucket string, key string, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionWrite, fileName, PriorityLow)
+	if !ok {
+		return
+	}
+	defer release()
+	defer request.Body.Close()
+
+	dir, ok := fs.s3Upload(response, request, bucket, key)
+	if !ok {
+		return
+	}
+	var complete s3CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(fs.s3Body(request), 1<<20)).Decode(&complete); err != nil || len(complete.Parts) == 0 {
+		fs.s3Fail(response, request, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+
+	// The upload's ETag is the MD5 of its parts' MD5s, suffixed with the number of parts, as S3 computes it.
+	var parts []io.Reader
+	var size int64
+	digests := md5.New()
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			fs.s3Fail(response, request, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+			return
+		}
+		etag := strings.Trim(part.ETag, `"`)
+		partPath := filepath.Join(dir, fmt.Sprintf("%05d-%s.part", part.PartNumber, etag))
+		digest, err := hex.DecodeString(etag)
+		var file *os.File
+		if err == nil {
+			file, err = os.Open(partPath)
+		}
+		if err != nil {
+			fs.s3Fail(response, request, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d with ETag %s was not uploaded.", part.PartNumber, part.ETag))
+			return
+		}
+		defer file.Close()
+		body, partSize, err := fs.openMultipartPart(file, partPath)
+		if err != nil {
+			log.Errorf("S3: failed to read part %s: %+v", partPath, err)
+			fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		size += partSize
+		parts = append(parts, body)
+		digests.Write(digest)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), len(complete.Parts))
+
+	ctx := fs.governanceBypass(request.Context(), request.Header.Get(s3BypassGovernanceHeader), fileName)
+	meta, replicated, err := fs.writeFileWith(ctx, fileName, &lengthVerifier{Reader: io.MultiReader(parts...), expected: size}, size, CreateOptions{MD5: etag})
+	if err != nil {
+		fs.s3WriteFailed(response, request, fileName, err)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("S3: failed to clean up completed upload %s: %+v", dir, err)
+	}
+	fs.awaitReplication(request.Context(), response, replicated)
+
+	fs.metrics.s3Requests.Inc("CompleteMultipartUpload", "OK")
+	fs.s3WriteXML(response, http.StatusOK, s3CompleteMultipartUploadResult{
+		Namespace: s3Namespace,
+		Location:  s3PathPrefix + "/" + bucket + "/" + key,
+		Bucket:    bucket,
+		Key:       key,
+		ETag:      meta.S3ETag(),
+	})
+}
+
+// openMultipartPart returns the part's plaintext and its size, decrypting it if it was stored encrypted.
+func (fs *FileServer) openMultipartPart(file *os.File, partPath string) (io.Reader, int64, error) {
+	data, err := os.ReadFile(partPath + ".key")
+	if errors.Is(err, os.ErrNotExist) {
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		return file, stat.Size(), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var key multipartPartKey
+	if err := json.Unmarshal(data, &key); err != nil || key.Envelope == nil {
+		return nil, 0, fmt.Errorf("malformed part key %s.key", partPath)
+	}
+	body, err := fs.keyring.NewReader(file, key.Envelope)
+	return body, key.Size, err
+}
+
+func (fs *FileServer) s3AbortMultipartUpload(response http.ResponseWriter, request *http.Request, bucket string, key string, fileName string) {
+	request, release, ok := fs.s3Begin(response, request, PermissionWrite, fileName, PriorityHigh)
+	if !ok {
+		return
+	}
+	defer release()
+
+	dir, ok := fs.s3Upload(response, request, bucket, key)
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	fs.metrics.s3Requests.Inc("AbortMultipartUpload", "OK")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// s3Upload returns the dir of the upload named by the uploadId param, failing with NoSuchUpload unless it's an
+// upload of bucket and key.
+func (fs *FileServer) s3Upload(response http.ResponseWriter, request *http.Request, bucket string, key string) (string, bool) {
+	uploadID := request.URL.Query().Get("uploadId")
+	if s3UploadIDFormat.MatchString(uploadID) {
+		dir := fs.multipartDir(uploadID)
+		var upload multipartUpload
+		data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+		if err == nil && json.Unmarshal(data, &upload) == nil && upload.Bucket == bucket && upload.Key == key {
+			return dir, true
+		}
+	}
+	fs.s3Fail(response, request, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+	return "", false
+}
+
+func (fs *FileServer) multipartDir(uploadID string) string {
+	return filepath.Join(fs.cfg.Storage.DataDir, reservedDir, multipartDir, uploadID)
+}
+
+// expireMultipartUploads removes uploads started more than multipartExpiry ago.
+func (fs *FileServer) expireMultipartUploads() {
+	root := filepath.Join(fs.cfg.Storage.DataDir, reservedDir, multipartDir)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < multipartExpiry {
+			continue
+		}
+		log.Infof("S3: removing multipart upload %s, started %s", entry.Name(), info.ModTime())
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			log.Errorf("S3: failed to remove expired multipart upload %s: %+v", entry.Name(), err)
+		}
+	}
+}
+
+// s3Begin authorizes the request for permission on fileName, then takes a connection slot the same way the rest of
+// the API does. release gives the slot back. Failures have been answered with an S3 error when ok is false.
+func (fs *FileServer) s3Begin(response http.ResponseWriter, request *http.Request, permission Permission, fileName string, priority Priority) (*http.Request, func(), bool) {
+	if len(fs.authenticators) > 0 {
+		if strings.HasPrefix(request.Header.Get("Authorization"), sigV4Algorithm) && request.Header.Get(amzContentHashHeader) == "" && request.ContentLength != 0 {
+			fs.s3Fail(response, request, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+			return request, nil, false
+		}
+		principal, err := fs.authenticate(request)
+		if err != nil {
+			fs.metrics.authFailures.Inc(authFailureReason(err))
+			switch {
+			case errors.Is(err, ErrSignatureMismatch):
+				fs.s3Fail(response, request, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+			case errors.Is(err, ErrClockSkew):
+				fs.s3Fail(response, request, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
+			case errors.Is(err, ErrNoCredentials):
+				fs.s3Fail(response, request, http.StatusForbidden, "AccessDenied", "Access Denied")
+			default:
+				fs.s3Fail(response, request, http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records.")
+			}
+			return request, nil, false
+		}
+		if !principal.Allows(permission, fileName) {
+			fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+			fs.s3Fail(response, request, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return request, nil, false
+		}
+		request = request.WithContext(withPrincipal(request.Context(), principal))
+	}
+
+	ctx := request.Context()
+	client, retryAfter, err := fs.admit(ctx, request, priority)
+	if err != nil {
+		fs.admission.WriteRateLimitHeaders(response, retryAfter)
+		fs.s3Fail(response, request, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return request, nil, false
+	}
+	acquiredAt := time.Now()
+	fs.SimulateLatency(ctx)
+	return request, func() { fs.releaseConnection(client, acquiredAt) }, true
+}
+
+// s3Body returns the request's payload: decoded from aws-chunked encoding if it wasn't already while authenticating,
+// checked against Content-MD5 if one was sent, and failing its last read with ErrShortBody if it's truncated.
+func (fs *FileServer) s3Body(request *http.Request) io.Reader {
+	if strings.HasPrefix(request.Header.Get(amzContentHashHeader), streamingPayloadPrefix) {
+		setAWSChunkedBody(request, nil)
+	}
+	var body io.Reader = &lengthVerifier{Reader: request.Body, expected: request.ContentLength}
+	if contentMD5 := request.Header.Get("Content-MD5"); contentMD5 != "" {
+		body = &digestVerifier{Reader: body, hash: md5.New(), expected: contentMD5}
+	}
+	return body
+}
+
+func (fs *FileServer) s3WriteFailed(response http.ResponseWriter, request *http.Request, fileName string, err error) {
+	switch {
+	case errors.Is(err, ErrRetained):
+		fs.s3Fail(response, request, http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock.")
+	case errors.Is(err, ErrSignatureMismatch):
+		fs.metrics.authFailures.Inc(authFailureReason(err))
+		fs.s3Fail(response, request, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+	case errors.Is(err, errBadDigest):
+		fs.s3Fail(response, request, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+	case errors.Is(err, ErrShortBody), errors.Is(err, ErrMalformedChunk), errors.Is(err, io.ErrUnexpectedEOF):
+		fs.s3Fail(response, request, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+	default:
+		log.Errorf("S3: failed to write %s: %+v", fileName, err)
+		fs.s3Fail(response, request, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+func (fs *FileServer) s3Fail(response http.ResponseWriter, request *http.Request, status int, code string, message string) {
+	fs.metrics.s3Requests.Inc(s3Operation(request), code)
+	if request.Method == http.MethodHead {
+		response.WriteHeader(status)
+		return
+	}
+	fs.s3WriteXML(response, status, s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  request.URL.Path,
+		RequestID: response.Header().Get("x-amz-request-id"),
+	})
+}
+
+func (fs *FileServer) s3WriteXML(response http.ResponseWriter, status int, body any) {
+	response.Header().Set("Content-Type", "application/xml")
+	response.WriteHeader(status)
+	fs.WriteResponseBody(response, xml.Header)
+	if err := xml.NewEncoder(response).Encode(body); err != nil {
+		log.Errorf("S3: failed to write response: %+v", err)
+	}
+}
+
+// s3Operation names the operation a request is for, as the metrics label failures are counted under.
+func s3Operation(request *http.Request) string {
+	query := request.URL.Query()
+	_, key, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, s3PathPrefix), "/"), "/")
+	switch {
+	case key == "":
+		return "bucket"
+	case query.Has("uploads"):
+		return "CreateMultipartUpload"
+	case query.Has("uploadId") && request.Method == http.MethodPut:
+		return "UploadPart"
+	case query.Has("uploadId") && request.Method == http.MethodPost:
+		return "CompleteMultipartUpload"
+	case query.Has("uploadId") && request.Method == http.MethodDelete:
+		return "AbortMultipartUpload"
+	case request.Method == http.MethodPut:
+		return "PutObject"
+	case request.Method == http.MethodGet:
+		return "GetObject"
+	case request.Method == http.MethodHead:
+		return "HeadObject"
+	case request.Method == http.MethodDelete:
+		return "DeleteObject"
+	}
+	return "other"
+}
+
+func s3ObjectHeaders(response http.ResponseWriter, meta ObjectMeta) {
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+	response.Header().Set("Accept-Ranges", "bytes")
+	if etag := meta.S3ETag(); etag != "" {
+		response.Header().Set("ETag", etag)
+	}
+	if retention := meta.Retention; retention != nil {
+		if retention.Mode != "" {
+			response.Header().Set("x-amz-object-lock-mode", strings.ToUpper(retention.Mode))
+			response.Header().Set("x-amz-object-lock-retain-until-date", retention.RetainUntil.Format(time.RFC3339))
+		}
+		if retention.LegalHold {
+			response.Header().Set("x-amz-object-lock-legal-hold", "ON")
+		}
+	}
+}
+
+// parseByteRange parses a single range Range header against an object of size bytes. partial is false if there's no
+// header, ok is false if it can't be satisfied.
+func parseByteRange(header string, size int64) (start int64, length int64, partial bool, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if header == "" || !found || strings.Contains(spec, ",") {
+		// No range, or one S3 would ignore too.
+		return 0, size, false, true
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	switch {
+	case first == "":
+		// Suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	default:
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 || start >= size {
+			return 0, 0, false, false
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return 0, 0, false, false
+			}
+			end = min(end, size-1)
+		}
+		return start, end - start + 1, true, true
+	}
+}
+
+// digestVerifier fails the final read of a body whose digest doesn't match the base64 encoded expected one.
+type digestVerifier struct {
+	io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && base64.StdEncoding.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return n, errBadDigest
+	}
+	return n, err
+}
+
+func newS3RequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+func newMultipartUploadID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
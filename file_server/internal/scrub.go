@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+type ScrubConfig struct {
+	Interval        time.Duration // How often the scrubber runs. 0 disables background runs, POST /admin/scrub still works.
+	VerifyChecksums bool          // Read every file back and compare it with the checksum taken on write
+	Quarantine      bool          // Move corrupt files to .fileserver/quarantine instead of only reporting them
+	WarmUpLimit     int           // Most unindexed files indexed at startup. 0 disables the warm-up.
+}
+
+type CorruptObject struct {
+	Name          string `json:"name"`
+	Error         string `json:"error"`
+	QuarantinedTo string `json:"quarantined_to,omitempty"`
+}
+
+// ScrubReport describes one scrubber run.
+type ScrubReport struct {
+	StartedAt      time.Time       `json:"started_at"`
+	Duration       string          `json:"duration"`
+	Objects        int             `json:"objects"`
+	Verified       int             `json:"verified"`
+	DroppedIndex   []string        `json:"dropped_from_index"` // Indexed but gone from disk
+	Corrupt        []CorruptObject `json:"corrupt"`
+	QuarantineMode bool            `json:"quarantine"`
+}
+
+// scrubber serializes runs and keeps the latest report.
+type scrubber struct {
+	running sync.Mutex
+	mutex   sync.Mutex
+	last    *ScrubReport
+}
+
+func (s *scrubber) lastReport() *ScrubReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last
+}
+
+// warmUp indexes files already on disk that the index doesn't describe, so their first reads don't each have to catch
+// the index up to find out they aren't in it.
+func (fs *FileServer) warmUp() {
+	start := time.Now()
+	adopted, err := fs.storage.Adopt(fs.cfg.Scrub.WarmUpLimit)
+	fs.metrics.scrubReconciled.Add(float64(len(adopted)), "index_added")
+	if err != nil {
+		log.Errorf("Warm-up failed after indexing %d files: %+v", len(adopted), err)
+		return
+	}
+	if len(adopted) >= fs.cfg.Scrub.WarmUpLimit {
+		log.Warnf("Warm-up stopped at its limit of %d files, the rest are served unindexed", fs.cfg.Scrub.WarmUpLimit)
+	}
+	log.Infof("Warmed up the index with %d unindexed files in %s", len(adopted), time.Since(start))
+}
+
+func (fs *FileServer) scrubEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := fs.Scrub(context.Background()); err != nil {
+			log.Errorf("Scrub failed: %+v", err)
+		}
+	}
+}
+
+// Scrub reconciles the storage index with what is on disk and, if configured, verifies every file's checksum. Only one
+// scrub runs at a time, a second caller waits for the first to finish.
+func (fs *FileServer) Scrub(ctx context.Context) (*ScrubReport, error) {
+	fs.scrubber.running.Lock()
+	defer fs.scrubber.running.Unlock()
+
+	ctx, span := startSpan(ctx, "fileserver.scrub")
+	report := &ScrubReport{StartedAt: time.Now().UTC(), QuarantineMode: fs.cfg.Scrub.Quarantine}
+	err := fs.scrub(ctx, report)
+	endSpan(span, err)
+	report.Duration = time.Since(report.StartedAt).String()
+
+	fs.metrics.scrubRuns.Inc()
+	fs.scrubber.mutex.Lock()
+	fs.scrubber.last = report
+	fs.scrubber.mutex.Unlock()
+
+	if len(report.Corrupt) > 0 || len(report.DroppedIndex) > 0 {
+		log.Warnf("Scrub found %d corrupt files and dropped %d index entries", len(report.Corrupt), len(report.DroppedIndex))
+	}
+	return report, err
+}
+
+func (fs *FileServer) scrub(ctx context.Context, report *ScrubReport) error {
+	dropped, err := fs.storage.Reconcile()
+	report.DroppedIndex = dropped
+	fs.metrics.scrubReconciled.Add(float64(len(dropped)), "index_dropped")
+	if err != nil {
+		return err
+	}
+
+	objects, err := fs.storage.List()
+	if err != nil {
+		return err
+	}
+	report.Objects = len(objects)
+
+	if !fs.cfg.Scrub.VerifyChecksums {
+		return nil
+	}
+	for _, meta := range objects {
+		if meta.Checksum == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		corrupt := fs.scrubObject(ctx, meta.Name)
+		if corrupt != nil {
+			report.Corrupt = append(report.Corrupt, *corrupt)
+		}
+		if corrupt != nil && corrupt.QuarantinedTo != "" {
+			fs.audit(ctx, AuditQuarantine, meta, ObjectMeta{})
+			fs.publish(EventDelete, ObjectMeta{Name: meta.Name}, false)
+		}
+		report.Verified++
+	}
+	return nil
+}
+
+// scrubObject verifies one file while holding its in-process lock, so a concurrent PUT can't be mistaken for rot.
+func (fs *FileServer) scrubObject(ctx context.Context, name string) *CorruptObject {
+	fs.waitForOpenInProcess(ctx, name)
+	defer fs.removeInProcessLock(name)
+
+	err := fs.storage.Verify(name)
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	fs.metrics.scrubCorrupt.Inc()
+	log.Errorf("Scrub: %s failed verification: %+v", name, err)
+
+	corrupt := &CorruptObject{Name: name, Error: err.Error()}
+	if !fs.cfg.Scrub.Quarantine || !errors.Is(err, ErrChecksumMismatch) {
+		return corrupt
+	}
+
+	target, err := fs.storage.Quarantine(name)
+	if err != nil {
+		log.Errorf("Scrub: failed to quarantine %s: %+v", name, err)
+		return corrupt
+	}
+	corrupt.QuarantinedTo = target
+	fs.metrics.scrubQuarantined.Inc()
+	log.Warnf("Scrub: quarantined %s to %s", name, target)
+	return corrupt
+}
+
+// HandleScrubReport returns the latest scrub report, 404 if none has run yet.
+func (fs *FileServer) HandleScrubReport(response http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	report := fs.scrubber.lastReport()
+	if report == nil {
+		response.WriteHeader(http.StatusNotFound)
+		fs.WriteResponseBody(response, "No scrub has run yet.")
+		return
+	}
+	fs.writeScrubReport(response, report)
+}
+
+// HandleScrub runs a scrub now and returns its report.
+func (fs *FileServer) HandleScrub(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	report, err := fs.Scrub(request.Context())
+	if err != nil {
+		log.Errorf("Scrub failed: %+v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+	fs.writeScrubReport(response, report)
+}
+
+func (fs *FileServer) writeScrubReport(response http.ResponseWriter, report *ScrubReport) {
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Errorf("Failed to write scrub report: %+v", err)
+	}
+}
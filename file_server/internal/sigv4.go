@@ -0,0 +1,310 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm         = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm    = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4ScopeTerminator   = "aws4_request"
+	amzDateHeader          = "X-Amz-Date"
+	amzContentHashHeader   = "X-Amz-Content-Sha256"
+	amzDecodedLengthHeader = "X-Amz-Decoded-Content-Length"
+
+	// Payload hashes of bodies sent in aws-chunked encoding, as S3 SDKs do for uploads. Only this one has signed
+	// chunks, the others, e.g. STREAMING-UNSIGNED-PAYLOAD-TRAILER, at most a trailing checksum.
+	streamingPayloadPrefix = "STREAMING-"
+	streamingSignedPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var ErrMalformedChunk = errors.New("malformed aws-chunked body")
+
+// SigV4Authenticator verifies requests signed with AWS Signature Version 4, so S3 SDKs and tools can authenticate
+// with a key's id as the access key id and its secret as the secret access key. Any region is accepted.
+type SigV4Authenticator struct {
+	keys         map[string]APIKey
+	maxClockSkew time.Duration
+	now          func() time.Time
+}
+
+func NewSigV4Authenticator(keys []APIKey, maxClockSkew time.Duration) *SigV4Authenticator {
+	byID := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+	return &SigV4Authenticator{keys: byID, maxClockSkew: maxClockSkew, now: time.Now}
+}
+
+func (a *SigV4Authenticator) Authenticate(request *http.Request) (*Principal, error) {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, sigV4Algorithm+" ") {
+		return nil, ErrNoCredentials
+	}
+
+	// Credential=<key id>/<yyyymmdd>/<region>/<service>/aws4_request
+	fields := parseAuthorizationFields(strings.TrimPrefix(authorization, sigV4Algorithm+" "))
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[4] != sigV4ScopeTerminator || fields["Signature"] == "" || fields["SignedHeaders"] == "" {
+		return nil, ErrInvalidCredentials
+	}
+	key, ok := a.keys[credential[0]]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	date, err := time.Parse(hmacDateFormat, request.Header.Get(amzDateHeader))
+	if err != nil || credential[1] != date.Format("20060102") {
+		return nil, ErrInvalidCredentials
+	}
+	skew := a.now().Sub(date)
+	if skew > a.maxClockSkew || skew < -a.maxClockSkew {
+		return nil, ErrClockSkew
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !containsString(signedHeaders, "host") {
+		return nil, ErrInvalidCredentials
+	}
+	// Without the header the signature covers the body's hash, which isn't known until it's read. Only empty bodies
+	// can be verified that way, S3 clients send the header whenever there's a body.
+	payloadHash := request.Header.Get(amzContentHashHeader)
+	if payloadHash == "" {
+		if request.ContentLength != 0 {
+			return nil, ErrInvalidCredentials
+		}
+		payloadHash = emptySHA256
+	}
+
+	scope := strings.Join(credential[1:], "/")
+	signingKey := sigV4SigningKey(key.Secret, credential[1], credential[2], credential[3])
+	canonicalHash := sha256.Sum256([]byte(sigV4CanonicalRequest(request, signedHeaders, payloadHash)))
+	stringToSign := strings.Join([]string{sigV4Algorithm, date.Format(hmacDateFormat), scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+	expected := hmacSHA256(signingKey, []byte(stringToSign))
+	provided, err := hex.DecodeString(fields["Signature"])
+	if err != nil || !hmac.Equal(expected, provided) {
+		return nil, ErrSignatureMismatch
+	}
+
+	switch {
+	case payloadHash == unsignedPayload:
+	case payloadHash == streamingSignedPayload:
+		// Each chunk is signed with the previous chunk's signature, starting from the request's.
+		chain := &chunkSignatureChain{key: signingKey, date: date.Format(hmacDateFormat), scope: scope, previous: fields["Signature"]}
+		setAWSChunkedBody(request, chain)
+	case strings.HasPrefix(payloadHash, streamingPayloadPrefix):
+		// Unsigned chunks, covered by a trailing checksum at most. Like UNSIGNED-PAYLOAD, the body isn't verified.
+		setAWSChunkedBody(request, nil)
+	default:
+		request.Body = &payloadVerifier{ReadCloser: request.Body, hash: sha256.New(), expected: payloadHash}
+	}
+	return principalFor(key), nil
+}
+
+func sigV4SigningKey(secret string, date string, region string, service string) []byte {
+	dateKey := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	regionKey := hmacSHA256(dateKey, []byte(region))
+	serviceKey := hmacSHA256(regionKey, []byte(service))
+	return hmacSHA256(serviceKey, []byte(sigV4ScopeTerminator))
+}
+
+func sigV4CanonicalRequest(request *http.Request, signedHeaders []string, payloadHash string) string {
+	sorted := append([]string(nil), signedHeaders...)
+	sort.Strings(sorted)
+
+	var headers strings.Builder
+	for _, name := range sorted {
+		value := strings.Join(request.Header.Values(name), ",")
+		switch {
+		case name == "host":
+			value = request.Host
+		case name == "content-length" && value == "":
+			value = strconv.FormatInt(request.ContentLength, 10)
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	path := request.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var query []string
+	for name, values := range request.URL.Query() {
+		for _, value := range values {
+			query = append(query, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(query)
+
+	return strings.Join([]string{
+		request.Method,
+		awsURIEncode(path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(sorted, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and slashes unless encodeSlash is set.
+func awsURIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			encoded.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// setAWSChunkedBody replaces request's body with its decoded payload, verifying chunk signatures against chain if
+// it's set. Content-Length becomes the decoded length.
+func setAWSChunkedBody(request *http.Request, chain *chunkSignatureChain) {
+	if _, ok := request.Body.(*awsChunkedReader); ok {
+		return
+	}
+	request.Body = &awsChunkedReader{reader: bufio.NewReader(request.Body), closer: request.Body, chain: chain}
+	request.ContentLength = -1
+	if decodedLength, err := strconv.ParseInt(request.Header.Get(amzDecodedLengthHeader), 10, 64); err == nil {
+		request.ContentLength = decodedLength
+	}
+}
+
+type chunkSignatureChain struct {
+	key      []byte
+	date     string
+	scope    string
+	previous string
+}
+
+func (c *chunkSignatureChain) verify(chunkHash []byte, signature string) bool {
+	stringToSign := strings.Join([]string{sigV4ChunkAlgorithm, c.date, c.scope, c.previous, emptySHA256, hex.EncodeToString(chunkHash)}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(c.key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	c.previous = signature
+	return true
+}
+
+// awsChunkedReader decodes an aws-chunked body: chunks of "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n", ending
+// with a zero size chunk and optional trailer headers.
+type awsChunkedReader struct {
+	reader    *bufio.Reader
+	closer    io.Closer
+	chain     *chunkSignatureChain
+	remaining int64
+	signature string
+	hash      hash.Hash
+	err       error
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining == 0 {
+		if r.hash != nil {
+			// End of a chunk with data, its signature covers what was just read.
+			if r.err = r.endChunk(); r.err != nil {
+				return 0, r.err
+			}
+		}
+		if r.err = r.startChunk(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *awsChunkedReader) startChunk() error {
+	line, err := r.readLine()
+	if err != nil {
+		// Ended before the final chunk.
+		return ErrMalformedChunk
+	}
+	sizeField, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return ErrMalformedChunk
+	}
+	r.signature = strings.TrimPrefix(extension, "chunk-signature=")
+	r.remaining, r.hash = size, sha256.New()
+	if size > 0 {
+		return nil
+	}
+
+	// The final chunk, followed by optional trailers and an empty line.
+	if r.chain != nil && !r.chain.verify(r.hash.Sum(nil), r.signature) {
+		return ErrSignatureMismatch
+	}
+	for {
+		line, err := r.readLine()
+		if err == io.EOF && line == "" {
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+func (r *awsChunkedReader) endChunk() error {
+	if line, err := r.readLine(); err != nil || line != "" {
+		return ErrMalformedChunk
+	}
+	if r.chain != nil && !r.chain.verify(r.hash.Sum(nil), r.signature) {
+		return ErrSignatureMismatch
+	}
+	r.hash = nil
+	return nil
+}
+
+func (r *awsChunkedReader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil && !(err == io.EOF && line == "") {
+		return "", ErrMalformedChunk
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (r *awsChunkedReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SnapshotFormatTar     = "tar"
+	SnapshotFormatTarZstd = "tar.zst"
+
+	snapshotDir          = "snapshots"
+	snapshotManifestName = "manifest.json"
+	snapshotFilesDir     = "files/"
+	snapshotVersion      = 1
+	snapshotTimeFormat   = "20060102T150405Z"
+
+	// Snapshot dirs older than this are assumed to be left over from a crash. Generous, a large archive can take a
+	// while to stream.
+	staleSnapshotAge = 24 * time.Hour
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// SnapshotManifest is the first entry of a snapshot archive.
+type SnapshotManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile describes a file in a snapshot archive. The archive holds its original bytes, decoded and decrypted,
+// so it can be restored whatever the storage settings are.
+type SnapshotFile struct {
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	SHA256    string     `json:"sha256"`
+	ModTime   time.Time  `json:"mod_time"`
+	Retention *Retention `json:"retention,omitempty"`
+	MD5       string     `json:"md5,omitempty"` // As recorded, the multipart form for S3 multipart uploads
+}
+
+// RestoreReport is the outcome of restoring a snapshot archive, or of checking one in a dry run.
+type RestoreReport struct {
+	DryRun    bool              `json:"dry_run"`
+	CreatedAt time.Time         `json:"snapshot_created_at"`
+	Files     int               `json:"files"`
+	Restored  int               `json:"restored"`         // Only checked, in a dry run
+	Failed    map[string]string `json:"failed,omitempty"` // Reason by file name
+	Pruned    []string          `json:"pruned,omitempty"` // Deleted as the snapshot doesn't have them, or would be in a dry run
+}
+
+// StorageSnapshot is a point-in-time view of every object, hard linked into .fileserver/snapshots so later writes and
+// deletes don't affect it. Close removes the links.
+type StorageSnapshot struct {
+	CreatedAt time.Time
+	Objects   []ObjectMeta
+	dir       string
+	keyring   *Keyring
+	paths     map[string]string // Linked data by object name
+}
+
+func newStorageSnapshot(dataDir string, keyring *Keyring) (*StorageSnapshot, error) {
+	parent := filepath.Join(dataDir, reservedDir, snapshotDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", parent, err)
+	}
+	removeStaleSnapshots(parent)
+
+	createdAt := time.Now().UTC()
+	dir, err := os.MkdirTemp(parent, createdAt.Format(snapshotTimeFormat)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &StorageSnapshot{CreatedAt: createdAt, dir: dir, keyring: keyring, paths: map[string]string{}}, nil
+}
+
+// add links the data at path into the snapshot as linkName, holding meta's object.
+func (s *StorageSnapshot) add(meta ObjectMeta, path string, linkName string) error {
+	if err := linkFile(path, filepath.Join(s.dir, linkName)); err != nil {
+		return err
+	}
+	s.share(meta, linkName)
+	return nil
+}
+
+// share records meta's object as held by data already linked as linkName.
+func (s *StorageSnapshot) share(meta ObjectMeta, linkName string) {
+	s.Objects = append(s.Objects, meta)
+	s.paths[meta.Name] = filepath.Join(s.dir, linkName)
+}
+
+// Open returns the original bytes of the snapshot's version of meta's object.
+func (s *StorageSnapshot) Open(meta ObjectMeta) (io.ReadCloser, error) {
+	file, err := os.Open(s.paths[meta.Name])
+	if err != nil {
+		return nil, err
+	}
+	stored, err := decryptStored(s.keyring, file, meta)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := newDecoder(meta.Encoding, stored)
+	if err != nil {
+		_ = stored.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decoder, multiCloser{decoder, stored}}, nil
+}
+
+// Manifest describes every object in the snapshot, sorted by name. Objects without a recorded checksum, i.e. files
+// written by other processes, are read to take one.
+func (s *StorageSnapshot) Manifest() (*SnapshotManifest, error) {
+	manifest := &SnapshotManifest{Version: snapshotVersion, CreatedAt: s.CreatedAt, Files: make([]SnapshotFile, 0, len(s.Objects))}
+	for _, meta := range s.Objects {
+		file := SnapshotFile{Name: meta.Name, Size: meta.Size, SHA256: meta.Checksum, ModTime: meta.ModTime, Retention: meta.Retention, MD5: meta.MD5}
+		if file.SHA256 == "" {
+			body, err := s.Open(meta)
+			if err != nil {
+				return nil, err
+			}
+			hash := sha256.New()
+			file.Size, err = io.Copy(hash, body)
+			_ = body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", meta.Name, err)
+			}
+			file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+	return manifest, nil
+}
+
+func (s *StorageSnapshot) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// WriteSnapshotArchive writes manifest and every file in it to w as a tar, zstd compressed if format says so. A file
+// not matching the manifest fails the archive.
+func WriteSnapshotArchive(w io.Writer, snapshot *StorageSnapshot, manifest *SnapshotManifest, format string) error {
+	var compressed io.WriteCloser
+	switch format {
+	case SnapshotFormatTar:
+	case SnapshotFormatTarZstd:
+		var err error
+		if compressed, err = newEncoder(EncodingZstd, CompressionDefault, w); err != nil {
+			return err
+		}
+		w = compressed
+	default:
+		return fmt.Errorf("unsupported snapshot format: %s", format)
+	}
+
+	archive := tar.NewWriter(w)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: snapshotManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return err
+	}
+
+	objects := make(map[string]ObjectMeta, len(snapshot.Objects))
+	for _, meta := range snapshot.Objects {
+		objects[meta.Name] = meta
+	}
+	for _, file := range manifest.Files {
+		header := &tar.Header{Name: snapshotFilesDir + file.Name, Mode: 0644, Size: file.Size, ModTime: file.ModTime}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		body, err := snapshot.Open(objects[file.Name])
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(archive, &snapshotVerifier{Reader: body, file: file, hash: sha256.New()})
+		_ = body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", file.Name, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if compressed != nil {
+		return compressed.Close()
+	}
+	return nil
+}
+
+// ReadSnapshotArchive reads an archive and calls restore with each file, which fails with ErrChecksumMismatch at its
+// end if it doesn't match the manifest. A nil restore only checks the files.
+func ReadSnapshotArchive(r io.Reader, restore func(file SnapshotFile, body io.Reader) error) (*SnapshotManifest, *RestoreReport, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer decoder.Close()
+		r = decoder
+	} else {
+		r = buffered
+	}
+
+	archive := tar.NewReader(r)
+	header, err := archive.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if header.Name != snapshotManifestName {
+		return nil, nil, fmt.Errorf("archive starts with %s instead of %s", header.Name, snapshotManifestName)
+	}
+	var manifest SnapshotManifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if manifest.Version != snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version: %d", manifest.Version)
+	}
+
+	report := &RestoreReport{CreatedAt: manifest.CreatedAt, Files: len(manifest.Files), Failed: map[string]string{}}
+	pending := make(map[string]SnapshotFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		pending[file.Name] = file
+	}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &manifest, report, err
+		}
+		name, ok := strings.CutPrefix(header.Name, snapshotFilesDir)
+		file, listed := pending[name]
+		switch {
+		case !ok || header.Typeflag != tar.TypeReg:
+			report.Failed[header.Name] = "not a file entry"
+			continue
+		case !listed:
+			report.Failed[name] = "not in the manifest, or archived twice"
+			continue
+		case !validFileName(name) || strings.ContainsRune(name, '/') || len(name) > 255:
+			report.Failed[name] = "invalid file name"
+		}
+		delete(pending, name)
+		if _, failed := report.Failed[name]; failed {
+			continue
+		}
+
+		verifier := &snapshotVerifier{Reader: archive, file: file, hash: sha256.New()}
+		if restore != nil {
+			err = restore(file, verifier)
+		}
+		if err == nil && !verifier.done {
+			_, err = io.Copy(io.Discard, verifier)
+		}
+		if err != nil {
+			report.Failed[name] = err.Error()
+			continue
+		}
+		report.Restored++
+	}
+	for name := range pending {
+		report.Failed[name] = "missing from the archive"
+	}
+	return &manifest, report, nil
+}
+
+// snapshotVerifier fails the final read of a file that doesn't match its manifest entry.
+type snapshotVerifier struct {
+	io.Reader
+	file SnapshotFile
+	hash hash.Hash
+	read int64
+	done bool
+}
+
+func (v *snapshotVerifier) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	v.hash.Write(p[:n])
+	v.read += int64(n)
+	if err == io.EOF {
+		v.done = true
+		if v.read != v.file.Size || hex.EncodeToString(v.hash.Sum(nil)) != v.file.SHA256 {
+			return n, fmt.Errorf("%w: %s", ErrChecksumMismatch, v.file.Name)
+		}
+	}
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (closers multiCloser) Close() error {
+	var err error
+	for _, closer := range closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// linkFile hard links path to link, copying it on filesystems without hard links.
+func linkFile(path string, link string) error {
+	err := os.Link(path, link)
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(link, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// removeStaleSnapshots clears snapshot dirs left behind by a crash, which would otherwise keep deleted data alive.
+func removeStaleSnapshots(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleSnapshotAge {
+			_ = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// HandleSnapshot streams an archive of every file as of now, see WriteSnapshotArchive. Writes are held off only
+// while the files are linked. ?format=tar skips compression.
+func (fs *FileServer) HandleSnapshot(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	format := request.URL.Query().Get("format")
+	if format == "" {
+		format = SnapshotFormatTarZstd
+	}
+	if format != SnapshotFormatTar && format != SnapshotFormatTarZstd {
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("format must be %s or %s", SnapshotFormatTar, SnapshotFormatTarZstd))
+		return
+	}
+
+	snapshot, err := fs.storage.Snapshot()
+	var manifest *SnapshotManifest
+	if err == nil {
+		defer snapshot.Close()
+		manifest, err = snapshot.Manifest()
+	}
+	if err != nil {
+		log.Errorf("Snapshot failed: %+v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		fs.WriteResponseBody(response, err.Error())
+		return
+	}
+
+	contentType := "application/x-tar"
+	if format == SnapshotFormatTarZstd {
+		contentType = "application/zstd"
+	}
+	response.Header().Set("Content-Type", contentType)
+	response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="fileserver-%s.%s"`, snapshot.CreatedAt.Format(snapshotTimeFormat), format))
+	if err := WriteSnapshotArchive(response, snapshot, manifest, format); err != nil {
+		// Part of the archive is already sent, drop the connection so the client can't mistake it for a whole one.
+		log.Errorf("Snapshot failed: %+v", err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Infof("Sent snapshot of %d files taken at %s", len(manifest.Files), snapshot.CreatedAt.Format(time.RFC3339))
+}
+
+// HandleRestore writes every file in the snapshot archive in the body through the regular write path. ?dry_run=true
+// only checks the archive, ?prune=true also deletes files it doesn't have.
+func (fs *FileServer) HandleRestore(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	ctx := request.Context()
+	dryRun := request.URL.Query().Get("dry_run") == "true"
+	prune := request.URL.Query().Get("prune") == "true"
+	if principal := PrincipalFromContext(ctx); prune && principal != nil && !principal.Allows(PermissionDelete, "") {
+		response.WriteHeader(http.StatusForbidden)
+		fs.WriteResponseBody(response, "Pruning needs delete permission.")
+		return
+	}
+
+	var restore func(file SnapshotFile, body io.Reader) error
+	if !dryRun {
+		restore = func(file SnapshotFile, body io.Reader) error {
+			_, _, err := fs.writeFileWith(ctx, file.Name, body, file.Size, CreateOptions{Retention: file.Retention, MD5: file.MD5})
+			return err
+		}
+	}
+	manifest, report, err := ReadSnapshotArchive(request.Body, restore)
+	if err != nil {
+		log.Errorf("Restore failed: %+v", err)
+		response.WriteHeader(http.StatusBadRequest)
+		fs.WriteResponseBody(response, fmt.Sprintf("Invalid snapshot archive: %s", err))
+		return
+	}
+	report.DryRun = dryRun
+
+	if prune {
+		keep := make(map[string]bool, len(manifest.Files))
+		for _, file := range manifest.Files {
+			keep[file.Name] = true
+		}
+		objects, err := fs.storage.List()
+		if err != nil {
+			log.Errorf("Restore failed to list files: %+v", err)
+			response.WriteHeader(http.StatusInternalServerError)
+			fs.WriteResponseBody(response, err.Error())
+			return
+		}
+		for _, meta := range objects {
+			if keep[meta.Name] {
+				continue
+			}
+			if !dryRun {
+				if _, _, err := fs.deleteFile(ctx, meta.Name); err != nil {
+					report.Failed[meta.Name] = err.Error()
+					continue
+				}
+			}
+			report.Pruned = append(report.Pruned, meta.Name)
+		}
+		sort.Strings(report.Pruned)
+	}
+	log.Infof("Restored %d of %d files from snapshot taken at %s, dry run: %t", report.Restored, report.Files, report.CreatedAt.Format(time.RFC3339), dryRun)
+
+	response.Header().Set("Content-Type", "application/json")
+	if len(report.Failed) > 0 {
+		response.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Errorf("Failed to write restore report: %+v", err)
+	}
+}
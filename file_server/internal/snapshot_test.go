@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotArchiveRoundTrip(t *testing.T) {
+	bodies := map[string]string{"a": strings.Repeat("alpha ", 1000), "b": "shared", "c": "shared", "empty": ""}
+	compressed := testStorageConfig("")
+	compressed.Compression = CompressionConfig{AtRest: true, Algorithm: EncodingZstd, MaxRatio: 0.9}
+
+	tests := []struct {
+		name   string
+		cfg    StorageConfig
+		mode   string
+		format string
+	}{
+		{"disk tar", testStorageConfig(""), StorageModeDisk, SnapshotFormatTar},
+		{"disk tar.zst", testStorageConfig(""), StorageModeDisk, SnapshotFormatTarZstd},
+		{"disk compressed at rest", compressed, StorageModeDisk, SnapshotFormatTar},
+		{"cas tar.zst", testStorageConfig(""), StorageModeCAS, SnapshotFormatTarZstd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			cfg.DataDir, cfg.Mode = t.TempDir(), test.mode
+			storage, err := NewStorage(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Index().Close()
+			createAll(t, storage, bodies)
+
+			snapshot, err := storage.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snapshot.Close()
+			manifest, err := snapshot.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Changes after the snapshot is taken don't make it into the archive.
+			createAll(t, storage, map[string]string{"a": "changed", "new": "new"})
+			if err := storage.Remove("b"); err != nil {
+				t.Fatal(err)
+			}
+
+			var archive bytes.Buffer
+			if err := WriteSnapshotArchive(&archive, snapshot, manifest, test.format); err != nil {
+				t.Fatal(err)
+			}
+			if isZstd := bytes.HasPrefix(archive.Bytes(), zstdMagic); isZstd != (test.format == SnapshotFormatTarZstd) {
+				t.Errorf("archive compressed %t in format %s", isZstd, test.format)
+			}
+
+			restored := map[string]string{}
+			_, report, err := ReadSnapshotArchive(&archive, func(file SnapshotFile, body io.Reader) error {
+				data, err := io.ReadAll(body)
+				restored[file.Name] = string(data)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Files != len(bodies) || report.Restored != len(bodies) || len(report.Failed) != 0 {
+				t.Errorf("got report %+v, want all %d files restored", report, len(bodies))
+			}
+			for name, body := range bodies {
+				if restored[name] != body {
+					t.Errorf("%s: restored %d bytes, want the %d in the snapshot", name, len(restored[name]), len(body))
+				}
+			}
+		})
+	}
+}
+
+type archiveEntry struct {
+	name string
+	body string
+}
+
+// buildArchive writes a tar archive of the given entries, whose first is normally the manifest.
+func buildArchive(t *testing.T, entries ...archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		if err := archive.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func manifestEntry(t *testing.T, version int, bodies map[string]string) archiveEntry {
+	t.Helper()
+	manifest := SnapshotManifest{Version: version, CreatedAt: time.Now().UTC()}
+	for name, body := range bodies {
+		sum := sha256.Sum256([]byte(body))
+		manifest.Files = append(manifest.Files, SnapshotFile{Name: name, Size: int64(len(body)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archiveEntry{snapshotManifestName, string(data)}
+}
+
+func TestReadSnapshotArchive(t *testing.T) {
+	manifest := manifestEntry(t, snapshotVersion, map[string]string{"a": "alpha", "b": "beta"})
+	tests := []struct {
+		name         string
+		entries      []archiveEntry
+		wantErr      bool
+		wantRestored int
+		wantFailed   map[string]string // Substring of the reason by name
+	}{
+		{"valid", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "beta"}}, false, 2, nil},
+		{"body mismatch", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "BETA"}}, false, 1, map[string]string{"b": "checksum"}},
+		{"size mismatch", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "beta!"}}, false, 1, map[string]string{"b": "checksum"}},
+		{"missing file", []archiveEntry{manifest, {"files/a", "alpha"}}, false, 1, map[string]string{"b": "missing"}},
+		{"archived twice", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "beta"}, {"files/a", "alpha"}}, false, 2, map[string]string{"a": "twice"}},
+		{"not in the manifest", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "beta"}, {"files/c", "gamma"}}, false, 2, map[string]string{"c": "not in the manifest"}},
+		{"outside files", []archiveEntry{manifest, {"files/a", "alpha"}, {"files/b", "beta"}, {"other", ""}}, false, 2, map[string]string{"other": "not a file"}},
+		{"invalid name", []archiveEntry{manifestEntry(t, snapshotVersion, map[string]string{"x/y": "z"}), {"files/x/y", "z"}}, false, 0, map[string]string{"x/y": "invalid"}},
+		{"manifest not first", []archiveEntry{{"files/a", "alpha"}, manifest}, true, 0, nil},
+		{"unsupported version", []archiveEntry{manifestEntry(t, snapshotVersion+1, nil)}, true, 0, nil},
+		{"empty", nil, true, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, report, err := ReadSnapshotArchive(buildArchive(t, test.entries...), nil)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got report %+v, want an error", report)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Restored != test.wantRestored || len(report.Failed) != len(test.wantFailed) {
+				t.Errorf("got %d restored, failed %v, want %d and %v", report.Restored, report.Failed, test.wantRestored, test.wantFailed)
+			}
+			for name, reason := range test.wantFailed {
+				if !strings.Contains(report.Failed[name], reason) {
+					t.Errorf("%s failed with %q, want %q", name, report.Failed[name], reason)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRestore(t *testing.T) {
+	source := newTestFileServer(t)
+	createAll(t, source.storage, map[string]string{"a": "alpha", "b": "beta"})
+	response := httptest.NewRecorder()
+	source.newRouter().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/zstd" {
+		t.Fatalf("got snapshot %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	archive := response.Body.Bytes()
+
+	target := newTestFileServer(t)
+	createAll(t, target.storage, map[string]string{"a": "old", "extra": "extra"})
+	router := target.newRouter()
+
+	tests := []struct {
+		name       string
+		query      string
+		body       []byte
+		wantStatus int
+		wantReport RestoreReport
+		wantBodies map[string]string // Every stored file afterwards
+	}{
+		{"dry run", "?dry_run=true&prune=true", archive, http.StatusOK,
+			RestoreReport{DryRun: true, Files: 2, Restored: 2, Pruned: []string{"extra"}},
+			map[string]string{"a": "old", "extra": "extra"}},
+		{"invalid archive", "", []byte("not an archive"), http.StatusBadRequest, RestoreReport{},
+			map[string]string{"a": "old", "extra": "extra"}},
+		{"restore", "", archive, http.StatusOK, RestoreReport{Files: 2, Restored: 2},
+			map[string]string{"a": "alpha", "b": "beta", "extra": "extra"}},
+		{"restore and prune", "?prune=true", archive, http.StatusOK, RestoreReport{Files: 2, Restored: 2, Pruned: []string{"extra"}},
+			map[string]string{"a": "alpha", "b": "beta"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/admin/restore"+test.query, bytes.NewReader(test.body)))
+			if response.Code != test.wantStatus {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body.String(), test.wantStatus)
+			}
+			if response.Code == http.StatusOK {
+				var report RestoreReport
+				if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+					t.Fatal(err)
+				}
+				if report.DryRun != test.wantReport.DryRun || report.Files != test.wantReport.Files || report.Restored != test.wantReport.Restored ||
+					len(report.Failed) != 0 || !slices.Equal(report.Pruned, test.wantReport.Pruned) {
+					t.Errorf("got report %+v, want %+v", report, test.wantReport)
+				}
+			}
+
+			objects, err := target.storage.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != len(test.wantBodies) {
+				t.Errorf("got %d files, want %v", len(objects), test.wantBodies)
+			}
+			for name, body := range test.wantBodies {
+				if got := readBody(t, target.storage, name); got != body {
+					t.Errorf("%s: got %q, want %q", name, got, body)
+				}
+			}
+		})
+	}
+}
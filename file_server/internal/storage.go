@@ -0,0 +1,1018 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// reservedDir holds the server's own state inside the data dir. It can't be used as a file name.
+	reservedDir   = ".fileserver"
+	tmpDir        = "tmp"
+	journalDir    = "journal"
+	quarantineDir = "quarantine"
+
+	// Temp files older than this are assumed to be left over from a crash.
+	staleTempAge = time.Hour
+)
+
+var (
+	ErrObjectNotFound   = fmt.Errorf("object not found: %w", os.ErrNotExist)
+	ErrShortBody        = errors.New("request body length does not match Content-Length")
+	ErrChecksumMismatch = errors.New("stored bytes do not match their checksum")
+	ErrNotInPlace       = errors.New("object can't be written in place")
+)
+
+type StorageConfig struct {
+	DataDir     string
+	Mode        string        // disk stores one file per name, cas stores each distinct body once
+	GCInterval  time.Duration // How often cas mode deletes blobs no name points to. 0 disables collection.
+	Compression CompressionConfig
+	Journal     JournalConfig
+	Encryption  EncryptionConfig
+	Layout      LayoutConfig // Disk mode only, cas mode always fans blobs out
+}
+
+// ObjectMeta describes a stored file. Size and Checksum always refer to the original bytes, even when the object
+// is stored encoded. StoredSize is the size of the encoded bytes, before any encryption.
+type ObjectMeta struct {
+	Name           string     `json:"name"`
+	Size           int64      `json:"size"`
+	StoredSize     int64      `json:"stored_size"`
+	Checksum       string     `json:"checksum,omitempty"` // Hex SHA-256 of the original bytes
+	Encoding       string     `json:"encoding,omitempty"` // Content encoding at rest, empty if stored as is
+	Incompressible bool       `json:"incompressible,omitempty"`
+	ModTime        time.Time  `json:"mod_time"`           // Modification time of the stored file
+	Envelope       *Envelope  `json:"envelope,omitempty"` // Set if the stored bytes are encrypted
+	Retention      *Retention `json:"retention,omitempty"`
+	Blob           string     `json:"blob,omitempty"` // The blob holding the stored bytes, cas mode only
+	// Hex MD5 of the original bytes, or for S3 multipart uploads the MD5 of the parts' MD5s suffixed with -<parts>
+	MD5    string     `json:"md5,omitempty"`
+	Hashes *HashState `json:"hashes,omitempty"` // Set if the object can be written in place, see writableInPlace
+}
+
+// HashState is the SHA-256 and MD5 state after hashing an object's original bytes, so appending to it extends both
+// without reading it back.
+type HashState struct {
+	SHA256 []byte `json:"sha256"`
+	MD5    []byte `json:"md5"`
+}
+
+func newHashState(checksum hash.Hash, digest hash.Hash) *HashState {
+	state := &HashState{}
+	state.SHA256, _ = checksum.(encoding.BinaryMarshaler).MarshalBinary()
+	state.MD5, _ = digest.(encoding.BinaryMarshaler).MarshalBinary()
+	return state
+}
+
+// restore returns hashes carrying on from the state.
+func (s *HashState) restore() (hash.Hash, hash.Hash, error) {
+	checksum, digest := sha256.New(), md5.New()
+	if err := checksum.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.SHA256); err != nil {
+		return nil, nil, err
+	}
+	if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.MD5); err != nil {
+		return nil, nil, err
+	}
+	return checksum, digest, nil
+}
+
+// writableInPlace reports whether meta's object is stored as is, with its hash state, so a partial write can go
+// straight into its file.
+func writableInPlace(meta ObjectMeta) bool {
+	return meta.Encoding == EncodingIdentity && meta.Envelope == nil && meta.Blob == "" && meta.Hashes != nil
+}
+
+// ETag returns a strong entity tag for the object, or "" if its checksum isn't known.
+func (m ObjectMeta) ETag() string {
+	if m.Checksum == "" {
+		return ""
+	}
+	return `"` + m.Checksum + `"`
+}
+
+// S3ETag returns the object's entity tag as S3 clients expect it, the quoted MD5. Objects stored before MD5s were
+// recorded fall back to ETag.
+func (m ObjectMeta) S3ETag() string {
+	if m.MD5 == "" {
+		return m.ETag()
+	}
+	return `"` + m.MD5 + `"`
+}
+
+// diskSize returns how many bytes the object takes on disk.
+func (m ObjectMeta) diskSize() int64 {
+	if m.Envelope == nil {
+		return m.StoredSize
+	}
+	return encryptedSize(m.StoredSize)
+}
+
+// CreateOptions is metadata Create records along with the data.
+type CreateOptions struct {
+	Retention *Retention // Nil for none
+	MD5       string     // Recorded instead of the body's own MD5, e.g. the multipart form for S3 multipart uploads
+}
+
+// Storage persists file bodies and their metadata. Implementations don't lock, callers serialize access per name.
+type Storage interface {
+	// Create stores body under name, replacing any existing object only once body has been fully written. The
+	// metadata in opts is journaled with the data, in the same index entry.
+	Create(name string, body io.Reader, opts CreateOptions) (ObjectMeta, error)
+	// Open returns the stored, possibly encoded, bytes of name and its metadata. Encrypted objects are decrypted,
+	// failing with ErrDecryptionFailed if they were tampered with.
+	Open(name string) (io.ReadCloser, ObjectMeta, error)
+	Stat(name string) (ObjectMeta, error)
+	Remove(name string) error
+	// List returns every stored object.
+	List() ([]ObjectMeta, error)
+	// Reconcile drops index entries whose data is gone, e.g. deleted by another file server, and returns their names.
+	Reconcile() ([]string, error)
+	// Adopt indexes up to limit files on disk the index has no entry for, e.g. written before the index existed, and
+	// returns their names.
+	Adopt(limit int) ([]string, error)
+	// Verify reads name back and returns ErrChecksumMismatch if it no longer matches the checksum taken on write.
+	// Objects without a recorded checksum pass.
+	Verify(name string) error
+	// Quarantine moves name's data out of the way so it's no longer served and returns where it was moved to.
+	Quarantine(name string) (string, error)
+	// Rewrap wraps name's data key with the active master key, without touching its data. Returns false if it
+	// already was, or name isn't encrypted.
+	Rewrap(name string) (bool, error)
+	// Snapshot links the current version of every object into a private dir, holding off writes only while it does,
+	// and returns a view of them later writes don't affect.
+	Snapshot() (*StorageSnapshot, error)
+	// SetRetention replaces name's retention settings, nil clears them, and returns its updated metadata. Files other
+	// processes wrote fail with ErrRetentionUnsupported.
+	SetRetention(name string, retention *Retention) (ObjectMeta, error)
+	// WriteAt writes body into name at offset, or appends it if offset is negative. Fails with ErrPreconditionFailed if
+	// name changed since expect, and ErrNotInPlace if it's stored encoded.
+	WriteAt(name string, expect ObjectMeta, offset int64, body io.Reader) (ObjectMeta, error)
+	// Index is the metadata index, shared with every file server using the same data dir.
+	Index() *MetaIndex
+}
+
+// DiskStorage stores each file under its name, with metadata in a journaled index shared by every file server using
+// the data dir. Files are only renamed into or out of place under the index's exclusive lock.
+type DiskStorage struct {
+	dataDir    string
+	compressor *Compressor
+	keyring    *Keyring // Nil if no master keys are configured
+	layout     layout
+	index      *MetaIndex
+	durable    bool // Sync file data and renames before acknowledging writes
+}
+
+func NewDiskStorage(cfg StorageConfig, keyring *Keyring) (*DiskStorage, error) {
+	tmp := filepath.Join(cfg.DataDir, reservedDir, tmpDir)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	removeStaleTemps(tmp)
+
+	if cfg.Journal.Dir == "" {
+		cfg.Journal.Dir = filepath.Join(cfg.DataDir, reservedDir, journalDir)
+	}
+	layout, err := newLayout(cfg.DataDir, cfg.Layout)
+	if err != nil {
+		return nil, err
+	}
+	index, err := OpenMetaIndex(cfg.Journal)
+	if err != nil {
+		return nil, err
+	}
+	layout.indexed = func(name string) bool {
+		_, ok := index.Get(name)
+		return ok
+	}
+
+	d := &DiskStorage{
+		dataDir:    cfg.DataDir,
+		compressor: NewCompressor(cfg.Compression),
+		keyring:    keyring,
+		layout:     layout,
+		index:      index,
+		durable:    cfg.Journal.Fsync == FsyncAlways,
+	}
+	if err := index.SetRepair(d.repair); err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Create journals the new metadata and renames the file into place under the index's exclusive lock.
+func (d *DiskStorage) Create(name string, body io.Reader, opts CreateOptions) (ObjectMeta, error) {
+	tmpPath, meta, err := writeObjectTemp(filepath.Join(d.dataDir, reservedDir, tmpDir), d.compressor, d.keyring, name, body, d.durable)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer func() {
+		// No-op once the temp file has been renamed into place.
+		_ = os.Remove(tmpPath)
+	}()
+	meta.Retention = opts.Retention
+	if opts.MD5 != "" {
+		meta.MD5 = opts.MD5
+	}
+
+	path := d.layout.path(name)
+	err = d.index.Update(func(tx IndexTx) error {
+		previous, existed := tx.Get(name)
+		if err := tx.Put(meta); err != nil {
+			return err
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+		if err != nil {
+			if existed {
+				_ = tx.Put(previous)
+			} else {
+				_ = tx.Delete(name)
+			}
+			return err
+		}
+		if d.layout.sharded() {
+			// A copy not yet migrated from the flat layout is stale now.
+			_ = os.Remove(d.layout.flatPath(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	if d.durable {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return ObjectMeta{}, err
+		}
+	}
+	return meta, nil
+}
+
+// Open describes the file it opened, so a concurrent replace can't pair one version's metadata with another's bytes.
+// The file is shared locked until closed, so WriteAt doesn't write it in place meanwhile.
+func (d *DiskStorage) Open(name string) (io.ReadCloser, ObjectMeta, error) {
+	file, err := os.Open(d.layout.locate(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ObjectMeta{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		_ = file.Close()
+		return nil, ObjectMeta{}, err
+	}
+	meta, err := d.describe(name, file.Stat, false)
+	if err != nil {
+		_ = file.Close()
+		return nil, ObjectMeta{}, err
+	}
+	stored, err := decryptStored(d.keyring, file, meta)
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	return stored, meta, nil
+}
+
+func (d *DiskStorage) Stat(name string) (ObjectMeta, error) {
+	return d.stat(name, false)
+}
+
+// stat is Stat, with caughtUp set when called holding the index's exclusive lock.
+func (d *DiskStorage) stat(name string, caughtUp bool) (ObjectMeta, error) {
+	path := d.layout.locate(name)
+	return d.describe(name, func() (os.FileInfo, error) { return os.Stat(path) }, caughtUp)
+}
+
+// describe returns the metadata of name's file, which stat stats, catching the index up if it doesn't describe it.
+func (d *DiskStorage) describe(name string, stat func() (os.FileInfo, error), caughtUp bool) (ObjectMeta, error) {
+	info, err := stat()
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectMeta{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	meta, ok := d.match(name, info)
+	if !ok && !caughtUp {
+		if err := d.index.Refresh(); err != nil {
+			return ObjectMeta{}, err
+		}
+		if info, err = stat(); err != nil {
+			return ObjectMeta{}, err
+		}
+		meta, ok = d.match(name, info)
+	}
+	if ok {
+		return meta, nil
+	}
+	if current, indexed := d.index.Get(name); indexed && current.Envelope != nil {
+		// Changed behind our back. Still decrypted, so tampering fails authentication instead of serving ciphertext.
+		return current, nil
+	}
+
+	// Not indexed, or the file was replaced by something other than a file server. Serve it as is, unless files are
+	// meant to be encrypted.
+	if d.keyring != nil {
+		return ObjectMeta{}, fmt.Errorf("%w: %s isn't indexed, which it has to be while encryption is on", ErrObjectNotFound, name)
+	}
+	return ObjectMeta{Name: name, Size: info.Size(), StoredSize: info.Size(), ModTime: info.ModTime().UTC()}, nil
+}
+
+// match finds the index entry describing the file stat was taken of. An earlier version may, until repair rolls back
+// a change whose file server died before renaming its file into place.
+func (d *DiskStorage) match(name string, stat os.FileInfo) (ObjectMeta, bool) {
+	if meta, ok := d.index.Get(name); ok && describes(meta, stat) {
+		return meta, true
+	}
+	versions := d.index.Versions(name)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if describes(versions[i], stat) {
+			return versions[i], true
+		}
+	}
+	return ObjectMeta{}, false
+}
+
+// Remove deletes the file before its index entry, so a crash in between can't leave an unindexed file that would be
+// served as is.
+func (d *DiskStorage) Remove(name string) error {
+	return d.index.Update(func(tx IndexTx) error {
+		err := os.Remove(d.layout.locate(name))
+		if errors.Is(err, os.ErrNotExist) {
+			err = ErrObjectNotFound
+		}
+		if _, ok := tx.Get(name); ok {
+			if indexErr := tx.Delete(name); indexErr != nil && err == nil {
+				err = indexErr
+			}
+		}
+		return err
+	})
+}
+
+// WriteAt spools body first, then writes it in place if nothing else has the file open or linked, or replaces the file
+// with a spliced copy.
+func (d *DiskStorage) WriteAt(name string, expect ObjectMeta, offset int64, body io.Reader) (ObjectMeta, error) {
+	if !writableInPlace(expect) || d.keyring.Encrypting() {
+		return ObjectMeta{}, ErrNotInPlace
+	}
+	spool, err := os.CreateTemp(filepath.Join(d.dataDir, reservedDir, tmpDir), filepath.Base(name)+".*")
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+	length, err := io.Copy(spool, body)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	path := d.layout.locate(name)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectMeta{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer file.Close()
+	opened, err := file.Stat()
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	if !describes(expect, opened) {
+		return expect, ErrPreconditionFailed
+	}
+	if offset < 0 {
+		offset = expect.Size
+	}
+	if offset > expect.Size {
+		return expect, ErrRangeNotSatisfiable
+	}
+	// spliced reads the new contents: the current bytes with the spool written over them at offset.
+	spliced := func() (io.Reader, error) {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		end := min(offset+length, expect.Size)
+		return io.MultiReader(io.NewSectionReader(file, 0, offset), spool, io.NewSectionReader(file, end, expect.Size-end)), nil
+	}
+
+	// Held until the file is closed, readers wait for the write.
+	inPlace := linkCount(opened) == 1 && syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+	var meta ObjectMeta
+	var replacement string
+	if inPlace {
+		meta, err = hashWrite(expect, offset, length, spool, spliced)
+	} else {
+		replacement, meta, err = d.replacement(expect, spliced)
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer func() {
+		// No-op once it has been renamed into place.
+		_ = os.Remove(replacement)
+	}()
+
+	err = d.index.Update(func(tx IndexTx) error {
+		current, ok := tx.Get(name)
+		onDisk, err := os.Stat(path)
+		if !ok || !sameVersion(current, expect) || err != nil || !os.SameFile(onDisk, opened) || !describes(expect, onDisk) {
+			return ErrPreconditionFailed
+		}
+		if inPlace && linkCount(onDisk) > 1 {
+			// Linked since it was opened.
+			if replacement, meta, err = d.replacement(expect, spliced); err != nil {
+				return err
+			}
+			inPlace = false
+		}
+		if !inPlace {
+			if err := tx.Put(meta); err != nil {
+				return err
+			}
+			if err := os.Rename(replacement, path); err != nil {
+				_ = tx.Put(current)
+				return err
+			}
+			return nil
+		}
+
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(io.NewOffsetWriter(file, offset), spool)
+		if err == nil && d.durable {
+			err = file.Sync()
+		}
+		if err == nil {
+			onDisk, err = file.Stat()
+		}
+		if err != nil {
+			// Half written. Describe what's there rather than keep an entry that no longer matches.
+			if torn, describeErr := redescribe(current, file); describeErr == nil {
+				_ = tx.Put(torn)
+			}
+			return err
+		}
+		meta.ModTime = onDisk.ModTime().UTC()
+		return tx.Put(meta)
+	})
+	if errors.Is(err, ErrPreconditionFailed) {
+		current, _ := d.index.Get(name)
+		return current, err
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	if !inPlace && d.durable {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return ObjectMeta{}, err
+		}
+	}
+	return meta, nil
+}
+
+// hashWrite returns expect updated for length bytes of spool written at offset. Appends extend the saved hash state,
+// range writes rehash the spliced contents.
+func hashWrite(expect ObjectMeta, offset int64, length int64, spool io.ReadSeeker, spliced func() (io.Reader, error)) (ObjectMeta, error) {
+	var checksum, digest hash.Hash
+	var content io.Reader
+	var err error
+	if offset == expect.Size {
+		checksum, digest, err = expect.Hashes.restore()
+		if err == nil {
+			_, err = spool.Seek(0, io.SeekStart)
+		}
+		content = spool
+	} else {
+		checksum, digest = sha256.New(), md5.New()
+		content, err = spliced()
+	}
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(checksum, digest), content)
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	meta := expect
+	meta.Size = max(expect.Size, offset+length)
+	meta.StoredSize = meta.Size
+	meta.Checksum = hex.EncodeToString(checksum.Sum(nil))
+	meta.MD5 = hex.EncodeToString(digest.Sum(nil))
+	meta.Hashes = newHashState(checksum, digest)
+	return meta, nil
+}
+
+// replacement writes the spliced contents to a temp file, returning it and expect updated to describe it.
+func (d *DiskStorage) replacement(expect ObjectMeta, spliced func() (io.Reader, error)) (string, ObjectMeta, error) {
+	content, err := spliced()
+	if err != nil {
+		return "", ObjectMeta{}, err
+	}
+	tmpPath, written, err := writeObjectTemp(filepath.Join(d.dataDir, reservedDir, tmpDir), NewCompressor(CompressionConfig{}), nil, expect.Name, content, d.durable)
+	if err != nil {
+		return "", ObjectMeta{}, err
+	}
+	meta := expect
+	meta.Size, meta.StoredSize, meta.ModTime = written.Size, written.StoredSize, written.ModTime
+	meta.Checksum, meta.MD5, meta.Hashes = written.Checksum, written.MD5, written.Hashes
+	return tmpPath, meta, nil
+}
+
+func (d *DiskStorage) Index() *MetaIndex {
+	return d.index
+}
+
+func (d *DiskStorage) List() ([]ObjectMeta, error) {
+	return d.list(false)
+}
+
+func (d *DiskStorage) list(caughtUp bool) ([]ObjectMeta, error) {
+	names, err := d.layout.names()
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectMeta, 0, len(names))
+	for _, name := range names {
+		meta, err := d.stat(name, caughtUp)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, meta)
+	}
+	return objects, nil
+}
+
+func (d *DiskStorage) Reconcile() ([]string, error) {
+	var missing []string
+	d.index.Range(func(name string, _ ObjectMeta) bool {
+		if _, err := os.Stat(d.layout.locate(name)); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, name)
+		}
+		return true
+	})
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	var dropped []string
+	err := d.index.Update(func(tx IndexTx) error {
+		for _, name := range missing {
+			// Recheck, it may have been written since the index was walked.
+			if _, ok := tx.Get(name); !ok {
+				continue
+			}
+			if _, err := os.Stat(d.layout.locate(name)); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err := tx.Delete(name); err != nil {
+				return err
+			}
+			dropped = append(dropped, name)
+		}
+		return nil
+	})
+	return dropped, err
+}
+
+// Adopt reads each file through to describe it, without holding the index's lock. Files written by other processes
+// aren't served while encryption is on, so there's nothing to adopt then.
+func (d *DiskStorage) Adopt(limit int) ([]string, error) {
+	if d.keyring != nil {
+		return nil, nil
+	}
+	names, err := d.layout.names()
+	if err != nil {
+		return nil, err
+	}
+
+	var adopted []string
+	for _, name := range names {
+		if len(adopted) >= limit {
+			break
+		}
+		if _, indexed := d.index.Get(name); indexed {
+			continue
+		}
+		meta, err := d.adopt(name)
+		if err != nil {
+			return adopted, err
+		}
+		if meta.Name != "" {
+			adopted = append(adopted, name)
+		}
+	}
+	return adopted, nil
+}
+
+// adopt indexes name's file unless it was indexed or changed while being read, returning the empty meta if not.
+func (d *DiskStorage) adopt(name string) (ObjectMeta, error) {
+	file, err := os.Open(d.layout.locate(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectMeta{}, nil
+	}
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer file.Close()
+	opened, err := file.Stat()
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	if !opened.Mode().IsRegular() {
+		return ObjectMeta{}, nil
+	}
+	meta, err := redescribe(ObjectMeta{Name: name}, file)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	err = d.index.Update(func(tx IndexTx) error {
+		stat, err := os.Stat(d.layout.locate(name))
+		if _, indexed := tx.Get(name); indexed || err != nil || !os.SameFile(stat, opened) || !describes(meta, stat) {
+			meta = ObjectMeta{}
+			return nil
+		}
+		return tx.Put(meta)
+	})
+	return meta, err
+}
+
+func (d *DiskStorage) Verify(name string) error {
+	file, meta, err := d.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if meta.Checksum == "" {
+		return nil
+	}
+	return verifyChecksum(meta, file)
+}
+
+// Quarantine moves the file to .fileserver/quarantine with its metadata beside it.
+func (d *DiskStorage) Quarantine(name string) (string, error) {
+	dir := filepath.Join(d.dataDir, reservedDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	err := d.index.Update(func(tx IndexTx) error {
+		meta, err := d.stat(name, true)
+		if err != nil {
+			return err
+		}
+		if data, err := json.Marshal(meta); err == nil {
+			_ = os.WriteFile(target+".json", data, 0644)
+		}
+		if err := os.Rename(d.layout.locate(name), target); err != nil {
+			return err
+		}
+		if _, ok := tx.Get(name); ok {
+			return tx.Delete(name)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func (d *DiskStorage) Rewrap(name string) (bool, error) {
+	rewrapped := false
+	err := d.index.Update(func(tx IndexTx) error {
+		meta, err := d.stat(name, true)
+		if err != nil || meta.Envelope == nil {
+			return err
+		}
+		envelope, changed, err := d.keyring.Rewrap(meta.Envelope)
+		if !changed {
+			return err
+		}
+		meta.Envelope = envelope
+		rewrapped = true
+		return tx.Put(meta)
+	})
+	return rewrapped, err
+}
+
+// SetRetention only changes the index entry.
+func (d *DiskStorage) SetRetention(name string, retention *Retention) (ObjectMeta, error) {
+	var meta ObjectMeta
+	err := d.index.Update(func(tx IndexTx) error {
+		var err error
+		meta, err = d.stat(name, true)
+		if err != nil {
+			return err
+		}
+		if _, ok := tx.Get(name); !ok || meta.Checksum == "" {
+			return ErrRetentionUnsupported
+		}
+		meta.Retention = retention
+		return tx.Put(meta)
+	})
+	return meta, err
+}
+
+// Snapshot hard links every file, in either layout, holding the index's exclusive lock so no file server writes
+// meanwhile. WriteAt doesn't write linked files in place, so a link keeps the version it was taken of.
+func (d *DiskStorage) Snapshot() (*StorageSnapshot, error) {
+	snapshot, err := newStorageSnapshot(d.dataDir, d.keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.index.Update(func(IndexTx) error {
+		objects, err := d.list(true)
+		if err != nil {
+			return err
+		}
+		for _, meta := range objects {
+			err = snapshot.add(meta, d.layout.locate(meta.Name), meta.Name)
+			if errors.Is(err, os.ErrNotExist) {
+				// Removed by another process since it was listed.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = snapshot.Close()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// repair decides what the index keeps for name, see indexRepair. An entry the file doesn't match is rolled back to the
+// newest earlier version that does, or dropped so the file is served as is, or not at all if encryption is on.
+func (d *DiskStorage) repair(name string, current ObjectMeta, indexed bool, versions []ObjectMeta, thorough bool) (ObjectMeta, bool, error) {
+	stat, err := os.Stat(d.layout.locate(name))
+	if errors.Is(err, os.ErrNotExist) {
+		if indexed {
+			log.Warnf("Recovery: %s is indexed but missing on disk, dropping it from the index", name)
+		}
+		return ObjectMeta{}, false, nil
+	}
+	if err != nil {
+		return ObjectMeta{}, false, err
+	}
+
+	if indexed && d.verify(current, stat, thorough) {
+		return current, true, nil
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if d.verify(versions[i], stat, thorough) {
+			log.Warnf("Recovery: %s on disk is an earlier version than indexed, rolling the index back", name)
+			return versions[i], true, nil
+		}
+	}
+	if indexed && current.Envelope != nil && current.diskSize() == stat.Size() {
+		// Modified in place. Served as is it would be ciphertext, kept it fails authentication until scrubbed.
+		log.Warnf("Recovery: encrypted %s on disk fails verification, keeping its index entry", name)
+		return current, true, nil
+	}
+	if indexed && writableInPlace(current) {
+		// Most likely a write in place that didn't finish. An append is cut off, anything else described as it is.
+		file, err := os.OpenFile(d.layout.locate(name), os.O_RDWR, 0)
+		if err != nil {
+			return ObjectMeta{}, false, err
+		}
+		defer file.Close()
+		if stat.Size() > current.Size && verifyChecksum(current, io.NewSectionReader(file, 0, current.Size)) == nil {
+			log.Warnf("Recovery: %s on disk has an unfinished append, truncating it", name)
+			err := file.Truncate(current.Size)
+			if err == nil {
+				err = os.Chtimes(file.Name(), current.ModTime, current.ModTime)
+			}
+			return current, err == nil, err
+		}
+		log.Warnf("Recovery: %s on disk was changed in place since it was indexed, describing it anew", name)
+		meta, err := redescribe(current, file)
+		return meta, err == nil, err
+	}
+	if indexed {
+		log.Warnf("Recovery: %s on disk matches no indexed version, dropping its index entry", name)
+	}
+	return ObjectMeta{}, false, nil
+}
+
+// redescribe returns meta updated to describe file, a stored as is object, reading it through.
+func redescribe(meta ObjectMeta, file *os.File) (ObjectMeta, error) {
+	checksum, digest := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(checksum, digest), io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	meta.Size, meta.StoredSize, meta.ModTime = size, size, stat.ModTime().UTC()
+	meta.Checksum = hex.EncodeToString(checksum.Sum(nil))
+	meta.MD5 = hex.EncodeToString(digest.Sum(nil))
+	meta.Hashes = newHashState(checksum, digest)
+	return meta, nil
+}
+
+// verify reports whether meta describes the file. If thorough, it's read back to compare checksums.
+func (d *DiskStorage) verify(meta ObjectMeta, stat os.FileInfo, thorough bool) bool {
+	if !describes(meta, stat) {
+		return false
+	}
+	if !thorough {
+		return true
+	}
+	file, err := os.Open(d.layout.locate(meta.Name))
+	if err != nil {
+		return false
+	}
+	stored, err := decryptStored(d.keyring, file, meta)
+	if errors.Is(err, ErrUnknownMasterKey) {
+		// Can't be checked without its master key. Dropping the entry would lose the data key, trust size and mtime.
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer stored.Close()
+	return verifyChecksum(meta, stored) == nil
+}
+
+// linkCount returns the number of hard links to the file stat was taken of.
+func linkCount(stat os.FileInfo) uint64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Nlink)
+	}
+	return 1
+}
+
+// describes reports whether meta plausibly describes the file stat was taken of. Cheap enough for every read.
+func describes(meta ObjectMeta, stat os.FileInfo) bool {
+	return meta.diskSize() == stat.Size() && meta.ModTime.Equal(stat.ModTime().UTC())
+}
+
+// decryptStored wraps file, holding meta's stored bytes, so reads return them decrypted. file is closed on failure.
+func decryptStored(keyring *Keyring, file *os.File, meta ObjectMeta) (io.ReadCloser, error) {
+	if meta.Envelope == nil {
+		return file, nil
+	}
+	decrypted, err := keyring.NewReader(file, meta.Envelope)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", meta.Name, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, file}, nil
+}
+
+// verifyChecksum reads the bytes in stored, decoding them if needed, and checks them against meta.
+func verifyChecksum(meta ObjectMeta, stored io.Reader) error {
+	decoder, err := newDecoder(meta.Encoding, stored)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, decoder)
+	if err != nil {
+		return err
+	}
+	if size != meta.Size || (meta.Checksum != "" && hex.EncodeToString(hash.Sum(nil)) != meta.Checksum) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, meta.Name)
+	}
+	return nil
+}
+
+// removeStaleTemps clears temp files left behind by writes a crash interrupted. Recent ones may belong to another
+// file server sharing the data dir.
+func removeStaleTemps(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleTempAge {
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// writeObjectTemp streams body, compressed and encrypted as configured, into a new file in tmpDir, hashing it on the
+// way. The caller renames the file into place or removes it.
+func writeObjectTemp(tmpDir string, compressor *Compressor, keyring *Keyring, name string, body io.Reader, durable bool) (string, ObjectMeta, error) {
+	tmp, err := os.CreateTemp(tmpDir, filepath.Base(name)+".*")
+	if err != nil {
+		return "", ObjectMeta{}, err
+	}
+
+	// CreateTemp is owner only, match what os.Create gave files before writes went through a temp file.
+	err = tmp.Chmod(0644)
+	hash, digest := sha256.New(), md5.New()
+	var meta ObjectMeta
+	var dst io.Writer = tmp
+	var encrypter io.WriteCloser
+	var envelope *Envelope
+	if err == nil && keyring.Encrypting() {
+		encrypter, envelope, err = keyring.NewWriter(tmp)
+		dst = encrypter
+	}
+	if err == nil {
+		meta, err = compressor.Encode(dst, io.TeeReader(body, io.MultiWriter(hash, digest)))
+	}
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if err == nil && durable {
+		err = tmp.Sync()
+	}
+	var stat os.FileInfo
+	if err == nil {
+		// Renaming keeps the mtime, it identifies this version of the file from then on.
+		stat, err = tmp.Stat()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", ObjectMeta{}, err
+	}
+
+	meta.Name = name
+	meta.Envelope = envelope
+	meta.Checksum = hex.EncodeToString(hash.Sum(nil))
+	meta.MD5 = hex.EncodeToString(digest.Sum(nil))
+	if meta.Encoding == EncodingIdentity && envelope == nil {
+		meta.Hashes = newHashState(hash, digest)
+	}
+	meta.ModTime = stat.ModTime().UTC()
+	return tmp.Name(), meta, nil
+}
+
+// writeFileAtomic replaces path with data via a temp file in tmpDir, so readers never see a partial write.
+func writeFileAtomic(path string, tmpDir string, data []byte) error {
+	tmp, err := os.CreateTemp(tmpDir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lengthVerifier fails the final read of a body that doesn't contain exactly expected bytes, so a truncated upload
+// is never committed. A negative expected length disables the check.
+type lengthVerifier struct {
+	io.Reader
+	expected int64
+	read     int64
+}
+
+func (v *lengthVerifier) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	v.read += int64(n)
+	if err == io.EOF && v.expected >= 0 && v.read != v.expected {
+		return n, fmt.Errorf("%w: expected %d, got %d", ErrShortBody, v.expected, v.read)
+	}
+	return n, err
+}
@@ -0,0 +1,405 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// crashHelperEnv makes the test binary run crashHelper instead of the tests, writing into the data dir it names.
+const crashHelperEnv = "FILESERVER_CRASH_HELPER_DIR"
+
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(crashHelperEnv); dir != "" {
+		crashHelper(dir)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func testStorageConfig(dir string) StorageConfig {
+	return StorageConfig{
+		DataDir: dir,
+		Journal: JournalConfig{Fsync: FsyncAlways, SnapshotEvery: 50},
+	}
+}
+
+// crashHelper overwrites a handful of names until it's killed.
+func crashHelper(dir string) {
+	storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ready")
+	for i := 0; ; i++ {
+		body := bytes.Repeat([]byte{byte(i)}, 1000+i%4096)
+		if _, err := storage.Create(fmt.Sprintf("file-%d", i%8), bytes.NewReader(body), CreateOptions{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// assertIndexMatchesDisk checks every file on disk is indexed with a checksum it passes, and every entry has a file.
+func assertIndexMatchesDisk(t *testing.T, storage *DiskStorage) {
+	t.Helper()
+	names, err := storage.layout.names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		meta, err := storage.Stat(name)
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if meta.Checksum == "" {
+			t.Errorf("%s is on disk but its index entry doesn't describe it", name)
+			continue
+		}
+		if err := storage.Verify(name); err != nil {
+			t.Errorf("verify %s: %v", name, err)
+		}
+	}
+	storage.index.Range(func(name string, _ ObjectMeta) bool {
+		if _, err := os.Stat(storage.layout.locate(name)); err != nil {
+			t.Errorf("%s is indexed but not on disk: %v", name, err)
+		}
+		return true
+	})
+}
+
+func TestRecoveryAfterKillMidPut(t *testing.T) {
+	dir := t.TempDir()
+	for round := 0; round < 5; round++ {
+		helper := exec.Command(os.Args[0], "-test.run=^$")
+		helper.Env = append(os.Environ(), crashHelperEnv+"="+dir)
+		stdout, err := helper.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		helper.Stderr = os.Stderr
+		if err := helper.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ready := make([]byte, len("ready\n"))
+		if _, err := stdout.Read(ready); err != nil {
+			t.Fatalf("helper didn't start: %v", err)
+		}
+		time.Sleep(time.Duration(50+round*30) * time.Millisecond)
+		if err := helper.Process.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		_ = helper.Wait()
+
+		storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+		if err != nil {
+			t.Fatalf("reopen after kill: %v", err)
+		}
+		assertIndexMatchesDisk(t, storage)
+		if err := storage.index.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A change journaled by a file server that died before renaming its file into place is rolled back on open.
+func TestRecoveryRollsBackUnappliedChange(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := storage.Create("a", bytes.NewReader([]byte("first")), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unapplied := written
+	unapplied.Checksum = "0000"
+	unapplied.ModTime = written.ModTime.Add(time.Second)
+	if err := storage.index.Put(unapplied); err != nil {
+		t.Fatal(err)
+	}
+	// Until repaired, reads still find the version on disk.
+	if meta, err := storage.Stat("a"); err != nil || meta.Checksum != written.Checksum {
+		t.Fatalf("stat before recovery = %+v, %v, want checksum %s", meta, err, written.Checksum)
+	}
+	if err := storage.index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+	if meta, ok := storage.index.Get("a"); !ok || meta.Checksum != written.Checksum {
+		t.Fatalf("index after recovery = %+v, %v, want checksum %s", meta, ok, written.Checksum)
+	}
+	assertIndexMatchesDisk(t, storage)
+}
+
+// File servers sharing a data dir see each other's writes with their metadata, not as unindexed files.
+func TestSharedDataDir(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.index.Close()
+	second, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatalf("second storage on the same data dir: %v", err)
+	}
+	defer second.index.Close()
+
+	for i := 0; i < 120; i++ {
+		written, err := first.Create(fmt.Sprintf("file-%d", i%10), bytes.NewReader([]byte(fmt.Sprint("version ", i))), CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := second.Stat(written.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Checksum != written.Checksum {
+			t.Fatalf("round %d: second storage sees %s with checksum %q, want %q", i, written.Name, meta.Checksum, written.Checksum)
+		}
+	}
+
+	if err := second.Remove("file-0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Stat("file-0"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("stat of a file removed by the other storage = %v, want ErrObjectNotFound", err)
+	}
+	if err := first.index.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.index.Get("file-0"); ok {
+		t.Fatal("removal by the other storage wasn't picked up on refresh")
+	}
+	if _, err := os.Stat(filepath.Join(dir, reservedDir, journalDir, snapshotFile)); err != nil {
+		t.Fatalf("expected the index to have been snapshotted: %v", err)
+	}
+}
+
+func TestCreateRecordsMD5(t *testing.T) {
+	storage, err := NewDiskStorage(testStorageConfig(t.TempDir()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+
+	meta, err := storage.Create("single", bytes.NewReader([]byte("hello")), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"5d41402abc4b2a76b9719d911017c592"`; meta.S3ETag() != want {
+		t.Errorf("S3 ETag = %s, want %s", meta.S3ETag(), want)
+	}
+	multipart := "f543ae078c5c2698af58c63827231928-2"
+	if _, err := storage.Create("multipart", bytes.NewReader([]byte("parts")), CreateOptions{MD5: multipart}); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := storage.index.Get("multipart"); meta.MD5 != multipart {
+		t.Errorf("indexed MD5 = %s, want %s", meta.MD5, multipart)
+	}
+}
+
+// Files written before the index existed are indexed by Adopt, up to its limit, files already indexed left alone.
+func TestAdopt(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+	indexed, err := storage.Create("indexed", bytes.NewReader([]byte("indexed")), CreateOptions{Retention: &Retention{Mode: RetentionGovernance, RetainUntil: time.Now().Add(time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("planted "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		limit int
+		want  int
+	}{{2, 2}, {2, 1}, {2, 0}} {
+		adopted, err := storage.Adopt(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(adopted) != test.want {
+			t.Errorf("adopt with limit %d indexed %v, want %d files", test.limit, adopted, test.want)
+		}
+	}
+	assertIndexMatchesDisk(t, storage)
+	sum := sha256.Sum256([]byte("planted a"))
+	if meta, _ := storage.index.Get("a"); meta.Checksum != hex.EncodeToString(sum[:]) || !writableInPlace(meta) {
+		t.Errorf("adopted a as %+v", meta)
+	}
+	if meta, _ := storage.index.Get("indexed"); !meta.ModTime.Equal(indexed.ModTime) || meta.Retention == nil {
+		t.Errorf("indexed file changed to %+v", meta)
+	}
+}
+
+func TestWriteAtInPlace(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := storage.Create("a", bytes.NewReader([]byte("hello")), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("hello")
+	for _, write := range []struct {
+		offset int64
+		data   string
+	}{{-1, " world"}, {0, "J"}, {9, "d!!"}, {-1, "?"}} {
+		if meta, err = storage.WriteAt("a", meta, write.offset, bytes.NewReader([]byte(write.data))); err != nil {
+			t.Fatal(err)
+		}
+		offset := int(write.offset)
+		if offset < 0 {
+			offset = len(want)
+		}
+		want = append(want[:offset], append([]byte(write.data), want[min(len(want), offset+len(write.data)):]...)...)
+		if sum := sha256.Sum256(want); meta.Checksum != hex.EncodeToString(sum[:]) || meta.Size != int64(len(want)) {
+			t.Fatalf("after writing %q at %d: %+v, want %q", write.data, write.offset, meta, want)
+		}
+		if err := storage.Verify("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("the file was replaced rather than written in place")
+	}
+	if sum := md5.Sum(want); meta.MD5 != hex.EncodeToString(sum[:]) {
+		t.Errorf("MD5 = %s after writes in place, want %x", meta.MD5, sum)
+	}
+
+	// Written against a stale version, the write doesn't apply.
+	stale := meta
+	stale.Checksum = "stale"
+	if _, err := storage.WriteAt("a", stale, -1, bytes.NewReader([]byte("x"))); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("write against a stale version = %v, want ErrPreconditionFailed", err)
+	}
+
+	// An append cut short by a crash is rolled back on open, any other write in place described anew. Both keep the
+	// entry's retention.
+	if _, err := storage.SetRetention("a", &Retention{Mode: RetentionGovernance, RetainUntil: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, torn := range []struct {
+		offset int64
+		data   string
+		want   string
+	}{{int64(len(want)), "torn", string(want)}, {1, "torn", string(want[:1]) + "torn" + string(want[5:])}} {
+		if err := storage.index.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, "a"), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.WriteAt([]byte(torn.data), torn.offset); err != nil {
+			t.Fatal(err)
+		}
+		_ = file.Close()
+		if storage, err = NewDiskStorage(testStorageConfig(dir), nil); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexMatchesDisk(t, storage)
+		meta, _ := storage.index.Get("a")
+		if sum := sha256.Sum256([]byte(torn.want)); meta.Retention == nil || meta.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("%q torn in at %d recovered as %+v, want %q", torn.data, torn.offset, meta, torn.want)
+		}
+		if err := storage.Verify("a"); err != nil {
+			t.Error(err)
+		}
+	}
+	_ = storage.index.Close()
+}
+
+// Files linked into a snapshot, or open for reading, are replaced rather than written in place, so the snapshot's
+// archive and the reader keep the version they have.
+func TestWriteAtDuringSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(testStorageConfig(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.index.Close()
+	meta, err := storage.Create("a", bytes.NewReader([]byte("hello")), CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	manifest, err := snapshot.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = storage.WriteAt("a", meta, -1, bytes.NewReader([]byte(" world"))); err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := storage.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if meta, err = storage.WriteAt("a", meta, 0, bytes.NewReader([]byte("J"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := WriteSnapshotArchive(&archive, snapshot, manifest, SnapshotFormatTar); err != nil {
+		t.Fatalf("archiving the snapshot after an append: %v", err)
+	}
+	archived := map[string]string{}
+	_, report, err := ReadSnapshotArchive(&archive, func(file SnapshotFile, body io.Reader) error {
+		data, err := io.ReadAll(body)
+		archived[file.Name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) > 0 || archived["a"] != "hello" {
+		t.Errorf("archived %q, failures %v, want the version snapshotted", archived["a"], report.Failed)
+	}
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "hello world" {
+		t.Errorf("reader opened before a range write read %q, %v", data, err)
+	}
+	if err := storage.Verify("a"); err != nil || meta.Size != int64(len("Jello world")) {
+		t.Errorf("after the writes %+v, %v", meta, err)
+	}
+}
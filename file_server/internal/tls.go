@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+
+	selfSignedValidity = time.Hour * 24 * 365
+)
+
+type TLSConfig struct {
+	Enabled      bool
+	CertFile     string
+	KeyFile      string
+	SelfSigned   bool     // Generate a self-signed cert/key at CertFile/KeyFile if they don't exist
+	Hosts        []string // DNS names and IPs the self-signed cert is valid for
+	ClientCAFile string   // PEM bundle of CAs client certs must chain to
+	ClientAuth   string   // none, request or require. Whether clients must present a cert (mutual TLS).
+	HTTP2        bool     // Serve HTTP/2, negotiated via ALPN over TLS and via h2c prior knowledge/upgrade over plaintext
+}
+
+// certReloader serves the current certificate to the TLS stack and swaps in a new one from disk on Reload, so certs
+// can be rotated without dropping listeners.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	lock     sync.RWMutex
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (r *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %w", r.certFile, err)
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate every time the process receives SIGHUP. A failed reload keeps serving
+// the previous certificate.
+func (r *certReloader) reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := r.Reload(); err != nil {
+			log.Errorf("Certificate reload failed, still serving previous certificate: %+v", err)
+			continue
+		}
+		log.Infof("Reloaded TLS certificate from %s", r.certFile)
+	}
+}
+
+// newServerTLSConfig builds the TLS config for the listener, generating a self-signed cert first if configured to.
+func newServerTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.SelfSigned {
+		if err := ensureSelfSignedCert(cfg.CertFile, cfg.KeyFile, cfg.Hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.reloadOnSIGHUP()
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	switch cfg.ClientAuth {
+	case ClientAuthNone, "":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown TLS client auth mode: %s", cfg.ClientAuth)
+	}
+
+	if tlsConfig.ClientAuth != tls.NoClientCert {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", path)
+	}
+	return pool, nil
+}
+
+// ensureSelfSignedCert writes a fresh self-signed ECDSA cert and key unless certFile already exists.
+func ensureSelfSignedCert(certFile string, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fileserver-challenge"}, CommonName: "file-server"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", certDER, 0644); err != nil {
+		return err
+	}
+
+	log.Infof("Generated self-signed certificate at %s for %v", certFile, hosts)
+	return nil
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// newHTTPServer builds the server for handler. Over TLS, HTTP/2 is negotiated via ALPN. Over plaintext, h2c is
+// accepted alongside HTTP/1.1.
+func newHTTPServer(addr string, handler http.Handler, cfg TLSConfig) (*http.Server, error) {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	if !cfg.Enabled {
+		if cfg.HTTP2 {
+			server.Handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+		return server, nil
+	}
+
+	tlsConfig, err := newServerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig = tlsConfig
+
+	if cfg.HTTP2 {
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			return nil, fmt.Errorf("failed to configure HTTP/2: %w", err)
+		}
+	} else {
+		// A non-nil empty map stops net/http from enabling HTTP/2 on its own.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	return server, nil
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// testCA is a certificate authority that issues client certs.
+type testCA struct {
+	certFile string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{certFile: certFile, cert: cert, key: key}
+}
+
+// newServerCert writes a self-signed server cert for 127.0.0.1 and returns a TLSConfig serving it and a pool trusting it.
+func newServerCert(t *testing.T, dir string) (TLSConfig, *x509.CertPool) {
+	t.Helper()
+	cfg := TLSConfig{Enabled: true, CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	if err := ensureSelfSignedCert(cfg.CertFile, cfg.KeyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		t.Fatal("no certificate in", cfg.CertFile)
+	}
+	return cfg, roots
+}
+
+// issueClientCert returns a client certificate signed by the CA.
+func (ca *testCA) issueClientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS serves a handler answering with the protocol and whether the client sent a cert, returning its URL.
+func serveTLS(t *testing.T, cfg TLSConfig) string {
+	t.Helper()
+	server, err := newHTTPServer("", http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(response, "%s %t", request.Proto, request.TLS != nil && len(request.TLS.PeerCertificates) > 0)
+	}), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if cfg.Enabled {
+			_ = server.ServeTLS(listener, "", "")
+		} else {
+			_ = server.Serve(listener)
+		}
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+	scheme := "http"
+	if cfg.Enabled {
+		scheme = "https"
+	}
+	return scheme + "://" + listener.Addr().String()
+}
+
+func get(client *http.Client, url string) (string, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var body [64]byte
+	n, _ := response.Body.Read(body[:])
+	return string(body[:n]), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverTLS, roots := newServerCert(t, dir)
+	clientCA := newTestCA(t, dir, "client-ca")
+	untrustedCA := newTestCA(t, dir, "untrusted")
+	trusted, untrusted := clientCA.issueClientCert(t), untrustedCA.issueClientCert(t)
+
+	// Clients only offer certs issued by a CA the server advertises, so an untrusted cert is never sent.
+	tests := []struct {
+		name       string
+		clientAuth string
+		cert       *tls.Certificate
+		want       string // Empty if the handshake should fail
+	}{
+		{"none without cert", ClientAuthNone, nil, "HTTP/1.1 false"},
+		{"none ignores cert", ClientAuthNone, &trusted, "HTTP/1.1 false"},
+		{"request without cert", ClientAuthRequest, nil, "HTTP/1.1 false"},
+		{"request with trusted cert", ClientAuthRequest, &trusted, "HTTP/1.1 true"},
+		{"request with untrusted cert", ClientAuthRequest, &untrusted, "HTTP/1.1 false"},
+		{"require without cert", ClientAuthRequire, nil, ""},
+		{"require with trusted cert", ClientAuthRequire, &trusted, "HTTP/1.1 true"},
+		{"require with untrusted cert", ClientAuthRequire, &untrusted, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := serverTLS
+			cfg.ClientCAFile, cfg.ClientAuth = clientCA.certFile, test.clientAuth
+			url := serveTLS(t, cfg)
+			clientTLS := &tls.Config{RootCAs: roots}
+			if test.cert != nil {
+				clientTLS.Certificates = []tls.Certificate{*test.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			defer client.CloseIdleConnections()
+
+			got, err := get(client, url)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("request succeeded with %q, want the handshake rejected", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	tlsConfig, roots := newServerCert(t, t.TempDir())
+
+	h2c := &http2.Transport{AllowHTTP: true, DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	tests := []struct {
+		name      string
+		cfg       TLSConfig
+		transport http.RoundTripper
+		want      string
+	}{
+		{"tls with http2", func() TLSConfig { cfg := tlsConfig; cfg.HTTP2 = true; return cfg }(),
+			&http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}, "HTTP/2.0 false"},
+		{"tls without http2", tlsConfig,
+			&http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}, "HTTP/1.1 false"},
+		{"h2c", TLSConfig{HTTP2: true}, h2c, "HTTP/2.0 false"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := serveTLS(t, test.cfg)
+			if got, err := get(&http.Client{Transport: test.transport}, url); err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := ensureSelfSignedCert(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := reloader.GetCertificate(nil)
+
+	// An existing cert is kept, rotating means replacing the files.
+	before, _ := os.ReadFile(certFile)
+	if err := ensureSelfSignedCert(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(certFile); string(after) != string(before) {
+		t.Error("ensureSelfSignedCert replaced an existing certificate")
+	}
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSelfSignedCert(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := reloader.GetCertificate(nil)
+	if string(second.Certificate[0]) == string(first.Certificate[0]) {
+		t.Error("reload kept serving the replaced certificate")
+	}
+
+	if err := os.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("reloading a corrupt certificate succeeded")
+	}
+	if current, _ := reloader.GetCertificate(nil); current != second {
+		t.Error("failed reload dropped the previous certificate")
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	recordedSpans     *tracetest.SpanRecorder
+	recordedSpansOnce sync.Once
+)
+
+// spanRecorder installs a global provider recording every span. The package tracer only ever delegates to the first
+// provider installed, so it's installed once for all tests.
+func spanRecorder() *tracetest.SpanRecorder {
+	recordedSpansOnce.Do(func() {
+		recordedSpans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recordedSpans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return recordedSpans
+}
+
+// spansOf returns the ended spans of trace id.
+func spansOf(recorder *tracetest.SpanRecorder, id trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == id {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	recorder := spanRecorder()
+	fs := newTestFileServer(t)
+	router := fs.newRouter()
+	if _, err := fs.storage.Create("a", strings.NewReader("traced"), CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		traceID    string
+		wantStatus int
+		wantChild  string
+	}{
+		{"get", http.MethodGet, "/api/fileserver/a", "4bf92f3577b34da6a3ce929d0e0e4736", http.StatusOK, "disk.open"},
+		{"missing file", http.MethodGet, "/api/fileserver/missing", "5bf92f3577b34da6a3ce929d0e0e4736", http.StatusNotFound, "disk.open"},
+		{"put", http.MethodPut, "/api/fileserver/b", "6bf92f3577b34da6a3ce929d0e0e4736", http.StatusCreated, "fileserver.simulated_latency"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader("body"))
+			request.Header.Set("traceparent", "00-"+test.traceID+"-00f067aa0ba902b7-01")
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != test.wantStatus {
+				t.Fatalf("got %d, want %d", response.Code, test.wantStatus)
+			}
+
+			id, _ := trace.TraceIDFromHex(test.traceID)
+			spans := spansOf(recorder, id)
+			server, ok := spans[test.method+" "+test.path]
+			if !ok {
+				t.Fatalf("no server span in the caller's trace, got %v", spans)
+			}
+			if server.Parent().SpanID().String() != "00f067aa0ba902b7" || server.SpanKind() != trace.SpanKindServer {
+				t.Errorf("server span has parent %s and kind %s, want the caller's span", server.Parent().SpanID(), server.SpanKind())
+			}
+			if server.Status().Code == codes.Error {
+				t.Errorf("server span status = %v, only server errors are errors", server.Status())
+			}
+			statusRecorded := false
+			for _, attr := range server.Attributes() {
+				if attr.Key == "http.response.status_code" && attr.Value.AsInt64() == int64(test.wantStatus) {
+					statusRecorded = true
+				}
+			}
+			if !statusRecorded {
+				t.Errorf("server span attributes %v lack the status code", server.Attributes())
+			}
+			if child, ok := spans[test.wantChild]; !ok || child.Parent().TraceID() != id {
+				t.Errorf("no %s span under the server span, got %v", test.wantChild, spans)
+			}
+		})
+	}
+}
+
+func TestTraceMiddlewareServerError(t *testing.T) {
+	recorder := spanRecorder()
+	handler := traceMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusInternalServerError)
+	}))
+	request := httptest.NewRequest(http.MethodGet, "/failing", nil)
+	request.Header.Set("traceparent", "00-7bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	id, _ := trace.TraceIDFromHex("7bf92f3577b34da6a3ce929d0e0e4736")
+	if server, ok := spansOf(recorder, id)["GET /failing"]; !ok || server.Status().Code != codes.Error {
+		t.Errorf("server span of a 500 = %v, want an error status", server)
+	}
+}
+
+func TestNewSpanExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	tests := []struct {
+		exporter string
+		want     bool
+		wantErr  bool
+	}{
+		{TracingExporterNone, false, false},
+		{"", false, false},
+		{TracingExporterStdout, true, false},
+		{TracingExporterFile, true, false},
+		{"zipkin", false, true},
+	}
+	for _, test := range tests {
+		exporter, closer, err := newSpanExporter(TracingConfig{Exporter: test.exporter, FilePath: path})
+		if (err != nil) != test.wantErr || (exporter != nil) != test.want {
+			t.Errorf("exporter %q = %v, %v, want exporter %t and error %t", test.exporter, exporter, err, test.want, test.wantErr)
+		}
+		if exporter != nil {
+			_ = exporter.Shutdown(context.Background())
+		}
+		if closer != nil {
+			_ = closer.Close()
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file exporter didn't create its file: %v", err)
+	}
+}
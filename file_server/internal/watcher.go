@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	WatchModeFSNotify = "fsnotify"
+	WatchModePoll     = "poll"
+	WatchModeOff      = "off"
+)
+
+type WatchConfig struct {
+	Mode         string        // fsnotify, poll or off. fsnotify falls back to polling if the watch can't be set up.
+	PollInterval time.Duration // How often poll mode catches up, and how often fsnotify mode does as a safety net
+}
+
+// indexWatcher keeps this server's copy of the metadata index in step with changes other file servers sharing the
+// volume journal. Reads that miss the index catch up anyway, watching keeps misses rare and priorities accurate.
+type indexWatcher struct {
+	mode        string
+	live        bool      // Events are being applied as they happen, so the index isn't stale
+	lastCatchUp time.Time // Last periodic catch up
+	mutex       sync.Mutex
+}
+
+// Staleness is how far behind the journal the index may be. Zero while events are applied live, otherwise the time
+// since the last periodic catch up.
+func (w *indexWatcher) Staleness() time.Duration {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.live || w.lastCatchUp.IsZero() {
+		return 0
+	}
+	return time.Since(w.lastCatchUp)
+}
+
+func (w *indexWatcher) Mode() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.mode
+}
+
+func (w *indexWatcher) setState(mode string, live bool) {
+	w.mutex.Lock()
+	w.mode, w.live = mode, live
+	w.mutex.Unlock()
+}
+
+func (w *indexWatcher) caughtUp() {
+	w.mutex.Lock()
+	w.lastCatchUp = time.Now()
+	w.mutex.Unlock()
+}
+
+// watchIndex starts catching the index up whenever another file server changes its journal.
+func (fs *FileServer) watchIndex() {
+	cfg := fs.cfg.Watch
+	if cfg.Mode == WatchModeOff {
+		fs.watcher.setState(WatchModeOff, false)
+		return
+	}
+	fs.watcher.caughtUp()
+
+	index := fs.storage.Index()
+	if cfg.Mode == WatchModeFSNotify {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			// The dir rather than the journal, snapshots replace the journal with a new file.
+			err = watcher.Add(index.Dir())
+		}
+		if err == nil {
+			fs.watcher.setState(WatchModeFSNotify, true)
+			log.Infof("Watching %s for index changes", index.Dir())
+			changed := make(chan struct{}, 1)
+			go fs.applyEvents(watcher, changed)
+			go fs.catchUpOnChange(changed)
+			go fs.pollIndex(cfg.PollInterval)
+			return
+		}
+		if watcher != nil {
+			_ = watcher.Close()
+		}
+		log.Warnf("Failed to watch %s, falling back to polling every %s: %v", index.Dir(), cfg.PollInterval, err)
+	}
+
+	fs.watcher.setState(WatchModePoll, false)
+	go fs.pollIndex(cfg.PollInterval)
+}
+
+// applyEvents signals changed for every change to the journal dir. Signals coalesce while a catch up is pending, a
+// burst of writes costs one.
+func (fs *FileServer) applyEvents(watcher *fsnotify.Watcher, changed chan<- struct{}) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case event.Has(fsnotify.Write):
+				fs.metrics.watchEvents.Inc("write")
+			case event.Has(fsnotify.Create), event.Has(fsnotify.Rename):
+				// A snapshot replacing the journal.
+				fs.metrics.watchEvents.Inc("replace")
+			default:
+				continue
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Most likely the kernel queue overflowed and events were lost. Stale until the catch up.
+			log.Warnf("Index watch error, catching up: %v", err)
+			fs.watcher.setState(WatchModeFSNotify, false)
+			fs.catchUpIndex(false)
+			fs.watcher.setState(WatchModeFSNotify, true)
+		}
+	}
+}
+
+func (fs *FileServer) catchUpOnChange(changed <-chan struct{}) {
+	for range changed {
+		if err := fs.storage.Index().Refresh(); err != nil {
+			log.Errorf("Failed to catch up with the index: %+v", err)
+		}
+	}
+}
+
+func (fs *FileServer) pollIndex(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		fs.catchUpIndex(true)
+	}
+}
+
+// catchUpIndex applies changes other file servers journaled. If periodic, the records it had to apply while events
+// were live are counted as drift, which should stay at zero.
+func (fs *FileServer) catchUpIndex(periodic bool) {
+	index := fs.storage.Index()
+	live := fs.watcher.Staleness() == 0 && fs.watcher.Mode() == WatchModeFSNotify
+	before := index.Seq()
+	if err := index.Refresh(); err != nil {
+		log.Errorf("Failed to catch up with the index: %+v", err)
+		return
+	}
+	if periodic && live {
+		fs.metrics.watchDrift.Add(float64(index.Seq()-before), "records")
+	}
+	fs.watcher.caughtUp()
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it holds or timeout passes, and returns whether it held.
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestWatchIndex(t *testing.T) {
+	tests := []struct {
+		mode         string
+		pollInterval string
+		wantMode     string
+		wantLive     bool // Staleness stays zero
+		wantCaughtUp bool
+	}{
+		// Polling is too slow to catch up within the test, events have to.
+		{WatchModeFSNotify, "1h", WatchModeFSNotify, true, true},
+		{WatchModePoll, "20ms", WatchModePoll, false, true},
+		{WatchModeOff, "20ms", WatchModeOff, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			t.Setenv("WATCH_MODE", test.mode)
+			t.Setenv("WATCH_POLL_INTERVAL", test.pollInterval)
+			fs := newTestFileServer(t)
+			fs.watchIndex()
+			if got := fs.watcher.Mode(); got != test.wantMode {
+				t.Fatalf("got mode %s, want %s", got, test.wantMode)
+			}
+
+			// Another file server sharing the volume.
+			other, err := NewStorage(fs.cfg.Storage, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Index().Close()
+			if _, err := other.Create("shared", strings.NewReader("body"), CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			timeout := 2 * time.Second
+			if !test.wantCaughtUp {
+				timeout = 200 * time.Millisecond
+			}
+			caughtUp := waitFor(timeout, func() bool {
+				_, ok := fs.storage.Index().Get("shared")
+				return ok
+			})
+			if caughtUp != test.wantCaughtUp {
+				t.Errorf("index caught up %t, want %t", caughtUp, test.wantCaughtUp)
+			}
+			if live := fs.watcher.Staleness() == 0; live != test.wantLive {
+				t.Errorf("got staleness %s, want live %t", fs.watcher.Staleness(), test.wantLive)
+			}
+		})
+	}
+}
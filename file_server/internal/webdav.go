@@ -0,0 +1,677 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// WebDAV is served next to the API, e.g. mounted as http://host:port/api/webdav/.
+	webdavPrefix = "/api/webdav"
+	// Folders map to file name prefixes: /a/b.txt is stored as a%2Fb.txt, the same way S3 keys are. A folder without
+	// files is kept as an empty marker file named after it with a trailing escaped slash, like S3 consoles do.
+	davDirSuffix = "%2F"
+)
+
+type WebDAVConfig struct {
+	Enabled bool // Serve the file store over WebDAV under /api/webdav
+}
+
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+type davRequestKey struct{}
+
+// davRequest carries what the file system needs from the request it is serving: how reading the body ended, so an
+// upload that was cut short isn't stored, and the response, to report sync replication on.
+type davRequest struct {
+	response http.ResponseWriter
+	body     *davBody
+}
+
+type davBody struct {
+	io.Reader
+	io.Closer
+	err error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func newDAVHandler(fs *FileServer) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     webdavPrefix,
+		FileSystem: &davFileSystem{fs: fs},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(request *http.Request, err error) {
+			if err != nil {
+				log.Debugf("WebDAV: %s %s failed: %+v", request.Method, request.URL.Path, err)
+			}
+		},
+	}
+}
+
+// HandleWebDAV serves the file store over WebDAV, under the same locks, admission and events as the rest of the API.
+func (fs *FileServer) HandleWebDAV(response http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	ctx := request.Context()
+	recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+	defer func() { fs.metrics.webdavRequests.Inc(request.Method, strconv.Itoa(recorder.status)) }()
+
+	fileName := davFileName(strings.TrimPrefix(request.URL.Path, webdavPrefix))
+	if len(fs.authenticators) > 0 {
+		principal, err := fs.authenticate(request)
+		if err != nil {
+			fs.metrics.authFailures.Inc(authFailureReason(err))
+			recorder.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
+			recorder.WriteHeader(http.StatusUnauthorized)
+			fs.WriteResponseBody(recorder, "Unauthorized.")
+			return
+		}
+		for _, access := range davAccesses(request, fileName) {
+			if !davAllows(principal, access.permission, access.name) {
+				fs.metrics.authFailures.Inc(authFailureReason(ErrForbidden))
+				recorder.WriteHeader(http.StatusForbidden)
+				fs.WriteResponseBody(recorder, "Forbidden.")
+				return
+			}
+		}
+		ctx = withPrincipal(ctx, principal)
+	}
+
+	priority := PriorityHigh
+	switch request.Method {
+	case http.MethodGet:
+		priority = fs.getPriority(fileName)
+	case http.MethodPut:
+		priority = fs.putPriority(request)
+	case "COPY", "MOVE":
+		priority = PriorityLow
+		ctx = withCopySource(ctx, fileName, davDestination(request))
+	}
+	// The principal and copy source travel in ctx, client identification and rate limiting read them from the request.
+	client, ok := fs.takeConnection(ctx, recorder, request.WithContext(ctx), priority)
+	if !ok {
+		return
+	}
+	defer fs.releaseConnection(client, time.Now())
+	fs.SimulateLatency(ctx)
+
+	body := &davBody{Reader: &lengthVerifier{Reader: request.Body, expected: request.ContentLength}, Closer: request.Body}
+	request.Body = body
+	ctx = context.WithValue(ctx, davRequestKey{}, &davRequest{response: recorder, body: body})
+	fs.dav.ServeHTTP(recorder, request.WithContext(ctx))
+}
+
+type davAccess struct {
+	permission Permission
+	name       string
+}
+
+// davAccesses lists the permissions a request needs: COPY reads its source and MOVE deletes it, both write their
+// Destination.
+func davAccesses(request *http.Request, fileName string) []davAccess {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return []davAccess{{PermissionRead, fileName}}
+	case http.MethodDelete:
+		return []davAccess{{PermissionDelete, fileName}}
+	case "COPY", "MOVE":
+		source := davAccess{PermissionRead, fileName}
+		if request.Method == "MOVE" {
+			source.permission = PermissionDelete
+		}
+		return []davAccess{source, {PermissionWrite, davDestination(request)}}
+	}
+	return []davAccess{{PermissionWrite, fileName}}
+}
+
+// davDestination returns the file a COPY or MOVE goes to.
+func davDestination(request *http.Request) string {
+	if parsed, err := url.Parse(request.Header.Get("Destination")); err == nil {
+		return davFileName(strings.TrimPrefix(parsed.Path, webdavPrefix))
+	}
+	return ""
+}
+
+// davAllows is Principal.Allows for WebDAV paths. A folder is allowed if its files are, and the folders leading to a
+// principal's prefix can be listed so it can be browsed to.
+func davAllows(principal *Principal, permission Permission, name string) bool {
+	if principal.Allows(permission, name) || principal.Allows(permission, name+davDirSuffix) {
+		return true
+	}
+	leadsToPrefix := name == "" || strings.HasPrefix(principal.Prefix, name+davDirSuffix)
+	return permission == PermissionRead && leadsToPrefix && principal.Allows(permission, principal.Prefix)
+}
+
+// davFileName maps a WebDAV path to the file it's stored as, "" being the root folder.
+func davFileName(davPath string) string {
+	return slashEscaper.Replace(strings.TrimPrefix(path.Clean("/"+davPath), "/"))
+}
+
+// davParent returns the folder fileName is in.
+func davParent(fileName string) string {
+	if i := strings.LastIndex(fileName, davDirSuffix); i >= 0 {
+		return fileName[:i]
+	}
+	return ""
+}
+
+// davFileSystem is a webdav.FileSystem over the file server, going through the same calls as the API handlers.
+type davFileSystem struct {
+	fs *FileServer
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	fileName := davFileName(name)
+	if fileName == "" {
+		return os.ErrExist
+	}
+	if _, err := d.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	if err := d.checkParent(ctx, fileName); err != nil {
+		return err
+	}
+	_, replicated, err := d.fs.writeFile(ctx, fileName+davDirSuffix, strings.NewReader(""), 0)
+	d.awaitReplication(ctx, replicated)
+	return err
+}
+
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	fileName := davFileName(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if fileName == "" || !validFileName(fileName) || len(fileName) > 255 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+		}
+		if _, _, err := d.readDir(ctx, fileName); err == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if err := d.checkParent(ctx, fileName); err != nil {
+			return nil, err
+		}
+		return d.create(ctx, fileName), nil
+	}
+
+	if fileName != "" {
+		file, err := d.open(ctx, fileName)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+	info, children, err := d.readDir(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &davDir{info: info, children: children}, nil
+}
+
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fileName := davFileName(name)
+	if fileName == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+
+	_, replicated, err := d.fs.deleteFile(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	contents, err := d.list(fileName + davDirSuffix)
+	if err != nil {
+		return err
+	}
+	for _, meta := range contents {
+		_, seq, err := d.fs.deleteFile(ctx, meta.Name)
+		if err != nil {
+			return err
+		}
+		replicated = max(replicated, seq)
+	}
+	d.awaitReplication(ctx, replicated)
+	return nil
+}
+
+// Rename moves a file, or every file in a folder, by copying it to its new name and deleting the old one. It isn't
+// atomic: a file briefly exists under both names, and an API write to the old name in between is lost.
+func (d *davFileSystem) Rename(ctx context.Context, oldName string, newName string) error {
+	from, to := davFileName(oldName), davFileName(newName)
+	if from == "" || to == "" {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	if err := d.checkParent(ctx, to); err != nil {
+		return err
+	}
+
+	if _, err := d.fs.statFile(ctx, from); err == nil {
+		return d.move(ctx, from, to)
+	}
+	contents, err := d.list(from + davDirSuffix)
+	if err != nil {
+		return err
+	}
+	if len(contents) == 0 {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	for _, meta := range contents {
+		if err := d.move(ctx, meta.Name, to+strings.TrimPrefix(meta.Name, from)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fileName := davFileName(name)
+	if fileName != "" {
+		meta, err := d.fs.statFile(ctx, fileName)
+		if err == nil {
+			return newDAVFileInfo(meta), nil
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+	info, _, err := d.readDir(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readDir returns the folder fileName and what's in it that the caller may see. A folder exists if any file is in
+// it, or it has a marker.
+func (d *davFileSystem) readDir(ctx context.Context, fileName string) (*davFileInfo, []os.FileInfo, error) {
+	prefix := ""
+	if fileName != "" {
+		prefix = fileName + davDirSuffix
+	}
+	contents, err := d.list(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fileName != "" && len(contents) == 0 {
+		return nil, nil, &os.PathError{Op: "stat", Path: fileName, Err: os.ErrNotExist}
+	}
+
+	principal := PrincipalFromContext(ctx)
+	visible := func(name string) bool {
+		return principal == nil || davAllows(principal, PermissionRead, name)
+	}
+	info := &davFileInfo{name: davBaseName(fileName), dir: true}
+	dirs := make(map[string]*davFileInfo)
+	var children []os.FileInfo
+	for _, meta := range contents {
+		if meta.ModTime.After(info.modTime) {
+			info.modTime = meta.ModTime
+		}
+		rest := strings.TrimPrefix(meta.Name, prefix)
+		if rest == "" {
+			// The folder's marker
+			continue
+		}
+		i := strings.Index(rest, davDirSuffix)
+		if i < 0 {
+			if visible(meta.Name) {
+				children = append(children, newDAVFileInfo(meta))
+			}
+			continue
+		}
+		dirName := prefix + rest[:i]
+		dir, seen := dirs[dirName]
+		if !seen {
+			if !visible(dirName) {
+				continue
+			}
+			dir = &davFileInfo{name: davBaseName(dirName), dir: true}
+			dirs[dirName] = dir
+			children = append(children, dir)
+		}
+		if meta.ModTime.After(dir.modTime) {
+			dir.modTime = meta.ModTime
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return info, children, nil
+}
+
+// checkParent fails with a not exist error unless the folder fileName would be created in exists.
+func (d *davFileSystem) checkParent(ctx context.Context, fileName string) error {
+	parent := davParent(fileName)
+	if parent == "" {
+		return nil
+	}
+	if _, err := d.fs.statFile(ctx, parent); err == nil {
+		return &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+	_, _, err := d.readDir(ctx, parent)
+	return err
+}
+
+// list returns every file whose name starts with prefix.
+func (d *davFileSystem) list(prefix string) ([]ObjectMeta, error) {
+	objects, err := d.fs.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	var matching []ObjectMeta
+	for _, meta := range objects {
+		if strings.HasPrefix(meta.Name, prefix) {
+			matching = append(matching, meta)
+		}
+	}
+	return matching, nil
+}
+
+// open opens fileName for reading. Its in-process lock is only held while opening, an open file isn't written in place.
+func (d *davFileSystem) open(ctx context.Context, fileName string) (*davReader, error) {
+	file, meta, release, err := d.fs.openFile(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	release()
+
+	reader := &davReader{storage: d.fs.storage, meta: meta}
+	if err := reader.reset(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (d *davFileSystem) move(ctx context.Context, from string, to string) error {
+	if !validFileName(to) || len(to) > 255 {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrInvalid}
+	}
+	reader, err := d.open(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, written, err := d.fs.writeFile(ctx, to, reader, reader.meta.Size)
+	if err != nil {
+		return err
+	}
+	_, deleted, err := d.fs.deleteFile(ctx, from)
+	d.awaitReplication(ctx, max(written, deleted))
+	return err
+}
+
+// create starts storing fileName from what's written to the returned file. It's stored on Close, or on Stat, which
+// webdav calls before Close to get the ETag of what was PUT.
+func (d *davFileSystem) create(ctx context.Context, fileName string) *davWriter {
+	reader, writer := io.Pipe()
+	file := &davWriter{fs: d, ctx: ctx, pipe: writer, done: make(chan struct{})}
+	go func() {
+		defer close(file.done)
+		file.meta, file.replicated, file.err = d.fs.writeFile(ctx, fileName, reader, -1)
+		// Unblocks Write if storing failed before the body was consumed.
+		reader.CloseWithError(file.err)
+	}()
+	return file
+}
+
+func (d *davFileSystem) awaitReplication(ctx context.Context, seq uint64) {
+	if request, ok := ctx.Value(davRequestKey{}).(*davRequest); ok {
+		d.fs.awaitReplication(ctx, request.response, seq)
+	}
+}
+
+// davReader is a stored file open for reading. Seeking is emulated for encoded files: forward by decoding and
+// discarding, backward by reopening.
+type davReader struct {
+	storage Storage
+	meta    ObjectMeta
+	file    io.ReadCloser
+	body    io.ReadCloser
+	offset  int64 // Where the caller has seeked to
+	read    int64 // How far body has been read
+}
+
+func (r *davReader) reset(file io.ReadCloser) error {
+	body, err := newDecoder(r.meta.Encoding, file)
+	if err != nil {
+		return err
+	}
+	r.file, r.body, r.read = file, body, 0
+	return nil
+}
+
+func (r *davReader) Read(p []byte) (int, error) {
+	if r.offset < r.read {
+		r.Close()
+		file, meta, err := r.storage.Open(r.meta.Name)
+		if err != nil {
+			return 0, err
+		}
+		if meta.Checksum != r.meta.Checksum || meta.ModTime != r.meta.ModTime {
+			file.Close()
+			return 0, errors.New("file changed while reading")
+		}
+		if err := r.reset(file); err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	if r.offset > r.read {
+		if seeker, ok := r.file.(io.Seeker); ok && r.meta.Encoding == EncodingIdentity {
+			if _, err := seeker.Seek(r.offset, io.SeekStart); err != nil {
+				return 0, err
+			}
+			r.read = r.offset
+		} else {
+			skipped, err := io.CopyN(io.Discard, r.body, r.offset-r.read)
+			r.read += skipped
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *davReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.meta.Size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *davReader) Close() error {
+	r.body.Close()
+	return r.file.Close()
+}
+
+func (r *davReader) Readdir(int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (r *davReader) Stat() (os.FileInfo, error) {
+	return newDAVFileInfo(r.meta), nil
+}
+
+func (r *davReader) Write([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davWriter is a file being stored.
+type davWriter struct {
+	fs         *davFileSystem
+	ctx        context.Context
+	pipe       *io.PipeWriter
+	done       chan struct{}
+	committed  bool
+	meta       ObjectMeta
+	replicated uint64
+	err        error
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+// commit ends the file and waits for it to be stored, or discarded if the request body it was copied from failed.
+func (w *davWriter) commit() error {
+	if w.committed {
+		return w.err
+	}
+	w.committed = true
+	request, _ := w.ctx.Value(davRequestKey{}).(*davRequest)
+	if request != nil && request.body.err != nil {
+		w.pipe.CloseWithError(request.body.err)
+	} else {
+		w.pipe.Close()
+	}
+	<-w.done
+	if w.err == nil {
+		w.fs.awaitReplication(w.ctx, w.replicated)
+	}
+	return w.err
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	if err := w.commit(); err != nil {
+		return nil, err
+	}
+	return newDAVFileInfo(w.meta), nil
+}
+
+func (w *davWriter) Close() error {
+	return w.commit()
+}
+
+func (w *davWriter) Read([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *davWriter) Seek(int64, int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *davWriter) Readdir(int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// davDir is a folder open for listing.
+type davDir struct {
+	info     *davFileInfo
+	children []os.FileInfo
+	listed   int
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.listed:]
+	if count <= 0 {
+		d.listed = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	d.listed += len(rest)
+	return rest, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(int64, int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+// davFileInfo describes a file or folder. It implements webdav.ETager and webdav.ContentTyper so PROPFIND doesn't
+// have to open files.
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+}
+
+func newDAVFileInfo(meta ObjectMeta) *davFileInfo {
+	return &davFileInfo{name: davBaseName(meta.Name), size: meta.Size, modTime: meta.ModTime, etag: meta.ETag()}
+}
+
+// davBaseName returns the last element of fileName's WebDAV path.
+func davBaseName(fileName string) string {
+	if i := strings.LastIndex(fileName, davDirSuffix); i >= 0 {
+		fileName = fileName[i+len(davDirSuffix):]
+	}
+	return slashUnescaper.Replace(fileName)
+}
+
+func (i *davFileInfo) Name() string       { return i.name }
+func (i *davFileInfo) Size() int64        { return i.size }
+func (i *davFileInfo) ModTime() time.Time { return i.modTime }
+func (i *davFileInfo) IsDir() bool        { return i.dir }
+func (i *davFileInfo) Sys() any           { return nil }
+
+func (i *davFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *davFileInfo) ETag(context.Context) (string, error) {
+	if i.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.etag, nil
+}
+
+func (i *davFileInfo) ContentType(context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(i.name)); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDAVFileName(t *testing.T) {
+	tests := []struct {
+		davPath string
+		want    string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"/a.txt", "a.txt"},
+		{"/docs/a.txt", "docs%2Fa.txt"},
+		{"/docs/", "docs"},
+		{"/docs/../a.txt", "a.txt"},
+		{"/../../a.txt", "a.txt"},
+	}
+	for _, test := range tests {
+		if got := davFileName(test.davPath); got != test.want {
+			t.Errorf("davFileName(%q) = %q, want %q", test.davPath, got, test.want)
+		}
+	}
+}
+
+func TestDAVAllows(t *testing.T) {
+	principal := &Principal{KeyID: "team", Permissions: []Permission{PermissionRead, PermissionWrite}, Prefix: "team%2Fdocs%2F"}
+	tests := []struct {
+		permission Permission
+		name       string
+		want       bool
+	}{
+		{PermissionRead, "team%2Fdocs%2Fa.txt", true},
+		{PermissionWrite, "team%2Fdocs%2Fa.txt", true},
+		{PermissionDelete, "team%2Fdocs%2Fa.txt", false},
+		// The folder holding the prefix's files, and the folders leading to it, can be listed.
+		{PermissionRead, "team%2Fdocs", true},
+		{PermissionRead, "team", true},
+		{PermissionRead, "", true},
+		{PermissionWrite, "team", false},
+		{PermissionWrite, "", false},
+		{PermissionRead, "other", false},
+		{PermissionRead, "te", false},
+		{PermissionRead, "team%2Fother.txt", false},
+	}
+	for _, test := range tests {
+		if got := davAllows(principal, test.permission, test.name); got != test.want {
+			t.Errorf("davAllows(%s, %q) = %t, want %t", test.permission, test.name, got, test.want)
+		}
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	t.Setenv("WEBDAV_ENABLED", "true")
+	fs := newTestFileServer(t)
+	router := fs.newRouter()
+
+	steps := []struct {
+		method      string
+		path        string
+		body        string
+		destination string
+		wantStatus  int
+		wantBody    string   // Substring of the response body
+		wantNames   []string // Every stored name afterwards
+	}{
+		{"MKCOL", "/docs", "", "", http.StatusCreated, "", []string{"docs%2F"}},
+		{http.MethodPut, "/docs/a.txt", "hello", "", http.StatusCreated, "", []string{"docs%2F", "docs%2Fa.txt"}},
+		{http.MethodPut, "/missing/b.txt", "hello", "", http.StatusConflict, "", []string{"docs%2F", "docs%2Fa.txt"}},
+		{http.MethodGet, "/docs/a.txt", "", "", http.StatusOK, "hello", []string{"docs%2F", "docs%2Fa.txt"}},
+		{"PROPFIND", "/docs", "", "", http.StatusMultiStatus, "/api/webdav/docs/a.txt", []string{"docs%2F", "docs%2Fa.txt"}},
+		{"MOVE", "/docs/a.txt", "", "/api/webdav/docs/b.txt", http.StatusCreated, "", []string{"docs%2F", "docs%2Fb.txt"}},
+		{"MOVE", "/docs", "", "/api/webdav/archive", http.StatusCreated, "", []string{"archive%2F", "archive%2Fb.txt"}},
+		{http.MethodGet, "/archive/b.txt", "", "", http.StatusOK, "hello", []string{"archive%2F", "archive%2Fb.txt"}},
+		{http.MethodDelete, "/archive", "", "", http.StatusNoContent, "", nil},
+		{http.MethodGet, "/archive/b.txt", "", "", http.StatusNotFound, "", nil},
+	}
+	for _, step := range steps {
+		request := httptest.NewRequest(step.method, webdavPrefix+step.path, strings.NewReader(step.body))
+		if step.destination != "" {
+			request.Header.Set("Destination", "http://"+request.Host+step.destination)
+		}
+		if step.method == "PROPFIND" {
+			request.Header.Set("Depth", "1")
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != step.wantStatus || !strings.Contains(response.Body.String(), step.wantBody) {
+			t.Fatalf("%s %s: got %d %q, want %d with %q", step.method, step.path, response.Code, response.Body.String(), step.wantStatus, step.wantBody)
+		}
+
+		objects, err := fs.storage.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, meta := range objects {
+			names = append(names, meta.Name)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, step.wantNames) {
+			t.Errorf("%s %s: stored %v, want %v", step.method, step.path, names, step.wantNames)
+		}
+	}
+}
+
+func TestWebDAVDisabled(t *testing.T) {
+	router := newTestFileServer(t).newRouter()
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("PROPFIND", webdavPrefix+"/", nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("got %d with WebDAV disabled, want %d", response.Code, http.StatusNotFound)
+	}
+}
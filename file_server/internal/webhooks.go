@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookSignatureHeader = "X-FS-Webhook-Signature"
+	webhookTimestampHeader = "X-FS-Webhook-Timestamp"
+	webhookIDHeader        = "X-FS-Webhook-ID"
+	webhookAttemptHeader   = "X-FS-Webhook-Attempt"
+
+	webhooksDir    = "webhooks"
+	deadLetterFile = "dead_letter.jsonl"
+)
+
+type WebhookConfig struct {
+	URLs           []string      // Receivers every create, update and delete is POSTed to
+	Secret         string        // HMAC key deliveries are signed with
+	MaxAttempts    int           // Attempts before a delivery goes to the dead-letter file
+	InitialBackoff time.Duration // Wait before the first retry, doubled on every further one
+	MaxBackoff     time.Duration
+	Timeout        time.Duration // Per attempt
+	QueueDir       string        // Pending deliveries and the dead-letter file. Defaults to .fileserver/webhooks/<instance id> in the data dir.
+}
+
+// webhookDelivery is one event on its way to one receiver, persisted in the queue dir until it's delivered or dead.
+type webhookDelivery struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Event     FileEvent `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	DeadAt    time.Time `json:"dead_at,omitempty"`
+
+	path    string
+	saved   chan struct{} // Closed once the delivery is persisted, or failed to be
+	saveErr error
+}
+
+// webhookBatch is one event's deliveries, queued for every receiver by Reserve and persisted by Save.
+type webhookBatch []*webhookDelivery
+
+// WebhookDispatcher POSTs file events to every receiver, each from its own on-disk queue and worker.
+type WebhookDispatcher struct {
+	cfg     WebhookConfig
+	dir     string
+	client  *http.Client
+	targets []*webhookTarget
+	lock    *os.File
+	metrics *serverMetrics
+	deadMux sync.Mutex
+}
+
+type webhookTarget struct {
+	url     string
+	dir     string
+	next    uint64 // Sequence number for the next queued delivery file
+	pending []*webhookDelivery
+	wake    chan struct{}
+	mutex   sync.Mutex
+}
+
+func NewWebhookDispatcher(cfg WebhookConfig, dataDir string) (*WebhookDispatcher, error) {
+	dir := cfg.QueueDir
+	if dir == "" {
+		dir = filepath.Join(dataDir, reservedDir, webhooksDir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create webhook queue dir %s: %w", dir, err)
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w, give each file server its own WEBHOOK_QUEUE_DIR", err)
+	}
+	if cfg.Secret == "" {
+		log.Warnf("WEBHOOK_SECRET is not set, webhook deliveries will not be signed.")
+	}
+
+	d := &WebhookDispatcher{cfg: cfg, dir: dir, client: &http.Client{Timeout: cfg.Timeout}, lock: lock}
+	for _, rawURL := range cfg.URLs {
+		if _, err := url.ParseRequestURI(rawURL); err != nil {
+			return nil, fmt.Errorf("invalid webhook url %q: %w", rawURL, err)
+		}
+		target, err := d.loadTarget(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		d.targets = append(d.targets, target)
+	}
+	return d, nil
+}
+
+// Start runs one delivery worker per receiver.
+func (d *WebhookDispatcher) Start(metrics *serverMetrics) {
+	d.metrics = metrics
+	for _, target := range d.targets {
+		go d.run(target)
+	}
+}
+
+// Reserve queues a delivery of event to every receiver, in the order Reserve is called, without touching disk. The
+// returned batch must be passed to Save, workers don't send a delivery before it's persisted.
+func (d *WebhookDispatcher) Reserve(event FileEvent) webhookBatch {
+	batch := make(webhookBatch, 0, len(d.targets))
+	for _, target := range d.targets {
+		target.mutex.Lock()
+		target.next++
+		delivery := &webhookDelivery{
+			ID:    fmt.Sprintf("%s-%d-%s", event.Epoch, event.Seq, filepath.Base(target.dir)),
+			URL:   target.url,
+			Event: event,
+			path:  filepath.Join(target.dir, fmt.Sprintf("%020d.json", target.next)),
+			saved: make(chan struct{}),
+		}
+		target.pending = append(target.pending, delivery)
+		target.mutex.Unlock()
+		batch = append(batch, delivery)
+	}
+	return batch
+}
+
+// Save persists the deliveries Reserve queued and wakes their workers. It only fails if the queue can't be written,
+// deliveries that couldn't be are dropped.
+func (d *WebhookDispatcher) Save(batch webhookBatch) error {
+	var errs []error
+	for i, delivery := range batch {
+		delivery.saveErr = d.save(delivery)
+		close(delivery.saved)
+		if delivery.saveErr != nil {
+			errs = append(errs, fmt.Errorf("failed to queue webhook for %s: %w", delivery.URL, delivery.saveErr))
+		}
+		select {
+		case d.targets[i].wake <- struct{}{}:
+		default:
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// QueueDepths returns the number of undelivered events per receiver.
+func (d *WebhookDispatcher) QueueDepths() map[string]int {
+	depths := map[string]int{}
+	for _, target := range d.targets {
+		target.mutex.Lock()
+		depths[target.url] = len(target.pending)
+		target.mutex.Unlock()
+	}
+	return depths
+}
+
+func (d *WebhookDispatcher) run(target *webhookTarget) {
+	for {
+		target.mutex.Lock()
+		var delivery *webhookDelivery
+		if len(target.pending) > 0 {
+			delivery = target.pending[0]
+		}
+		target.mutex.Unlock()
+
+		if delivery == nil {
+			<-target.wake
+			continue
+		}
+
+		// Retry the head of the queue until it's delivered or dead, so receivers see events in order.
+		<-delivery.saved
+		for delivery.saveErr == nil && !d.attempt(delivery) {
+			time.Sleep(d.backoff(delivery.Attempts))
+		}
+
+		target.mutex.Lock()
+		target.pending = target.pending[1:]
+		target.mutex.Unlock()
+	}
+}
+
+// attempt makes one delivery attempt. Returns true once the delivery is finished, delivered or dead-lettered.
+func (d *WebhookDispatcher) attempt(delivery *webhookDelivery) bool {
+	delivery.Attempts++
+	err := d.post(delivery)
+	if err == nil {
+		d.metrics.webhookDeliveries.Inc(delivery.URL, "success")
+		if err := os.Remove(delivery.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Failed to remove delivered webhook %s: %+v", delivery.path, err)
+		}
+		return true
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.cfg.MaxAttempts {
+		d.metrics.webhookDeliveries.Inc(delivery.URL, "dead_letter")
+		log.Errorf("Webhook %s to %s failed %d times, moving it to the dead-letter file: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+		if err := d.deadLetter(delivery); err != nil {
+			// Keep it queued rather than lose it, it'll be retried after the next restart.
+			log.Errorf("Failed to dead-letter webhook %s: %+v", delivery.ID, err)
+		}
+		return true
+	}
+
+	d.metrics.webhookDeliveries.Inc(delivery.URL, "retry")
+	log.Warnf("Webhook %s to %s failed, attempt %d of %d: %v", delivery.ID, delivery.URL, delivery.Attempts, d.cfg.MaxAttempts, err)
+	if err := d.save(delivery); err != nil {
+		log.Errorf("Failed to persist webhook %s attempt count: %+v", delivery.ID, err)
+	}
+	return false
+}
+
+func (d *WebhookDispatcher) post(delivery *webhookDelivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "file-server-webhooks")
+	request.Header.Set(webhookIDHeader, delivery.ID)
+	request.Header.Set(webhookAttemptHeader, strconv.Itoa(delivery.Attempts))
+	request.Header.Set(webhookTimestampHeader, timestamp)
+	if d.cfg.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, SignWebhook([]byte(d.cfg.Secret), timestamp, body))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("receiver responded %s", response.Status)
+	}
+	return nil
+}
+
+// backoff doubles from InitialBackoff up to MaxBackoff, with jitter so receivers coming back aren't stampeded.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.InitialBackoff
+	for i := 1; i < attempts && wait < d.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.cfg.MaxBackoff {
+		wait = d.cfg.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (d *WebhookDispatcher) save(delivery *webhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(delivery.path, filepath.Dir(delivery.path), data)
+}
+
+// deadLetter appends delivery to the dead-letter file, one JSON object per line, and drops it from the queue.
+func (d *WebhookDispatcher) deadLetter(delivery *webhookDelivery) error {
+	delivery.DeadAt = time.Now().UTC()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	d.deadMux.Lock()
+	defer d.deadMux.Unlock()
+	file, err := os.OpenFile(filepath.Join(d.dir, deadLetterFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(delivery.path)
+}
+
+// loadTarget reads the receiver's queue left over from a previous run. Each receiver's queue lives in a dir named
+// after a hash of its URL, so changing the URL list doesn't mix queues up.
+func (d *WebhookDispatcher) loadTarget(rawURL string) (*webhookTarget, error) {
+	hash := sha256.Sum256([]byte(rawURL))
+	target := &webhookTarget{url: rawURL, dir: filepath.Join(d.dir, hex.EncodeToString(hash[:6])), wake: make(chan struct{}, 1)}
+	if err := os.MkdirAll(target.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(target.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(target.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		delivery := &webhookDelivery{path: path, saved: make(chan struct{})}
+		close(delivery.saved)
+		if err := json.Unmarshal(data, delivery); err != nil {
+			log.Errorf("Dropping unreadable queued webhook %s: %v", path, err)
+			_ = os.Remove(path)
+			continue
+		}
+		target.pending = append(target.pending, delivery)
+		target.next = seq
+	}
+	if len(target.pending) > 0 {
+		log.Infof("Resuming %d queued webhooks for %s", len(target.pending), rawURL)
+	}
+	return target, nil
+}
+
+// SignWebhook returns the signature header value for a delivery: sha256= followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>".
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(hmacSHA256(secret, []byte(timestamp+"."+string(body))))
+}
+
+// VerifyWebhook checks a received delivery's signature and that its timestamp is within maxAge, for receivers written
+// in Go.
+func VerifyWebhook(secret []byte, request *http.Request, body []byte, maxAge time.Duration) bool {
+	timestamp := request.Header.Get(webhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > maxAge {
+		return false
+	}
+	expected := SignWebhook(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(request.Header.Get(webhookSignatureHeader)))
+}
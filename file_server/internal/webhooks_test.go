@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records deliveries, answering each with the next status in statuses, then 200.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   []byte
+	statuses []int
+	attempts []string
+	got      chan FileEvent
+	mutex    sync.Mutex
+}
+
+func newWebhookReceiver(t *testing.T, secret string, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{t: t, secret: []byte(secret), statuses: statuses, got: make(chan FileEvent, 100)}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func (r *webhookReceiver) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		r.t.Errorf("read delivery: %v", err)
+		return
+	}
+	if len(r.secret) > 0 && !VerifyWebhook(r.secret, request, body, time.Minute) {
+		r.t.Errorf("delivery %s has an invalid signature %q", request.Header.Get(webhookIDHeader), request.Header.Get(webhookSignatureHeader))
+	}
+
+	r.mutex.Lock()
+	r.attempts = append(r.attempts, request.Header.Get(webhookAttemptHeader))
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.mutex.Unlock()
+	response.WriteHeader(status)
+	if status != http.StatusOK {
+		return
+	}
+
+	var event FileEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		r.t.Errorf("invalid delivery body %s: %v", body, err)
+	}
+	r.got <- event
+}
+
+func (r *webhookReceiver) next(t *testing.T) FileEvent {
+	t.Helper()
+	select {
+	case event := <-r.got:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a webhook delivery")
+		return FileEvent{}
+	}
+}
+
+func testWebhookConfig(url string, dir string) WebhookConfig {
+	return WebhookConfig{
+		URLs:           []string{url},
+		Secret:         "hook-secret",
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     4 * time.Millisecond,
+		Timeout:        time.Second,
+		QueueDir:       dir,
+	}
+}
+
+func testWebhookMetrics() *serverMetrics {
+	return &serverMetrics{webhookDeliveries: NewMetrics().NewCounter("webhook_deliveries", "", "target", "result")}
+}
+
+func enqueueWebhook(t *testing.T, d *WebhookDispatcher, seq uint64, name string) {
+	t.Helper()
+	event := FileEvent{Epoch: "test", Seq: seq, Type: EventCreate, Name: name}
+	if err := d.Save(d.Reserve(event)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookSigning(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "hook-secret")
+	d, err := NewWebhookDispatcher(testWebhookConfig(server.URL, t.TempDir()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start(testWebhookMetrics())
+	enqueueWebhook(t, d, 1, "a")
+	if event := receiver.next(t); event.Name != "a" {
+		t.Fatalf("delivered %+v, want a", event)
+	}
+
+	body := []byte(`{"name":"a"}`)
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(webhookTimestampHeader, timestamp)
+	request.Header.Set(webhookSignatureHeader, SignWebhook([]byte("hook-secret"), timestamp, body))
+	if VerifyWebhook([]byte("other-secret"), request, body, time.Minute) {
+		t.Error("signature verified with the wrong secret")
+	}
+	if VerifyWebhook([]byte("hook-secret"), request, []byte(`{"name":"b"}`), time.Minute) {
+		t.Error("signature verified a tampered body")
+	}
+	request.Header.Set(webhookTimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	if VerifyWebhook([]byte("hook-secret"), request, body, time.Minute) {
+		t.Error("signature verified with a stale timestamp")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := &WebhookDispatcher{cfg: WebhookConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for attempts, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 50; i++ {
+			if wait := d.backoff(attempts); wait < want/2 || wait > want {
+				t.Fatalf("backoff after %d attempts = %s, want between %s and %s", attempts, wait, want/2, want)
+			}
+		}
+	}
+
+	// Failed attempts are retried in order, the attempt count increasing, until the receiver accepts.
+	receiver, server := newWebhookReceiver(t, "hook-secret", http.StatusInternalServerError, http.StatusServiceUnavailable)
+	d, err := NewWebhookDispatcher(testWebhookConfig(server.URL, t.TempDir()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start(testWebhookMetrics())
+	enqueueWebhook(t, d, 1, "a")
+	enqueueWebhook(t, d, 2, "b")
+	if first, second := receiver.next(t), receiver.next(t); first.Name != "a" || second.Name != "b" {
+		t.Fatalf("delivered %s then %s, want a then b", first.Name, second.Name)
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if want := []string{"1", "2", "3", "1"}; len(receiver.attempts) != len(want) || receiver.attempts[2] != "3" || receiver.attempts[3] != "1" {
+		t.Fatalf("attempt headers = %v, want %v", receiver.attempts, want)
+	}
+}
+
+func TestWebhookQueueReplayedAfterRestart(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "hook-secret")
+	dir := t.TempDir()
+	stopped, err := NewWebhookDispatcher(testWebhookConfig(server.URL, dir), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Never started, as if the server died before delivering.
+	for i, name := range []string{"a", "b", "c"} {
+		enqueueWebhook(t, stopped, uint64(i+1), name)
+	}
+	_ = stopped.lock.Close()
+
+	restarted, err := NewWebhookDispatcher(testWebhookConfig(server.URL, dir), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := restarted.QueueDepths()[server.URL]; depth != 3 {
+		t.Fatalf("queue depth after restart = %d, want 3", depth)
+	}
+	restarted.Start(testWebhookMetrics())
+	for _, want := range []string{"a", "b", "c"} {
+		if event := receiver.next(t); event.Name != want {
+			t.Fatalf("replayed %s, want %s", event.Name, want)
+		}
+	}
+	enqueueWebhook(t, restarted, 4, "d")
+	if event := receiver.next(t); event.Name != "d" {
+		t.Fatalf("delivered %s after the replay, want d", event.Name)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "hook-secret", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	dir := t.TempDir()
+	d, err := NewWebhookDispatcher(testWebhookConfig(server.URL, dir), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start(testWebhookMetrics())
+	enqueueWebhook(t, d, 1, "dead")
+	enqueueWebhook(t, d, 2, "alive")
+	// The next delivery only goes out once the first is dead-lettered.
+	if event := receiver.next(t); event.Name != "alive" {
+		t.Fatalf("delivered %s, want alive", event.Name)
+	}
+
+	file, err := os.Open(filepath.Join(dir, deadLetterFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var dead []webhookDelivery
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var delivery webhookDelivery
+		if err := json.Unmarshal(scanner.Bytes(), &delivery); err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, delivery)
+	}
+	if len(dead) != 1 || dead[0].Event.Name != "dead" || dead[0].Attempts != 3 || dead[0].LastError == "" || dead[0].DeadAt.IsZero() {
+		t.Fatalf("dead letters = %+v, want the one delivery after 3 attempts", dead)
+	}
+
+	// Removed once the receiver's response is read, which may be after it got the body.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		entries, err := os.ReadDir(d.targets[0].dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue dir still holds %d deliveries", len(entries))
+		}
+	}
+}
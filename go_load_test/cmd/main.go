@@ -36,6 +36,11 @@ func main() {
 	port := load_test.GetEnv("FILE_SERVER_PORT", "1234")
 	proto := load_test.GetEnv("FILE_SERVER_PROTO", "http")
 	prefix := load_test.GetEnv("FILE_SERVER_PATH_PREFIX", "api/fileserver")
+	caFile := load_test.GetEnv("FILE_SERVER_CA_FILE", "")
+	insecureSkipVerify, _ := strconv.ParseBool(load_test.GetEnv("FILE_SERVER_TLS_INSECURE", "false"))
+	clientCertFile := load_test.GetEnv("FILE_SERVER_CLIENT_CERT_FILE", "")
+	clientKeyFile := load_test.GetEnv("FILE_SERVER_CLIENT_KEY_FILE", "")
+	maxRetries, _ := strconv.Atoi(load_test.GetEnv("FILE_SERVER_MAX_RETRIES", "-1"))
 	maxFileCount, _ := strconv.Atoi(load_test.GetEnv("MAX_FILE_COUNT", "500"))
 	maxFileSize, _ := strconv.ParseInt(load_test.GetEnv("MAX_FILE_SIZE", "1024"), 10, 64)
 	requestsPerSecond, _ := strconv.Atoi(load_test.GetEnv("REQUESTS_PER_SECOND", "1"))
@@ -46,10 +51,15 @@ func main() {
 
 	cfg := load_test.TestSchedulerConfig{
 		EndpointCfg: load_test.TestEndpointConfig{
-			Proto:      proto,
-			Host:       host,
-			Port:       port,
-			PathPrefix: prefix,
+			Proto:              proto,
+			Host:               host,
+			Port:               port,
+			PathPrefix:         prefix,
+			CAFile:             caFile,
+			InsecureSkipVerify: insecureSkipVerify,
+			ClientCertFile:     clientCertFile,
+			ClientKeyFile:      clientKeyFile,
+			MaxRetries:         maxRetries,
 		},
 		SeedCadence: load_test.TestCadenceConfig{
 			Duration:         time.Second,
@@ -105,7 +115,7 @@ func main() {
 	}()
 
 	// Wait for ctrl +c
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/fatih/color v1.15.0
+	github.com/mancej/fileserver-challenge/client v0.0.0
 	github.com/rodaine/table v1.1.0
 	github.com/sirupsen/logrus v1.9.0
 
@@ -14,3 +15,6 @@ require (
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 )
+
+// The client is its own module, built from this repo rather than a published version.
+replace github.com/mancej/fileserver-challenge/client => ../client
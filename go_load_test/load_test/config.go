@@ -1,13 +1,57 @@
 package load_test
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
 const (
 	MaxFailuresBeforeExit       = 1000
 	HugeFileSize          int64 = 150000000
 )
 
 type TestEndpointConfig struct {
-	Proto      string // http or https
-	Host       string // localhost or google.com
-	Port       string // 1234
-	PathPrefix string // api/foo/bar   (no prefix or trailing slashes)
+	Proto              string // http or https
+	Host               string // localhost or google.com
+	Port               string // 1234
+	PathPrefix         string // api/foo/bar   (no prefix or trailing slashes)
+	CAFile             string // PEM bundle to verify the server cert against, e.g. the file server's self-signed cert
+	InsecureSkipVerify bool   // Skip server cert verification entirely
+	ClientCertFile     string // Client cert presented when the server requires mutual TLS
+	ClientKeyFile      string
+	MaxRetries         int // Retries of throttled and 5xx requests, negative for none. Only the last attempt is scored
+}
+
+// BaseURL is where the endpoint serves files.
+func (c TestEndpointConfig) BaseURL() string {
+	return fmt.Sprintf("%s://%s:%s/%s", c.Proto, c.Host, c.Port, c.PathPrefix)
+}
+
+// TLSClientConfig builds the TLS settings for talking to the endpoint over https.
+func (c TestEndpointConfig) TLSClientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", c.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
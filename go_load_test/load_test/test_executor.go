@@ -2,9 +2,12 @@ package load_test
 
 import (
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	b64 "encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/mancej/fileserver-challenge/client"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"math/rand"
@@ -15,20 +18,18 @@ import (
 )
 
 type TestExecutor struct {
-	client                *http.Client
+	client                *client.Client
 	inProcess             FileSet
 	maxFileSize           int64
 	inProcessLock         sync.RWMutex
 	results               chan TestResult
-	endpointCfg           TestEndpointConfig
 	fileSizeLock          sync.RWMutex
 	uploadRandomLargeFile bool
 }
 
-func NewTestExecutor(client *http.Client, config TestEndpointConfig, testConfig TestConfig, resultsChan chan TestResult) *TestExecutor {
+func NewTestExecutor(fsClient *client.Client, testConfig TestConfig, resultsChan chan TestResult) *TestExecutor {
 	return &TestExecutor{
-		client:                client,
-		endpointCfg:           config,
+		client:                fsClient,
 		inProcess:             make(map[string]bool),
 		maxFileSize:           testConfig.MaxFileSize,
 		inProcessLock:         sync.RWMutex{},
@@ -63,14 +64,11 @@ func (tr *TestExecutor) PutFile(fileName string) {
 		tr.inProcess.Delete(fileName)
 		tr.inProcessLock.Unlock()
 	}()
-	fileSize := tr.randomFileSize()
-	fileBytes := make([]byte, fileSize)
-	_, err := crand.Read(fileBytes)
+	byteString, err := randomFileString(tr.randomFileSize())
 	if err != nil {
 		tr.results <- TestResult{
 			fileName: fileName,
 			testType: PUT,
-			response: nil,
 			message:  "Failed to generate random file bytes",
 			err:      err,
 			failed:   true,
@@ -79,43 +77,8 @@ func (tr *TestExecutor) PutFile(fileName string) {
 		return
 	}
 
-	byteString := b64.StdEncoding.EncodeToString(fileBytes)
-	req, err := http.NewRequest(http.MethodPut, tr.buildPath(fileName), strings.NewReader(byteString))
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: PUT,
-			response: nil,
-			message:  "Failed to initialize request for PutFile",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err := tr.client.Do(req)
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: PUT,
-			response: response,
-			message:  "Error executing http request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	tr.results <- TestResult{
-		fileName: fileName,
-		testType: PUT,
-		response: response,
-		message:  responseToString(response),
-		err:      err,
-		duration: time.Now().Sub(start),
-	}
+	_, err = tr.client.Put(context.Background(), fileName, strings.NewReader(byteString), int64(len(byteString)))
+	tr.report(fileName, PUT, start, http.StatusCreated, err)
 }
 
 func (tr *TestExecutor) CreateFile(fileName string) {
@@ -126,14 +89,11 @@ func (tr *TestExecutor) CreateFile(fileName string) {
 		tr.inProcess.Delete(fileName)
 		tr.inProcessLock.Unlock()
 	}()
-	fileSize := rand.Int63n(tr.maxFileSize) + 1
-	fileBytes := make([]byte, fileSize)
-	_, err := crand.Read(fileBytes)
+	byteString, err := randomFileString(rand.Int63n(tr.GetMaxFileSize()) + 1)
 	if err != nil {
 		tr.results <- TestResult{
 			fileName: fileName,
 			testType: CREATE,
-			response: nil,
 			message:  "Failed to generate random file bytes",
 			err:      err,
 			failed:   true,
@@ -142,71 +102,14 @@ func (tr *TestExecutor) CreateFile(fileName string) {
 		return
 	}
 
-	byteString := b64.StdEncoding.EncodeToString(fileBytes)
-	req, err := http.NewRequest(http.MethodPut, tr.buildPath(fileName), strings.NewReader(byteString))
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CREATE,
-			response: nil,
-			message:  "Failed to initialize request for PutFile",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err := tr.client.Do(req)
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CREATE,
-			response: response,
-			message:  "Error executing http request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	tr.results <- TestResult{
-		fileName: fileName,
-		testType: CREATE,
-		response: response,
-		message:  responseToString(response),
-		err:      err,
-		failed:   response.StatusCode >= 400,
-		duration: time.Now().Sub(start),
-	}
+	_, err = tr.client.Put(context.Background(), fileName, strings.NewReader(byteString), int64(len(byteString)))
+	tr.report(fileName, CREATE, start, http.StatusCreated, err)
 }
 
 func (tr *TestExecutor) GetFile(fileName string) {
 	start := time.Now()
-	response, err := tr.client.Get(tr.buildPath(fileName))
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: GET,
-			response: response,
-			message:  "Error executing http GET request",
-			err:      err,
-			duration: time.Now().Sub(start),
-			failed:   true,
-		}
-		return
-	}
-
-	tr.results <- TestResult{
-		fileName: fileName,
-		testType: GET,
-		response: response,
-		message:  responseToString(response),
-		err:      err,
-		failed:   response.StatusCode >= 400,
-		duration: time.Now().Sub(start),
-	}
+	_, err := tr.client.Get(context.Background(), fileName, io.Discard)
+	tr.report(fileName, GET, start, http.StatusOK, err)
 }
 
 func (tr *TestExecutor) DeleteFile(fileName string) {
@@ -219,43 +122,8 @@ func (tr *TestExecutor) DeleteFile(fileName string) {
 		tr.inProcessLock.Unlock()
 	}()
 
-	req, err := http.NewRequest(http.MethodDelete, tr.buildPath(fileName), nil)
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: DELETE,
-			response: nil,
-			message:  "Failed ot build delete request.",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err := tr.client.Do(req)
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: DELETE,
-			response: response,
-			message:  "Error executing http DELETE request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	tr.results <- TestResult{
-		fileName: fileName,
-		testType: DELETE,
-		response: response,
-		message:  responseToString(response),
-		err:      err,
-		failed:   response.StatusCode >= 400,
-		duration: time.Now().Sub(start),
-	}
+	err := tr.client.Delete(context.Background(), fileName)
+	tr.report(fileName, DELETE, start, http.StatusOK, err)
 }
 
 func (tr *TestExecutor) ConsistencyCheck(fileName string) {
@@ -266,15 +134,13 @@ func (tr *TestExecutor) ConsistencyCheck(fileName string) {
 		tr.inProcess.Delete(fileName)
 		tr.inProcessLock.Unlock()
 	}()
+	ctx := context.Background()
 
-	fileSize := tr.randomFileSize()
-	fileBytes := make([]byte, fileSize)
-	_, err := crand.Read(fileBytes)
+	byteString, err := randomFileString(tr.randomFileSize())
 	if err != nil {
 		tr.results <- TestResult{
 			fileName: fileName,
 			testType: CONSISTENCY,
-			response: nil,
 			message:  "Failed to create file",
 			err:      err,
 			failed:   true,
@@ -284,179 +150,95 @@ func (tr *TestExecutor) ConsistencyCheck(fileName string) {
 	}
 
 	// Perform write
-	byteString := b64.StdEncoding.EncodeToString(fileBytes)
-	req, err := http.NewRequest(http.MethodPut, tr.buildPath(fileName), strings.NewReader(byteString))
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: nil,
-			message:  "Failed to initialize request for PutFile",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err := tr.client.Do(req)
+	_, err = tr.client.Put(ctx, fileName, strings.NewReader(byteString), int64(len(byteString)))
 	if err != nil {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  "Error executing http request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	if response.StatusCode != http.StatusCreated {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("PUT failed due to unexpected status code, got: %d but expected 201.", response.StatusCode),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: client.StatusCode(err),
+			message:    fmt.Sprintf("PUT failed: %s", err.Error()),
+			err:        err,
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
 
 	// Fetch immediately after write, verify data is consistent.
-	response, err = tr.client.Get(tr.buildPath(fileName))
+	body := new(bytes.Buffer)
+	_, err = tr.client.Get(ctx, fileName, body)
 	if err != nil {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  "Error executing http GET request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: client.StatusCode(err),
+			message:    fmt.Sprintf("GET failed: %s", err.Error()),
+			err:        err,
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
 
-	if response.StatusCode != http.StatusOK {
+	if body.String() != byteString {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("GET failed due to unexpected status code, got: %d but expected 200.", response.StatusCode),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: http.StatusOK,
+			message:    "Written and read body are not identical! Inconsistent data returned",
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
 
-	body, err := io.ReadAll(response.Body)
+	err = tr.client.Delete(ctx, fileName)
 	if err != nil {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("Error decoding response body: %s", err.Error()),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: client.StatusCode(err),
+			message:    fmt.Sprintf("DELETE failed: %s", err.Error()),
+			err:        err,
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
 
-	if string(body) != byteString {
+	_, err = tr.client.Get(ctx, fileName, io.Discard)
+	if err == nil {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  "Written and read body are not identical! Inconsistent data returned",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: http.StatusOK,
+			message:    fmt.Sprintf("File was deleted but received non-404 http code on immediate get. Got: %d for file: %s", http.StatusOK, fileName),
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
-
-	req, err = http.NewRequest(http.MethodDelete, tr.buildPath(fileName), nil)
-	if err != nil {
+	if !errors.Is(err, client.ErrNotFound) {
 		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: nil,
-			message:  "Failed to create delete request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err = tr.client.Do(req)
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  "Error executing http DELETE request",
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	if response.StatusCode != http.StatusOK {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("DELETE failed due to unexpected status code, got: %d but expected 200.", response.StatusCode),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	response, err = tr.client.Get(tr.buildPath(fileName))
-	if err != nil {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("Error performing GET for deleted file in consistent test. file: %s. Error: %s", fileName, err.Error()),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
-		}
-		return
-	}
-
-	if response.StatusCode != http.StatusNotFound {
-		tr.results <- TestResult{
-			fileName: fileName,
-			testType: CONSISTENCY,
-			response: response,
-			message:  fmt.Sprintf("File was deleted but received non-404 http code on immediate get. Got: %d for file: %s", response.StatusCode, fileName),
-			err:      err,
-			failed:   true,
-			duration: time.Now().Sub(start),
+			fileName:   fileName,
+			testType:   CONSISTENCY,
+			statusCode: client.StatusCode(err),
+			message:    fmt.Sprintf("Error performing GET for deleted file in consistent test. file: %s. Error: %s", fileName, err.Error()),
+			err:        err,
+			failed:     true,
+			duration:   time.Now().Sub(start),
 		}
 		return
 	}
 
 	tr.results <- TestResult{
-		fileName: fileName,
-		testType: CONSISTENCY,
-		response: response,
-		message:  "Consistency check passed!",
-		err:      nil,
-		failed:   false,
-		duration: time.Now().Sub(start),
+		fileName:   fileName,
+		testType:   CONSISTENCY,
+		statusCode: http.StatusNotFound,
+		message:    "Consistency check passed!",
+		err:        nil,
+		failed:     false,
+		duration:   time.Now().Sub(start),
 	}
 }
 
@@ -500,16 +282,42 @@ func (tr *TestExecutor) randomFileSize() int64 {
 	return size
 }
 
-func (tr *TestExecutor) buildPath(fileName string) string {
-	return fmt.Sprintf("%s://%s:%s/%s/%s", tr.endpointCfg.Proto, tr.endpointCfg.Host, tr.endpointCfg.Port, tr.endpointCfg.PathPrefix, fileName)
+// report publishes the result of a single request test. statusCode is what the server answers on success, err is
+// what the client returned.
+func (tr *TestExecutor) report(fileName string, testType TestType, start time.Time, statusCode int, err error) {
+	result := TestResult{
+		fileName:   fileName,
+		testType:   testType,
+		statusCode: statusCode,
+		duration:   time.Now().Sub(start),
+	}
+
+	var statusErr *client.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		result.statusCode = statusErr.StatusCode
+		result.message = statusErr.Message
+		result.failed = true
+	case errors.Is(err, client.ErrChecksumMismatch):
+		// The server answered, but with bytes that don't match its own checksum.
+		result.message = err.Error()
+		result.err = err
+		result.failed = true
+	case err != nil:
+		result.statusCode = 0
+		result.message = "Error executing http request"
+		result.err = err
+		result.failed = true
+	}
+
+	tr.results <- result
 }
 
-func responseToString(resp *http.Response) string {
-	if resp != nil && resp.Body != nil {
-		buf := new(bytes.Buffer)
-		_, _ = buf.ReadFrom(resp.Body)
-		return buf.String()
+// randomFileString returns size random bytes, base64 encoded.
+func randomFileString(size int64) (string, error) {
+	fileBytes := make([]byte, size)
+	if _, err := crand.Read(fileBytes); err != nil {
+		return "", err
 	}
-
-	return ""
+	return b64.StdEncoding.EncodeToString(fileBytes), nil
 }
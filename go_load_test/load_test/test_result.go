@@ -6,49 +6,49 @@ import (
 )
 
 type TestResult struct {
-	response *http.Response
-	testType TestType
-	duration time.Duration
-	fileName string
-	message  string
-	err      error
-	failed   bool
+	statusCode int // 0 if no response was received
+	testType   TestType
+	duration   time.Duration
+	fileName   string
+	message    string
+	err        error
+	failed     bool
 }
 
-func NewTestResult(response *http.Response) TestResult {
-	return TestResult{response: response}
+func NewTestResult(statusCode int) TestResult {
+	return TestResult{statusCode: statusCode}
 }
 
 func (tr *TestResult) WasSuccess() bool {
-	if tr.response == nil {
+	if tr.statusCode == 0 {
 		return false
 	}
 
-	if tr.TestType() == CONSISTENCY && tr.response.StatusCode == 404 {
+	if tr.TestType() == CONSISTENCY && tr.statusCode == 404 {
 		return true
 	}
 
-	return 200 <= tr.response.StatusCode && tr.response.StatusCode < 300
+	return 200 <= tr.statusCode && tr.statusCode < 300
 }
 
 func (tr *TestResult) WasError() bool {
-	if tr.response == nil || tr.err != nil {
+	if tr.statusCode == 0 || tr.err != nil {
 		return true
 	}
 
-	if tr.TestType() == CONSISTENCY && tr.response.StatusCode == 404 {
+	if tr.TestType() == CONSISTENCY && tr.statusCode == 404 {
 		return false
 	}
 
-	return tr.response.StatusCode >= 400
+	return tr.statusCode >= 400
 }
 
 func (tr *TestResult) Was5XX() bool {
-	if tr.response == nil {
+	if tr.statusCode == 0 {
 		return false
 	}
 
-	return tr.response.StatusCode >= 500
+	return tr.statusCode >= 500
 }
 
 func (tr *TestResult) WasTestFailure() bool {
@@ -60,19 +60,19 @@ func (tr *TestResult) WasTestFailure() bool {
 }
 
 func (tr *TestResult) Was404() bool {
-	if tr.response == nil {
+	if tr.statusCode == 0 {
 		return false
 	}
 
-	return tr.response.StatusCode == 404
+	return tr.statusCode == 404
 }
 
 func (tr *TestResult) WasThrottled() bool {
-	if tr.response == nil {
+	if tr.statusCode == 0 {
 		return false
 	}
 
-	return tr.response.StatusCode == http.StatusTooManyRequests
+	return tr.statusCode == http.StatusTooManyRequests
 }
 
 func (tr *TestResult) TestType() TestType {
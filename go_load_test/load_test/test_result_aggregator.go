@@ -70,7 +70,7 @@ func (tr *TestResults) Merge(result TestResult) {
 	}
 
 	if result.WasError() {
-		if result.response != nil {
+		if result.statusCode != 0 {
 			msg := fmt.Sprintf("File: %s, Error: %s", result.FileName(), result.message)
 			log.Error(msg)
 			tr.httpErrors = append(tr.httpErrors, msg)
@@ -1,6 +1,7 @@
 package load_test
 
 import (
+	"github.com/mancej/fileserver-challenge/client"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"time"
@@ -26,14 +27,30 @@ type TestRunnerConfig struct {
 
 // Run Listens to scheduler test chan and runs tests
 func (tr *TestRunner) Run() {
-	client := &http.Client{
+	tlsConfig, err := tr.cfg.EndpointCfg.TLSClientConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %+v", err)
+	}
+
+	httpClient := &http.Client{
 		Transport: &http.Transport{
-			MaxIdleConns:    45000,
-			MaxConnsPerHost: 0,
+			MaxIdleConns:      45000,
+			MaxConnsPerHost:   0,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
 		},
 		Timeout: time.Second * 20,
 	}
-	exec := NewTestExecutor(client, tr.cfg.EndpointCfg, tr.cfg.TestConfig, tr.cfg.ResultChan)
+	// The load test brings its own unbounded pool, capping it at the server's slot limit would hide throttling.
+	fsClient, err := client.New(client.Config{
+		BaseURL:    tr.cfg.EndpointCfg.BaseURL(),
+		HTTPClient: httpClient,
+		MaxRetries: tr.cfg.EndpointCfg.MaxRetries,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create file server client: %+v", err)
+	}
+	exec := NewTestExecutor(fsClient, tr.cfg.TestConfig, tr.cfg.ResultChan)
 
 	lastFileSizeUpdate := time.Now()
 